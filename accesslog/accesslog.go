@@ -0,0 +1,152 @@
+// Package accesslog writes a line for each request the IdP handles: how long it took, its status and, when
+// known, the SP and binding involved
+package accesslog
+
+import (
+	"context"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// What handlers learn about a request while handling it
+type entry struct {
+	binding         string
+	serviceProvider string
+}
+
+type contextKey struct{}
+
+// Notes the binding of the endpoint handling the request. Does nothing when the request isn't logged.
+func SetBinding(request *http.Request, binding string) {
+	if entry, ok := request.Context().Value(contextKey{}).(*entry); ok {
+		entry.binding = binding
+	}
+}
+
+// Notes the SP the request came from or the response is for. Does nothing when the request isn't logged.
+func SetServiceProvider(request *http.Request, entityID string) {
+	if entry, ok := request.Context().Value(contextKey{}).(*entry); ok {
+		entry.serviceProvider = entityID
+	}
+}
+
+// Wraps an endpoint to note its binding
+func Binding(binding string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		SetBinding(request, binding)
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Logs the requests handled by the handlers it wraps
+type Logger struct {
+	logger   *slog.Logger
+	settings config.AccessLog
+	excluded map[string]bool
+}
+
+// Opens the access log. A nil Logger is returned when there are no settings, and logs nothing.
+func New(settings *config.AccessLog) (*Logger, error) {
+	if settings == nil {
+		return nil, nil
+	}
+	defaults := settings.WithDefaults()
+	var output io.Writer = os.Stdout
+	if defaults.File != "" {
+		file, err := os.OpenFile(defaults.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, err
+		}
+		output = file
+	}
+	var handler slog.Handler = slog.NewJSONHandler(output, nil)
+	if strings.ToLower(defaults.Format) == "text" {
+		handler = slog.NewTextHandler(output, nil)
+	}
+	logger := &Logger{logger: slog.New(handler), settings: defaults, excluded: make(map[string]bool)}
+	for _, path := range defaults.ExcludePaths {
+		logger.excluded[path] = true
+	}
+	return logger, nil
+}
+
+// Wraps the handler so its requests are logged. The handler is returned as is by a nil Logger. Requests
+// are tagged with their correlation ID when the handler is inside logging.Handler.
+func (logger *Logger) Handler(handler http.Handler) http.Handler {
+	if logger == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if logger.excluded[request.URL.Path] {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		start := time.Now()
+		entry := &entry{}
+		recorder := &recorder{ResponseWriter: writer, status: http.StatusOK}
+		handler.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), contextKey{}, entry)))
+		elapsed := time.Since(start)
+		if !logger.sampled(recorder.status, elapsed) {
+			return
+		}
+		attributes := []slog.Attr{
+			slog.String("request_id", writer.Header().Get(logging.RequestIDHeader)),
+			slog.String("remote", request.RemoteAddr),
+			slog.String("method", request.Method),
+			slog.String("host", request.Host),
+			slog.String("path", request.URL.Path),
+			slog.Int("status", recorder.status),
+			slog.Int64("bytes", recorder.bytes),
+			slog.Float64("duration_ms", float64(elapsed.Microseconds())/1000),
+			slog.String("user_agent", request.UserAgent()),
+		}
+		if entry.binding != "" {
+			attributes = append(attributes, slog.String("binding", entry.binding))
+		}
+		if entry.serviceProvider != "" {
+			attributes = append(attributes, slog.String("sp", entry.serviceProvider))
+		}
+		logger.logger.LogAttrs(request.Context(), slog.LevelInfo, "request", attributes...)
+	})
+}
+
+// Failed and slow requests are always logged, others at the sample rate
+func (logger *Logger) sampled(status int, elapsed time.Duration) bool {
+	if status >= 400 {
+		return true
+	}
+	threshold := time.Duration(logger.settings.SlowThreshold) * time.Millisecond
+	if threshold > 0 && elapsed >= threshold {
+		return true
+	}
+	return logger.settings.SampleRate >= 1 || rand.Float64() < logger.settings.SampleRate
+}
+
+// Counts what the handler writes
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (recorder *recorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status, recorder.wroteHeader = status, true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *recorder) Write(data []byte) (int, error) {
+	recorder.wroteHeader = true
+	written, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += int64(written)
+	return written, err
+}
@@ -0,0 +1,70 @@
+// Package activity keeps recent figures about the IdP's use for the admin console. Figures are kept in
+// memory, so each instance reports its own.
+package activity
+
+import (
+	"sync"
+	"time"
+)
+
+// A login that ended with an error response to the SP
+type Failure struct {
+	Time            time.Time
+	ServiceProvider string
+	Reason          string
+}
+
+type Monitor struct {
+	mutex    sync.Mutex
+	sessions map[string]time.Time
+	failures []Failure
+	limit    int
+}
+
+// Creates a monitor remembering the given number of failures
+func New(failures int) *Monitor {
+	return &Monitor{sessions: make(map[string]time.Time), limit: failures}
+}
+
+// Notes a session used to log in
+func (monitor *Monitor) Session(id string, expires time.Time) {
+	if id == "" {
+		return
+	}
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.sessions[id] = expires
+}
+
+// Returns the number of unexpired sessions, forgetting expired ones
+func (monitor *Monitor) ActiveSessions() int {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	now := time.Now()
+	for id, expires := range monitor.sessions {
+		if now.After(expires) {
+			delete(monitor.sessions, id)
+		}
+	}
+	return len(monitor.sessions)
+}
+
+func (monitor *Monitor) Fail(entityId, reason string) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	monitor.failures = append(monitor.failures, Failure{time.Now(), entityId, reason})
+	if len(monitor.failures) > monitor.limit {
+		monitor.failures = monitor.failures[len(monitor.failures)-monitor.limit:]
+	}
+}
+
+// Returns the remembered failures, newest first
+func (monitor *Monitor) Failures() []Failure {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	failures := make([]Failure, len(monitor.failures))
+	for i, failure := range monitor.failures {
+		failures[len(failures)-1-i] = failure
+	}
+	return failures
+}
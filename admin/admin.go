@@ -0,0 +1,258 @@
+// Package admin serves the IdP's administrative API. Callers present the configured token as a bearer
+// token in the Authorization header.
+package admin
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/activity"
+	"github.com/amdonov/lite-idp/bearer"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/registry"
+	"github.com/amdonov/lite-idp/store"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Creates the API handler. Relative to the Admin path:
+//
+//	POST reload                                    reloads the configuration file
+//	GET service-providers                          lists SPs registered through the API
+//	GET service-providers?entityId=<SP>            returns a registration
+//	POST service-providers                         registers an SP
+//	PUT service-providers?entityId=<SP>            registers or updates an SP
+//	DELETE service-providers?entityId=<SP>         removes a registration
+//	GET release-policies                           lists release policies set through the API
+//	PUT release-policies                           replaces them
+//	GET status                                     reports SPs, sessions and recent failures
+//	GET sessions[?user=<name>&sp=<SP>&ip=<address>] lists active sessions, optionally filtered
+//	GET sessions?id=<handle>                       returns a session by the ID it was listed with
+//	DELETE sessions?id=<handle>                    revokes a session
+//	DELETE sessions?user=<name>                    revokes every session of a user
+//	GET console                                    serves the admin console, which asks for the token
+//
+// Registrations are sent as JSON holding ServiceProvider settings as in the configuration file, with
+// Metadata XML or a MetadataURL to fetch it from. Metadata may also be sent on its own as an XML body.
+func New(config *config.Configuration, registry *registry.Registry, monitor *activity.Monitor,
+	store store.Storer) http.Handler {
+	api := &api{config, registry, monitor, store}
+	// Changes publish a new snapshot, so they apply from the next request
+	protected := config.Guard(bearer.Require(config.Admin.Token, api))
+	return http.StripPrefix(config.Admin.Path, http.HandlerFunc(func(writer http.ResponseWriter,
+		request *http.Request) {
+		if strings.Trim(request.URL.Path, "/") == "console" {
+			serveConsole(writer, request)
+			return
+		}
+		protected.ServeHTTP(writer, request)
+	}))
+}
+
+type api struct {
+	config   *config.Configuration
+	registry *registry.Registry
+	monitor  *activity.Monitor
+	store    store.Storer
+}
+
+func (api *api) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch strings.Trim(request.URL.Path, "/") {
+	case "reload":
+		if request.Method != "POST" {
+			http.Error(writer, "Method Not Allowed", 405)
+			return
+		}
+		if err := api.config.Reload(); err != nil {
+			logging.FromRequest(request).Error("Failed to reload configuration", "err", err)
+			reply(writer, 400, map[string]string{"Error": err.Error()})
+			return
+		}
+		logging.FromRequest(request).Info("Reloaded configuration")
+		reply(writer, 200, map[string]string{"Status": "reloaded"})
+	case "service-providers":
+		api.serviceProviders(writer, request)
+	case "release-policies":
+		api.releasePolicies(writer, request)
+	case "status":
+		api.status(writer, request)
+	case "sessions":
+		api.sessions(writer, request)
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+func (api *api) serviceProviders(writer http.ResponseWriter, request *http.Request) {
+	entityId := request.URL.Query().Get("entityId")
+	entries, err := api.registry.List()
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to read registrations", "err", err)
+		reply(writer, 500, map[string]string{"Error": "unable to read registrations"})
+		return
+	}
+	existing, found := entries[entityId]
+	switch request.Method {
+	case "GET":
+		if entityId == "" {
+			reply(writer, 200, entries)
+		} else if found {
+			reply(writer, 200, existing)
+		} else {
+			reply(writer, 404, map[string]string{"Error": entityId + " isn't registered"})
+		}
+	case "POST", "PUT":
+		entry, err := readEntry(request)
+		if err != nil {
+			reply(writer, 400, map[string]string{"Error": err.Error()})
+			return
+		}
+		if request.Method == "PUT" {
+			if entityId == "" {
+				reply(writer, 400, map[string]string{"Error": "entityId is required"})
+				return
+			}
+			if entry.ServiceProvider.EntityId != "" && entry.ServiceProvider.EntityId != entityId {
+				reply(writer, 400, map[string]string{"Error": "entity IDs don't match"})
+				return
+			}
+			entry.ServiceProvider.EntityId = entityId
+		} else if _, exists := entries[entry.ServiceProvider.EntityId]; exists {
+			reply(writer, 409, map[string]string{"Error": entry.ServiceProvider.EntityId + " is already registered"})
+			return
+		}
+		err = api.registry.Put(entry)
+		if err != nil {
+			reply(writer, 400, map[string]string{"Error": err.Error()})
+			return
+		}
+		logging.FromRequest(request).Info("Registered service provider", "sp", entry.ServiceProvider.EntityId)
+		status := 200
+		if request.Method == "POST" {
+			status = 201
+		}
+		reply(writer, status, entry)
+	case "DELETE":
+		deleted, err := api.registry.Delete(entityId)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to delete registration", "sp", entityId, "err", err)
+			reply(writer, 500, map[string]string{"Error": "unable to delete registration"})
+			return
+		}
+		if !deleted {
+			reply(writer, 404, map[string]string{"Error": entityId + " isn't registered"})
+			return
+		}
+		logging.FromRequest(request).Info("Removed service provider", "sp", entityId)
+		writer.WriteHeader(204)
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+func (api *api) releasePolicies(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "GET":
+		policies, err := api.registry.ReleasePolicies()
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to read release policies", "err", err)
+			reply(writer, 500, map[string]string{"Error": "unable to read release policies"})
+			return
+		}
+		if policies == nil {
+			policies = []*config.ReleasePolicy{}
+		}
+		reply(writer, 200, policies)
+	case "PUT":
+		var policies []*config.ReleasePolicy
+		err := json.NewDecoder(io.LimitReader(request.Body, maxBody)).Decode(&policies)
+		if err == nil {
+			err = api.registry.SetReleasePolicies(policies)
+		}
+		if err != nil {
+			reply(writer, 400, map[string]string{"Error": err.Error()})
+			return
+		}
+		logging.FromRequest(request).Info("Replaced release policies")
+		reply(writer, 200, policies)
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+// Metadata expiring within this long is flagged
+const expiryWarning = 14 * 24 * time.Hour
+
+type providerStatus struct {
+	EntityId string
+	// Registered through the API rather than in the configuration file
+	Managed    bool
+	ValidUntil *time.Time `json:",omitempty"`
+	// Expired, expiring or empty
+	Warning string `json:",omitempty"`
+}
+
+type status struct {
+	ServiceProviders []providerStatus
+	ActiveSessions   int
+	Failures         []activity.Failure
+}
+
+func (api *api) status(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+	now := time.Now()
+	result := status{ServiceProviders: []providerStatus{}, ActiveSessions: api.monitor.ActiveSessions(),
+		Failures: api.monitor.Failures()}
+	for _, sp := range api.config.For(request).ServiceProviders {
+		provider := providerStatus{EntityId: sp.EntityId, Managed: api.config.IsManaged(sp.EntityId)}
+		if sp.Descriptor != nil {
+			if expires, found := sp.Descriptor.Expires(); found {
+				provider.ValidUntil = &expires
+				if now.After(expires) {
+					provider.Warning = "expired"
+				} else if now.Add(expiryWarning).After(expires) {
+					provider.Warning = "expiring"
+				}
+			}
+		}
+		result.ServiceProviders = append(result.ServiceProviders, provider)
+	}
+	reply(writer, 200, result)
+}
+
+// Reads a registration from JSON or, for XML bodies, from the SP's metadata alone
+func readEntry(request *http.Request) (*registry.Entry, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxBody))
+	if err != nil {
+		return nil, err
+	}
+	entry := &registry.Entry{}
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if strings.HasSuffix(mediaType, "xml") {
+		entry.Metadata = string(body)
+	} else if err := json.Unmarshal(body, entry); err != nil {
+		return nil, err
+	}
+	if entry.ServiceProvider == nil {
+		entry.ServiceProvider = &config.ServiceProvider{}
+	}
+	return entry, nil
+}
+
+// Largest registration accepted
+const maxBody = 10 << 20
+
+func reply(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(body)
+}
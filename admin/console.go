@@ -0,0 +1,192 @@
+package admin
+
+import (
+	"net/http"
+)
+
+// The console is a static page calling the API from the browser with the token the administrator enters,
+// so it holds no data of its own
+func serveConsole(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "GET" {
+		http.Error(writer, "Method Not Allowed", 405)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; "+
+		"style-src 'unsafe-inline'; connect-src 'self'")
+	writer.Header().Set("X-Frame-Options", "DENY")
+	writer.Write([]byte(console))
+}
+
+const console = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>lite-idp administration</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.expired { color: #b00; font-weight: bold; }
+.expiring { color: #b60; }
+input[type=text] { width: 18em; }
+#error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>lite-idp administration</h1>
+<form id="login">
+<label>Admin token <input type="password" id="token"></label>
+<button type="submit">Sign in</button>
+</form>
+<p id="error"></p>
+<div id="console" hidden>
+<h2>Service providers</h2>
+<table>
+<thead><tr><th>Entity ID</th><th>Source</th><th>Metadata valid until</th></tr></thead>
+<tbody id="providers"></tbody>
+</table>
+<h2>Sessions</h2>
+<p><span id="sessions"></span> active sessions on this server</p>
+<h2>Recent authentication failures</h2>
+<table>
+<thead><tr><th>Time</th><th>Service provider</th><th>Reason</th></tr></thead>
+<tbody id="failures"></tbody>
+</table>
+<h2>Release policies</h2>
+<p>Applied in addition to the policies in the configuration file. Separate values with commas.</p>
+<table>
+<thead><tr><th>Entity IDs</th><th>Entity categories</th><th>Attributes</th><th>Denied attributes</th><th></th></tr></thead>
+<tbody id="policies"></tbody>
+</table>
+<button id="add">Add policy</button>
+<button id="save">Save policies</button>
+</div>
+<script>
+(function () {
+  var base = location.pathname.replace(/console\/?$/, "");
+  var fields = ["EntityIds", "EntityCategories", "Attributes", "Deny"];
+
+  function call(method, path, body) {
+    var options = {method: method, headers: {"Authorization": "Bearer " + sessionStorage.getItem("token")}};
+    if (body !== undefined) {
+      options.body = JSON.stringify(body);
+      options.headers["Content-Type"] = "application/json";
+    }
+    return fetch(base + path, options).then(function (response) {
+      return response.json().then(function (data) {
+        if (!response.ok) {
+          throw new Error(data.Error || response.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function showError(err) {
+    document.getElementById("error").textContent = err.message;
+  }
+
+  function cell(row, text, className) {
+    var td = row.insertCell();
+    td.textContent = text;
+    if (className) {
+      td.className = className;
+    }
+    return td;
+  }
+
+  function loadStatus() {
+    return call("GET", "status").then(function (status) {
+      var providers = document.getElementById("providers");
+      providers.textContent = "";
+      status.ServiceProviders.forEach(function (sp) {
+        var row = providers.insertRow();
+        cell(row, sp.EntityId);
+        cell(row, sp.Managed ? "admin API" : "configuration file");
+        var validity = sp.ValidUntil ? new Date(sp.ValidUntil).toLocaleString() : "";
+        if (sp.Warning) {
+          validity += " (" + sp.Warning + ")";
+        }
+        cell(row, validity, sp.Warning);
+      });
+      document.getElementById("sessions").textContent = status.ActiveSessions;
+      var failures = document.getElementById("failures");
+      failures.textContent = "";
+      status.Failures.forEach(function (failure) {
+        var row = failures.insertRow();
+        cell(row, new Date(failure.Time).toLocaleString());
+        cell(row, failure.ServiceProvider);
+        cell(row, failure.Reason);
+      });
+    });
+  }
+
+  function addPolicy(policy) {
+    var row = document.getElementById("policies").insertRow();
+    fields.forEach(function (field) {
+      var input = document.createElement("input");
+      input.type = "text";
+      input.name = field;
+      input.value = (policy[field] || []).join(", ");
+      row.insertCell().appendChild(input);
+    });
+    var remove = document.createElement("button");
+    remove.textContent = "Remove";
+    remove.onclick = function () {
+      row.parentNode.removeChild(row);
+    };
+    row.insertCell().appendChild(remove);
+  }
+
+  function loadPolicies() {
+    return call("GET", "release-policies").then(function (policies) {
+      document.getElementById("policies").textContent = "";
+      policies.forEach(addPolicy);
+    });
+  }
+
+  function savePolicies() {
+    var policies = [];
+    Array.prototype.forEach.call(document.getElementById("policies").rows, function (row) {
+      var policy = {};
+      Array.prototype.forEach.call(row.querySelectorAll("input"), function (input) {
+        policy[input.name] = input.value.split(",").map(function (value) {
+          return value.trim();
+        }).filter(function (value) {
+          return value !== "";
+        });
+      });
+      policies.push(policy);
+    });
+    call("PUT", "release-policies", policies).then(loadPolicies).then(function () {
+      document.getElementById("error").textContent = "";
+    }).catch(showError);
+  }
+
+  function start() {
+    Promise.all([loadStatus(), loadPolicies()]).then(function () {
+      document.getElementById("login").hidden = true;
+      document.getElementById("console").hidden = false;
+      document.getElementById("error").textContent = "";
+    }).catch(showError);
+  }
+
+  document.getElementById("login").onsubmit = function (event) {
+    event.preventDefault();
+    sessionStorage.setItem("token", document.getElementById("token").value);
+    start();
+  };
+  document.getElementById("add").onclick = function () {
+    addPolicy({});
+  };
+  document.getElementById("save").onclick = savePolicies;
+  if (sessionStorage.getItem("token")) {
+    start();
+  }
+})();
+</script>
+</body>
+</html>
+`
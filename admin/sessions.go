@@ -0,0 +1,103 @@
+package admin
+
+import (
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/webhook"
+	"net"
+	"net/http"
+)
+
+// A session as the API shows it. Its ID is replaced by a handle, as the ID is the user's session cookie.
+type session struct {
+	*authentication.SessionInfo
+	ID string
+}
+
+func newSession(info *authentication.SessionInfo) *session {
+	return &session{info, authentication.SessionHandle(info.ID)}
+}
+
+func (api *api) sessions(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	handle, user := query.Get("id"), query.Get("user")
+	switch {
+	case request.Method == "GET" && handle != "":
+		info, err := authentication.LookupSessionHandle(api.store, handle)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to read session", "err", err)
+			reply(writer, 500, map[string]string{"Error": "unable to read session"})
+		} else if info == nil {
+			reply(writer, 404, map[string]string{"Error": "no such session"})
+		} else {
+			reply(writer, 200, newSession(info))
+		}
+	case request.Method == "GET":
+		sessions, err := authentication.ListSessions(api.store)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to list sessions", "err", err)
+			reply(writer, 500, map[string]string{"Error": "unable to list sessions"})
+			return
+		}
+		ip := net.ParseIP(query.Get("ip"))
+		if query.Get("ip") != "" && ip == nil {
+			reply(writer, 400, map[string]string{"Error": "ip isn't an IP address"})
+			return
+		}
+		matching := []*session{}
+		for _, info := range sessions {
+			if (user == "" || info.User == user) && (ip == nil || ip.Equal(info.IP)) &&
+				usedFor(info, query.Get("sp")) {
+				matching = append(matching, newSession(info))
+			}
+		}
+		reply(writer, 200, matching)
+	case request.Method == "DELETE" && handle != "":
+		info, err := authentication.LookupSessionHandle(api.store, handle)
+		if err == nil && info != nil {
+			err = authentication.RevokeSession(api.store, info.ID)
+		}
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to revoke session", "err", err)
+			reply(writer, 500, map[string]string{"Error": "unable to revoke session"})
+			return
+		}
+		if info == nil {
+			reply(writer, 404, map[string]string{"Error": "no such session"})
+			return
+		}
+		logging.FromRequest(request).Info("Revoked session", "user", info.User)
+		webhook.Notify(request, &webhook.Event{Type: config.EventSessionRevoked, User: info.User, Sessions: 1})
+		writer.WriteHeader(204)
+	case request.Method == "DELETE" && user != "":
+		revoked, err := authentication.RevokeUserSessions(api.store, user)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to revoke sessions", "user", user, "err", err)
+			reply(writer, 500, map[string]string{"Error": "unable to revoke sessions"})
+			return
+		}
+		logging.FromRequest(request).Info("Revoked sessions", "user", user, "count", revoked)
+		if revoked > 0 {
+			webhook.Notify(request, &webhook.Event{Type: config.EventSessionRevoked, User: user, Sessions: revoked})
+		}
+		reply(writer, 200, map[string]int{"Revoked": revoked})
+	case request.Method == "DELETE":
+		reply(writer, 400, map[string]string{"Error": "id or user is required"})
+	default:
+		http.Error(writer, "Method Not Allowed", 405)
+	}
+}
+
+// Reports whether the session logged in to the SP. Every session matches an empty entity ID.
+func usedFor(session *authentication.SessionInfo, entityId string) bool {
+	if entityId == "" {
+		return true
+	}
+	for _, sp := range session.ServiceProviders {
+		if sp == entityId {
+			return true
+		}
+	}
+	return false
+}
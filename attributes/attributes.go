@@ -1,14 +1,16 @@
 package attributes
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"github.com/amdonov/lite-idp/authentication"
 	"github.com/amdonov/lite-idp/protocol"
 	"io"
 )
 
 type Retriever interface {
-	Retrieve(*protocol.AuthenticatedUser) (map[string][]string, error)
+	Retrieve(context.Context, *protocol.AuthenticatedUser) (map[string][]string, error)
 }
 
 func NewJSONRetriever(jsonData io.Reader) (Retriever, error) {
@@ -25,10 +27,38 @@ type jsonRetriever struct {
 	people map[string]map[string][]string
 }
 
-func (store *jsonRetriever) Retrieve(user *protocol.AuthenticatedUser) (map[string][]string, error) {
+func (store *jsonRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
 	attributes, found := store.people[user.Name]
 	if !found {
 		return nil, errors.New("No attributes found for " + user.Name)
 	}
 	return attributes, nil
 }
+
+// Returns the attributes asserted by the authenticator, such as those from an upstream IdP
+func NewAuthenticatorRetriever() Retriever {
+	return authenticatorRetriever{}
+}
+
+type authenticatorRetriever struct{}
+
+func (authenticatorRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	return user.Attributes, nil
+}
+
+// Returns the attributes the user store knows of the user, so accounts and their attributes can be kept in
+// one backend
+func NewUserStoreRetriever(users authentication.UserStore) Retriever {
+	return userStoreRetriever{users}
+}
+
+type userStoreRetriever struct {
+	users authentication.UserStore
+}
+
+func (retriever userStoreRetriever) Retrieve(ctx context.Context,
+	user *protocol.AuthenticatedUser) (map[string][]string, error) {
+	return retriever.users.Attributes(ctx, user.Name)
+}
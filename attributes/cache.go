@@ -0,0 +1,38 @@
+package attributes
+
+import (
+	"context"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+)
+
+// Creates a retriever keeping each principal's attributes in the store for lifetime seconds, so logins to
+// several SPs in quick succession only query the backend once. Failures aren't cached.
+func NewCachingRetriever(retriever Retriever, store store.Storer, name string, lifetime int) Retriever {
+	return &cachingRetriever{retriever, store, "attributes:" + name + ":", lifetime}
+}
+
+type cachingRetriever struct {
+	retriever Retriever
+	store     store.Storer
+	prefix    string
+	lifetime  int
+}
+
+func (cache *cachingRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	key := cache.prefix + user.Name
+	var attributes map[string][]string
+	if err := cache.store.Retrieve(key, &attributes); err == nil && attributes != nil {
+		return attributes, nil
+	}
+	attributes, err := cache.retriever.Retrieve(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.store.Store(key, attributes, cache.lifetime); err != nil {
+		logging.FromContext(ctx).Warn("Failed to cache attributes", "key", key, "err", err)
+	}
+	return attributes, nil
+}
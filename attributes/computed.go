@@ -0,0 +1,103 @@
+package attributes
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"text/template"
+)
+
+// Failure policies for computed attributes
+const (
+	// Leaves the attribute out and logs the error
+	OnErrorSkip = "skip"
+	// Fails attribute resolution
+	OnErrorFail = "fail"
+)
+
+// Creates a retriever adding attributes computed with text/template from the attributes the wrapped
+// retriever returns. Templates see the first value of each attribute by name, and .value holds the current
+// value of the ForEach attribute. Referencing a missing attribute is an error.
+func NewComputedRetriever(retriever Retriever, computed []*config.ComputedAttribute) (Retriever, error) {
+	templates := make([]*template.Template, len(computed))
+	for i, attribute := range computed {
+		switch attribute.OnError {
+		case "", OnErrorSkip, OnErrorFail:
+		default:
+			return nil, fmt.Errorf("unknown error policy %s for computed attribute %s", attribute.OnError,
+				attribute.Name)
+		}
+		tmpl, err := template.New(attribute.Name).Option("missingkey=error").Parse(attribute.Template)
+		if err != nil {
+			return nil, err
+		}
+		templates[i] = tmpl
+	}
+	return &computedRetriever{retriever, computed, templates}, nil
+}
+
+type computedRetriever struct {
+	retriever Retriever
+	computed  []*config.ComputedAttribute
+	templates []*template.Template
+}
+
+func (retriever *computedRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	attributes, err := retriever.retriever.Retrieve(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	// Copied as retrievers may return their own maps
+	resolved := make(map[string][]string, len(attributes)+len(retriever.computed))
+	for name, values := range attributes {
+		resolved[name] = values
+	}
+	attributes = resolved
+	// Computed attributes may build on earlier ones
+	for i, attribute := range retriever.computed {
+		values, err := evaluate(retriever.templates[i], attribute, attributes)
+		if err != nil {
+			if attribute.OnError == OnErrorFail {
+				return nil, fmt.Errorf("computing %s: %s", attribute.Name, err)
+			}
+			logging.FromContext(ctx).Warn("Skipping computed attribute", "attribute", attribute.Name, "user",
+				user.Name, "err", err)
+			continue
+		}
+		if len(values) > 0 {
+			attributes[attribute.Name] = values
+		}
+	}
+	return attributes, nil
+}
+
+func evaluate(tmpl *template.Template, attribute *config.ComputedAttribute,
+	attributes map[string][]string) ([]string, error) {
+	data := make(map[string]string)
+	for name, values := range attributes {
+		if len(values) > 0 {
+			data[name] = values[0]
+		}
+	}
+	inputs := []string{""}
+	if attribute.ForEach != "" {
+		inputs = attributes[attribute.ForEach]
+	}
+	var values []string
+	for _, input := range inputs {
+		data["value"] = input
+		var out bytes.Buffer
+		err := tmpl.Execute(&out, data)
+		if err != nil {
+			return nil, err
+		}
+		if out.Len() > 0 {
+			values = append(values, out.String())
+		}
+	}
+	return values, nil
+}
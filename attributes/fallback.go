@@ -0,0 +1,41 @@
+package attributes
+
+import (
+	"context"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+)
+
+// Creates a retriever remembering each principal's attributes for lifetime seconds and returning them when
+// the wrapped retriever fails. The error is returned when nothing was remembered.
+func NewFallbackRetriever(retriever Retriever, store store.Storer, name string, lifetime int) Retriever {
+	return &fallbackRetriever{retriever, store, name, lifetime}
+}
+
+type fallbackRetriever struct {
+	retriever Retriever
+	store     store.Storer
+	name      string
+	lifetime  int
+}
+
+func (fallback *fallbackRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	key := "attributes-last:" + fallback.name + ":" + user.Name
+	attributes, err := fallback.retriever.Retrieve(ctx, user)
+	if err == nil {
+		if err := fallback.store.Store(key, attributes, fallback.lifetime); err != nil {
+			logging.FromContext(ctx).Warn("Failed to remember attributes", "source", fallback.name, "err", err)
+		}
+		return attributes, nil
+	}
+	var last map[string][]string
+	if fallback.store.Retrieve(key, &last) != nil || last == nil {
+		return nil, err
+	}
+	recordOutcome(fallback.name, "cached")
+	logging.FromContext(ctx).Warn("Attribute source failed, using its last values", "source", fallback.name,
+		"user", user.Name, "err", err)
+	return last, nil
+}
@@ -0,0 +1,88 @@
+package attributes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/httpclient"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/telemetry"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Responses larger than this are rejected
+const maxHTTPResponse = 1 << 20
+
+// Creates a retriever that fetches a JSON document describing the user from a REST endpoint and picks
+// attribute values out of it with the configured paths
+func NewHTTPRetriever(config *config.HTTPAttributes) Retriever {
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &httpRetriever{config, &http.Client{Transport: httpclient.Transport, Timeout: timeout}}
+}
+
+type httpRetriever struct {
+	config *config.HTTPAttributes
+	client *http.Client
+}
+
+// Puts the user's name in place of {user}, escaped for the path or for the query string depending on where it is
+func expandURL(template, name string) string {
+	split := strings.Index(template, "?")
+	if split < 0 {
+		return strings.Replace(template, "{user}", url.PathEscape(name), -1)
+	}
+	return strings.Replace(template[:split], "{user}", url.PathEscape(name), -1) +
+		strings.Replace(template[split:], "{user}", url.QueryEscape(name), -1)
+}
+
+func (retriever *httpRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	location := expandURL(retriever.config.URL, user.Name)
+	request, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return nil, err
+	}
+	telemetry.Inject(ctx, request.Header)
+	request.Header.Set("Accept", "application/json")
+	if retriever.config.Authorization != "" {
+		request.Header.Set("Authorization", retriever.config.Authorization)
+	}
+	response, err := retriever.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Connections are only reused once their response has been read to the end
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, maxHTTPResponse))
+		response.Body.Close()
+	}()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, errors.New("No attributes found for " + user.Name)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("attribute service returned %s", response.Status)
+	}
+	var document interface{}
+	err = json.NewDecoder(io.LimitReader(response.Body, maxHTTPResponse)).Decode(&document)
+	if err != nil {
+		return nil, err
+	}
+	attributes := make(map[string][]string)
+	for name, path := range retriever.config.Fields {
+		values := selectPath(document, path)
+		if len(values) > 0 {
+			attributes[name] = values
+		}
+	}
+	return attributes, nil
+}
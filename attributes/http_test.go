@@ -0,0 +1,15 @@
+package attributes
+
+import "testing"
+
+func TestExpandURLEscapesForPosition(t *testing.T) {
+	tests := map[string]string{
+		"https://directory.example.com/users/{user}":          "https://directory.example.com/users/j%20doe+a&b%3Fc",
+		"https://directory.example.com/lookup?uid={user}&x=1": "https://directory.example.com/lookup?uid=j+doe%2Ba%26b%3Fc&x=1",
+	}
+	for template, expected := range tests {
+		if location := expandURL(template, "j doe+a&b?c"); location != expected {
+			t.Errorf("%s expanded to %s", template, location)
+		}
+	}
+}
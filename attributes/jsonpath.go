@@ -0,0 +1,75 @@
+package attributes
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Returns the scalar values at a path such as $.profile.emails[*].address. Segments are object keys,
+// optionally followed by [n] to index an array or [*] to take every element. Arrays reached at the end of
+// the path contribute each of their scalar elements.
+func selectPath(document interface{}, path string) []string {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	nodes := []interface{}{document}
+	if path != "" {
+		for _, segment := range strings.Split(path, ".") {
+			nodes = step(nodes, segment)
+		}
+	}
+	var values []string
+	for _, node := range nodes {
+		if array, ok := node.([]interface{}); ok {
+			for _, element := range array {
+				values = appendScalar(values, element)
+			}
+			continue
+		}
+		values = appendScalar(values, node)
+	}
+	return values
+}
+
+func step(nodes []interface{}, segment string) []interface{} {
+	key, index := segment, ""
+	if open := strings.IndexByte(segment, '['); open >= 0 && strings.HasSuffix(segment, "]") {
+		key, index = segment[:open], segment[open+1:len(segment)-1]
+	}
+	var next []interface{}
+	for _, node := range nodes {
+		if key != "" {
+			object, ok := node.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if node, ok = object[key]; !ok {
+				continue
+			}
+		}
+		if index == "" {
+			next = append(next, node)
+			continue
+		}
+		array, ok := node.([]interface{})
+		if !ok {
+			continue
+		}
+		if index == "*" {
+			next = append(next, array...)
+		} else if i, err := strconv.Atoi(index); err == nil && i >= 0 && i < len(array) {
+			next = append(next, array[i])
+		}
+	}
+	return next
+}
+
+func appendScalar(values []string, node interface{}) []string {
+	switch value := node.(type) {
+	case string:
+		return append(values, value)
+	case float64:
+		return append(values, strconv.FormatFloat(value, 'f', -1, 64))
+	case bool:
+		return append(values, strconv.FormatBool(value))
+	}
+	return values
+}
@@ -0,0 +1,57 @@
+package attributes
+
+import (
+	"context"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/directory"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"gopkg.in/ldap.v2"
+	"strings"
+)
+
+// Creates a retriever that looks users up in an LDAP directory. The filter's {user} placeholder is replaced
+// with the escaped principal name.
+func NewLDAPRetriever(pool *directory.Pool, config *config.LDAPAttributes) Retriever {
+	return &ldapRetriever{pool, config}
+}
+
+type ldapRetriever struct {
+	pool   *directory.Pool
+	config *config.LDAPAttributes
+}
+
+func (retriever *ldapRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	filter := strings.Replace(retriever.config.Filter, "{user}", ldap.EscapeFilter(user.Name), -1)
+	search := ldap.NewSearchRequest(retriever.config.Base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+		false, filter, retriever.config.Attributes, nil)
+	conn, err := retriever.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	_, span := telemetry.Start(ctx, "ldap.search", attribute.String("ldap.base", retriever.config.Base))
+	result, err := conn.Search(search)
+	telemetry.End(span, err)
+	if err != nil {
+		// The connection may be broken, so don't reuse it
+		conn.Close()
+		return nil, err
+	}
+	retriever.pool.Put(conn)
+	if len(result.Entries) == 0 {
+		return nil, errors.New("No attributes found for " + user.Name)
+	}
+	if len(result.Entries) > 1 {
+		return nil, errors.New("More than one directory entry matches " + user.Name)
+	}
+	attributes := make(map[string][]string)
+	for _, attribute := range result.Entries[0].Attributes {
+		if len(attribute.Values) > 0 {
+			attributes[attribute.Name] = attribute.Values
+		}
+	}
+	return attributes, nil
+}
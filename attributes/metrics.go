@@ -0,0 +1,12 @@
+package attributes
+
+import "expvar"
+
+// Outcomes of attribute lookups published at /debug/vars, keyed by the source's name and then the outcome:
+// succeeded, failed when the login failed with it, or omitted. Lookups answered with a source's last values
+// count as cached as well as succeeded, as the pipeline sees them succeed.
+var sourceStats = expvar.NewMap("attributeSources")
+
+func recordOutcome(source, outcome string) {
+	sourceStats.Add(source+"."+outcome, 1)
+}
@@ -0,0 +1,113 @@
+package attributes
+
+import (
+	"context"
+	"fmt"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"sort"
+)
+
+// Ways of combining attributes from several sources
+const (
+	// Every value from every source
+	MergeUnion = "union"
+	// Each attribute from the first source, in order, that provides it
+	MergeFirst = "first"
+	// Each attribute from the highest priority source that provides it
+	MergePriority = "priority"
+)
+
+// What a pipeline does when a source fails
+const (
+	// Fails the whole pipeline
+	OnFailureFail = "fail"
+	// Continues without the source's attributes
+	OnFailureOmit = "omit"
+	// Uses the values the source last returned, or continues without them if there are none. The source's
+	// retriever must be wrapped with NewFallbackRetriever.
+	OnFailureCached = "cached"
+)
+
+// A retriever taking part in a pipeline
+type Source struct {
+	Name      string
+	Retriever Retriever
+	Priority  int
+	// Defaults to omit
+	OnFailure string
+}
+
+// Creates a retriever consulting each source and combining their attributes with the merge strategy.
+// Sources are consulted in the order given.
+func NewPipeline(merge string, sources []Source) (Retriever, error) {
+	for _, source := range sources {
+		switch source.OnFailure {
+		case "", OnFailureFail, OnFailureOmit, OnFailureCached:
+		default:
+			return nil, fmt.Errorf("unknown failure policy %s for attribute source %s", source.OnFailure,
+				source.Name)
+		}
+	}
+	switch merge {
+	case "":
+		merge = MergeUnion
+	case MergeUnion, MergeFirst:
+	case MergePriority:
+		sorted := make([]Source, len(sources))
+		copy(sorted, sources)
+		// Stable so equal priorities keep their order
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].Priority > sorted[j].Priority
+		})
+		sources = sorted
+	default:
+		return nil, fmt.Errorf("unknown attribute merge strategy %s", merge)
+	}
+	return &pipeline{merge, sources}, nil
+}
+
+type pipeline struct {
+	merge   string
+	sources []Source
+}
+
+func (pipeline *pipeline) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	logger := logging.FromContext(ctx)
+	merged := make(map[string][]string)
+	for _, source := range pipeline.sources {
+		sourceCtx, span := telemetry.Start(ctx, "attributes.source", attribute.String("source", source.Name))
+		attributes, err := source.Retriever.Retrieve(sourceCtx, user)
+		telemetry.End(span, err)
+		if err != nil {
+			if source.OnFailure == OnFailureFail {
+				recordOutcome(source.Name, "failed")
+				logger.Error("Attribute source failed, failing login", "source", source.Name, "user", user.Name,
+					"err", err)
+				return nil, fmt.Errorf("attribute source %s failed: %s", source.Name, err)
+			}
+			recordOutcome(source.Name, "omitted")
+			logger.Warn("Attribute source failed, omitting its attributes", "source", source.Name, "user",
+				user.Name, "err", err)
+			continue
+		}
+		recordOutcome(source.Name, "succeeded")
+		for name, values := range attributes {
+			existing, found := merged[name]
+			if found && pipeline.merge != MergeUnion {
+				// Priority sources are sorted, so both strategies keep the earlier values
+				continue
+			}
+			for _, value := range values {
+				if !containsValue(existing, value) {
+					existing = append(existing, value)
+				}
+			}
+			merged[name] = existing
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,60 @@
+package attributes
+
+import (
+	"context"
+	"errors"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"testing"
+)
+
+// Returns its attributes, or its error when it has one
+type fixedRetriever struct {
+	attributes map[string][]string
+	err        error
+}
+
+func (retriever *fixedRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	return retriever.attributes, retriever.err
+}
+
+func outcomes(source, outcome string) int64 {
+	if count, ok := sourceStats.Get(source + "." + outcome).(interface{ Value() int64 }); ok {
+		return count.Value()
+	}
+	return 0
+}
+
+func TestPipelineFailurePolicies(t *testing.T) {
+	down := errors.New("connection refused")
+	user := &protocol.AuthenticatedUser{Name: "jdoe"}
+	ldap := &fixedRetriever{attributes: map[string][]string{"mail": {"jdoe@example.com"}}}
+	cached := NewFallbackRetriever(ldap, store.NewMemory(), "test-cached", 60)
+	pipeline, err := NewPipeline(MergeUnion, []Source{
+		{Name: "test-omitted", Retriever: &fixedRetriever{err: down}, OnFailure: OnFailureOmit},
+		{Name: "test-cached", Retriever: cached, OnFailure: OnFailureCached}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first lookup is remembered, so the later one can use it while the source is down
+	for _, err := range []error{nil, down} {
+		ldap.err = err
+		attributes, err := pipeline.Retrieve(context.Background(), user)
+		if err != nil || len(attributes["mail"]) != 1 {
+			t.Fatalf("retrieved %v: %v", attributes, err)
+		}
+	}
+	if omitted, used := outcomes("test-omitted", "omitted"), outcomes("test-cached", "cached"); omitted != 2 ||
+		used != 1 {
+		t.Errorf("counted %d omitted and %d cached lookups", omitted, used)
+	}
+	failing, _ := NewPipeline(MergeUnion, []Source{{Name: "test-failed", Retriever: &fixedRetriever{err: down},
+		OnFailure: OnFailureFail}})
+	if _, err := failing.Retrieve(context.Background(), user); err == nil {
+		t.Error("failing source didn't fail the lookup")
+	}
+	if failed := outcomes("test-failed", "failed"); failed != 1 {
+		t.Errorf("counted %d failed lookups", failed)
+	}
+}
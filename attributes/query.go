@@ -17,10 +17,12 @@ type AttributeQueryBody struct {
 }
 
 type AttributeQuery struct {
-	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
-	ID      string   `xml:",attr"`
-	Issuer  string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
-	Subject saml.Subject
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
+	ID           string   `xml:",attr"`
+	IssueInstant string   `xml:",attr"`
+	Destination  string   `xml:",attr"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Subject      saml.Subject
 }
 
 type AttributeRespEnv struct {
@@ -0,0 +1,95 @@
+package attributes
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/protocol"
+	"time"
+)
+
+// Creates a retriever running each configured query with the principal name as its only parameter. Every
+// row adds a value to the attribute named for its column, so multi-row results become multi-valued
+// attributes.
+func NewSQLRetriever(config *config.SQLAttributes) (Retriever, error) {
+	db, err := sql.Open(config.Driver, config.DataSource)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &sqlRetriever{db, config.Queries, timeout}, nil
+}
+
+type sqlRetriever struct {
+	db      *sql.DB
+	queries []*config.SQLQuery
+	timeout time.Duration
+}
+
+func (retriever *sqlRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	ctx, cancel := context.WithTimeout(ctx, retriever.timeout)
+	defer cancel()
+	attributes := make(map[string][]string)
+	for _, query := range retriever.queries {
+		err := retriever.run(ctx, query, user.Name, attributes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(attributes) == 0 {
+		return nil, errors.New("No attributes found for " + user.Name)
+	}
+	return attributes, nil
+}
+
+func (retriever *sqlRetriever) run(ctx context.Context, query *config.SQLQuery, name string,
+	attributes map[string][]string) error {
+	rows, err := retriever.db.QueryContext(ctx, query.Statement, name)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]sql.NullString, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+	for rows.Next() {
+		err = rows.Scan(targets...)
+		if err != nil {
+			return err
+		}
+		for i, column := range columns {
+			if !values[i].Valid {
+				continue
+			}
+			attribute := column
+			if mapped, found := query.Columns[column]; found {
+				attribute = mapped
+			}
+			// Joins can repeat a value across rows
+			if !containsValue(attributes[attribute], values[i].String) {
+				attributes[attribute] = append(attributes[attribute], values[i].String)
+			}
+		}
+	}
+	return rows.Err()
+}
+
+func containsValue(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package attributes
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/protocol"
+	"regexp"
+	"strings"
+)
+
+// Transform types
+const (
+	TransformLowercase = "lowercase"
+	TransformUppercase = "uppercase"
+	TransformReplace   = "replace"
+	TransformScope     = "scope"
+	// Encodes values, such as binary identifiers from a directory, so they can be sent as text
+	TransformBase64 = "base64"
+)
+
+// Creates a retriever applying the transforms in order to the values the wrapped retriever returns
+func NewTransformingRetriever(retriever Retriever, transforms []*config.Transform) (Retriever, error) {
+	funcs := make([]func(string) string, len(transforms))
+	for i, transform := range transforms {
+		switch transform.Type {
+		case TransformLowercase:
+			funcs[i] = strings.ToLower
+		case TransformUppercase:
+			funcs[i] = strings.ToUpper
+		case TransformReplace:
+			re, err := regexp.Compile(transform.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			replacement := transform.Replacement
+			funcs[i] = func(value string) string {
+				return re.ReplaceAllString(value, replacement)
+			}
+		case TransformScope:
+			if transform.Scope == "" {
+				return nil, fmt.Errorf("scope transform of %s has no scope", transform.Attribute)
+			}
+			suffix := "@" + transform.Scope
+			funcs[i] = func(value string) string {
+				if strings.Contains(value, "@") {
+					return value
+				}
+				return value + suffix
+			}
+		case TransformBase64:
+			funcs[i] = func(value string) string {
+				return base64.StdEncoding.EncodeToString([]byte(value))
+			}
+		default:
+			return nil, fmt.Errorf("unknown transform %s for attribute %s", transform.Type, transform.Attribute)
+		}
+	}
+	return &transformingRetriever{retriever, transforms, funcs}, nil
+}
+
+type transformingRetriever struct {
+	retriever  Retriever
+	transforms []*config.Transform
+	funcs      []func(string) string
+}
+
+func (retriever *transformingRetriever) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	attributes, err := retriever.retriever.Retrieve(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	// Copied as retrievers may return their own maps
+	transformed := make(map[string][]string, len(attributes))
+	for name, values := range attributes {
+		transformed[name] = values
+	}
+	for i, transform := range retriever.transforms {
+		values, found := transformed[transform.Attribute]
+		if !found {
+			continue
+		}
+		changed := make([]string, len(values))
+		for j, value := range values {
+			changed[j] = retriever.funcs[i](value)
+		}
+		transformed[transform.Attribute] = changed
+	}
+	return transformed, nil
+}
@@ -0,0 +1,276 @@
+// Package audit keeps a tamper-evident record of the assertions the IdP issues, separate from its
+// operational logs. Each entry includes the hash of the one before, so removing or altering an entry
+// breaks the chain from that point on.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/saml"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// An issued assertion or a change to the signing keys
+type Entry struct {
+	Sequence uint64
+	Time     time.Time
+	// Set for key changes, with the SHA-256 fingerprint of the key's certificate
+	Event string `json:",omitempty"`
+	Key   string `json:",omitempty"`
+	// How the assertion was requested: sso, query or delegation
+	Via             string
+	User            string
+	ServiceProvider string
+	NameID          string
+	AuthnContext    string `json:",omitempty"`
+	ClientIP        string `json:",omitempty"`
+	AssertionID     string
+	// Names of the attributes released in the clear, and how many more were encrypted
+	Attributes          []string
+	EncryptedAttributes int `json:",omitempty"`
+	// Hash of the previous entry, empty for the first
+	Previous string
+	Hash     string `json:",omitempty"`
+}
+
+// Ways assertions are requested
+const (
+	ViaSSO        = "sso"
+	ViaQuery      = "query"
+	ViaDelegation = "delegation"
+)
+
+// Signing key changes
+const (
+	EventKeyGenerated = "key-generated"
+	EventKeyActivated = "key-activated"
+	EventKeyArchived  = "key-archived"
+)
+
+// Describes a change to a signing key
+func NewKeyEvent(event, fingerprint string) *Entry {
+	return &Entry{Event: event, Key: fingerprint}
+}
+
+// Describes an assertion issued to the SP for the user
+func NewEntry(via, user, entityId string, ip net.IP, assertion *saml.Assertion) *Entry {
+	entry := &Entry{Via: via, User: user, ServiceProvider: entityId, AssertionID: assertion.ID,
+		Attributes: []string{}}
+	if ip != nil {
+		entry.ClientIP = ip.String()
+	}
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		entry.NameID = assertion.Subject.NameID.Value
+	}
+	if statement := assertion.AuthnStatement; statement != nil && statement.AuthnContext != nil {
+		entry.AuthnContext = statement.AuthnContext.AuthnContextClassRef
+	}
+	if statement := assertion.AttributeStatement; statement != nil {
+		for _, attribute := range statement.Attributes {
+			name := attribute.FriendlyName
+			if name == "" {
+				name = attribute.Name
+			}
+			entry.Attributes = append(entry.Attributes, name)
+		}
+		entry.EncryptedAttributes = len(statement.EncryptedAttributes)
+	}
+	return entry
+}
+
+// Returns the hash of the entry, covering every field but Hash
+func (entry Entry) hash() (string, error) {
+	entry.Hash = ""
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Appends entries to a file, one JSON object per line, and queues them for collectors. A nil Log records
+// nothing.
+type Log struct {
+	mutex    sync.Mutex
+	file     *rotatingFile
+	queues   []*queue
+	sequence uint64
+	previous string
+}
+
+// Opens the audit file, continuing the chain from its last entry, and starts sending to the configured
+// collectors. Problems writing and sending entries are logged to the logger.
+func New(settings *config.Audit, logger *slog.Logger) (*Log, error) {
+	defaults := settings.WithDefaults()
+	log := &Log{}
+	if settings.File != "" {
+		last, err := lastEntry(settings.File)
+		if err != nil {
+			return nil, err
+		}
+		// The current file is empty right after rotation
+		if last == nil {
+			backups, err := rotated(settings.File)
+			if err != nil {
+				return nil, err
+			}
+			if len(backups) > 0 {
+				last, err = lastEntry(backups[len(backups)-1])
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if last != nil {
+			log.sequence = last.Sequence
+			log.previous = last.Hash
+		}
+		log.file, err = openRotating(settings.File, int64(settings.MaxSize)<<20,
+			time.Duration(settings.MaxAge)*time.Hour, settings.MaxBackups, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if settings.Syslog != nil {
+		sink, err := NewSyslogSink(settings.Syslog)
+		if err != nil {
+			return nil, err
+		}
+		log.queues = append(log.queues, newQueue("syslog", sink, defaults, 1, 0, logger))
+	}
+	if settings.HTTP != nil {
+		sink, err := NewHTTPSink(settings.HTTP)
+		if err != nil {
+			return nil, err
+		}
+		batch := settings.HTTP.BatchSize
+		if batch <= 0 {
+			batch = 100
+		}
+		interval := settings.HTTP.FlushInterval
+		if interval <= 0 {
+			interval = 5
+		}
+		log.queues = append(log.queues, newQueue("http", sink, defaults, batch, time.Duration(interval)*time.Second,
+			logger))
+	}
+	return log, nil
+}
+
+// How far from the end of the file the last entry is looked for
+const maxEntry = 1 << 20
+
+func lastEntry(path string) (*Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	offset := info.Size() - maxEntry
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxEntry)
+	var line []byte
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			line = append(line[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if line == nil {
+		return nil, nil
+	}
+	var entry Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, fmt.Errorf("last entry of %s is damaged: %s", path, err)
+	}
+	return &entry, nil
+}
+
+// Chains the entry to the previous one and appends it, returning once it's on disk
+func (log *Log) Record(entry *Entry) error {
+	if log == nil {
+		return nil
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	entry.Sequence = log.sequence + 1
+	entry.Time = time.Now().UTC()
+	entry.Previous = log.previous
+	hash, err := entry.hash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if log.file != nil {
+		if err := log.file.write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	log.sequence = entry.Sequence
+	log.previous = entry.Hash
+	for _, queue := range log.queues {
+		queue.add(data)
+	}
+	return nil
+}
+
+// Checks the chain in an audit file, returning the number of entries or an error describing the first
+// entry that doesn't follow from the one before
+func Verify(reader io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxEntry)
+	var count, sequence uint64
+	previous := ""
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return count, fmt.Errorf("entry after sequence %d is damaged: %s", count, err)
+		}
+		hash, err := entry.hash()
+		if err != nil {
+			return count, err
+		}
+		// The chain may start partway through a file that was rotated
+		if count > 0 && (entry.Previous != previous || entry.Sequence != sequence+1) {
+			return count, fmt.Errorf("entry %d doesn't follow the entry before it", entry.Sequence)
+		}
+		if hash != entry.Hash {
+			return count, fmt.Errorf("entry %d has been altered", entry.Sequence)
+		}
+		previous, sequence = entry.Hash, entry.Sequence
+		count++
+	}
+	return count, scanner.Err()
+}
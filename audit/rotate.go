@@ -0,0 +1,140 @@
+package audit
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Suffix of rotated files. It sorts in the order the files were rotated.
+const rotatedLayout = "20060102T150405.000000000Z"
+
+// An append-only file renamed aside once it's too large or too old
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	file       *os.File
+	size       int64
+	// When the file was started, taken from the last rotation
+	started time.Time
+	logger  *slog.Logger
+}
+
+func openRotating(path string, maxSize int64, maxAge time.Duration, maxBackups int,
+	logger *slog.Logger) (*rotatingFile, error) {
+	rotating := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups,
+		started: time.Now(), logger: logger}
+	backups, err := rotated(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) > 0 {
+		newest := strings.TrimPrefix(backups[len(backups)-1], path+".")
+		if started, err := time.Parse(rotatedLayout, newest); err == nil {
+			rotating.started = started
+		}
+	}
+	if err := rotating.open(); err != nil {
+		return nil, err
+	}
+	return rotating, nil
+}
+
+func (rotating *rotatingFile) open() error {
+	file, err := os.OpenFile(rotating.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rotating.file = file
+	rotating.size = info.Size()
+	return nil
+}
+
+// Appends the data, rotating first if it's due, and returns once it's on disk
+func (rotating *rotatingFile) write(data []byte) error {
+	if rotating.size > 0 && rotating.due(int64(len(data))) {
+		if err := rotating.rotate(); err != nil {
+			return err
+		}
+	}
+	written, err := rotating.file.Write(data)
+	rotating.size += int64(written)
+	if err != nil {
+		return err
+	}
+	return rotating.file.Sync()
+}
+
+func (rotating *rotatingFile) due(length int64) bool {
+	if rotating.maxSize > 0 && rotating.size+length > rotating.maxSize {
+		return true
+	}
+	return rotating.maxAge > 0 && time.Since(rotating.started) >= rotating.maxAge
+}
+
+func (rotating *rotatingFile) rotate() error {
+	if err := rotating.file.Close(); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if err := os.Rename(rotating.path, rotating.path+"."+now.Format(rotatedLayout)); err != nil {
+		// Keep appending to the old file rather than lose entries
+		if openErr := rotating.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	rotating.started = now
+	if err := rotating.open(); err != nil {
+		return err
+	}
+	// Old files left behind don't put entries at risk
+	if err := rotating.prune(); err != nil {
+		rotating.logger.Warn("Failed to remove old audit files", "err", err)
+	}
+	return nil
+}
+
+// Removes the oldest rotated files beyond the number kept
+func (rotating *rotatingFile) prune() error {
+	if rotating.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := rotated(rotating.path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > rotating.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Returns the files rotated from the path, oldest first
+func rotated(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(rotatedLayout, strings.TrimPrefix(match, path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
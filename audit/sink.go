@@ -0,0 +1,218 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/httpclient"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A collector entries are copied to
+type Sink interface {
+	// Delivers entries, each a JSON object, in order. Entries are sent again after an error.
+	Send(entries [][]byte) error
+}
+
+// Longest wait between attempts to deliver to a failing collector
+const maxRetryDelay = time.Minute
+
+// Feeds entries to a sink from a background goroutine
+type queue struct {
+	name     string
+	sink     Sink
+	entries  chan []byte
+	drop     bool
+	batch    int
+	interval time.Duration
+	logger   *slog.Logger
+}
+
+// Starts a queue delivering up to batch entries at a time. A partial batch waits for the interval, or is
+// sent straight away when the interval is zero.
+func newQueue(name string, sink Sink, settings config.Audit, batch int, interval time.Duration,
+	logger *slog.Logger) *queue {
+	queue := &queue{name: name, sink: sink, entries: make(chan []byte, settings.Buffer),
+		drop: settings.Overflow == config.OverflowDrop, batch: batch, interval: interval, logger: logger}
+	go queue.run()
+	return queue
+}
+
+func (queue *queue) add(entry []byte) {
+	if !queue.drop {
+		queue.entries <- entry
+		return
+	}
+	select {
+	case queue.entries <- entry:
+	default:
+		queue.logger.Error("Audit queue is full, dropping entry", "sink", queue.name)
+	}
+}
+
+func (queue *queue) run() {
+	var timer <-chan time.Time
+	var pending [][]byte
+	for {
+		select {
+		case entry := <-queue.entries:
+			pending = append(pending, entry)
+			if len(pending) < queue.batch && queue.interval > 0 {
+				if timer == nil {
+					timer = time.After(queue.interval)
+				}
+				continue
+			}
+		case <-timer:
+		}
+		queue.deliver(pending)
+		pending, timer = nil, nil
+	}
+}
+
+// Keeps trying until the collector accepts the entries. Meanwhile the queue fills, then blocks or drops.
+func (queue *queue) deliver(entries [][]byte) {
+	delay := time.Second
+	for {
+		err := queue.sink.Send(entries)
+		if err == nil {
+			return
+		}
+		queue.logger.Error("Failed to send audit entries", "sink", queue.name, "entries", len(entries), "err", err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// Sends entries to a syslog collector over TCP, optionally with TLS
+type syslogSink struct {
+	settings  *config.AuditSyslog
+	tlsConfig *tls.Config
+	hostname  string
+	conn      net.Conn
+}
+
+func NewSyslogSink(settings *config.AuditSyslog) (Sink, error) {
+	sink := &syslogSink{settings: settings, hostname: "-"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		sink.hostname = hostname
+	}
+	if settings.TLS {
+		host, _, err := net.SplitHostPort(settings.Address)
+		if err != nil {
+			return nil, err
+		}
+		sink.tlsConfig = &tls.Config{ServerName: host}
+		if sink.tlsConfig.RootCAs, err = loadCAs(settings.CACertificate); err != nil {
+			return nil, err
+		}
+	}
+	return sink, nil
+}
+
+func (sink *syslogSink) Send(entries [][]byte) error {
+	if sink.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var err error
+		if sink.tlsConfig != nil {
+			sink.conn, err = tls.DialWithDialer(dialer, "tcp", sink.settings.Address, sink.tlsConfig)
+		} else {
+			sink.conn, err = dialer.Dial("tcp", sink.settings.Address)
+		}
+		if err != nil {
+			sink.conn = nil
+			return err
+		}
+	}
+	facility := sink.settings.Facility
+	if facility == 0 {
+		facility = 13
+	}
+	appName := sink.settings.AppName
+	if appName == "" {
+		appName = "lite-idp"
+	}
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		// Severity 6 is informational. MSGID identifies audit entries among other messages from the IdP.
+		message := fmt.Sprintf("<%d>1 %s %s %s %d assertion - %s", facility*8+6,
+			time.Now().UTC().Format(time.RFC3339Nano), sink.hostname, appName, os.Getpid(), entry)
+		fmt.Fprintf(&buffer, "%d %s", len(message), message)
+	}
+	sink.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := sink.conn.Write(buffer.Bytes()); err != nil {
+		// A partial write leaves the stream unframed, so start a new connection
+		sink.conn.Close()
+		sink.conn = nil
+		return err
+	}
+	return nil
+}
+
+// POSTs batches of entries to a collector as JSON arrays
+type httpSink struct {
+	settings *config.AuditHTTP
+	client   *http.Client
+}
+
+func NewHTTPSink(settings *config.AuditHTTP) (Sink, error) {
+	roots, err := loadCAs(settings.CACertificate)
+	if err != nil {
+		return nil, err
+	}
+	transport := httpclient.Transport
+	if roots != nil {
+		transport = httpclient.New(roots)
+	}
+	return &httpSink{settings, &http.Client{Transport: transport, Timeout: 30 * time.Second}}, nil
+}
+
+func (sink *httpSink) Send(entries [][]byte) error {
+	body := append([]byte{'['}, bytes.Join(entries, []byte{','})...)
+	body = append(body, ']')
+	request, err := http.NewRequest("POST", sink.settings.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if sink.settings.Authorization != "" {
+		request.Header.Set("Authorization", sink.settings.Authorization)
+	}
+	response, err := sink.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("collector replied %s", response.Status)
+	}
+	return nil
+}
+
+// Returns the certificates in the file, or nil for the system's when there's no file
+func loadCAs(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
@@ -1,17 +1,69 @@
 package authentication
 
 import (
+	"context"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
 	"github.com/amdonov/lite-idp/protocol"
 	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/telemetry"
 	"github.com/satori/go.uuid"
-	"log"
 	"net"
 	"net/http"
-	"strings"
+	"time"
+)
+
+type sessionsKey struct{}
+
+// Applies the IdP's session lifetimes and cookie names to the requests the handler serves. Requests that
+// don't pass through it get the defaults.
+func WithSessions(settings config.Sessions, handler http.Handler) http.Handler {
+	settings = settings.WithDefaults()
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), sessionsKey{}, settings)))
+	})
+}
+
+type sessionStoreKey struct{}
+
+// Keeps the sessions of the requests the handler serves in the store, such as one made with store.WriteBehind
+// so logins don't wait for them to be saved. Requests that don't pass through it keep them in the store
+// they're given.
+func WithSessionStore(sessions store.Storer, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), sessionStoreKey{},
+			sessions)))
+	})
+}
+
+// Returns the store the IdP serving the request keeps sessions in, or shared if it has none of its own
+func SessionStore(request *http.Request, shared store.Storer) store.Storer {
+	if sessions, ok := request.Context().Value(sessionStoreKey{}).(store.Storer); ok {
+		return sessions
+	}
+	return shared
+}
+
+// Returns the session settings of the IdP serving the request
+func sessionsFor(request *http.Request) config.Sessions {
+	if settings, ok := request.Context().Value(sessionsKey{}).(config.Sessions); ok {
+		return settings
+	}
+	return config.Sessions{}.WithDefaults()
+}
+
+// Authentication method names used in the AuthnContexts configuration
+const (
+	MethodPassword = "password"
+	MethodX509     = "x509"
+	MethodProxy    = "proxy"
 )
 
 type AuthFunc func(*protocol.AuthnRequest, string, *protocol.AuthenticatedUser, http.ResponseWriter, *http.Request)
 
+// Called when the request can't be satisfied, so the SP can be sent an error response
+type ErrorFunc func(*protocol.AuthnRequest, string, error, http.ResponseWriter, *http.Request)
+
 type Authenticator interface {
 	Authenticate(*protocol.AuthnRequest, string, http.ResponseWriter, *http.Request)
 }
@@ -21,85 +73,201 @@ type HandlerAuthenticator interface {
 	Authenticator
 }
 
+// Implemented by authenticators with pages that are read again when the configuration reloads
+type Reloader interface {
+	Reload() error
+}
+
 func getIP(request *http.Request) net.IP {
 	addr := request.RemoteAddr
-	if strings.Contains(addr, ":") {
-		addr = strings.Split(addr, ":")[0]
+	// Also handles IPv6 clients, such as those reported by a trusted proxy
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
 	return net.ParseIP(addr)
 }
 
 func retrieveUserFromSession(request *http.Request, store store.Storer) *protocol.AuthenticatedUser {
 	// Does this user have a session?
-	cookie, err := request.Cookie("lidp-user")
+	cookie, err := request.Cookie(sessionsFor(request).Cookie)
 	if err != nil {
 		return nil
 	}
 	// Read the user information from Redis
-	var tmpUser protocol.AuthenticatedUser
-	err = store.Retrieve(cookie.Value, &tmpUser)
+	_, span := telemetry.Start(request.Context(), "session.lookup")
+	var user protocol.AuthenticatedUser
+	err = SessionStore(request, store).Retrieve(cookie.Value, &user)
+	telemetry.End(span, err)
 	if err != nil {
 		return nil
 	}
-	user := &tmpUser
-	log.Printf("Using exising session for %s\n", user.Name)
+	return checkSession(request, &user)
+}
+
+// Returns the user of a session read from the store, or nil if it can't be used for this request
+func checkSession(request *http.Request, user *protocol.AuthenticatedUser) *protocol.AuthenticatedUser {
+	logger := logging.FromRequest(request)
+	logger.Debug("Using existing session", "user", user.Name)
 	// Make sure the IP matches
 	if !getIP(request).Equal(user.IP) {
-		log.Println("Warning - Existing session associated with a different IP address.")
+		logger.Warn("Existing session associated with a different IP address", "user", user.Name,
+			"session_ip", user.IP.String(), "ip", getIP(request).String())
 		// Force them to authenticate again
 		return nil
 	}
 	return user
 }
 
+// Returns the user signed in to the IdP on this request, or nil if they have no session
+func CurrentUser(request *http.Request, store store.Storer) *protocol.AuthenticatedUser {
+	return retrieveUserFromSession(request, store)
+}
+
 // No need to return an error. We can't do anything. They'll just have to sign in again
-func storeUserInSession(writer http.ResponseWriter, store store.Storer, user *protocol.AuthenticatedUser) {
+func storeUserInSession(writer http.ResponseWriter, request *http.Request, store store.Storer,
+	user *protocol.AuthenticatedUser) {
+	store = SessionStore(request, store)
 	// Create a session and save user info
 	sessionID := uuid.NewV4().String()
+	sessions := sessionsFor(request)
 
 	// Set a cookie for the user session
-	c := &http.Cookie{Name: "lidp-user", Value: sessionID, Path: "/", HttpOnly: true, Secure: true}
+	c := &http.Cookie{Name: sessions.Cookie, Value: sessionID, Path: "/", HttpOnly: true, Secure: true}
 	http.SetCookie(writer, c)
 
-	log.Printf("Creating a new session for %s\n", user.Name)
-	// Save information for 8 hours
-	err := store.Store(sessionID, user, 28800)
+	logger := logging.FromRequest(request)
+	logger.Info("Creating a new session", "user", user.Name)
+	user.SessionID = sessionID
+	user.SessionExpires = time.Now().Add(time.Duration(sessions.Lifetime) * time.Second)
+	_, span := telemetry.Start(request.Context(), "session.store")
+	err := store.Store(sessionID, user, sessions.Lifetime)
+	telemetry.End(span, err)
 	if err != nil {
-		log.Println("Failed to save session for user.")
+		logger.Error("Failed to save session", "user", user.Name, "err", err)
+		return
+	}
+	if err := recordSession(request, store, user); err != nil {
+		logger.Error("Failed to record session", "user", user.Name, "err", err)
+	}
+}
+
+// Signs the user in to the session the browser already has when it's theirs, as when they sign in again for a
+// stronger context, so SPs they've signed in to through it are still logged out with it. Someone else's
+// session is ended and a new one created.
+func continueSession(writer http.ResponseWriter, request *http.Request, store store.Storer,
+	user, existing *protocol.AuthenticatedUser) {
+	store = SessionStore(request, store)
+	logger := logging.FromRequest(request)
+	if existing == nil || existing.SessionID == "" || existing.Name != user.Name {
+		if existing != nil && existing.SessionID != "" {
+			if err := RevokeSession(store, existing.SessionID); err != nil {
+				logger.Error("Failed to end replaced session", "user", existing.Name, "err", err)
+			}
+		}
+		storeUserInSession(writer, request, store, user)
+		return
+	}
+	ttl := int(existing.SessionExpires.Sub(time.Now()).Seconds())
+	if ttl <= 0 {
+		storeUserInSession(writer, request, store, user)
+		return
+	}
+	logger.Info("Continuing the existing session", "user", user.Name)
+	user.SessionID = existing.SessionID
+	user.SessionExpires = existing.SessionExpires
+	_, span := telemetry.Start(request.Context(), "session.store")
+	err := store.Store(user.SessionID, user, ttl)
+	telemetry.End(span, err)
+	if err != nil {
+		logger.Error("Failed to save session", "user", user.Name, "err", err)
+		return
+	}
+	if err := touchSession(store, user.SessionID, ""); err != nil {
+		logger.Error("Failed to record session", "user", user.Name, "err", err)
 	}
 }
 
 type RequestState struct {
 	AuthnRequest *protocol.AuthnRequest
 	RelayState   string
+	// ID of the original request, used for InResponseTo
+	RequestID string
+	Expires   time.Time
+	// IdP and request ID the request was forwarded with when proxying
+	Upstream          string
+	UpstreamRequestID string
 }
 
-func storeRequestState(writer http.ResponseWriter, store store.Storer, authnRequest *protocol.AuthnRequest, relayState string) error {
-	// Save the request and relaystate for 5 minutes
-	sessionID := uuid.NewV4().String()
-	state := RequestState{authnRequest, relayState}
-	err := store.Store(sessionID, state, 300)
+func newRequestState(request *http.Request, authnRequest *protocol.AuthnRequest, relayState string) *RequestState {
+	return &RequestState{AuthnRequest: authnRequest, RelayState: relayState, RequestID: authnRequest.ID,
+		Expires: time.Now().Add(time.Duration(sessionsFor(request).RequestLifetime) * time.Second)}
+}
+
+// Saves the request and relaystate for the request lifetime, returning the key it's stored under
+func saveRequestState(request *http.Request, store store.Storer, state *RequestState) (string, error) {
+	key := uuid.NewV4().String()
+	return key, store.Store(key, state, sessionsFor(request).RequestLifetime)
+}
+
+// Returns the request state stored under key or nil if it's missing or expired
+func loadRequestState(request *http.Request, store store.Storer, key string) *RequestState {
+	var rs RequestState
+	return checkRequestState(request, &rs, store.Retrieve(key, &rs))
+}
+
+// Returns the request state read from the store, or nil if it couldn't be read or has expired
+func checkRequestState(request *http.Request, rs *RequestState, err error) *RequestState {
+	if err != nil {
+		logging.FromRequest(request).Warn("Failed to load request state", "err", err)
+		return nil
+	}
+	if rs.AuthnRequest == nil || time.Now().After(rs.Expires) {
+		logging.FromRequest(request).Info("Request state has expired")
+		return nil
+	}
+	// Make sure the response is correlated with the original request
+	rs.AuthnRequest.ID = rs.RequestID
+	return rs
+}
+
+func storeRequestState(writer http.ResponseWriter, request *http.Request, store store.Storer,
+	authnRequest *protocol.AuthnRequest, relayState string) error {
+	sessionID, err := saveRequestState(request, store, newRequestState(request, authnRequest, relayState))
 	if err != nil {
 		return err
 	}
 	// Set a cookie for the request state
-	c := &http.Cookie{Name: "lidp-rs", Value: sessionID, Path: "/", HttpOnly: true, Secure: true}
+	c := &http.Cookie{Name: sessionsFor(request).RequestCookie, Value: sessionID, Path: "/", HttpOnly: true, Secure: true}
 	http.SetCookie(writer, c)
 	return err
 }
 
-func retrieveRequestState(request *http.Request, store store.Storer) (*protocol.AuthnRequest, string) {
+// Reads the request state saved before the login form was shown together with the browser's session, in one
+// round trip on stores that allow it. Either is nil when it's missing or can't be used.
+func retrieveLoginState(writer http.ResponseWriter, request *http.Request,
+	shared store.Storer) (*RequestState, *protocol.AuthenticatedUser) {
 	// Does this user have a saved request state
-	cookie, err := request.Cookie("lidp-rs")
+	sessions := sessionsFor(request)
+	cookie, err := request.Cookie(sessions.RequestCookie)
 	if err != nil {
-		return nil, ""
+		return nil, nil
 	}
-	// Read the user information from Redis
+	// The state is only good for one response
+	http.SetCookie(writer, &http.Cookie{Name: sessions.RequestCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: true})
 	var rs RequestState
-	err = store.Retrieve(cookie.Value, &rs)
-	if err != nil {
-		log.Println(err)
-		return nil, ""
+	var user protocol.AuthenticatedUser
+	keys := []interface{}{cookie.Value}
+	values := []interface{}{&rs}
+	if session, err := request.Cookie(sessions.Cookie); err == nil {
+		keys = append(keys, session.Value)
+		values = append(values, &user)
+	}
+	_, span := telemetry.Start(request.Context(), "session.lookup")
+	errs := store.RetrieveAll(SessionStore(request, shared), keys, values)
+	telemetry.End(span, errs[0])
+	state := checkRequestState(request, &rs, errs[0])
+	if state == nil || len(errs) < 2 || errs[1] != nil {
+		return state, nil
 	}
-	return rs.AuthnRequest, rs.RelayState
+	return state, checkSession(request, &user)
 }
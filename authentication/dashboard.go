@@ -0,0 +1,113 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/webhook"
+	"html/template"
+	"net/http"
+	"time"
+)
+
+// Creates the page where signed in users see their sessions and sign out of any of them, such as one left
+// open on a shared computer
+func NewDashboard(store store.Storer, config *config.Configuration) http.Handler {
+	return &dashboard{store, config, template.Must(template.New("sessions").Parse(sessionsPage))}
+}
+
+type dashboard struct {
+	store    store.Storer
+	config   *config.Configuration
+	template *template.Template
+}
+
+type dashboardPage struct {
+	User     string
+	Token    string
+	Sessions []dashboardSession
+}
+
+type dashboardSession struct {
+	// Identifies the session in the form without revealing its ID, which is as good as the cookie
+	Handle    string
+	Current   bool
+	IP        string
+	UserAgent string
+	Created   string
+	LastUsed  string
+	// SPs the session logged in to
+	ServiceProviders []string
+}
+
+// Form token tied to the user's session, so other sites can't submit the form for the user
+func dashboardToken(id string) string {
+	sum := sha256.Sum256([]byte("session-dashboard:" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+func (dashboard *dashboard) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	user := CurrentUser(request, dashboard.store)
+	if user == nil || user.SessionID == "" {
+		errorpage.Error(writer, request, "You aren't signed in. Sign in at a site that uses this service to see your sessions.",
+			401)
+		return
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	own, err := ListUserSessions(dashboard.store, user.Name)
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to list sessions", "user", user.Name, "err", err)
+		errorpage.Error(writer, request, "Unable to list your sessions", 500)
+		return
+	}
+	switch request.Method {
+	case "GET":
+		page := dashboardPage{User: user.Name, Token: dashboardToken(user.SessionID)}
+		for _, session := range own {
+			entry := dashboardSession{Handle: SessionHandle(session.ID), Current: session.ID == user.SessionID,
+				UserAgent: session.UserAgent, Created: session.Created.Format(time.RFC1123),
+				LastUsed: session.LastUsed.Format(time.RFC1123), ServiceProviders: session.ServiceProviders}
+			if session.IP != nil {
+				entry.IP = session.IP.String()
+			}
+			page.Sessions = append(page.Sessions, entry)
+		}
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		dashboard.template.Execute(writer, page)
+	case "POST":
+		token := request.PostFormValue("token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(dashboardToken(user.SessionID))) != 1 {
+			errorpage.Error(writer, request, "Bad Request", 400)
+			return
+		}
+		// Either one session by its handle, or every session but this one
+		target, others := request.PostFormValue("session"), request.PostFormValue("others") != ""
+		for _, session := range own {
+			if (others && session.ID != user.SessionID) || (!others && SessionHandle(session.ID) == target) {
+				if err := RevokeSession(SessionStore(request, dashboard.store), session.ID); err != nil {
+					logging.FromRequest(request).Error("Failed to revoke session", "user", user.Name, "err", err)
+					errorpage.Error(writer, request, "Unable to sign out of the session", 500)
+					return
+				}
+				logging.FromRequest(request).Info("User revoked session", "user", user.Name)
+				webhook.Notify(request, &webhook.Event{Type: config.EventSessionRevoked, User: user.Name, Sessions: 1})
+				if session.ID == user.SessionID {
+					http.SetCookie(writer, &http.Cookie{Name: sessionsFor(request).Cookie, Value: "", Path: "/",
+						MaxAge: -1, HttpOnly: true, Secure: true})
+				}
+			}
+		}
+		path := dashboard.config.EndpointPath(request, dashboard.config.Sessions.Dashboard)
+		http.Redirect(writer, request, path, http.StatusSeeOther)
+	default:
+		errorpage.Error(writer, request, "Method Not Allowed", 405)
+	}
+}
+
+//go:embed sessions.html
+var sessionsPage string
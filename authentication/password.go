@@ -2,60 +2,157 @@ package authentication
 
 import (
 	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/hooks"
+	"github.com/amdonov/lite-idp/logging"
 	"github.com/amdonov/lite-idp/protocol"
 	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/telemetry"
+	"github.com/amdonov/lite-idp/webhook"
+	"io/ioutil"
 	"net/http"
+	"sync/atomic"
 )
 
-func NewPasswordAuthenticator(callback AuthFunc, store store.Storer, form *config.Form) HandlerAuthenticator {
-	return &passwordAuthenticator{callback, store, form.Form, form.Error}
+const contextPassword = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+
+// Signs users in with the login form, checking their passwords with the user store. A nil user store checks
+// them against the form's users file. The form and error pages are read now, unless reload is set.
+func NewPasswordAuthenticator(callback AuthFunc, fail ErrorFunc, policy protocol.AuthnContextPolicy, store store.Storer,
+	form *config.Form, users UserStore, reload bool) (HandlerAuthenticator, error) {
+	if users == nil {
+		users = NewFileUserStore(form.Users)
+	}
+	formPage, err := loadPage(form.Form, reload)
+	if err != nil {
+		return nil, err
+	}
+	errorPage, err := loadPage(form.Error, reload)
+	if err != nil {
+		return nil, err
+	}
+	return &passwordAuthenticator{callback, fail, policy, store, formPage, errorPage, users}, nil
 }
 
 type passwordAuthenticator struct {
 	callback  AuthFunc
+	fail      ErrorFunc
+	policy    protocol.AuthnContextPolicy
 	store     store.Storer
-	form      string
-	errorPage string
+	form      *page
+	errorPage *page
+	users     UserStore
 }
 
 func (auth *passwordAuthenticator) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	err := request.ParseForm()
 	if err != nil {
-		http.Error(writer, err.Error(), 500)
+		errorpage.Error(writer, request, err.Error(), 500)
 		return
 	}
 	uid := request.Form.Get("uid")
 	pwd := request.Form.Get("pwd")
-	if "jdoe" != uid && "secret" != pwd {
-		http.ServeFile(writer, request, auth.errorPage)
+	if !auth.check(request, uid, pwd) {
+		webhook.Notify(request, &webhook.Event{Type: config.EventLoginFailed, User: uid,
+			Reason: "invalid user name or password"})
+		auth.errorPage.serve(writer, request)
 		return
 	}
-	authnRequest, relayState := retrieveRequestState(request, auth.store)
-	if authnRequest == nil {
-		http.Error(writer, "Failed to restore your request. Perhaps authentication took too long or you are not accepting cookies.", 500)
+	state, existing := retrieveLoginState(writer, request, auth.store)
+	if state == nil {
+		errorpage.Error(writer, request, "Failed to restore your request. Perhaps authentication took too long or you are not accepting cookies.", 500)
 		return
 	}
-	user := &protocol.AuthenticatedUser{uid,
-		"urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
-		"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport", getIP(request)}
-	storeUserInSession(writer, auth.store, user)
-	auth.callback(authnRequest, relayState, user, writer, request)
+	user := &protocol.AuthenticatedUser{Name: uid,
+		Format:  "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+		Context: contextPassword, IP: getIP(request),
+		Methods: []string{MethodPassword}}
+	continueSession(writer, request, auth.store, user, existing)
+	auth.callback(state.AuthnRequest, state.RelayState, user, writer, request)
+}
+
+func (auth *passwordAuthenticator) check(request *http.Request, uid, pwd string) bool {
+	ctx, span := telemetry.Start(request.Context(), "authenticate.password")
+	defer span.End()
+	verified, err := auth.users.Verify(ctx, uid, pwd)
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to check password", "err", err)
+		return false
+	}
+	return verified
 }
 
 func (auth *passwordAuthenticator) Authenticate(authnRequest *protocol.AuthnRequest, relayState string,
 	writer http.ResponseWriter, request *http.Request) {
 	// Does this user have a session?
 	user := retrieveUserFromSession(request, auth.store)
-	if user != nil {
+	if user != nil && auth.policy.Permits(authnRequest, user.Methods, user.Context) {
 		// We're good no need to have them login again
 		auth.callback(authnRequest, relayState, user, writer, request)
 		return
 	}
-	err := storeRequestState(writer, auth.store, authnRequest, relayState)
+	if !auth.policy.Permits(authnRequest, []string{MethodPassword}, contextPassword) {
+		auth.fail(authnRequest, relayState, protocol.ErrNoAuthnContext, writer, request)
+		return
+	}
+	// Passive requests can't show the login form
+	if authnRequest.IsPassive {
+		auth.fail(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, protocol.StatusNoPassive,
+			"user must log in"), writer, request)
+		return
+	}
+	if err := hooks.BeforeLogin(request, authnRequest); err != nil {
+		auth.fail(authnRequest, relayState, err, writer, request)
+		return
+	}
+	err := storeRequestState(writer, request, auth.store, authnRequest, relayState)
 	if err != nil {
-		http.Error(writer, err.Error(), 500)
+		errorpage.Error(writer, request, err.Error(), 500)
 		return
 	}
 	// Present the user with the login form
-	http.ServeFile(writer, request, auth.form)
+	auth.form.serve(writer, request)
+}
+
+// Reads the form and error pages again. A page that can't be read keeps what was read before.
+func (auth *passwordAuthenticator) Reload() error {
+	if err := auth.form.read(); err != nil {
+		return err
+	}
+	return auth.errorPage.read()
+}
+
+// An HTML file of the login form, kept in memory so logins don't read it
+type page struct {
+	path string
+	// Set while pages reload, when the file is served instead
+	reload  bool
+	content atomic.Pointer[[]byte]
+}
+
+func loadPage(path string, reload bool) (*page, error) {
+	page := &page{path: path, reload: reload}
+	return page, page.read()
+}
+
+// Reads the file into memory, unless it's served from disk anyway
+func (page *page) read() error {
+	if page.reload {
+		return nil
+	}
+	content, err := ioutil.ReadFile(page.path)
+	if err != nil {
+		return err
+	}
+	page.content.Store(&content)
+	return nil
+}
+
+func (page *page) serve(writer http.ResponseWriter, request *http.Request) {
+	if page.reload {
+		http.ServeFile(writer, request, page.path)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Write(*page.content.Load())
 }
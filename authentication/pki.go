@@ -8,12 +8,17 @@ import (
 	"net/http"
 )
 
-func NewPKIAuthenticator(callback AuthFunc, store store.Storer, fallback Authenticator) Authenticator {
-	return &pkiAuthenticator{callback, store, fallback}
+const contextX509 = "urn:oasis:names:tc:SAML:2.0:ac:classes:X509"
+
+func NewPKIAuthenticator(callback AuthFunc, fail ErrorFunc, policy protocol.AuthnContextPolicy, store store.Storer,
+	fallback Authenticator) Authenticator {
+	return &pkiAuthenticator{callback, fail, policy, store, fallback}
 }
 
 type pkiAuthenticator struct {
 	callback AuthFunc
+	fail     ErrorFunc
+	policy   protocol.AuthnContextPolicy
 	store    store.Storer
 	fallback Authenticator
 }
@@ -22,22 +27,33 @@ func (auth *pkiAuthenticator) Authenticate(authnRequest *protocol.AuthnRequest,
 	writer http.ResponseWriter, request *http.Request) {
 	// Does this user have a session?
 	user := retrieveUserFromSession(request, auth.store)
+	// A session established with a method the SP won't accept requires authenticating again
+	if user != nil && !auth.policy.Permits(authnRequest, user.Methods, user.Context) {
+		user = nil
+	}
 	if user == nil {
 		// Authenticate the User
-		if len(request.TLS.PeerCertificates) == 0 {
-			// No certs fallback if available
+		permitted := auth.policy.Permits(authnRequest, []string{MethodX509}, contextX509)
+		if len(request.TLS.PeerCertificates) == 0 || !permitted {
+			// No usable certs fallback if available
 			if auth.fallback == nil {
-				http.Error(writer, "No certificate provided.", 403)
+				err := protocol.NewStatusError(protocol.StatusResponder, protocol.StatusAuthnFailed,
+					"no certificate provided")
+				if !permitted {
+					err = protocol.ErrNoAuthnContext
+				}
+				auth.fail(authnRequest, relayState, err, writer, request)
 			} else {
 				auth.fallback.Authenticate(authnRequest, relayState, writer, request)
 			}
 			return
 		} else {
 			names := request.TLS.PeerCertificates[0].Subject.Names
-			user = &protocol.AuthenticatedUser{getDN(names),
-				"urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
-				"urn:oasis:names:tc:SAML:2.0:ac:classes:X509", getIP(request)}
-			storeUserInSession(writer, auth.store, user)
+			user = &protocol.AuthenticatedUser{Name: getDN(names),
+				Format:  "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
+				Context: contextX509, IP: getIP(request),
+				Methods: []string{MethodX509}}
+			storeUserInSession(writer, request, auth.store, user)
 		}
 	}
 	auth.callback(authnRequest, relayState, user, writer, request)
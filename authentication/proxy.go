@@ -0,0 +1,309 @@
+package authentication
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/hooks"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Creates an authenticator that sends users to an upstream IdP and translates its assertions for the
+// downstream SP. It handles upstream responses at the proxy's assertion consumer service.
+func NewProxyAuthenticator(callback AuthFunc, fail ErrorFunc, policy protocol.AuthnContextPolicy, store store.Storer,
+	config *config.Configuration) (HandlerAuthenticator, error) {
+	certificates := make(map[string]*x509.Certificate)
+	for _, upstream := range config.Proxy.Upstreams {
+		data, err := ioutil.ReadFile(upstream.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := dsig.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		certificates[upstream.EntityId] = cert
+	}
+	return &proxyAuthenticator{callback, fail, policy, store, config, certificates}, nil
+}
+
+type proxyAuthenticator struct {
+	callback     AuthFunc
+	fail         ErrorFunc
+	policy       protocol.AuthnContextPolicy
+	store        store.Storer
+	config       *config.Configuration
+	certificates map[string]*x509.Certificate
+}
+
+func (auth *proxyAuthenticator) Authenticate(authnRequest *protocol.AuthnRequest, relayState string,
+	writer http.ResponseWriter, request *http.Request) {
+	// Does this user have a session?
+	user := retrieveUserFromSession(request, auth.store)
+	if user != nil && auth.policy.Permits(authnRequest, user.Methods, user.Context) {
+		auth.callback(authnRequest, relayState, user, writer, request)
+		return
+	}
+	route := auth.config.Proxy.RouteFor(authnRequest.Issuer)
+	if route == nil || !authnRequest.Scoping.Allows(route.Upstream) {
+		auth.fail(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder,
+			protocol.StatusNoSupportedIDP, "no upstream identity provider is available"), writer, request)
+		return
+	}
+	upstream := auth.config.Proxy.Upstream(route.Upstream)
+	if upstream == nil {
+		errorpage.Error(writer, request, "Upstream identity provider "+route.Upstream+" is not configured.", 500)
+		return
+	}
+	// Sending the user upstream takes the place of showing them the login form
+	if err := hooks.BeforeLogin(request, authnRequest); err != nil {
+		auth.fail(authnRequest, relayState, err, writer, request)
+		return
+	}
+	scoping, err := protocol.UpstreamScoping(authnRequest.Scoping, authnRequest.Issuer)
+	if err != nil {
+		auth.fail(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder,
+			protocol.StatusProxyCountExceeded, err.Error()), writer, request)
+		return
+	}
+	upstreamRequest := &protocol.AuthnRequest{
+		AssertionConsumerServiceURL: auth.config.EndpointURL(request, auth.config.Proxy.AssertionConsumerService),
+		ProtocolBinding:             protocol.HTTPPostBinding,
+		IsPassive:                   authnRequest.IsPassive,
+		RequestedAuthnContext:       authnRequest.RequestedAuthnContext,
+		Scoping:                     scoping,
+	}
+	upstreamRequest.ID = protocol.NewID()
+	upstreamRequest.Version = "2.0"
+	upstreamRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+	upstreamRequest.Issuer = auth.config.EntityId
+	upstreamRequest.Destination = upstream.SingleSignOnService
+
+	// The state is found again through the RelayState, as cookies may not survive the cross-site POST
+	state := newRequestState(request, authnRequest, relayState)
+	state.Upstream = upstream.EntityId
+	state.UpstreamRequestID = upstreamRequest.ID
+	key, err := saveRequestState(request, auth.store, state)
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 500)
+		return
+	}
+	target, err := protocol.EncodeRedirect(upstream.SingleSignOnService, upstreamRequest, key)
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 500)
+		return
+	}
+	http.Redirect(writer, request, target, 302)
+}
+
+// Consumes a response from an upstream IdP
+func (auth *proxyAuthenticator) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	err := request.ParseForm()
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	key := request.Form.Get("RelayState")
+	state := loadRequestState(request, auth.store, key)
+	if state == nil || state.Upstream == "" {
+		errorpage.Error(writer, request, "Failed to restore your request. Perhaps authentication took too long.", 400)
+		return
+	}
+	errorpage.SetServiceProvider(request, state.AuthnRequest.Issuer)
+	// Each request state may only be used once
+	unused, err := auth.store.StoreIfAbsent("proxy-consumed:"+key, true, sessionsFor(request).RequestLifetime)
+	if err != nil || !unused {
+		errorpage.Error(writer, request, "This response has already been processed.", 400)
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(request.Form.Get("SAMLResponse"))
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	assertion, err := auth.consume(request, data, state)
+	if err != nil {
+		// Pass upstream failures along and report anything else as an authentication failure
+		if _, ok := err.(*protocol.StatusError); !ok {
+			logging.FromRequest(request).Warn("Rejected response from upstream IdP", "upstream", state.Upstream, "err", err)
+			err = protocol.NewStatusError(protocol.StatusResponder, protocol.StatusAuthnFailed,
+				"upstream authentication failed")
+		}
+		auth.fail(state.AuthnRequest, state.RelayState, err, writer, request)
+		return
+	}
+	// The route may have been removed by a reload since the user was sent upstream
+	route := auth.config.Proxy.RouteFor(state.AuthnRequest.Issuer)
+	if route == nil {
+		auth.fail(state.AuthnRequest, state.RelayState, protocol.NewStatusError(protocol.StatusResponder,
+			protocol.StatusNoSupportedIDP, "no upstream identity provider is available"), writer, request)
+		return
+	}
+	user, err := translate(route, assertion)
+	if err != nil {
+		auth.fail(state.AuthnRequest, state.RelayState, protocol.NewStatusError(protocol.StatusResponder,
+			protocol.StatusUnknownPrincipal, err.Error()), writer, request)
+		return
+	}
+	user.IP = getIP(request)
+	user.AuthenticatingAuthorities = append(user.AuthenticatingAuthorities, state.Upstream)
+	storeUserInSession(writer, request, auth.store, user)
+	auth.callback(state.AuthnRequest, state.RelayState, user, writer, request)
+}
+
+// Validates the upstream response and returns its assertion. Failure statuses from the upstream IdP are
+// returned as a StatusError.
+func (auth *proxyAuthenticator) consume(request *http.Request, data []byte, state *RequestState) (*saml.Assertion, error) {
+	var response protocol.Response
+	err := xml.Unmarshal(data, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Status == nil || response.Status.StatusCode.Value != protocol.StatusSuccess {
+		statusErr := protocol.NewStatusError(protocol.StatusResponder, "", "upstream authentication failed")
+		if response.Status != nil {
+			statusErr.Code = response.Status.StatusCode.Value
+			if response.Status.StatusCode.StatusCode != nil {
+				statusErr.SubCode = response.Status.StatusCode.StatusCode.Value
+			}
+		}
+		return nil, statusErr
+	}
+	// A second assertion beside the signed one would be merged into it when decoding
+	assertions, err := xmlutil.Count(data, saml.Namespace, "Assertion")
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := xmlutil.Count(data, saml.Namespace, "EncryptedAssertion")
+	if err != nil {
+		return nil, err
+	}
+	if assertions+encrypted > 1 {
+		return nil, errors.New("response has more than one assertion")
+	}
+	if assertions == 0 {
+		return nil, errors.New("response has no unencrypted assertion")
+	}
+	// Either the response or the assertion must be signed. Everything else is read from what was signed.
+	cert := auth.certificates[state.Upstream]
+	if cert == nil {
+		return nil, protocol.NewStatusError(protocol.StatusResponder, protocol.StatusNoSupportedIDP,
+			"upstream identity provider "+state.Upstream+" is not trusted")
+	}
+	var assertion *saml.Assertion
+	if signed, err := dsig.Verify(data, response.ID, cert); err == nil {
+		response = protocol.Response{}
+		if err := xml.Unmarshal(signed, &response); err != nil {
+			return nil, err
+		}
+		assertion = response.Assertion
+	} else {
+		if response.Assertion == nil {
+			return nil, err
+		}
+		signed, err := dsig.Verify(data, response.Assertion.ID, cert)
+		if err != nil {
+			return nil, err
+		}
+		assertion = &saml.Assertion{}
+		if err := xml.Unmarshal(signed, assertion); err != nil {
+			return nil, err
+		}
+	}
+	if assertion == nil {
+		return nil, errors.New("response has no unencrypted assertion")
+	}
+	if response.Issuer != nil && response.Issuer.Value != state.Upstream {
+		return nil, fmt.Errorf("response issued by %s rather than %s", response.Issuer.Value, state.Upstream)
+	}
+	if response.InResponseTo != state.UpstreamRequestID {
+		return nil, errors.New("response is not for the request sent")
+	}
+	acs := auth.config.EndpointURL(request, auth.config.Proxy.AssertionConsumerService)
+	if response.Destination != "" && response.Destination != acs {
+		return nil, errors.New("response Destination does not match")
+	}
+	if assertion.Issuer == nil || assertion.Issuer.Value != state.Upstream {
+		return nil, errors.New("assertion was not issued by " + state.Upstream)
+	}
+	now := time.Now()
+	skew := auth.config.ClockSkewFor(state.Upstream)
+	// An assertion for any audience could have been issued to another SP of the upstream IdP
+	conditions := assertion.Conditions
+	if conditions == nil || conditions.AudienceRestriction == nil {
+		return nil, errors.New("assertion has no audience restriction")
+	}
+	if !conditions.NotBefore.IsZero() && now.Add(skew).Before(conditions.NotBefore) {
+		return nil, errors.New("assertion is not yet valid")
+	}
+	if !conditions.NotOnOrAfter.IsZero() && !now.Add(-skew).Before(conditions.NotOnOrAfter) {
+		return nil, errors.New("assertion has expired")
+	}
+	allowed := false
+	for _, audience := range conditions.AudienceRestriction.Audience {
+		allowed = allowed || audience == auth.config.EntityId
+	}
+	if !allowed {
+		return nil, errors.New("assertion is not intended for this proxy")
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.SubjectConfirmation == nil ||
+		assertion.Subject.SubjectConfirmation.SubjectConfirmationData == nil {
+		return nil, errors.New("assertion has no bearer subject")
+	}
+	confirmation := assertion.Subject.SubjectConfirmation.SubjectConfirmationData
+	if confirmation.Recipient != acs || confirmation.InResponseTo != state.UpstreamRequestID ||
+		!now.Add(-skew).Before(confirmation.NotOnOrAfter) {
+		return nil, errors.New("subject confirmation is not valid for this request")
+	}
+	return assertion, nil
+}
+
+// Creates the downstream user from the upstream assertion according to the route's mapping rules
+func translate(route *config.ProxyRoute, assertion *saml.Assertion) (*protocol.AuthenticatedUser, error) {
+	user := &protocol.AuthenticatedUser{Name: assertion.Subject.NameID.Value,
+		Format: assertion.Subject.NameID.Format, Methods: []string{MethodProxy}}
+	if statement := assertion.AuthnStatement; statement != nil && statement.AuthnContext != nil {
+		user.Context = statement.AuthnContext.AuthnContextClassRef
+		user.AuthenticatingAuthorities = statement.AuthnContext.AuthenticatingAuthority
+	}
+	user.Attributes = make(map[string][]string)
+	if statement := assertion.AttributeStatement; statement != nil {
+		for _, att := range statement.Attributes {
+			name := att.Name
+			if len(route.Attributes) > 0 {
+				renamed, found := route.Attributes[att.Name]
+				if !found {
+					continue
+				}
+				name = renamed
+			}
+			for _, value := range att.AttributeValues {
+				user.Attributes[name] = append(user.Attributes[name], value.Value)
+			}
+		}
+	}
+	if route.NameIDAttribute != "" {
+		values := user.Attributes[route.NameIDAttribute]
+		if len(values) == 0 {
+			return nil, errors.New("upstream assertion has no " + route.NameIDAttribute + " attribute")
+		}
+		user.Name = values[0]
+		user.Format = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	}
+	if route.NameIDFormat != "" {
+		user.Format = route.NameIDFormat
+	}
+	return user, nil
+}
@@ -0,0 +1,160 @@
+package authentication
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/hooks"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testUpstream = "https://upstream.example.com/idp"
+	testProxy    = "https://proxy.example.com/idp"
+	testACS      = "/proxy/acs"
+)
+
+// Returns a proxy trusting a freshly generated upstream key, and a signer holding that key
+func newTestProxy(t *testing.T) (*proxyAuthenticator, dsig.Signer) {
+	key, cert, err := dsig.GenerateSelfSigned("upstream", nil, 2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dsig.NewSigner(bytes.NewReader(key), bytes.NewReader(cert), dsig.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := dsig.ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &config.Configuration{EntityId: testProxy, BaseURL: "https://proxy.example.com",
+		Proxy: &config.Proxy{AssertionConsumerService: testACS}}
+	return &proxyAuthenticator{config: settings,
+		certificates: map[string]*x509.Certificate{testUpstream: certificate}}, signer
+}
+
+// Returns a successful upstream response for the user whose assertion, restricted to the audience unless it's
+// empty, is signed by the signer
+func signedResponse(t *testing.T, signer dsig.Signer, state *RequestState, name, audience string) []byte {
+	now := time.Now()
+	assertion := &saml.Assertion{ID: "_a1", Version: "2.0", IssueInstant: now,
+		Issuer: saml.NewIssuer(testUpstream)}
+	if audience != "" {
+		assertion.Conditions = &saml.Conditions{NotBefore: now.Add(-time.Minute),
+			NotOnOrAfter: now.Add(5 * time.Minute), AudienceRestriction: &saml.AudienceRestriction{Audience: []string{audience}}}
+	}
+	assertion.Subject = &saml.Subject{NameID: &saml.NameID{Value: name},
+		SubjectConfirmation: &saml.SubjectConfirmation{Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+			SubjectConfirmationData: &saml.SubjectConfirmationData{Recipient: "https://proxy.example.com" + testACS,
+				InResponseTo: state.UpstreamRequestID, NotOnOrAfter: now.Add(5 * time.Minute)}}}
+	response := &protocol.Response{Assertion: assertion, Status: protocol.NewStatus(true)}
+	response.ID = "_r1"
+	response.Version = "2.0"
+	response.IssueInstant = now
+	response.InResponseTo = state.UpstreamRequestID
+	response.Issuer = saml.NewIssuer(testUpstream)
+	data, err := xmlutil.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = signer.SignElement(data, assertion.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestProxyAcceptsSignedAssertion(t *testing.T) {
+	auth, signer := newTestProxy(t)
+	state := &RequestState{Upstream: testUpstream, UpstreamRequestID: "_q1"}
+	data := signedResponse(t, signer, state, "jdoe", testProxy)
+	assertion, err := auth.consume(httptest.NewRequest("POST", testACS, nil), data, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := assertion.Subject.NameID.Value; name != "jdoe" {
+		t.Errorf("signed in as %s rather than jdoe", name)
+	}
+}
+
+// An unsigned assertion without an ID after the signed one is merged into it by encoding/xml, so it must
+// not be able to replace the signed subject
+func TestProxyRejectsWrappedAssertion(t *testing.T) {
+	auth, signer := newTestProxy(t)
+	state := &RequestState{Upstream: testUpstream, UpstreamRequestID: "_q1"}
+	data := string(signedResponse(t, signer, state, "jdoe", testProxy))
+	end := strings.Index(data, "</saml:Assertion>") + len("</saml:Assertion>")
+	forged := `<saml:Assertion><saml:Subject><saml:NameID>victim</saml:NameID></saml:Subject></saml:Assertion>`
+	wrapped := data[:end] + forged + data[end:]
+	assertion, err := auth.consume(httptest.NewRequest("POST", testACS, nil), []byte(wrapped), state)
+	if err == nil {
+		t.Fatalf("wrapped response accepted for %s", assertion.Subject.NameID.Value)
+	}
+}
+
+// Assertions must name the proxy as their audience, so one issued to another SP can't be replayed to it
+func TestProxyRequiresAudience(t *testing.T) {
+	auth, signer := newTestProxy(t)
+	state := &RequestState{Upstream: testUpstream, UpstreamRequestID: "_q1"}
+	for _, audience := range []string{"", "https://other.example.com/sp"} {
+		data := signedResponse(t, signer, state, "jdoe", audience)
+		if _, err := auth.consume(httptest.NewRequest("POST", testACS, nil), data, state); err == nil {
+			t.Errorf("accepted an assertion for audience %q", audience)
+		}
+	}
+}
+
+// A login started with an upstream IdP that's no longer trusted fails with a status rather than a panic
+func TestProxyRejectsUnknownUpstream(t *testing.T) {
+	auth, signer := newTestProxy(t)
+	state := &RequestState{Upstream: testUpstream, UpstreamRequestID: "_q1"}
+	data := signedResponse(t, signer, state, "jdoe", testProxy)
+	delete(auth.certificates, testUpstream)
+	_, err := auth.consume(httptest.NewRequest("POST", testACS, nil), data, state)
+	if status, ok := err.(*protocol.StatusError); !ok || status.SubCode != protocol.StatusNoSupportedIDP {
+		t.Errorf("response from an untrusted upstream returned %v", err)
+	}
+}
+
+// The BeforeLogin hook runs before the user is sent upstream, and its error stops the login
+func TestProxyRunsBeforeLoginHook(t *testing.T) {
+	auth, _ := newTestProxy(t)
+	auth.store = store.NewMemory()
+	auth.config.Proxy.Upstreams = []*config.Upstream{{EntityId: testUpstream,
+		SingleSignOnService: "https://upstream.example.com/sso"}}
+	auth.config.Proxy.Routes = []*config.ProxyRoute{{Upstream: testUpstream}}
+	var failure error
+	auth.fail = func(authnRequest *protocol.AuthnRequest, relayState string, err error, writer http.ResponseWriter,
+		request *http.Request) {
+		failure = err
+	}
+	denied := errors.New("logins are closed")
+	var checked *protocol.AuthnRequest
+	handler := (&hooks.Hooks{BeforeLogin: func(request *http.Request, authnRequest *protocol.AuthnRequest) error {
+		checked = authnRequest
+		return denied
+	}}).Handler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		authnRequest := &protocol.AuthnRequest{}
+		authnRequest.Issuer = "https://sp.example.com"
+		auth.Authenticate(authnRequest, "", writer, request)
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil))
+	if checked == nil || failure != denied {
+		t.Errorf("hook checked %v and the login failed with %v", checked, failure)
+	}
+	if location := recorder.Header().Get("Location"); location != "" {
+		t.Errorf("user was sent to %s", location)
+	}
+}
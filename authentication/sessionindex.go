@@ -0,0 +1,40 @@
+package authentication
+
+import (
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"time"
+)
+
+// Links a SessionIndex issued to an SP back to the IdP session it came from
+type SessionIndexEntry struct {
+	SessionID string
+	EntityId  string
+	Name      string
+}
+
+// Remembers the SessionIndex sent to an SP until the user's session expires so that logout requests
+// referencing it can be matched to the right session
+func RecordSessionIndex(store store.Storer, user *protocol.AuthenticatedUser, entityId, index string) error {
+	if user.SessionID == "" {
+		return nil
+	}
+	ttl := int(user.SessionExpires.Sub(time.Now()).Seconds())
+	if ttl <= 0 {
+		return nil
+	}
+	entry := SessionIndexEntry{user.SessionID, entityId, user.Name}
+	if err := store.Store("session-index:"+index, entry, ttl); err != nil {
+		return err
+	}
+	return touchSession(store, user.SessionID, entityId)
+}
+
+func LookupSessionIndex(store store.Storer, index string) (*SessionIndexEntry, error) {
+	var entry SessionIndexEntry
+	err := store.Retrieve("session-index:"+index, &entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
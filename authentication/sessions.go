@@ -0,0 +1,184 @@
+package authentication
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// What's known about an IdP session, kept beside it so sessions can be listed and revoked
+type SessionInfo struct {
+	ID        string
+	User      string
+	IP        net.IP
+	UserAgent string
+	Created   time.Time
+	LastUsed  time.Time
+	Expires   time.Time
+	// SPs the session was used to log in to
+	ServiceProviders []string
+}
+
+const (
+	sessionInfoPrefix = "session-info:"
+	// Sets of the IDs of each user's sessions, so they can be listed without scanning every session
+	userSessionsPrefix = "user-sessions:"
+)
+
+// Saves the info until the session expires
+func saveSessionInfo(store store.Storer, info *SessionInfo) error {
+	ttl := int(info.Expires.Sub(time.Now()).Seconds())
+	if ttl <= 0 {
+		return nil
+	}
+	return store.Store(sessionInfoPrefix+info.ID, info, ttl)
+}
+
+func recordSession(request *http.Request, shared store.Storer, user *protocol.AuthenticatedUser) error {
+	now := time.Now()
+	info := &SessionInfo{ID: user.SessionID, User: user.Name, IP: user.IP, UserAgent: request.UserAgent(),
+		Created: now, LastUsed: now, Expires: user.SessionExpires}
+	if err := saveSessionInfo(shared, info); err != nil {
+		return err
+	}
+	ttl := int(info.Expires.Sub(now).Seconds())
+	if ttl <= 0 {
+		return nil
+	}
+	return store.AddMember(shared, userSessionsPrefix+user.Name, user.SessionID, ttl)
+}
+
+// Notes that the session was used again, and for which SP when one is given
+func touchSession(store store.Storer, id, entityId string) error {
+	info, err := LookupSession(store, id)
+	if err != nil || info == nil {
+		return err
+	}
+	info.LastUsed = time.Now()
+	if entityId != "" {
+		found := false
+		for _, sp := range info.ServiceProviders {
+			found = found || sp == entityId
+		}
+		if !found {
+			info.ServiceProviders = append(info.ServiceProviders, entityId)
+		}
+	}
+	return saveSessionInfo(store, info)
+}
+
+// Returns the session's info, or nil when there's no such session
+func LookupSession(shared store.Storer, id string) (*SessionInfo, error) {
+	var info SessionInfo
+	err := shared.Retrieve(sessionInfoPrefix+id, &info)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// Returns the active sessions, most recently used first. Sessions created before sessions were recorded
+// aren't listed.
+func ListSessions(store store.Storer) ([]*SessionInfo, error) {
+	keys, err := store.Keys(sessionInfoPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*SessionInfo{}
+	for _, key := range keys {
+		info, err := LookupSession(store, key[len(sessionInfoPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		// Expired since it was listed
+		if info != nil {
+			sessions = append(sessions, info)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+	return sessions, nil
+}
+
+// Returns a value naming the session that, unlike its ID, can't be used as the user's session cookie
+func SessionHandle(id string) string {
+	sum := sha256.Sum256([]byte("session-handle:" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the info of the session the handle names, or nil when there's no such session
+func LookupSessionHandle(store store.Storer, handle string) (*SessionInfo, error) {
+	sessions, err := ListSessions(store)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		if subtle.ConstantTimeCompare([]byte(SessionHandle(session.ID)), []byte(handle)) == 1 {
+			return session, nil
+		}
+	}
+	return nil, nil
+}
+
+// Returns the user's active sessions, most recently used first, reading only the user's own. Sessions created
+// before they were indexed by user aren't listed.
+func ListUserSessions(shared store.Storer, user string) ([]*SessionInfo, error) {
+	ids, err := store.Members(shared, userSessionsPrefix+user)
+	if err != nil {
+		return nil, err
+	}
+	sessions := []*SessionInfo{}
+	for _, id := range ids {
+		info, err := LookupSession(shared, id)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil || info.User != user {
+			// Ended or expired since it was indexed
+			if err := store.RemoveMember(shared, userSessionsPrefix+user, id); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+	return sessions, nil
+}
+
+// Ends the session. The user has to log in again the next time an SP sends them to the IdP.
+func RevokeSession(store store.Storer, id string) error {
+	return store.Delete(id, sessionInfoPrefix+id)
+}
+
+// Ends every session of the user, returning how many there were
+func RevokeUserSessions(store store.Storer, user string) (int, error) {
+	sessions, err := ListSessions(store)
+	if err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, session := range sessions {
+		if session.User != user {
+			continue
+		}
+		if err := RevokeSession(store, session.ID); err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+	return revoked, nil
+}
@@ -0,0 +1,56 @@
+package authentication
+
+import (
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Sessions are found by a handle that can't be used as their cookie
+func TestLookupSessionHandle(t *testing.T) {
+	storer := store.NewMemory()
+	info := &SessionInfo{ID: "cookie-value", User: "jdoe", Expires: time.Now().Add(time.Hour)}
+	if err := saveSessionInfo(storer, info); err != nil {
+		t.Fatal(err)
+	}
+	handle := SessionHandle(info.ID)
+	if handle == info.ID {
+		t.Fatal("the handle is the session ID")
+	}
+	found, err := LookupSessionHandle(storer, handle)
+	if err != nil || found == nil || found.User != "jdoe" {
+		t.Fatalf("handle found %+v: %v", found, err)
+	}
+	if found, err := LookupSessionHandle(storer, info.ID); err != nil || found != nil {
+		t.Errorf("the session ID was accepted as a handle: %+v %v", found, err)
+	}
+}
+
+// Users' sessions are listed from their own index, which drops those that have ended
+func TestListUserSessions(t *testing.T) {
+	storer := store.NewMemory()
+	request := httptest.NewRequest("GET", "/", nil)
+	expires := time.Now().Add(time.Hour)
+	for _, user := range []*protocol.AuthenticatedUser{{Name: "jdoe", SessionID: "a", SessionExpires: expires},
+		{Name: "jdoe", SessionID: "b", SessionExpires: expires},
+		{Name: "asmith", SessionID: "c", SessionExpires: expires}} {
+		if err := recordSession(request, storer, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RevokeSession(storer, "a"); err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := ListUserSessions(storer, "jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != "b" {
+		t.Errorf("listed %+v", sessions)
+	}
+	if ids, _ := store.Members(storer, userSessionsPrefix+"jdoe"); len(ids) != 1 {
+		t.Errorf("index still holds %v", ids)
+	}
+}
@@ -0,0 +1,74 @@
+package authentication
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local accounts checked by the login form, mapping user names to bcrypt password hashes
+type Users map[string]string
+
+// Reads the users file. A missing file has no users.
+func LoadUsers(path string) (Users, error) {
+	users := make(Users)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return users, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Replaces the users file. The new file is written alongside and renamed so a sign in never reads half
+// of it.
+func (users Users) Save(path string) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(path), ".users")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temporary.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), path)
+}
+
+// Returns the bcrypt hash of the password
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Compared against for unknown users, so they take as long to reject as a wrong password
+var unknownUser, _ = HashPassword("unknown user")
+
+// Reports whether the password is the user's
+func (users Users) Check(name, password string) bool {
+	hash, found := users[name]
+	if !found {
+		hash = unknownUser
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil && found
+}
@@ -0,0 +1,209 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/directory"
+	"github.com/amdonov/lite-idp/telemetry"
+	"gopkg.in/ldap.v2"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Where accounts are kept, apart from how users sign in to them. The login form and other ways of signing in
+// check passwords with a UserStore, so the same backend serves each of them.
+type UserStore interface {
+	// Reports whether the user exists
+	Lookup(ctx context.Context, name string) (bool, error)
+	// Reports whether the password is the user's. Unknown users are reported as a wrong password.
+	Verify(ctx context.Context, name, password string) (bool, error)
+	// Returns what the store knows of the user, such as their mail address
+	Attributes(ctx context.Context, name string) (map[string][]string, error)
+	// Returns the names of every user
+	Users(ctx context.Context) ([]string, error)
+}
+
+// Creates a store of the accounts in a users file, as maintained with lite-idp user add. The file is read at
+// each call, so changes apply straight away. An empty path has only the sample account, jdoe.
+func NewFileUserStore(path string) UserStore {
+	if path == "" {
+		return sampleUserStore{}
+	}
+	return fileUserStore(path)
+}
+
+type fileUserStore string
+
+func (path fileUserStore) Lookup(ctx context.Context, name string) (bool, error) {
+	users, err := LoadUsers(string(path))
+	if err != nil {
+		return false, err
+	}
+	_, found := users[name]
+	return found, nil
+}
+
+func (path fileUserStore) Verify(ctx context.Context, name, password string) (bool, error) {
+	users, err := LoadUsers(string(path))
+	if err != nil {
+		return false, err
+	}
+	return users.Check(name, password), nil
+}
+
+// Users files hold only password hashes
+func (path fileUserStore) Attributes(ctx context.Context, name string) (map[string][]string, error) {
+	return map[string][]string{}, nil
+}
+
+func (path fileUserStore) Users(ctx context.Context) ([]string, error) {
+	users, err := LoadUsers(string(path))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// The account accepted when no users file is configured, so a new installation can be tried out
+type sampleUserStore struct{}
+
+func (sampleUserStore) Lookup(ctx context.Context, name string) (bool, error) {
+	return name == "jdoe", nil
+}
+
+func (sampleUserStore) Verify(ctx context.Context, name, password string) (bool, error) {
+	return "jdoe" == name && "secret" == password, nil
+}
+
+func (sampleUserStore) Attributes(ctx context.Context, name string) (map[string][]string, error) {
+	return map[string][]string{}, nil
+}
+
+func (sampleUserStore) Users(ctx context.Context) ([]string, error) {
+	return []string{"jdoe"}, nil
+}
+
+// Creates a store of the accounts in an LDAP directory. Users are found with the search and their passwords
+// verified by binding as them.
+func NewLDAPUserStore(pool *directory.Pool, search *config.LDAPAttributes) UserStore {
+	return &ldapUserStore{pool, search}
+}
+
+type ldapUserStore struct {
+	pool   *directory.Pool
+	search *config.LDAPAttributes
+}
+
+// Returns the named attributes of the entries the filter matches with {user} replaced by value, which must
+// already be escaped
+func (users *ldapUserStore) find(ctx context.Context, value string, attributes []string) ([]*ldap.Entry, error) {
+	filter := strings.Replace(users.search.Filter, "{user}", value, -1)
+	search := ldap.NewSearchRequest(users.search.Base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0,
+		false, filter, attributes, nil)
+	conn, err := users.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	_, span := telemetry.Start(ctx, "ldap.search")
+	result, err := conn.Search(search)
+	telemetry.End(span, err)
+	if err != nil {
+		// The connection may be broken, so don't reuse it
+		conn.Close()
+		return nil, err
+	}
+	users.pool.Put(conn)
+	return result.Entries, nil
+}
+
+// Returns the user's entry, or nil if there's none
+func (users *ldapUserStore) entry(ctx context.Context, name string) (*ldap.Entry, error) {
+	entries, err := users.find(ctx, ldap.EscapeFilter(name), users.search.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	switch len(entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return entries[0], nil
+	default:
+		return nil, errors.New("More than one directory entry matches " + name)
+	}
+}
+
+func (users *ldapUserStore) Lookup(ctx context.Context, name string) (bool, error) {
+	entry, err := users.entry(ctx, name)
+	return entry != nil, err
+}
+
+func (users *ldapUserStore) Verify(ctx context.Context, name, password string) (bool, error) {
+	// Servers treat a bind without a password as anonymous, which would always succeed
+	if password == "" {
+		return false, nil
+	}
+	entry, err := users.entry(ctx, name)
+	if err != nil || entry == nil {
+		return false, err
+	}
+	conn, err := users.pool.Get()
+	if err != nil {
+		return false, err
+	}
+	// Bound as the user, the connection is no use to the pool's other callers
+	defer conn.Close()
+	_, span := telemetry.Start(ctx, "ldap.bind")
+	err = conn.Bind(entry.DN, password)
+	span.End()
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (users *ldapUserStore) Attributes(ctx context.Context, name string) (map[string][]string, error) {
+	entry, err := users.entry(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, errors.New("No directory entry matches " + name)
+	}
+	attributes := make(map[string][]string)
+	for _, attribute := range entry.Attributes {
+		if len(attribute.Values) > 0 {
+			attributes[attribute.Name] = attribute.Values
+		}
+	}
+	return attributes, nil
+}
+
+// Matches the attribute the filter compares with the user's name, such as uid in (uid={user})
+var nameAttribute = regexp.MustCompile(`\(([\w.;-]+)=\{user\}\)`)
+
+// Lists the users the filter matches with any name. Directories may limit how many entries a search returns.
+func (users *ldapUserStore) Users(ctx context.Context) ([]string, error) {
+	match := nameAttribute.FindStringSubmatch(users.search.Filter)
+	if match == nil {
+		return nil, errors.New("can't tell which attribute holds user names from the filter " + users.search.Filter)
+	}
+	entries, err := users.find(ctx, "*", match[1:])
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if name := entry.GetAttributeValue(match[1]); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
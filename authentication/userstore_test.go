@@ -0,0 +1,28 @@
+package authentication
+
+import (
+	"context"
+	"testing"
+)
+
+// The sample account needs both its name and its password
+func TestSampleUserStoreVerify(t *testing.T) {
+	tests := []struct {
+		name, password string
+		valid          bool
+	}{
+		{"jdoe", "secret", true},
+		{"jdoe", "wrong", false},
+		{"asmith", "secret", false},
+		{"asmith", "wrong", false},
+	}
+	for _, test := range tests {
+		valid, err := sampleUserStore{}.Verify(context.Background(), test.name, test.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid != test.valid {
+			t.Errorf("%s with password %s verified as %t", test.name, test.password, valid)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Package bearer protects the IdP's APIs with static bearer tokens, presented in the Authorization header
+package bearer
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// Reports whether the request presents the token. Nothing is authorized by an empty token, so an API
+// without one configured stays closed.
+func Authorized(request *http.Request, token string) bool {
+	presented := []byte(request.Header.Get("Authorization"))
+	expected := []byte("Bearer " + token)
+	return token != "" && subtle.ConstantTimeCompare(presented, expected) == 1
+}
+
+// Asks the client for a bearer token. The caller replies with the 401 status.
+func Challenge(writer http.ResponseWriter) {
+	writer.Header().Set("WWW-Authenticate", "Bearer")
+}
+
+// Wraps the handler so only requests presenting the token reach it. Others are answered with a plain
+// 401 Unauthorized.
+func Require(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !Authorized(request, token) {
+			Challenge(writer)
+			http.Error(writer, "Unauthorized", 401)
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
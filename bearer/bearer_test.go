@@ -0,0 +1,43 @@
+package bearer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	handler := Require("s3cret", http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	for _, test := range []struct {
+		authorization string
+		status        int
+	}{
+		{"Bearer s3cret", 200},
+		{"", 401},
+		{"Bearer wrong", 401},
+		{"Basic s3cret", 401},
+		{"Bearer s3cret2", 401},
+	} {
+		request := httptest.NewRequest("GET", "/", nil)
+		if test.authorization != "" {
+			request.Header.Set("Authorization", test.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%q: status %d rather than %d", test.authorization, recorder.Code, test.status)
+		}
+		if test.status == 401 && recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%q: no bearer challenge", test.authorization)
+		}
+	}
+}
+
+// An API without a token configured accepts nobody, even a client presenting an empty one
+func TestEmptyTokenAuthorizesNothing(t *testing.T) {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set("Authorization", "Bearer ")
+	if Authorized(request, "") {
+		t.Error("an empty token was accepted")
+	}
+}
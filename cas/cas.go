@@ -0,0 +1,153 @@
+// Package cas serves the CAS 2.0 and 3.0 protocol. Login requests are handed to the authenticators as
+// AuthnRequests with Binding, and the responses generated for them become service tickets, so CAS
+// applications share the users' sessions and the attributes released to SAML SPs.
+package cas
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// Binding of the AuthnRequests made for login requests. The Server is its marshaller.
+	Binding = "urn:lite-idp:cas:service-ticket"
+	// Store key prefixes
+	ticketPrefix    = "cas-ticket:"
+	validatedPrefix = "cas-validated:"
+)
+
+// What a service ticket was issued for
+type ticket struct {
+	Service  string
+	EntityId string
+	User     string
+	// Released attributes under their CAS names
+	Attributes   map[string][]string
+	AuthTime     time.Time
+	AuthnContext string
+}
+
+type Server struct {
+	authenticator authentication.Authenticator
+	store         store.Storer
+	config        *config.Configuration
+}
+
+// Creates the server. Register it as the marshaller of Binding and serve its Login and Validate handlers
+// under the configured path.
+func New(authenticator authentication.Authenticator, store store.Storer, config *config.Configuration) *Server {
+	return &Server{authenticator, store, config}
+}
+
+// The login endpoint. Users already signed in are sent straight back to the service with a ticket. With
+// gateway=true users who aren't are sent back without one rather than asked to sign in.
+func (server *Server) Login(writer http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	service := request.Form.Get("service")
+	if service == "" {
+		errorpage.Error(writer, request, "The application didn't say where to return to after signing in.", 400)
+		return
+	}
+	sp := server.config.For(request).CASService(service)
+	if sp == nil {
+		errorpage.Error(writer, request, "The application isn't registered with the IdP.", 400)
+		return
+	}
+	accesslog.SetServiceProvider(request, sp.EntityId)
+	errorpage.SetServiceProvider(request, sp.EntityId)
+	// Present the request to the authenticators as if it were a SAML request
+	authnRequest := &protocol.AuthnRequest{AssertionConsumerServiceURL: service, ProtocolBinding: Binding,
+		IsPassive: request.Form.Get("gateway") == "true"}
+	authnRequest.ID = protocol.NewID()
+	authnRequest.Version = "2.0"
+	authnRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+	authnRequest.Issuer = sp.EntityId
+	server.authenticator.Authenticate(authnRequest, "", writer, request)
+}
+
+// Sends the user back to the service with a ticket. Gateway requests that would need a login are sent back
+// without one; other failures are shown to the user, as CAS has no way to tell the service.
+func (server *Server) Marshal(writer http.ResponseWriter, request *http.Request, response *protocol.Response,
+	authnRequest *protocol.AuthnRequest, relayState string) {
+	service := authnRequest.AssertionConsumerServiceURL
+	if response.Status == nil || response.Status.StatusCode.Value != protocol.StatusSuccess ||
+		response.Assertion == nil {
+		if authnRequest.IsPassive {
+			http.Redirect(writer, request, service, http.StatusFound)
+			return
+		}
+		message := "Signing in to the application failed."
+		if response.Status != nil && response.Status.StatusMessage != "" {
+			message = "Signing in to the application failed: " + response.Status.StatusMessage
+		}
+		errorpage.Error(writer, request, message, 403)
+		return
+	}
+	id := "ST-" + newSecret()
+	settings := server.config.For(request)
+	if err := server.store.Store(ticketPrefix+id, newTicket(settings, authnRequest, response),
+		settings.CAS.WithDefaults().TicketLifetime); err != nil {
+		logging.FromRequest(request).Error("Failed to save service ticket", "err", err)
+		errorpage.Error(writer, request, "Signing in to the application failed.", 500)
+		return
+	}
+	target, err := url.Parse(service)
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	query := target.Query()
+	query.Set("ticket", id)
+	target.RawQuery = query.Encode()
+	http.Redirect(writer, request, target.String(), http.StatusFound)
+}
+
+func newTicket(config *config.Configuration, authnRequest *protocol.AuthnRequest,
+	response *protocol.Response) *ticket {
+	var names map[string]string
+	if sp := config.ServiceProvider(authnRequest.Issuer); sp != nil && sp.CAS != nil {
+		names = sp.CAS.Attributes
+	}
+	claims := protocol.Claims(response.Assertion, names)
+	ticket := &ticket{Service: authnRequest.AssertionConsumerServiceURL, EntityId: authnRequest.Issuer,
+		Attributes: make(map[string][]string)}
+	for name, value := range claims {
+		switch value := value.(type) {
+		case string:
+			if name == "sub" {
+				ticket.User = value
+			} else {
+				ticket.Attributes[name] = []string{value}
+			}
+		case []string:
+			ticket.Attributes[name] = value
+		}
+	}
+	if statement := response.Assertion.AuthnStatement; statement != nil {
+		ticket.AuthTime = statement.AuthnInstant
+		if statement.AuthnContext != nil {
+			ticket.AuthnContext = statement.AuthnContext.AuthnContextClassRef
+		}
+	}
+	return ticket
+}
+
+// Returns a random value for tickets
+func newSecret() string {
+	data := make([]byte, 24)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
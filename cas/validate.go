@@ -0,0 +1,162 @@
+package cas
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/logging"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CAS failure codes
+const (
+	InvalidRequest = "INVALID_REQUEST"
+	InvalidTicket  = "INVALID_TICKET"
+	InvalidService = "INVALID_SERVICE"
+	InternalError  = "INTERNAL_ERROR"
+)
+
+type serviceResponse struct {
+	XMLName xml.Name               `xml:"cas:serviceResponse" json:"-"`
+	Xmlns   string                 `xml:"xmlns:cas,attr" json:"-"`
+	Success *authenticationSuccess `xml:"cas:authenticationSuccess,omitempty" json:"authenticationSuccess,omitempty"`
+	Failure *authenticationFailure `xml:"cas:authenticationFailure,omitempty" json:"authenticationFailure,omitempty"`
+}
+
+type authenticationSuccess struct {
+	User       string      `xml:"cas:user" json:"user"`
+	Attributes *attributes `xml:"cas:attributes,omitempty" json:"attributes,omitempty"`
+}
+
+type authenticationFailure struct {
+	Code        string `xml:"code,attr" json:"code"`
+	Description string `xml:",chardata" json:"description"`
+}
+
+// Released attributes, which CAS 3.0 encodes as elements named for them
+type attributes map[string][]string
+
+func (attributes attributes) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range attributes[name] {
+			if err := encoder.EncodeElement(value, xml.StartElement{Name: xml.Name{Local: "cas:" + name}}); err != nil {
+				return err
+			}
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// The serviceValidate endpoint of CAS 2.0, which returns only the user
+func (server *Server) ServiceValidate(writer http.ResponseWriter, request *http.Request) {
+	server.validate(writer, request, false)
+}
+
+// The p3/serviceValidate endpoint of CAS 3.0, which also returns the released attributes
+func (server *Server) ServiceValidateV3(writer http.ResponseWriter, request *http.Request) {
+	server.validate(writer, request, true)
+}
+
+// Redeems a service ticket. Tickets are good once, for the service they were issued to.
+func (server *Server) validate(writer http.ResponseWriter, request *http.Request, withAttributes bool) {
+	query := request.URL.Query()
+	asJSON := strings.EqualFold(query.Get("format"), "JSON")
+	fail := func(code, description string) {
+		logging.FromRequest(request).Warn("Rejected service ticket", "code", code, "description", description)
+		writeResponse(writer, &serviceResponse{Failure: &authenticationFailure{code, description}}, asJSON)
+	}
+	service, id := query.Get("service"), query.Get("ticket")
+	if service == "" || id == "" {
+		fail(InvalidRequest, "service and ticket are required")
+		return
+	}
+	if query.Get("renew") == "true" {
+		// Tickets aren't marked with whether they came from a fresh login
+		fail(InvalidTicket, "renew isn't supported")
+		return
+	}
+	var ticket ticket
+	if err := server.store.Retrieve(ticketPrefix+id, &ticket); err != nil {
+		fail(InvalidTicket, "ticket "+id+" not recognized")
+		return
+	}
+	accesslog.SetServiceProvider(request, ticket.EntityId)
+	first, err := server.store.StoreIfAbsent(validatedPrefix+id, service,
+		server.config.For(request).CAS.WithDefaults().TicketLifetime)
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to redeem service ticket", "err", err)
+		fail(InternalError, "the ticket couldn't be redeemed")
+		return
+	}
+	server.store.Delete(ticketPrefix + id)
+	switch {
+	case !first:
+		fail(InvalidTicket, "ticket "+id+" has already been used")
+	case ticket.Service != service:
+		fail(InvalidService, "ticket "+id+" was issued to another service")
+	default:
+		success := &authenticationSuccess{User: ticket.User}
+		if withAttributes {
+			success.Attributes = ticket.released()
+		}
+		writeResponse(writer, &serviceResponse{Success: success}, asJSON)
+	}
+}
+
+// Returns the attributes to release with the ticket. Names that can't be element names are left out.
+func (ticket *ticket) released() *attributes {
+	released := attributes{}
+	for name, values := range ticket.Attributes {
+		if validName(name) {
+			released[name] = values
+		}
+	}
+	if !ticket.AuthTime.IsZero() {
+		released["authenticationDate"] = []string{ticket.AuthTime.UTC().Format(time.RFC3339)}
+	}
+	if ticket.AuthnContext != "" {
+		released["authnContextClass"] = []string{ticket.AuthnContext}
+	}
+	return &released
+}
+
+// Reports whether name can be the local part of an element name. Non-ASCII letters are accepted, which
+// is looser than XML but enough to keep URIs and other punctuation out.
+func validName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || r > 0x7f || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z'):
+		case i > 0 && (r == '-' || r == '.' || ('0' <= r && r <= '9')):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func writeResponse(writer http.ResponseWriter, response *serviceResponse, asJSON bool) {
+	writer.Header().Set("Cache-Control", "no-store")
+	if asJSON {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]*serviceResponse{"serviceResponse": response})
+		return
+	}
+	response.Xmlns = "http://www.yale.edu/tp/cas"
+	writer.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	writer.Write([]byte(xml.Header))
+	xml.NewEncoder(writer).Encode(response)
+}
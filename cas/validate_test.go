@@ -0,0 +1,59 @@
+package cas
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const testService = "https://app.example.com/login"
+
+// Returns a server holding a ticket issued to the test service
+func newTestServer(t *testing.T) (*Server, string) {
+	server := New(nil, store.NewMemory(), &config.Configuration{CAS: &config.CAS{}})
+	id := "ST-" + newSecret()
+	issued := &ticket{Service: testService, EntityId: "https://app.example.com", User: "jdoe"}
+	if err := server.store.Store(ticketPrefix+id, issued, 60); err != nil {
+		t.Fatal(err)
+	}
+	return server, id
+}
+
+// Validates the ticket for the service and returns the response
+func validateTicket(server *Server, service, id string) *serviceResponse {
+	query := url.Values{"service": {service}, "ticket": {id}, "format": {"JSON"}}
+	recorder := httptest.NewRecorder()
+	server.ServiceValidate(recorder, httptest.NewRequest("GET", "/cas/serviceValidate?"+query.Encode(), nil))
+	var response struct {
+		ServiceResponse serviceResponse `json:"serviceResponse"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return &response.ServiceResponse
+}
+
+func TestValidateRedeemsTicketOnce(t *testing.T) {
+	server, id := newTestServer(t)
+	if response := validateTicket(server, testService, id); response.Success == nil ||
+		response.Success.User != "jdoe" {
+		t.Fatalf("ticket validated as %+v", response)
+	}
+	if response := validateTicket(server, testService, id); response.Failure == nil ||
+		response.Failure.Code != InvalidTicket {
+		t.Errorf("reused ticket validated as %+v", response)
+	}
+}
+
+func TestValidateChecksService(t *testing.T) {
+	server, id := newTestServer(t)
+	if response := validateTicket(server, "https://other.example.com/login", id); response.Failure == nil ||
+		response.Failure.Code != InvalidService {
+		t.Errorf("ticket for another service validated as %+v", response)
+	}
+	// The ticket is spent even so, so it can't be tried against other services
+	if response := validateTicket(server, testService, id); response.Failure == nil {
+		t.Errorf("ticket validated after a failed attempt as %+v", response)
+	}
+}
@@ -0,0 +1,246 @@
+package cli
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/protocol"
+	"html"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stages of a simulated login, in order
+var benchStages = []string{
+	// The SP's AuthnRequest, answered with the login form
+	"request",
+	// Submitting credentials, answered with the SAML response
+	"login",
+	// A second SP request answered from the session
+	"session",
+}
+
+var samlResponseField = regexp.MustCompile(`name="SAMLResponse"\s+value="([^"]*)"`)
+
+// Simulates users signing in to an SP through a running IdP and reports how long each stage took. The
+// password authenticator without a users file accepts the default credentials, so the IdP's own checks are
+// measured rather than a directory's.
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	baseURL := flags.String("url", "", "base URL of the IdP, such as https://idp.example.com")
+	sp := flags.String("sp", "https://sp.example.com/shibboleth", "entity ID of a configured SP to sign in to")
+	sso := flags.String("sso", "/SAML2/Redirect/SSO", "path of the redirect binding SSO service")
+	action := flags.String("action", "/authenticate", "path the login form is submitted to")
+	user := flags.String("user", "jdoe", "user name submitted")
+	password := flags.String("password", "secret", "password submitted")
+	flows := flags.Int("flows", 100, "logins simulated in total")
+	concurrency := flags.Int("concurrency", 10, "logins in progress at once")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for each request")
+	insecure := flags.Bool("insecure", false, "accept any TLS certificate, such as a self-signed one")
+	flags.Parse(args)
+	if *baseURL == "" {
+		return errors.New("-url is required")
+	}
+	if *flows < 1 || *concurrency < 1 {
+		return errors.New("-flows and -concurrency must be positive")
+	}
+	base := strings.TrimSuffix(*baseURL, "/")
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure},
+		MaxIdleConnsPerHost: *concurrency}
+	simulation := &simulation{sso: base + *sso, action: base + *action, sp: *sp, user: *user,
+		password: *password, transport: transport, timeout: *timeout,
+		timings: make(map[string][]time.Duration), failures: make(map[string]int)}
+	flowsLeft := make(chan struct{}, *flows)
+	for i := 0; i < *flows; i++ {
+		flowsLeft <- struct{}{}
+	}
+	close(flowsLeft)
+	started := time.Now()
+	var workers sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for range flowsLeft {
+				simulation.flow()
+			}
+		}()
+	}
+	workers.Wait()
+	elapsed := time.Since(started)
+	simulation.report(*flows, elapsed)
+	if failed := simulation.failed(); failed > 0 {
+		return fmt.Errorf("%d of %d logins failed. The first error was: %s", failed, *flows, simulation.firstError)
+	}
+	return nil
+}
+
+type simulation struct {
+	sso, action, sp string
+	user, password  string
+	transport       *http.Transport
+	timeout         time.Duration
+	mutex           sync.Mutex
+	timings         map[string][]time.Duration
+	failures        map[string]int
+	firstError      error
+}
+
+// Runs one user's login, recording each stage until one fails
+func (simulation *simulation) flow() {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Transport: simulation.transport, Jar: jar, Timeout: simulation.timeout}
+	page, err := simulation.stage("request", func() (string, error) {
+		return simulation.request(client)
+	})
+	if err != nil {
+		return
+	}
+	if !strings.Contains(page, "<form") {
+		simulation.fail("request", errors.New("the IdP didn't show a login form"))
+		return
+	}
+	if _, err := simulation.stage("login", func() (string, error) {
+		page, err := fetch(client, "POST", simulation.action, url.Values{"uid": {simulation.user},
+			"pwd": {simulation.password}})
+		if err != nil {
+			return "", err
+		}
+		return page, succeeded(page)
+	}); err != nil {
+		return
+	}
+	simulation.stage("session", func() (string, error) {
+		page, err := simulation.request(client)
+		if err != nil {
+			return "", err
+		}
+		return page, succeeded(page)
+	})
+}
+
+// Sends a fresh AuthnRequest for the SP
+func (simulation *simulation) request(client *http.Client) (string, error) {
+	authnRequest := &protocol.AuthnRequest{ProtocolBinding: protocol.HTTPPostBinding}
+	authnRequest.ID = protocol.NewID()
+	authnRequest.Version = "2.0"
+	authnRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+	authnRequest.Issuer = simulation.sp
+	authnRequest.Destination = simulation.sso
+	location, err := protocol.EncodeRedirect(simulation.sso, authnRequest, "")
+	if err != nil {
+		return "", err
+	}
+	return fetch(client, "GET", location, nil)
+}
+
+// Times the stage, recording its duration when it succeeds and its failure otherwise
+func (simulation *simulation) stage(name string, run func() (string, error)) (string, error) {
+	started := time.Now()
+	page, err := run()
+	if err != nil {
+		simulation.fail(name, err)
+		return "", err
+	}
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	simulation.timings[name] = append(simulation.timings[name], time.Since(started))
+	return page, nil
+}
+
+func (simulation *simulation) fail(stage string, err error) {
+	simulation.mutex.Lock()
+	defer simulation.mutex.Unlock()
+	simulation.failures[stage]++
+	if simulation.firstError == nil {
+		simulation.firstError = fmt.Errorf("%s: %s", stage, err)
+	}
+}
+
+func (simulation *simulation) failed() int {
+	failed := 0
+	for _, count := range simulation.failures {
+		failed += count
+	}
+	return failed
+}
+
+// Prints latency percentiles by stage
+func (simulation *simulation) report(flows int, elapsed time.Duration) {
+	fmt.Printf("%d logins in %s, %.1f per second\n\n", flows, elapsed.Round(time.Millisecond),
+		float64(flows)/elapsed.Seconds())
+	fmt.Printf("%-8s %6s %6s %9s %9s %9s %9s\n", "stage", "ok", "failed", "p50", "p90", "p99", "max")
+	for _, name := range benchStages {
+		timings := simulation.timings[name]
+		sort.Slice(timings, func(i, j int) bool { return timings[i] < timings[j] })
+		fmt.Printf("%-8s %6d %6d %9s %9s %9s %9s\n", name, len(timings), simulation.failures[name],
+			percentile(timings, 0.5), percentile(timings, 0.9), percentile(timings, 0.99), percentile(timings, 1))
+	}
+}
+
+// Returns the duration at the quantile of sorted durations
+func percentile(sorted []time.Duration, quantile float64) string {
+	if len(sorted) == 0 {
+		return "-"
+	}
+	return sorted[int(quantile*float64(len(sorted)-1))].Round(100 * time.Microsecond).String()
+}
+
+// Requests the page, following redirects, and returns its body. Statuses other than 200 are errors.
+func fetch(client *http.Client, method, location string, form url.Values) (string, error) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	request, err := http.NewRequest(method, location, body)
+	if err != nil {
+		return "", err
+	}
+	if form != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, 10<<20))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("the IdP replied %s", response.Status)
+	}
+	return string(data), nil
+}
+
+// Checks that the page posts a successful SAML response to the SP
+func succeeded(page string) error {
+	data, err := postedResponse(page)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(data), protocol.StatusSuccess) {
+		return errors.New("the SAML response reports a failure")
+	}
+	return nil
+}
+
+// Returns the SAML response the page posts to the SP
+func postedResponse(page string) ([]byte, error) {
+	match := samlResponseField.FindStringSubmatch(page)
+	if match == nil {
+		return nil, errors.New("the IdP didn't send a SAML response")
+	}
+	return base64.StdEncoding.DecodeString(html.UnescapeString(match[1]))
+}
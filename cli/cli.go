@@ -0,0 +1,169 @@
+// Package cli implements the lite-idp subcommands used to operate an IdP: registering SPs, managing local
+// users and sessions, generating keys, validating the configuration and testing it with a built-in SP.
+// Commands reach a running IdP through the admin API when given its URL, and otherwise work offline on the
+// store and files named in the configuration.
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A subcommand. Run receives the arguments after the command's name.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"sp register", "register an SP from a metadata file", registerSP},
+	{"sp list", "list SPs registered through the API", listSPs},
+	{"sp remove", "remove a registered SP", removeSP},
+	{"user add", "add a local user or change their password", addUser},
+	{"user remove", "remove a local user", removeUser},
+	{"password hash", "print the hash of a password read from standard input", hashPassword},
+	{"session list", "list active sessions", listSessions},
+	{"session revoke", "revoke a session or every session of a user", revokeSessions},
+	{"backup", "copy the keys in the store to a file while the IdP runs", backup},
+	{"restore", "write the keys in a backup back to the store", restore},
+	{"key generate", "generate a key and self-signed certificate", generateKey},
+	{"validate", "check the configuration, SP metadata and keys without starting the IdP", validate},
+	{"bench", "simulate concurrent SP logins against a running IdP and report latency by stage", bench},
+	{"conformance", "check how a running IdP handles valid and malformed requests", conformance},
+	{"test-sp", "run a minimal SP that validates and shows the IdP's responses", testSP},
+}
+
+// Runs the subcommand named by the arguments, such as "session list -user jdoe"
+func Run(args []string) error {
+	for _, command := range commands {
+		words := strings.Fields(command.name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == command.name {
+			return command.run(args[len(words):])
+		}
+	}
+	return errors.New("unknown command " + strings.Join(args, " ") + "\n\n" + Usage())
+}
+
+// Lists the subcommands
+func Usage() string {
+	var usage strings.Builder
+	usage.WriteString("Usage: lite-idp [-config file] [command]\n\nWithout a command the IdP is started. Commands:\n")
+	for _, command := range commands {
+		fmt.Fprintf(&usage, "  %-16s %s\n", command.name, command.summary)
+	}
+	usage.WriteString("\nRun a command with -h for its options.\n")
+	return usage.String()
+}
+
+// Where a command sends its changes: the admin API of a running IdP, or the store directly
+type target struct {
+	adminURL string
+	token    string
+}
+
+func (target *target) flags(flags *flag.FlagSet) {
+	flags.StringVar(&target.adminURL, "admin-url", "",
+		"URL of the admin API, such as https://idp.example.com/admin/. Works offline when empty.")
+	flags.StringVar(&target.token, "token", os.Getenv("LIDP_ADMIN_TOKEN"),
+		"admin API token. Defaults to $LIDP_ADMIN_TOKEN.")
+}
+
+func (target *target) online() bool {
+	return target.adminURL != ""
+}
+
+// Calls the admin API, decoding a JSON reply into result when it's not nil
+func (target *target) call(method, path string, query url.Values, contentType string, body []byte,
+	result interface{}) error {
+	endpoint := strings.TrimSuffix(target.adminURL, "/") + "/" + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+target.token)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	client := &http.Client{Timeout: time.Minute}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, 10<<20))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var failure struct{ Error string }
+		if json.Unmarshal(data, &failure) == nil && failure.Error != "" {
+			return errors.New(failure.Error)
+		}
+		return fmt.Errorf("admin API replied %s", response.Status)
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Loads the configuration and opens its store, for commands working offline
+func offline() (*config.Configuration, store.Storer, error) {
+	settings, err := config.LoadConfiguration()
+	if err != nil {
+		return nil, nil, err
+	}
+	redis := settings.Redis.WithDefaults()
+	return settings, store.New(redis.Address, redis.Password, redis.MaxIdle,
+		time.Duration(redis.IdleTimeout)*time.Second), nil
+}
+
+// Prints the value as indented JSON, like the admin API
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// Reads one line from standard input, so secrets stay out of the shell's history
+func readSecret(prompt string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, prompt)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("no password given")
+	}
+	return line, nil
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,352 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/registry"
+	"github.com/amdonov/lite-idp/store"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func registerSP(args []string) error {
+	var target target
+	flags := flag.NewFlagSet("sp register", flag.ExitOnError)
+	metadata := flags.String("metadata", "", "SP metadata file")
+	target.flags(flags)
+	flags.Parse(args)
+	if *metadata == "" {
+		return errors.New("-metadata is required")
+	}
+	data, err := ioutil.ReadFile(*metadata)
+	if err != nil {
+		return err
+	}
+	var entry registry.Entry
+	if target.online() {
+		if err := target.call("POST", "service-providers", nil, "application/samlmetadata+xml", data,
+			&entry); err != nil {
+			return err
+		}
+	} else {
+		settings, store, err := offline()
+		if err != nil {
+			return err
+		}
+		entry.Metadata = string(data)
+		if err := registry.New(store, settings).Put(&entry); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "IdPs that are running use the registration within a minute.")
+	}
+	fmt.Println("Registered", entry.ServiceProvider.EntityId)
+	return nil
+}
+
+func listSPs(args []string) error {
+	var target target
+	flags := flag.NewFlagSet("sp list", flag.ExitOnError)
+	target.flags(flags)
+	flags.Parse(args)
+	entries := make(map[string]*registry.Entry)
+	if target.online() {
+		if err := target.call("GET", "service-providers", nil, "", nil, &entries); err != nil {
+			return err
+		}
+	} else {
+		settings, store, err := offline()
+		if err != nil {
+			return err
+		}
+		if entries, err = registry.New(store, settings).List(); err != nil {
+			return err
+		}
+	}
+	return printJSON(entries)
+}
+
+func removeSP(args []string) error {
+	var target target
+	flags := flag.NewFlagSet("sp remove", flag.ExitOnError)
+	entityId := flags.String("entity-id", "", "entity ID of the SP")
+	target.flags(flags)
+	flags.Parse(args)
+	if *entityId == "" {
+		return errors.New("-entity-id is required")
+	}
+	if target.online() {
+		return target.call("DELETE", "service-providers", url.Values{"entityId": {*entityId}}, "", nil, nil)
+	}
+	settings, store, err := offline()
+	if err != nil {
+		return err
+	}
+	removed, err := registry.New(store, settings).Delete(*entityId)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return errors.New(*entityId + " isn't registered")
+	}
+	return nil
+}
+
+// Returns the users file given on the command line, or else the one in the configuration
+func usersFile(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	settings, _, err := offline()
+	if err != nil {
+		return "", err
+	}
+	if form := settings.Authenticator.Fallback.Form; form.Users != "" {
+		return form.Users, nil
+	}
+	return "", errors.New("no users file is configured. Set Authenticator.Fallback.Form.Users or use -users.")
+}
+
+func addUser(args []string) error {
+	flags := flag.NewFlagSet("user add", flag.ExitOnError)
+	name := flags.String("name", "", "user name")
+	path := flags.String("users", "", "users file. Defaults to the one in the configuration.")
+	flags.Parse(args)
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+	file, err := usersFile(*path)
+	if err != nil {
+		return err
+	}
+	users, err := authentication.LoadUsers(file)
+	if err != nil {
+		return err
+	}
+	password, err := readSecret("Password: ")
+	if err != nil {
+		return err
+	}
+	if users[*name], err = authentication.HashPassword(password); err != nil {
+		return err
+	}
+	return users.Save(file)
+}
+
+func removeUser(args []string) error {
+	flags := flag.NewFlagSet("user remove", flag.ExitOnError)
+	name := flags.String("name", "", "user name")
+	path := flags.String("users", "", "users file. Defaults to the one in the configuration.")
+	flags.Parse(args)
+	file, err := usersFile(*path)
+	if err != nil {
+		return err
+	}
+	users, err := authentication.LoadUsers(file)
+	if err != nil {
+		return err
+	}
+	if _, found := users[*name]; !found {
+		return fmt.Errorf("%s isn't a user. Users are %s", *name, strings.Join(sortedKeys(users), ", "))
+	}
+	delete(users, *name)
+	return users.Save(file)
+}
+
+func hashPassword(args []string) error {
+	flags := flag.NewFlagSet("password hash", flag.ExitOnError)
+	flags.Parse(args)
+	password, err := readSecret("Password: ")
+	if err != nil {
+		return err
+	}
+	hash, err := authentication.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hash)
+	return nil
+}
+
+func listSessions(args []string) error {
+	var target target
+	flags := flag.NewFlagSet("session list", flag.ExitOnError)
+	user := flags.String("user", "", "only sessions of the user")
+	sp := flags.String("sp", "", "only sessions used to log in to the SP")
+	ip := flags.String("ip", "", "only sessions from the address")
+	target.flags(flags)
+	flags.Parse(args)
+	var sessions []*authentication.SessionInfo
+	if target.online() {
+		query := url.Values{}
+		for name, value := range map[string]string{"user": *user, "sp": *sp, "ip": *ip} {
+			if value != "" {
+				query.Set(name, value)
+			}
+		}
+		if err := target.call("GET", "sessions", query, "", nil, &sessions); err != nil {
+			return err
+		}
+		return printJSON(sessions)
+	}
+	_, store, err := offline()
+	if err != nil {
+		return err
+	}
+	all, err := authentication.ListSessions(store)
+	if err != nil {
+		return err
+	}
+	address := net.ParseIP(*ip)
+	sessions = []*authentication.SessionInfo{}
+	for _, session := range all {
+		if (*user == "" || session.User == *user) && (address == nil || address.Equal(session.IP)) &&
+			(*sp == "" || contains(session.ServiceProviders, *sp)) {
+			sessions = append(sessions, session)
+		}
+	}
+	return printJSON(sessions)
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func revokeSessions(args []string) error {
+	var target target
+	flags := flag.NewFlagSet("session revoke", flag.ExitOnError)
+	id := flags.String("id", "", "session to revoke")
+	user := flags.String("user", "", "user whose sessions are all revoked")
+	target.flags(flags)
+	flags.Parse(args)
+	if (*id == "") == (*user == "") {
+		return errors.New("either -id or -user is required")
+	}
+	if target.online() {
+		query := url.Values{"id": {*id}}
+		if *user != "" {
+			query = url.Values{"user": {*user}}
+		}
+		return target.call("DELETE", "sessions", query, "", nil, nil)
+	}
+	_, store, err := offline()
+	if err != nil {
+		return err
+	}
+	if *id != "" {
+		return authentication.RevokeSession(store, *id)
+	}
+	revoked, err := authentication.RevokeUserSessions(store, *user)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Revoked", revoked, "sessions")
+	return nil
+}
+
+func backup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "file the backup is written to, which must not exist. Defaults to standard output.")
+	prefix := flags.String("prefix", "", "only keys starting with the prefix, such as tenant:example:")
+	flags.Parse(args)
+	_, storer, err := offline()
+	if err != nil {
+		return err
+	}
+	writer := io.Writer(os.Stdout)
+	if *out != "" {
+		// Backups hold sessions, so they're only readable by the owner
+		file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	buffered := bufio.NewWriter(writer)
+	count, err := store.Backup(storer, *prefix, buffered)
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %d keys\n", count)
+	return nil
+}
+
+func restore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := flags.String("in", "", "file the backup is read from. Defaults to standard input.")
+	replace := flags.Bool("replace", false, "overwrite keys already in the store rather than keeping them")
+	flags.Parse(args)
+	_, storer, err := offline()
+	if err != nil {
+		return err
+	}
+	reader := io.Reader(os.Stdin)
+	if *in != "" {
+		file, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	count, err := store.Restore(storer, reader, *replace)
+	fmt.Fprintf(os.Stderr, "Restored %d keys\n", count)
+	return err
+}
+
+func generateKey(args []string) error {
+	flags := flag.NewFlagSet("key generate", flag.ExitOnError)
+	commonName := flags.String("cn", "", "common name of the certificate, such as the IdP's host name")
+	dnsNames := flags.String("dns", "", "comma separated DNS names, for a certificate that also serves HTTPS")
+	bits := flags.Int("bits", 2048, "size of the RSA key")
+	days := flags.Int("days", 3650, "days the certificate is valid")
+	keyPath := flags.String("key", "signing.key", "file the key is written to")
+	certPath := flags.String("cert", "signing.crt", "file the certificate is written to")
+	flags.Parse(args)
+	if *commonName == "" {
+		return errors.New("-cn is required")
+	}
+	var names []string
+	if *dnsNames != "" {
+		names = strings.Split(*dnsNames, ",")
+	}
+	keyData, certData, err := dsig.GenerateSelfSigned(*commonName, names, *bits,
+		time.Duration(*days)*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	// Existing keys are never overwritten
+	if err := writeNewFile(*keyPath, keyData, 0600); err != nil {
+		return err
+	}
+	return writeNewFile(*certPath, certData, 0644)
+}
+
+func writeNewFile(path string, data []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
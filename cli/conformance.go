@@ -0,0 +1,232 @@
+package cli
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/metadata"
+	"github.com/amdonov/lite-idp/protocol"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Exercises a running IdP with valid and malformed requests and reports whether each was handled as the
+// profile requires, to catch regressions in protocol handling. After signing in once, every request is sent
+// within the session, so the IdP answers accepted requests with a successful response without prompting.
+func conformance(args []string) error {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	baseURL := flags.String("url", "", "base URL of the IdP, such as https://idp.example.com")
+	metadataPath := flags.String("metadata", "/Metadata", "path of the IdP's metadata")
+	sp := flags.String("sp", "https://sp.example.com/shibboleth", "entity ID of a configured SP to sign in to")
+	spKeys := flags.Bool("sp-keys", false,
+		"the SP has signing keys registered, so requests with bad signatures must be rejected")
+	action := flags.String("action", "/authenticate", "path the login form is submitted to")
+	user := flags.String("user", "jdoe", "user name submitted")
+	password := flags.String("password", "secret", "password submitted")
+	timeout := flags.Duration("timeout", 30*time.Second, "time allowed for each request")
+	insecure := flags.Bool("insecure", false, "accept any TLS certificate, such as a self-signed one")
+	flags.Parse(args)
+	if *baseURL == "" {
+		return errors.New("-url is required")
+	}
+	base := strings.TrimSuffix(*baseURL, "/")
+	idp, err := loadIdPMetadata(base+*metadataPath, *insecure)
+	if err != nil {
+		return err
+	}
+	jar, _ := cookiejar.New(nil)
+	suite := &conformanceSuite{idp: idp, sp: *sp, action: base + *action, user: *user, password: *password,
+		sso: idp.IDPSSODescriptor.SingleSignOnService(protocol.HTTPRedirectBinding),
+		client: &http.Client{Jar: jar, Timeout: *timeout, Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecure}}}}
+	if suite.sso == "" {
+		return errors.New("the IdP's metadata has no HTTP-Redirect SingleSignOnService")
+	}
+	if _, err := url.Parse(suite.sso); err != nil {
+		return err
+	}
+	suite.run(*spKeys)
+	failed := 0
+	for _, check := range suite.checks {
+		status := "PASS"
+		switch {
+		case check.skipped:
+			status = "SKIP"
+		case !check.passed:
+			status = "FAIL"
+			failed++
+		}
+		fmt.Printf("%s %-40s %s\n", status, check.name, check.detail)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(suite.checks))
+	}
+	return nil
+}
+
+type conformanceSuite struct {
+	idp            *metadata.EntityDescriptor
+	sp, sso        string
+	action         string
+	user, password string
+	client         *http.Client
+	checks         []conformanceCheck
+}
+
+type conformanceCheck struct {
+	name    string
+	passed  bool
+	skipped bool
+	detail  string
+}
+
+func (suite *conformanceSuite) record(name string, passed bool, detail string) bool {
+	suite.checks = append(suite.checks, conformanceCheck{name: name, passed: passed, detail: detail})
+	return passed
+}
+
+func (suite *conformanceSuite) skip(name, detail string) {
+	suite.checks = append(suite.checks, conformanceCheck{name: name, skipped: true, detail: detail})
+}
+
+// Returns a valid AuthnRequest from the SP
+func (suite *conformanceSuite) authnRequest() *protocol.AuthnRequest {
+	authnRequest := &protocol.AuthnRequest{ProtocolBinding: protocol.HTTPPostBinding}
+	authnRequest.ID = protocol.NewID()
+	authnRequest.Version = "2.0"
+	authnRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+	authnRequest.Issuer = suite.sp
+	authnRequest.Destination = suite.sso
+	return authnRequest
+}
+
+func (suite *conformanceSuite) location(authnRequest *protocol.AuthnRequest) string {
+	// The SSO location was parsed when the suite started, so encoding can't fail
+	location, _ := protocol.EncodeRedirect(suite.sso, authnRequest, "")
+	return location
+}
+
+func (suite *conformanceSuite) run(spKeys bool) {
+	first := suite.authnRequest()
+	page, err := fetch(suite.client, "GET", suite.location(first), nil)
+	if !suite.record("valid request shows the login form", err == nil && strings.Contains(page, "<form"),
+		errorDetail(err, "")) {
+		return
+	}
+	page, err = fetch(suite.client, "POST", suite.action, url.Values{"uid": {suite.user}, "pwd": {suite.password}})
+	if err == nil {
+		err = succeeded(page)
+	}
+	if !suite.record("login returns a successful response", err == nil, errorDetail(err, "")) {
+		return
+	}
+	assertionID := suite.checkResponse(page, first)
+
+	second := suite.authnRequest()
+	secondLocation := suite.location(second)
+	page, err = fetch(suite.client, "GET", secondLocation, nil)
+	if err == nil {
+		err = succeeded(page)
+	}
+	if suite.record("request is answered from the session", err == nil, errorDetail(err, "")) {
+		if id := suite.checkResponse(page, second); id != "" && assertionID != "" {
+			suite.record("assertion IDs aren't reused", id != assertionID, id)
+		}
+	}
+	suite.rejected("replayed request is rejected", secondLocation)
+
+	expired := suite.authnRequest()
+	expired.IssueInstant = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	suite.rejected("expired request is rejected", suite.location(expired))
+	future := suite.authnRequest()
+	future.IssueInstant = time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	suite.rejected("request issued in the future is rejected", suite.location(future))
+	version := suite.authnRequest()
+	version.Version = "1.0"
+	suite.rejected("unsupported version is rejected", suite.location(version))
+	unknown := suite.authnRequest()
+	unknown.Issuer = "https://unknown.invalid/sp"
+	suite.rejected("unknown SP is rejected", suite.location(unknown))
+	acs := suite.authnRequest()
+	acs.AssertionConsumerServiceURL = "https://attacker.invalid/acs"
+	suite.rejected("unregistered ACS is rejected", suite.location(acs))
+	destination := suite.authnRequest()
+	destination.Destination = "https://elsewhere.invalid/SSO"
+	suite.rejected("wrong Destination is rejected", suite.location(destination))
+	noID := suite.authnRequest()
+	noID.ID = ""
+	suite.rejected("request without an ID is rejected", suite.location(noID))
+
+	// A signature of random bytes can't verify against any key
+	value := make([]byte, 256)
+	rand.Read(value)
+	signed, _ := url.Parse(suite.location(suite.authnRequest()))
+	query := signed.Query()
+	query.Set("SigAlg", dsig.RSASHA256)
+	query.Set("Signature", base64.StdEncoding.EncodeToString(value))
+	signed.RawQuery = query.Encode()
+	if spKeys {
+		suite.rejected("bad signature is rejected", signed.String())
+	} else {
+		suite.skip("bad signature is rejected", "signatures can't be checked without -sp-keys")
+	}
+
+	malformed, _ := url.Parse(suite.sso)
+	malformed.RawQuery = url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString([]byte("<AuthnRequest"))}}.Encode()
+	suite.rejected("malformed request is rejected", malformed.String())
+}
+
+// Checks that the request was answered without a successful response
+func (suite *conformanceSuite) rejected(name, location string) {
+	page, err := fetch(suite.client, "GET", location, nil)
+	if err != nil {
+		suite.record(name, true, err.Error())
+		return
+	}
+	suite.record(name, succeeded(page) != nil, "")
+}
+
+// Checks the successful response the page posts answers the request and is signed by the IdP. Returns the
+// ID of its assertion, or an empty string if the response isn't valid.
+func (suite *conformanceSuite) checkResponse(page string, authnRequest *protocol.AuthnRequest) string {
+	data, err := postedResponse(page)
+	if err != nil {
+		suite.record("response is valid", false, err.Error())
+		return ""
+	}
+	var response protocol.Response
+	if err := xml.Unmarshal(data, &response); err != nil {
+		suite.record("response is valid", false, err.Error())
+		return ""
+	}
+	if !suite.record("response answers the request", response.InResponseTo == authnRequest.ID,
+		response.InResponseTo) {
+		return ""
+	}
+	_, err = verifyResponse(data, &response, suite.idp.IDPSSODescriptor.SigningCertificates())
+	if !suite.record("response is signed by the IdP", err == nil, errorDetail(err, "")) {
+		return ""
+	}
+	assertion := response.Assertion
+	if assertion == nil {
+		suite.skip("assertion is restricted to the SP", "the assertion is encrypted")
+		return ""
+	}
+	var audiences []string
+	if conditions := assertion.Conditions; conditions != nil && conditions.AudienceRestriction != nil {
+		audiences = conditions.AudienceRestriction.Audience
+	}
+	if !suite.record("assertion is restricted to the SP", contains(audiences, suite.sp),
+		strings.Join(audiences, ", ")) {
+		return ""
+	}
+	return assertion.ID
+}
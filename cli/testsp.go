@@ -0,0 +1,352 @@
+package cli
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/metadata"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runs a minimal SP, so an IdP's configuration can be checked end to end without standing up Shibboleth.
+// Register the SP with its metadata, sign in through it and it reports each check of the response along
+// with the assertion it carried.
+func testSP(args []string) error {
+	flags := flag.NewFlagSet("test-sp", flag.ExitOnError)
+	idpMetadata := flags.String("idp-metadata", "", "URL or file of the IdP's metadata")
+	listen := flags.String("listen", ":9090", "address the SP listens on")
+	baseURL := flags.String("url", "http://localhost:9090", "base URL browsers reach the SP at")
+	entityId := flags.String("entity-id", "", "entity ID of the SP. Defaults to the URL of its metadata.")
+	certPath := flags.String("tls-cert", "", "certificate served over HTTPS. Plain HTTP is served when empty.")
+	keyPath := flags.String("tls-key", "", "key of the HTTPS certificate")
+	insecure := flags.Bool("insecure", false, "accept any TLS certificate when fetching the IdP's metadata")
+	flags.Parse(args)
+	if *idpMetadata == "" {
+		return errors.New("-idp-metadata is required")
+	}
+	idp, err := loadIdPMetadata(*idpMetadata, *insecure)
+	if err != nil {
+		return err
+	}
+	descriptor := idp.IDPSSODescriptor
+	sp := &testServiceProvider{base: strings.TrimSuffix(*baseURL, "/"), entityId: *entityId, idp: idp,
+		sso: descriptor.SingleSignOnService(protocol.HTTPRedirectBinding), certificates: descriptor.SigningCertificates(),
+		requests: make(map[string]time.Time)}
+	if sp.entityId == "" {
+		sp.entityId = sp.base + "/metadata"
+	}
+	if sp.sso == "" {
+		return errors.New("the IdP's metadata has no HTTP-Redirect SingleSignOnService")
+	}
+	if len(sp.certificates) == 0 {
+		return errors.New("the IdP's metadata has no signing certificate")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", sp.home)
+	mux.HandleFunc("/login", sp.login)
+	mux.HandleFunc("/metadata", sp.metadata)
+	mux.HandleFunc("/acs", sp.acs)
+	fmt.Fprintf(os.Stderr, "Register %s/metadata with the IdP as %s and then visit %s\n", sp.base, sp.entityId,
+		sp.base)
+	if *certPath != "" {
+		return http.ListenAndServeTLS(*listen, *certPath, *keyPath, mux)
+	}
+	return http.ListenAndServe(*listen, mux)
+}
+
+// Reads the IdP's metadata from its URL or a file
+func loadIdPMetadata(location string, insecure bool) (*metadata.EntityDescriptor, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(location, "https://") || strings.HasPrefix(location, "http://") {
+		client := &http.Client{Timeout: time.Minute, Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}}}
+		var response *http.Response
+		if response, err = client.Get(location); err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching the IdP's metadata failed with %s", response.Status)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(response.Body, 10<<20))
+	} else {
+		data, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	descriptor, err := metadata.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if descriptor.IDPSSODescriptor == nil {
+		return nil, errors.New(location + " doesn't describe an IdP")
+	}
+	return descriptor, nil
+}
+
+type testServiceProvider struct {
+	base, entityId string
+	idp            *metadata.EntityDescriptor
+	sso            string
+	certificates   []*x509.Certificate
+	mutex          sync.Mutex
+	// IDs of AuthnRequests awaiting a response and when they were sent
+	requests map[string]time.Time
+}
+
+// Outcome of one check of a response
+type testCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// What the result page shows
+type testResult struct {
+	Checks    []testCheck
+	Passed    bool
+	Assertion *saml.Assertion
+	// The assertion as indented XML
+	XML string
+}
+
+func (result *testResult) check(name string, passed bool, detail string) bool {
+	result.Checks = append(result.Checks, testCheck{name, passed, detail})
+	result.Passed = result.Passed && passed
+	return passed
+}
+
+// What the home page and metadata are rendered with
+type testSPView struct {
+	EntityId, ACS, IdP string
+}
+
+func (sp *testServiceProvider) view() testSPView {
+	return testSPView{sp.entityId, sp.base + "/acs", sp.idp.EntityID}
+}
+
+func (sp *testServiceProvider) home(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	testSPPage.ExecuteTemplate(writer, "home", sp.view())
+}
+
+// Sends the browser to the IdP with a fresh AuthnRequest, which is passive when asked with ?passive
+func (sp *testServiceProvider) login(writer http.ResponseWriter, request *http.Request) {
+	authnRequest := &protocol.AuthnRequest{AssertionConsumerServiceURL: sp.base + "/acs",
+		ProtocolBinding: protocol.HTTPPostBinding, IsPassive: request.URL.Query().Get("passive") != ""}
+	authnRequest.ID = protocol.NewID()
+	authnRequest.Version = "2.0"
+	authnRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+	authnRequest.Issuer = sp.entityId
+	authnRequest.Destination = sp.sso
+	location, err := protocol.EncodeRedirect(sp.sso, authnRequest, "")
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	sp.mutex.Lock()
+	// Requests never answered are forgotten after an hour
+	for id, sent := range sp.requests {
+		if time.Since(sent) > time.Hour {
+			delete(sp.requests, id)
+		}
+	}
+	sp.requests[authnRequest.ID] = time.Now()
+	sp.mutex.Unlock()
+	http.Redirect(writer, request, location, 302)
+}
+
+func (sp *testServiceProvider) metadata(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/samlmetadata+xml")
+	testSPPage.ExecuteTemplate(writer, "metadata", sp.view())
+}
+
+// Validates the response the IdP posted, reporting every check rather than stopping at the first failure
+func (sp *testServiceProvider) acs(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		http.Error(writer, "Responses must be posted", 405)
+		return
+	}
+	result := &testResult{Passed: true}
+	sp.validate(request.FormValue("SAMLResponse"), result)
+	for _, check := range result.Checks {
+		status := "ok  "
+		if !check.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("%s %s %s\n", status, check.Name, check.Detail)
+	}
+	if result.XML != "" {
+		fmt.Println(result.XML)
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	testSPPage.ExecuteTemplate(writer, "result", result)
+}
+
+func (sp *testServiceProvider) validate(encoded string, result *testResult) {
+	if !result.check("SAMLResponse", encoded != "", "") {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if !result.check("Decoded", err == nil, errorDetail(err, "")) {
+		return
+	}
+	var response protocol.Response
+	err = xml.Unmarshal(data, &response)
+	if !result.check("Parsed", err == nil, errorDetail(err, "")) {
+		return
+	}
+	issuer := ""
+	if response.Issuer != nil {
+		issuer = response.Issuer.Value
+	}
+	result.check("Response issuer", issuer == "" || issuer == sp.idp.EntityID, issuer)
+	sp.mutex.Lock()
+	_, requested := sp.requests[response.InResponseTo]
+	delete(sp.requests, response.InResponseTo)
+	sp.mutex.Unlock()
+	result.check("InResponseTo", requested, response.InResponseTo)
+	result.check("Destination", response.Destination == "" || response.Destination == sp.base+"/acs",
+		response.Destination)
+	status := ""
+	if response.Status != nil {
+		status = response.Status.StatusCode.Value
+		if response.Status.StatusCode.StatusCode != nil {
+			status += " " + response.Status.StatusCode.StatusCode.Value
+		}
+		if response.Status.StatusMessage != "" {
+			status += ": " + response.Status.StatusMessage
+		}
+	}
+	if !result.check("Status", response.Status != nil &&
+		response.Status.StatusCode.Value == protocol.StatusSuccess, status) {
+		return
+	}
+	if response.EncryptedAssertion != nil {
+		result.check("Assertion", false,
+			"the assertion is encrypted. Register the test SP without an encryption certificate.")
+		return
+	}
+	assertion := response.Assertion
+	if !result.check("Assertion", assertion != nil, "") {
+		return
+	}
+	result.Assertion = assertion
+	if indented, err := xml.MarshalIndent(assertion, "", "  "); err == nil {
+		result.XML = string(indented)
+	}
+	signed, err := verifyResponse(data, &response, sp.certificates)
+	result.check("Signature", err == nil, errorDetail(err, "signed element "+signed))
+	issuer = ""
+	if assertion.Issuer != nil {
+		issuer = assertion.Issuer.Value
+	}
+	result.check("Assertion issuer", issuer == sp.idp.EntityID, issuer)
+	now := time.Now()
+	if conditions := assertion.Conditions; conditions != nil {
+		result.check("NotBefore", conditions.NotBefore.IsZero() || !now.Before(conditions.NotBefore),
+			conditions.NotBefore.Format(time.RFC3339))
+		result.check("NotOnOrAfter", conditions.NotOnOrAfter.IsZero() || now.Before(conditions.NotOnOrAfter),
+			conditions.NotOnOrAfter.Format(time.RFC3339))
+		if restriction := conditions.AudienceRestriction; restriction != nil {
+			result.check("Audience", contains(restriction.Audience, sp.entityId),
+				strings.Join(restriction.Audience, ", "))
+		}
+	}
+	var confirmation *saml.SubjectConfirmationData
+	if subject := assertion.Subject; subject != nil && subject.SubjectConfirmation != nil {
+		confirmation = subject.SubjectConfirmation.SubjectConfirmationData
+	}
+	if !result.check("Subject confirmation", confirmation != nil, "") {
+		return
+	}
+	result.check("Recipient", confirmation.Recipient == sp.base+"/acs", confirmation.Recipient)
+	result.check("Confirmation InResponseTo", confirmation.InResponseTo == response.InResponseTo,
+		confirmation.InResponseTo)
+	result.check("Confirmation NotOnOrAfter", now.Before(confirmation.NotOnOrAfter),
+		confirmation.NotOnOrAfter.Format(time.RFC3339))
+}
+
+// Checks that either the response or its assertion is signed by one of the certificates. Returns the ID of
+// the signed element.
+func verifyResponse(data []byte, response *protocol.Response, certificates []*x509.Certificate) (string, error) {
+	ids := []string{response.ID}
+	if response.Assertion != nil {
+		ids = append(ids, response.Assertion.ID)
+	}
+	err := errors.New("the IdP's metadata has no signing certificate")
+	for _, id := range ids {
+		for _, cert := range certificates {
+			if _, err = dsig.Verify(data, id, cert); err == nil {
+				return id, nil
+			}
+		}
+	}
+	return "", err
+}
+
+// Describes the error, or gives the detail when there's none
+func errorDetail(err error, detail string) string {
+	if err != nil {
+		return err.Error()
+	}
+	return detail
+}
+
+var testSPPage = template.Must(template.New("test-sp").Parse(`
+{{ define "home" }}<!DOCTYPE html>
+<html><head><title>lite-idp test SP</title></head>
+<body>
+<h1>lite-idp test SP</h1>
+<p>Entity ID <code>{{ .EntityId }}</code>, metadata at <a href="/metadata">/metadata</a></p>
+<p>IdP <code>{{ .IdP }}</code></p>
+<ul>
+<li><a href="/login">Sign in</a></li>
+<li><a href="/login?passive=1">Sign in passively</a></li>
+</ul>
+</body></html>{{ end }}
+{{ define "metadata" }}<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="{{ .EntityId }}">
+    <SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+        <AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+                                  Location="{{ .ACS }}" index="0" isDefault="true"/>
+    </SPSSODescriptor>
+</EntityDescriptor>{{ end }}
+{{ define "result" }}<!DOCTYPE html>
+<html><head><title>lite-idp test SP</title></head>
+<body>
+<h1>{{ if .Passed }}The response is valid{{ else }}The response is not valid{{ end }}</h1>
+<table>
+{{ range .Checks }}<tr><td>{{ if .Passed }}ok{{ else }}<strong>FAIL</strong>{{ end }}</td><td>{{ .Name }}</td><td><code>{{ .Detail }}</code></td></tr>
+{{ end }}</table>
+{{ with .Assertion }}{{ with .Subject }}{{ with .NameID }}<h2>Subject</h2>
+<p><code>{{ .Value }}</code> ({{ .Format }})</p>{{ end }}{{ end }}
+{{ with .AuthnStatement }}<h2>Authentication</h2>
+<p>At {{ .AuthnInstant }}{{ with .AuthnContext }} with <code>{{ .AuthnContextClassRef }}</code>{{ end }}, session <code>{{ .SessionIndex }}</code></p>{{ end }}
+{{ with .AttributeStatement }}<h2>Attributes</h2>
+<table>
+{{ range .Attributes }}<tr><td>{{ .Name }}{{ with .FriendlyName }} ({{ . }}){{ end }}</td><td>{{ range .AttributeValues }}<code>{{ .Value }}{{ with .NameID }}{{ .Value }}{{ end }}</code><br>{{ end }}</td></tr>
+{{ end }}</table>{{ end }}{{ end }}
+{{ with .XML }}<h2>Assertion</h2>
+<pre>{{ . }}</pre>{{ end }}
+<p><a href="/">Sign in again</a></p>
+</body></html>{{ end }}`))
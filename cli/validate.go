@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Checks what the IdP would load at startup and reports every problem, for CI pipelines and checks before
+// a deployment. Nothing is written and no listener is opened.
+func validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.Parse(args)
+	settings, err := config.CheckConfiguration()
+	if err != nil {
+		return err
+	}
+	problems := checkSite(settings)
+	if len(settings.Tenants) > 0 {
+		tenants, err := settings.LoadTenants()
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for i, tenant := range tenants {
+			for _, problem := range checkSite(tenant) {
+				problems = append(problems, "tenant "+settings.Tenants[i].Name+": "+problem)
+			}
+		}
+	}
+	if settings.PKCS11 != nil {
+		fmt.Fprintln(os.Stderr, "The PKCS#11 signing key isn't checked, as only the IdP opens the token.")
+	} else if settings.ExternalKey() {
+		fmt.Fprintln(os.Stderr, "The signing key in Vault isn't checked, as only the IdP reads it.")
+	}
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) == 1 {
+			return errors.New("1 problem found")
+		}
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("The configuration is valid")
+	return nil
+}
+
+// Checks the settings and keys of the IdP or one of its tenants
+func checkSite(settings *config.Configuration) []string {
+	problems := settings.Inconsistencies()
+	if !settings.ExternalKey() {
+		problems = append(problems, checkKeyPair("Key", settings.Key, settings.Certificate)...)
+	}
+	if settings.NextKey != "" {
+		problems = append(problems, checkKeyPair("NextKey", settings.NextKey, settings.NextCertificate)...)
+	}
+	listeners := map[string]config.TLS{"TLS": settings.TLS}
+	if settings.BackChannel != nil {
+		listeners["BackChannel.TLS"] = settings.BackChannel.TLS
+	}
+	for name, listener := range listeners {
+		if listener.Certificate == "" || listener.Key == "" {
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(listener.Certificate, listener.Key); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+	}
+	return problems
+}
+
+// Checks that the key can sign and belongs to the certificate, which is still valid
+func checkKeyPair(name, keyPath, certPath string) []string {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return []string{name + ": " + err.Error()}
+	}
+	key, err := dsig.ParsePrivateKey(keyData)
+	if err != nil {
+		return []string{name + ": " + err.Error()}
+	}
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return []string{name + " certificate: " + err.Error()}
+	}
+	certificate, err := dsig.ParseCertificate(certData)
+	if err != nil {
+		return []string{name + " certificate: " + err.Error()}
+	}
+	var problems []string
+	if public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok ||
+		!public.Equal(certificate.PublicKey) {
+		problems = append(problems, name+" doesn't match its certificate "+certPath)
+	}
+	if time.Now().After(certificate.NotAfter) {
+		problems = append(problems, fmt.Sprintf("%s certificate %s expired on %s", name, certPath,
+			certificate.NotAfter.Format("2006-01-02")))
+	}
+	return problems
+}
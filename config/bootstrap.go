@@ -0,0 +1,78 @@
+package config
+
+import (
+	"github.com/amdonov/lite-idp/dsig"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Where the signing key is kept when the configuration doesn't say, relative to the configuration file
+const (
+	defaultCertificate = "signing.crt"
+	defaultKey         = "signing.key"
+)
+
+// Generates a signing key and self-signed certificate when neither file exists yet, so the IdP runs out of
+// the box for evaluation. SPs trust the certificate through the IdP's metadata, and it also serves as the
+// listener's certificate unless another is configured. Instances behind one load balancer must share the
+// files, or each would sign with a key of its own.
+func (config *Configuration) bootstrapKey() error {
+	if config.ExternalKey() || config.Certificate == "" || config.Key == "" {
+		return nil
+	}
+	// Only when both are missing, so a misplaced file is reported rather than replaced
+	for _, path := range []string{config.Certificate, config.Key} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			return nil
+		}
+	}
+	key, certificate, err := dsig.GenerateSelfSigned(config.HostName(), config.DNSNames(), 2048,
+		10*365*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	// The key is written first so a failure never leaves a certificate without one
+	if err := writeNewFile(config.Key, key, 0600); err != nil {
+		return err
+	}
+	if err := writeNewFile(config.Certificate, certificate, 0644); err != nil {
+		return err
+	}
+	config.generatedKey = true
+	return nil
+}
+
+// Reports whether loading the configuration generated a self-signed signing key for evaluation
+func (config *Configuration) GeneratedKey() bool {
+	return config.generatedKey
+}
+
+// Returns the host of the entity ID, or the entity ID when it isn't a URL. Used to name generated keys.
+func (config *Configuration) HostName() string {
+	if target, err := url.Parse(config.EntityId); err == nil && target.Hostname() != "" {
+		return target.Hostname()
+	}
+	return config.EntityId
+}
+
+// Returns the host of BaseURL for generated certificates
+func (config *Configuration) DNSNames() []string {
+	if target, err := url.Parse(config.BaseURL); err == nil && target.Hostname() != "" {
+		return []string{target.Hostname()}
+	}
+	return nil
+}
+
+// Writes data to a new file, failing rather than overwriting one created in the meantime
+func writeNewFile(path string, data []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
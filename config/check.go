@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Loads the configuration like LoadConfiguration, except that missing signing keys are reported rather than
+// generated. For checking a configuration before it's deployed.
+func CheckConfiguration() (*Configuration, error) {
+	dryRun = true
+	return load(configFile, false)
+}
+
+// Set while checking, so loading has no side effects
+var dryRun bool
+
+// Looks for settings that load but would fail once the IdP serves requests, such as endpoints sharing a
+// path or policies naming SPs that aren't configured. SPs registered through the admin API aren't known
+// here. Returns a description of each problem.
+func (config *Configuration) Inconsistencies() []string {
+	config = config.Current()
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	// Every endpoint is served from one mux, which refuses a path registered twice
+	paths := make(map[string]string)
+	endpoint := func(path, name string, required bool) {
+		switch {
+		case path == "":
+			if required {
+				problem("%s is required", name)
+			}
+		case !strings.HasPrefix(path, "/"):
+			problem("%s must be a path such as /%s", name, strings.TrimPrefix(path, "/"))
+		case paths[path] != "":
+			problem("%s and %s are both served at %s", paths[path], name, path)
+		default:
+			paths[path] = name
+		}
+	}
+	services := config.Services
+	endpoint(services.Authentication, "Services.Authentication", true)
+	endpoint(services.ArtifactResolution, "Services.ArtifactResolution", true)
+	endpoint(services.AttributeQuery, "Services.AttributeQuery", true)
+	endpoint(services.Metadata, "Services.Metadata", true)
+	endpoint(services.SAML11Authentication, "Services.SAML11Authentication", false)
+	endpoint(services.Delegation, "Services.Delegation", false)
+	endpoint(services.SingleLogout, "Services.SingleLogout", false)
+	endpoint(services.JWT, "Services.JWT", false)
+	endpoint(services.WSFederation, "Services.WSFederation", false)
+	endpoint(config.Sessions.Dashboard, "Sessions.Dashboard", false)
+	if config.Consent != nil {
+		endpoint(config.Consent.Prompt, "Consent.Prompt", false)
+		endpoint(config.Consent.API, "Consent.API", false)
+	}
+	if config.Authenticator != nil && config.Authenticator.Fallback != nil && config.Authenticator.Fallback.Form != nil {
+		form := config.Authenticator.Fallback.Form
+		endpoint(form.Context, "Authenticator.Fallback.Form.Context", true)
+		endpoint(form.Action, "Authenticator.Fallback.Form.Action", true)
+	}
+	if config.Proxy != nil {
+		endpoint(config.Proxy.AssertionConsumerService, "Proxy.AssertionConsumerService", true)
+	}
+	if config.Admin != nil {
+		endpoint(config.Admin.Path, "Admin.Path", false)
+	}
+	if config.SCIM != nil {
+		endpoint(config.SCIM.WithDefaults().Path+"/", "SCIM.Path", true)
+	}
+	if config.CAS != nil {
+		path := config.CAS.WithDefaults().Path
+		endpoint(path+"/login", "CAS login", true)
+		endpoint(path+"/serviceValidate", "CAS serviceValidate", true)
+		endpoint(path+"/p3/serviceValidate", "CAS p3/serviceValidate", true)
+	}
+	if config.OIDC != nil {
+		oidc := config.OIDC.WithDefaults()
+		endpoint(oidc.Authorization, "OIDC.Authorization", true)
+		endpoint(oidc.Token, "OIDC.Token", true)
+		endpoint(oidc.UserInfo, "OIDC.UserInfo", true)
+		endpoint(oidc.JWKS, "OIDC.JWKS", true)
+		endpoint(oidc.Introspection, "OIDC.Introspection", true)
+		endpoint(oidc.Revocation, "OIDC.Revocation", true)
+		endpoint(OIDCDiscovery, "the OpenID Connect discovery document", true)
+	}
+	if config.Debug != nil {
+		endpoint(config.Debug.Path, "Debug.Path", false)
+	}
+	for _, sp := range config.ServiceProviders {
+		if len(sp.AssertionConsumerServices) == 0 && sp.OIDC == nil && sp.CAS == nil {
+			problem("ServiceProvider %s has no assertion consumer service in its settings or metadata", sp.EntityId)
+		}
+		for _, acs := range sp.AssertionConsumerServices {
+			if target, err := url.Parse(acs.Location); err != nil || !target.IsAbs() {
+				problem("ServiceProvider %s: assertion consumer service %q isn't an absolute URL", sp.EntityId,
+					acs.Location)
+			}
+		}
+		if sp.Delegation != nil {
+			for _, target := range sp.Delegation.Targets {
+				if config.ServiceProvider(target) == nil {
+					problem("ServiceProvider %s may delegate to %s, which isn't configured", sp.EntityId, target)
+				}
+			}
+		}
+	}
+	for i, policy := range config.ReleasePolicies {
+		for _, entityId := range policy.EntityIds {
+			if config.ServiceProvider(entityId) == nil {
+				problem("ReleasePolicies[%d] names %s, which isn't configured", i, entityId)
+			}
+		}
+	}
+	if config.Proxy != nil {
+		for _, upstream := range config.Proxy.Upstreams {
+			if target, err := url.Parse(upstream.SingleSignOnService); err != nil || !target.IsAbs() {
+				problem("Proxy upstream %s: SingleSignOnService must be an absolute URL", upstream.EntityId)
+			}
+		}
+		for i, route := range config.Proxy.Routes {
+			if config.Proxy.Upstream(route.Upstream) == nil {
+				problem("Proxy.Routes[%d] uses upstream %s, which isn't configured", i, route.Upstream)
+			}
+			for _, entityId := range route.ServiceProviders {
+				if config.ServiceProvider(entityId) == nil {
+					problem("Proxy.Routes[%d] names %s, which isn't configured", i, entityId)
+				}
+			}
+		}
+	}
+	return problems
+}
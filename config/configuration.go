@@ -1,40 +1,66 @@
 package config
 
 import (
-	"encoding/json"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/identifier"
+	"github.com/amdonov/lite-idp/metadata"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/xmlenc"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 )
 
 var configFile string
 
 func init() {
 	// Check for a command line argument referencing the configuration file.
-	flag.StringVar(&configFile, "config", "config.json", "path to configuration file")
+	defaultFile := os.Getenv(environmentPrefix + "CONFIG")
+	if defaultFile == "" {
+		defaultFile = "config.json"
+	}
+	flag.StringVar(&configFile, "config", defaultFile, "path to configuration file in JSON, YAML or TOML")
 }
 
 func LoadConfiguration() (*Configuration, error) {
-	file, err := os.Open(configFile)
+	return load(configFile, false)
+}
+
+// Loads the configuration file at the path rather than the one named on the command line, for programs
+// embedding the IdP. Overrides from the environment still apply.
+func Load(path string) (*Configuration, error) {
+	return load(path, false)
+}
+
+// Loads a configuration file. Overrides from the environment and command line only apply to the main
+// file, not to tenants.
+func load(path string, tenant bool) (*Configuration, error) {
+	config, err := readConfiguration(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-	var config Configuration
-	err = decoder.Decode(&config)
-	if err != nil {
-		return nil, err
+	config.file, config.tenant = path, tenant
+	if !tenant {
+		if err := applyOverrides(config); err != nil {
+			return nil, err
+		}
 	}
 	// Convert all of the configuration file paths to absolute paths
-	configAbs, err := filepath.Abs(configFile)
+	configAbs, err := filepath.Abs(path)
 	if err != nil {
 		return nil, err
 	}
 	configDir := filepath.Dir(configAbs)
 	resolvePath := func(path *string) {
-		// If the path is absolute, leave it alone
-		if filepath.IsAbs(*path) {
+		// If the path is absolute or missing, leave it alone
+		if *path == "" || filepath.IsAbs(*path) {
 			return
 		}
 		relPath := filepath.Join(configDir, *path)
@@ -45,32 +71,1279 @@ func LoadConfiguration() (*Configuration, error) {
 		}
 		*path = absPath
 	}
-	resolvePath(&config.AttributeProviders.JsonStore.File)
+	if config.AttributeProviders != nil && config.AttributeProviders.JsonStore != nil {
+		resolvePath(&config.AttributeProviders.JsonStore.File)
+	}
+	if config.Audit != nil {
+		resolvePath(&config.Audit.File)
+		if config.Audit.Syslog != nil {
+			resolvePath(&config.Audit.Syslog.CACertificate)
+		}
+		if config.Audit.HTTP != nil {
+			resolvePath(&config.Audit.HTTP.CACertificate)
+		}
+	}
+	if config.AccessLog != nil {
+		resolvePath(&config.AccessLog.File)
+	}
+	if config.SCIM != nil {
+		resolvePath(&config.SCIM.File)
+	}
+	if config.Streaming != nil && config.Streaming.NATS != nil {
+		resolvePath(&config.Streaming.NATS.Credentials)
+	}
+	resolvePath(&config.ErrorPages.Template)
+	if config.LDAP != nil && config.LDAP.CACertificate != "" {
+		resolvePath(&config.LDAP.CACertificate)
+	}
+	if !config.ExternalKey() && config.Certificate == "" && config.Key == "" {
+		config.Certificate, config.Key = defaultCertificate, defaultKey
+	}
 	resolvePath(&config.Certificate)
 	resolvePath(&config.Key)
+	if config.Vault != nil {
+		resolvePath(&config.Vault.TokenFile)
+		resolvePath(&config.Vault.CACertificate)
+	}
+	for _, listener := range config.listenerTLS() {
+		settings := listener.settings
+		resolvePath(&settings.Certificate)
+		resolvePath(&settings.Key)
+		resolvePath(&settings.ClientCA)
+		if settings.ACME != nil {
+			resolvePath(&settings.ACME.Cache)
+		}
+	}
+	if config.KeyRotation != nil {
+		resolvePath(&config.KeyRotation.Directory)
+	}
+	for _, tenant := range config.Tenants {
+		resolvePath(&tenant.Config)
+	}
+	if config.NextCertificate != "" {
+		resolvePath(&config.NextCertificate)
+		resolvePath(&config.NextKey)
+	}
 	// Password form fixes
-	form := config.Authenticator.Fallback.Form
-	if form != nil {
+	if config.Authenticator != nil && config.Authenticator.Fallback != nil && config.Authenticator.Fallback.Form != nil {
+		form := config.Authenticator.Fallback.Form
 		resolvePath(&form.Directory)
 		form.Form = filepath.Join(form.Directory, form.Form)
 		form.Error = filepath.Join(form.Directory, form.Error)
+		resolvePath(&form.Users)
+	}
+	if config.Proxy != nil {
+		for _, upstream := range config.Proxy.Upstreams {
+			resolvePath(&upstream.Certificate)
+		}
+	}
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		if err := config.bootstrapKey(); err != nil {
+			return nil, fmt.Errorf("failed to generate a signing key: %s", err)
+		}
+	}
+	// Report configuration mistakes before acting on the settings
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.Pairwise != nil {
+		resolvePath(&config.Pairwise.SaltFile)
+		config.Pairwise.Salts, err = identifier.LoadSalts(config.Pairwise.SaltFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, policy := range config.ReleasePolicies {
+		if err := policy.compile(); err != nil {
+			return nil, err
+		}
+	}
+	// Load SP metadata files, reporting every one that fails
+	var failures []string
+	for _, sp := range config.ServiceProviders {
+		if sp.Metadata == "" {
+			continue
+		}
+		resolvePath(&sp.Metadata)
+		err = sp.loadMetadata()
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("metadata of %s: %s", sp.EntityId, err))
+		}
+	}
+	if len(failures) > 0 {
+		return nil, errors.New(strings.Join(failures, "\n"))
 	}
-	resolvePath(&config.Authenticator.Fallback.Form.Directory)
 
-	return &config, nil
+	config.fileProviders = config.ServiceProviders
+	config.filePolicies = config.ReleasePolicies
+	config.index()
+	config.publish()
+	return config, nil
 }
 
 type Configuration struct {
-	EntityId           string
-	Address            string
-	BaseURL            string
-	Certificate        string
-	Key                string
-	Log                string
+	EntityId string
+	Address  string
+	// Scheme, host and optional path prefix users and SPs reach the IdP at, such as https://idp.example.com
+	// or https://www.example.com/idp. Service paths are appended to it.
+	BaseURL string
+	// Addresses or CIDR ranges of reverse proxies whose Forwarded or X-Forwarded-* headers are believed.
+	// Their headers override the scheme, host and prefix of BaseURL and give the client's address.
+	TrustedProxies []string
+	// Signing certificate and key. Default to signing.crt and signing.key next to the configuration file,
+	// which are generated when neither exists.
+	Certificate string
+	Key         string
+	// Signing key published in metadata ahead of a rollover and used from KeyRollover onwards
+	NextCertificate string
+	NextKey         string
+	KeyRollover     time.Time
+	// Uses a key held in a PKCS#11 token rather than the Key file
+	PKCS11 *PKCS11
+	// Reads secrets from HashiCorp Vault. Settings written as vault:path#field, such as
+	// vault:secret/data/idp#ldap-password, are replaced with the field of the secret at path when the
+	// configuration loads. Vault can also hold the signing key.
+	Vault *Vault
+	// Generates signing keys on a schedule, starting from Key, instead of rolling over to NextKey
+	KeyRotation *KeyRotation
+	// File messages are appended to. Defaults to standard error.
+	Log string
+	// debug, info, warn or error. Defaults to info.
+	LogLevel string
+	// text or json. Defaults to text.
+	LogFormat          string
 	Redis              Redis
+	Sessions           Sessions
 	Services           Services
 	Authenticator      *Authenticator
 	AttributeProviders *AttributeProviders
+	// Directory shared by the LDAP components
+	LDAP *LDAP
+	// Seconds of clock drift tolerated between the IdP and SPs
+	ClockSkew        int
+	ServiceProviders []*ServiceProvider
+	// Maps authentication methods to AuthnContextClassRef values. The first matching entry wins.
+	AuthnContexts []*AuthnContextMapping
+	// Context classes from weakest to strongest, used for minimum, maximum and better comparisons
+	AuthnContextOrder []string
+	Validity          Validity
+	// Protocol behavior for SPs without their own profile
+	Profile Profile
+	// Authenticates users at upstream IdPs instead of locally
+	Proxy *Proxy
+	// Requires SOAP clients to present a TLS certificate found in their SP metadata
+	RequireClientCertificates bool
+	// Settings of the HTTPS listener at Address
+	TLS TLS
+	// Serves the SOAP services on a listener of their own instead of at Address
+	BackChannel *BackChannel
+	// Captures SAML messages for troubleshooting when set
+	Debug *Debug
+	// Pages shown to users when their request can't be handled
+	ErrorPages ErrorPages
+	// Reads the login form and error page files again for every request, so edits show without a restart
+	// while designing them. Mistakes are then only found when a page is shown, so leave it off in production.
+	ReloadTemplates bool
+	// Logs every request for capacity planning and debugging when set
+	AccessLog *AccessLog
+	// Exports OpenTelemetry traces of requests when set
+	Telemetry *Telemetry
+	// Records issued assertions when set
+	Audit *Audit
+	// Limits on redirect binding requests
+	RequestLimits RequestLimits
+	// Caps on request rates and concurrent logins across the process, including tenants
+	RateLimits *RateLimits
+	RelayState RelayStatePolicy
+	// NameQualifier of issued NameIDs. Defaults to EntityId.
+	NameQualifier string
+	// Naming of released attributes. Attributes not listed use the basic name format. A source listed more
+	// than once is released under each name.
+	Attributes []*saml.AttributeEncoding
+	// Enables pairwise identifiers
+	Pairwise *Pairwise
+	// Converts directory group DNs into roles or entitlements for SPs without their own mappings
+	GroupMappings []*GroupMapping
+	// Asks users before releasing their attributes when set
+	Consent *Consent
+	// Serves OpenID Connect alongside SAML when set
+	OIDC *OIDC
+	// Serves the CAS protocol when set
+	CAS *CAS
+	// Rules choosing the attributes released to each SP. Once any are configured, attributes are only
+	// released when a rule allows it. Without rules every attribute is released.
+	ReleasePolicies []*ReleasePolicy
+	// XML signature and digest algorithm URIs. When empty SHA-256 is used with an algorithm matching the key.
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+	// Namespace prefixes listed in the exclusive canonicalization InclusiveNamespaces PrefixList
+	InclusiveNamespaces []string
+	// Administrative API, disabled when not set
+	Admin *Admin
+	// SCIM 2.0 API provisioning local accounts, disabled when not set
+	SCIM *SCIM
+	// Receivers notified of logins, revoked sessions, consent decisions and sign-outs as they happen
+	Webhooks []*Webhook
+	// Publishes the same events to Kafka or NATS when set
+	Streaming *Streaming
+	// Further IdPs served by the process, each from a configuration file of its own
+	Tenants []*Tenant
+	// Snapshots published by reloads and registrations. Nil in the snapshots themselves.
+	snapshots *snapshots
+	// The file the configuration was read from, and whether it's a tenant's
+	file   string
+	tenant bool
+	// Whether loading generated the signing key, which the IdP warns about with its logger
+	generatedKey bool
+	// Parsed TrustedProxies
+	trustedProxies []*net.IPNet
+	// ServiceProviders combines those in the file with those registered at runtime, which replace file
+	// entries with the same entity ID
+	fileProviders []*ServiceProvider
+	managed       []*ServiceProvider
+	// ServiceProviders by entity ID and by signing certificate, rebuilt whenever they change
+	byEntityId    map[string]*ServiceProvider
+	byCertificate map[string]*ServiceProvider
+	// ReleasePolicies are those in the file followed by those set at runtime
+	filePolicies    []*ReleasePolicy
+	managedPolicies []*ReleasePolicy
+}
+
+// Settings of the administrative API
+type Admin struct {
+	// Endpoint the API is served under, such as /admin/
+	Path string
+	// Bearer token required by the API
+	Token string
+}
+
+// SCIM 2.0 provisioning of the accounts the login form checks. Provisioned users and groups are kept in File,
+// and the password hashes of active users are written to the login form's Users file.
+type SCIM struct {
+	// Endpoint the Users, Groups and discovery resources are served under. Defaults to /scim/v2.
+	Path string
+	// Bearer token required of provisioning clients
+	Token string
+	// JSON file holding the provisioned users and groups
+	File string
+}
+
+// Returns the settings with defaults applied
+func (settings SCIM) WithDefaults() SCIM {
+	if settings.Path == "" {
+		settings.Path = "/scim/v2"
+	}
+	settings.Path = strings.TrimSuffix(settings.Path, "/")
+	return settings
+}
+
+// A receiver of identity events. Each event is posted as a JSON object.
+type Webhook struct {
+	URL string
+	// Key of the HMAC-SHA256 signature in the X-Webhook-Signature header, which covers the
+	// X-Webhook-Timestamp header and the body. Events are unsigned without one.
+	Secret string
+	// Events sent, such as login.failed. Defaults to all of them.
+	Events []string
+	// Seconds the receiver has to accept an event. Defaults to 5.
+	Timeout int
+	// Further attempts at delivering an event the receiver didn't accept, with growing delays between them.
+	// Defaults to 5.
+	Retries int
+	// Events waiting to be delivered. Events are dropped while it's full. Defaults to 1000.
+	Buffer int
+}
+
+// Identity events sent to webhooks
+const (
+	EventLoginSucceeded  = "login.succeeded"
+	EventLoginFailed     = "login.failed"
+	EventSessionRevoked  = "session.revoked"
+	EventConsentGranted  = "consent.granted"
+	EventConsentDeclined = "consent.declined"
+	EventConsentRevoked  = "consent.revoked"
+	EventLogout          = "logout"
+)
+
+var webhookEvents = map[string]bool{EventLoginSucceeded: true, EventLoginFailed: true, EventSessionRevoked: true,
+	EventConsentGranted: true, EventConsentDeclined: true, EventConsentRevoked: true, EventLogout: true}
+
+func (webhook Webhook) WithDefaults() Webhook {
+	if webhook.Timeout == 0 {
+		webhook.Timeout = 5
+	}
+	if webhook.Retries == 0 {
+		webhook.Retries = 5
+	}
+	if webhook.Buffer == 0 {
+		webhook.Buffer = 1000
+	}
+	return webhook
+}
+
+// Where and how events are published for stream processors
+type Streaming struct {
+	Kafka *Kafka
+	NATS  *NATS
+	// StreamJSON or StreamAvro. Defaults to StreamJSON.
+	Format string
+	// Events published, such as login.succeeded. Defaults to all of them.
+	Events []string
+	// Further attempts at publishing events the broker didn't accept. Defaults to 5.
+	Retries int
+	// Events waiting to be published. Events are dropped while it's full. Defaults to 1000.
+	Buffer int
+}
+
+// Serializations of streamed events
+const (
+	StreamJSON = "json"
+	// Avro single-object encoding, which identifies the schema by its fingerprint
+	StreamAvro = "avro"
+)
+
+func (streaming Streaming) WithDefaults() Streaming {
+	if streaming.Format == "" {
+		streaming.Format = StreamJSON
+	}
+	if streaming.Retries == 0 {
+		streaming.Retries = 5
+	}
+	if streaming.Buffer == 0 {
+		streaming.Buffer = 1000
+	}
+	return streaming
+}
+
+type Kafka struct {
+	// Addresses of the bootstrap brokers, such as kafka-1:9092
+	Brokers []string
+	// Events are keyed by user, so each user's events stay in order
+	Topic string
+	// Connects to the brokers with TLS, trusting the system's roots
+	TLS bool
+}
+
+type NATS struct {
+	// Such as nats://nats.example.com:4222
+	URL string
+	// Events are published to the subject followed by their type, such as idp.events.login.failed for idp.events
+	Subject string
+	// Credentials file of the IdP's NATS user
+	Credentials string
+}
+
+type AuthnContextMapping struct {
+	// All of these methods must have been used
+	Methods  []string
+	ClassRef string
+}
+
+// Settings for an individual relying party. Zero values fall back to the global configuration.
+type ServiceProvider struct {
+	EntityId string
+	// Path to the SP's SAML metadata
+	Metadata string
+	// Endpoints in addition to any found in the metadata
+	AssertionConsumerServices []metadata.IndexedEndpoint
+	Descriptor                *metadata.EntityDescriptor `json:"-"`
+	ClockSkew                 int
+	Validity                  Validity
+	// Audiences added to the assertion in addition to the SP's entity ID
+	Audiences        []string
+	OneTimeUse       bool
+	ProxyRestriction *ProxyRestriction
+	// Confirms the subject with the user's TLS client certificate rather than as a bearer
+	HolderOfKey bool
+	// SPs this SP may obtain assertions for on the user's behalf
+	Delegation *Delegation
+	// Overrides the global AuthnContexts table for this SP
+	AuthnContexts []*AuthnContextMapping
+	NameQualifier string
+	// SPNameQualifier of NameIDs issued to the SP, such as an affiliation ID. Defaults to EntityId.
+	SPNameQualifier string
+	// Affiliations the SP belongs to, which it may request as the SPNameQualifier
+	Affiliations []string
+	// Encodings replacing the global ones for the same source attribute
+	Attributes []*saml.AttributeEncoding
+	// Identifiers sent as attributes: eduPersonTargetedID, pairwise-id or subject-id. Pairwise identifiers
+	// are derived for the SPNameQualifier, so SPs in an affiliation share them.
+	Identifiers []string
+	// Salt version for the SP's pairwise identifiers. Defaults to the newest, and should be pinned to the
+	// version in use before a new salt is added.
+	SaltVersion int
+	// Replace the global group mappings
+	GroupMappings []*GroupMapping
+	// Constant attributes sent to the SP in addition to the user's, such as a tenant identifier. They're
+	// released regardless of the release policies and replace user attributes of the same name.
+	StaticAttributes map[string][]string
+	// Entity categories in addition to those in the SP's metadata
+	EntityCategories []string
+	// Releases attributes without asking the user, such as to the organization's own services
+	SkipConsent bool
+	// Replaces the global profile. The assertion lifetime is set by Validity.
+	Profile *Profile
+	// Algorithm overrides for relying parties that can't handle the global choice
+	SignatureAlgorithm  string
+	DigestAlgorithm     string
+	InclusiveNamespaces []string
+	// Algorithms for encrypting content to the SP's metadata encryption key. Default to AES-256-GCM and RSA-OAEP.
+	EncryptionAlgorithm   string
+	KeyTransportAlgorithm string
+	// Shown on error pages for requests from the SP, such as who supports it
+	ErrorHelp string
+	// Makes the SP an OpenID Connect client whose client ID is the EntityId
+	OIDC *OIDCClient
+	// Issues a signed JWT alongside each assertion, for SPs moving from SAML to tokens
+	JWT *JWTIssuance
+	// Makes the SP a CAS application
+	CAS *CASService
+	// Token settings of a WS-Federation relying party, whose wtrealm is the EntityId and whose wreply
+	// addresses are assertion consumer services with the WS-Federation binding
+	WSFederation *WSFedRelyingParty
+	// Creates or updates the user's account through the SP's SCIM API when they first sign in to it
+	Provisioning *Provisioning
+}
+
+// Just-in-time provisioning of accounts at an SP with SCIM 2.0
+type Provisioning struct {
+	// Base URL of the SP's SCIM API, such as https://sp.example.com/scim/v2
+	URL string
+	// Value of the Authorization header, such as a bearer token
+	Authorization string
+	// Released attributes keyed by the SCIM user attribute set from them, such as name.givenName or emails.
+	// The userName is the subject's NameID unless it's mapped.
+	Attributes map[string]string
+	// Seconds before the account is updated again when the user next signs in. Defaults to a day.
+	Refresh int
+	// Seconds to wait for the SP. Defaults to 5.
+	Timeout int
+	// Stops the login when the account can't be provisioned. Otherwise the assertion is issued regardless.
+	Required bool
+}
+
+// Returns the settings with defaults applied
+func (provisioning Provisioning) WithDefaults() Provisioning {
+	if provisioning.Refresh == 0 {
+		provisioning.Refresh = 24 * 60 * 60
+	}
+	if provisioning.Timeout == 0 {
+		provisioning.Timeout = 5
+	}
+	return provisioning
+}
+
+// Token types issued to WS-Federation relying parties
+const (
+	WSFedSAML11Token = "urn:oasis:names:tc:SAML:1.0:assertion"
+	WSFedSAML2Token  = "urn:oasis:names:tc:SAML:2.0:assertion"
+)
+
+// How tokens are issued to a WS-Federation relying party
+type WSFedRelyingParty struct {
+	// WSFedSAML11Token or WSFedSAML2Token. Defaults to SAML 1.1, which SharePoint requires.
+	TokenType string
+	// Claim type URIs of released attributes, such as
+	// http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress, keyed by the attribute's Name or
+	// FriendlyName. Other attributes keep their Name.
+	Claims map[string]string
+}
+
+// Returns the settings with defaults applied
+func (rp WSFedRelyingParty) WithDefaults() WSFedRelyingParty {
+	if rp.TokenType == "" {
+		rp.TokenType = WSFedSAML11Token
+	}
+	return rp
+}
+
+// CAS 2.0 and 3.0 server settings. Applications are ServiceProviders with a CAS section, so they share the
+// sessions, release policies and attributes of SAML SPs.
+type CAS struct {
+	// Prefix of the login, serviceValidate and p3/serviceValidate endpoints, the server URL prefix CAS
+	// clients are configured with. Defaults to /cas.
+	Path string
+	// Seconds a service ticket may be validated in. Defaults to 60.
+	TicketLifetime int
+}
+
+// Returns the settings with defaults applied
+func (settings CAS) WithDefaults() CAS {
+	if settings.Path == "" {
+		settings.Path = "/cas"
+	}
+	settings.Path = strings.TrimSuffix(settings.Path, "/")
+	if settings.TicketLifetime == 0 {
+		settings.TicketLifetime = 60
+	}
+	return settings
+}
+
+// Settings of an SP that signs users in with CAS
+type CASService struct {
+	// URLs the service parameter of the application's requests starts with
+	Services []string
+	// Names of released attributes in p3/serviceValidate responses, keyed by the attribute's Name or
+	// FriendlyName. Other attributes are sent under their FriendlyName, or their Name when they have none.
+	Attributes map[string]string
+}
+
+// Reports whether the service URL belongs to the application. A prefix without a path only matches its
+// own host.
+func (service *CASService) Matches(url string) bool {
+	for _, prefix := range service.Services {
+		if !strings.HasPrefix(url, prefix) {
+			continue
+		}
+		rest := url[len(prefix):]
+		if rest == "" || strings.HasSuffix(prefix, "/") || strings.ContainsAny(rest[:1], "/?#") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the CAS application the service URL belongs to, or nil if none is configured for it
+func (config *Configuration) CASService(url string) *ServiceProvider {
+	config = config.Current()
+	for _, sp := range config.ServiceProviders {
+		if sp.CAS != nil && sp.CAS.Matches(url) {
+			return sp
+		}
+	}
+	return nil
+}
+
+// How JWTs issued alongside assertions reach the SP
+const (
+	// An extra field of the HTTP-POST binding's form. SPs answered with artifacts get no JWT.
+	JWTDeliveryForm = "form"
+	// Fetched by the SP from Services.JWT with the assertion's SessionIndex
+	JWTDeliveryEndpoint = "endpoint"
+)
+
+// A JWT with the assertion's subject, attributes and lifetime, signed with the IdP's key
+type JWTIssuance struct {
+	// form or endpoint. Defaults to form.
+	Delivery string
+	// Name of the form field. Defaults to JWT.
+	Field string
+	// Claim names of released attributes, as for OpenID Connect clients
+	Claims map[string]string
+}
+
+// Returns the settings with defaults applied
+func (issuance JWTIssuance) WithDefaults() JWTIssuance {
+	if issuance.Delivery == "" {
+		issuance.Delivery = JWTDeliveryForm
+	}
+	if issuance.Field == "" {
+		issuance.Field = "JWT"
+	}
+	return issuance
+}
+
+// Assertion validity windows in seconds. Zero values fall back to the global setting, then the default.
+type Validity struct {
+	// How far NotBefore is backdated. Defaults to 0.
+	NotBefore int
+	// Lifetime of the assertion. Defaults to 300.
+	NotOnOrAfter int
+	// Lifetime of the bearer SubjectConfirmationData. Defaults to the assertion lifetime.
+	SubjectConfirmation int
+}
+
+const defaultAssertionLifetime = 300
+
+// Bounds on inflating redirect binding messages, so a small request can't expand without limit
+type RequestLimits struct {
+	// Maximum size in bytes of the inflated XML. Defaults to 65536.
+	MaxSize int
+	// Maximum ratio of inflated to compressed size. Defaults to 50.
+	MaxRatio int
+}
+
+// Returns the limits with defaults applied
+func (limits RequestLimits) WithDefaults() RequestLimits {
+	if limits.MaxSize == 0 {
+		limits.MaxSize = 65536
+	}
+	if limits.MaxRatio == 0 {
+		limits.MaxRatio = 50
+	}
+	return limits
+}
+
+// Protects the store and signing key from floods of requests. Changes need a restart.
+type RateLimits struct {
+	// Limits on requests to particular paths
+	Endpoints []*EndpointLimit
+	// Most login requests handled at once, counting requests to the authentication services, login forms,
+	// consent prompts and proxy assertion consumer services. Further AuthnRequests are answered with a
+	// Responder error and other requests with 429. No limit when 0.
+	MaxConcurrentLogins int
+}
+
+// Requests to a path beyond its rate are answered with 429
+type EndpointLimit struct {
+	// Path limited, matched exactly
+	Path string
+	// Requests per second allowed
+	Rate float64
+	// Requests allowed in a burst above the rate. Defaults to the rate, and to at least 1.
+	Burst int
+	// Limits each client address on its own rather than all clients together
+	PerClient bool
+}
+
+// Returns the limit with defaults applied
+func (limit EndpointLimit) WithDefaults() EndpointLimit {
+	if limit.Burst == 0 {
+		limit.Burst = int(limit.Rate)
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+	}
+	return limit
+}
+
+// Handling of RelayState values sent by SPs
+type RelayStatePolicy struct {
+	// Longer values are rejected unless StoreOversized is set. Defaults to 80.
+	MaxLength int
+	// Keeps oversized values in the store and passes a short reference through the IdP in their place
+	StoreOversized bool
+}
+
+func (policy RelayStatePolicy) WithDefaults() RelayStatePolicy {
+	if policy.MaxLength == 0 {
+		policy.MaxLength = 80
+	}
+	return policy
+}
+
+// Settings for identifiers derived per SP
+type Pairwise struct {
+	// File of versioned salts, created with a random salt if missing. Losing it changes every identifier.
+	SaltFile string
+	// Scope of pairwise-id and subject-id values, such as example.org
+	Scope string
+	Salts *identifier.Salts `json:"-"`
+}
+
+// Releases attributes to the SPs it matches. A policy matches an SP when one of its entity ID patterns or
+// entity categories does. Patterns may use * to match any run of characters.
+type ReleasePolicy struct {
+	EntityIds        []string
+	EntityCategories []string
+	// Attributes released. * releases every attribute.
+	Attributes []string
+	// Attributes withheld even when another policy releases them
+	Deny []string
+	// Regular expressions by attribute name. Only values matching an expression from one of the SP's
+	// policies are released, such as ^app-x-.* for group memberships.
+	PermitValues map[string][]string
+	// Regular expressions by attribute name matching values withheld even when permitted
+	DenyValues map[string][]string
+	permit     map[string][]*regexp.Regexp
+	deny       map[string][]*regexp.Regexp
+}
+
+func (policy *ReleasePolicy) compile() error {
+	var err error
+	if policy.permit, err = compilePatterns(policy.PermitValues); err != nil {
+		return err
+	}
+	policy.deny, err = compilePatterns(policy.DenyValues)
+	return err
+}
+
+func compilePatterns(patterns map[string][]string) (map[string][]*regexp.Regexp, error) {
+	compiled := make(map[string][]*regexp.Regexp, len(patterns))
+	for name, expressions := range patterns {
+		for _, expression := range expressions {
+			re, err := regexp.Compile(expression)
+			if err != nil {
+				return nil, err
+			}
+			compiled[name] = append(compiled[name], re)
+		}
+	}
+	return compiled, nil
+}
+
+// Reports whether the policy limits the values of the attribute and, if it does, whether the value is
+// one it permits
+func (policy *ReleasePolicy) PermitsValue(name, value string) (restricted, permitted bool) {
+	patterns, restricted := policy.permit[name]
+	return restricted, matchAny(patterns, value)
+}
+
+// Reports whether the policy withholds the value of the attribute
+func (policy *ReleasePolicy) DeniesValue(name, value string) bool {
+	return matchAny(policy.deny[name], value)
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the policy applies to the SP
+func (policy *ReleasePolicy) Matches(entityId string, categories []string) bool {
+	for _, pattern := range policy.EntityIds {
+		if matchWildcard(pattern, entityId) {
+			return true
+		}
+	}
+	for _, category := range policy.EntityCategories {
+		if contains(categories, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the entity categories of the SP from its metadata and configuration
+func (config *Configuration) EntityCategoriesFor(entityId string) []string {
+	sp := config.ServiceProvider(entityId)
+	if sp == nil {
+		return nil
+	}
+	categories := sp.EntityCategories
+	if sp.Descriptor != nil {
+		categories = append(categories[:len(categories):len(categories)], sp.Descriptor.EntityCategories()...)
+	}
+	return categories
+}
+
+// Matches the value against a pattern in which * stands for any run of characters
+func matchWildcard(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		index := strings.Index(value, part)
+		if index < 0 {
+			return false
+		}
+		value = value[index+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// Converts the group DNs in one attribute into values of another, so SPs don't see raw DNs
+type GroupMapping struct {
+	// Attribute holding group DNs, such as memberOf. It isn't released to the SP.
+	Source string
+	// Attribute receiving the values, such as eduPersonEntitlement
+	Target string
+	// Values by group DN. DNs are compared ignoring case and spaces around separators. Groups not listed
+	// aren't released.
+	Groups map[string][]string
+}
+
+// Returns the group mappings for the SP
+func (config *Configuration) GroupMappingsFor(entityId string) []*GroupMapping {
+	config = config.Current()
+	if sp := config.ServiceProvider(entityId); sp != nil && sp.GroupMappings != nil {
+		return sp.GroupMappings
+	}
+	return config.GroupMappings
+}
+
+// Settings for asking users to approve the release of their attributes
+type Consent struct {
+	// Page where users are asked
+	Prompt string
+	// Endpoint where signed in users review and revoke their decisions
+	API string
+	// Days before users are asked again. Defaults to 365.
+	Lifetime int
+}
+
+// Path of the OpenID Connect discovery document, relative to the issuer
+const OIDCDiscovery = "/.well-known/openid-configuration"
+
+// OpenID Connect provider settings. Clients are ServiceProviders with an OIDC section, so they share the
+// sessions, release policies and identifiers of SAML SPs. The issuer is the BaseURL, and the discovery
+// document is served at /.well-known/openid-configuration.
+type OIDC struct {
+	// Endpoint paths. Default to /oidc/authorize, /oidc/token, /oidc/userinfo, /oidc/jwks,
+	// /oidc/introspect and /oidc/revoke.
+	Authorization string
+	Token         string
+	UserInfo      string
+	JWKS          string
+	// RFC 7662 endpoint where resource servers check access tokens, authenticating as confidential clients
+	Introspection string
+	// RFC 7009 endpoint where clients revoke their access tokens
+	Revocation string
+	// Seconds an authorization code may be redeemed in. Defaults to 60.
+	CodeLifetime int
+	// Seconds ID and access tokens are valid. Defaults to 300.
+	TokenLifetime int
+}
+
+// Returns the settings with defaults applied
+func (settings OIDC) WithDefaults() OIDC {
+	if settings.Authorization == "" {
+		settings.Authorization = "/oidc/authorize"
+	}
+	if settings.Token == "" {
+		settings.Token = "/oidc/token"
+	}
+	if settings.UserInfo == "" {
+		settings.UserInfo = "/oidc/userinfo"
+	}
+	if settings.JWKS == "" {
+		settings.JWKS = "/oidc/jwks"
+	}
+	if settings.Introspection == "" {
+		settings.Introspection = "/oidc/introspect"
+	}
+	if settings.Revocation == "" {
+		settings.Revocation = "/oidc/revoke"
+	}
+	if settings.CodeLifetime == 0 {
+		settings.CodeLifetime = 60
+	}
+	if settings.TokenLifetime == 0 {
+		settings.TokenLifetime = 300
+	}
+	return settings
+}
+
+// Settings of an SP that signs users in with OpenID Connect's authorization code flow
+type OIDCClient struct {
+	// Exact URIs the client may be sent back to. Resource servers that only introspect tokens have none.
+	RedirectURIs []string
+	// bcrypt hash of the client secret, as printed by lite-idp password hash. Clients without one, such
+	// as single-page apps, are public and must use PKCE.
+	SecretHash string
+	// Claim names of released attributes, keyed by the attribute's Name or FriendlyName. Other attributes
+	// are sent under their FriendlyName, or their Name when they have none.
+	Claims map[string]string
+}
+
+// Reports whether the URI is one the client may be sent back to
+func (client *OIDCClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range client.RedirectURIs {
+		if uri == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// What the IdP signs in responses
+const (
+	SignAssertion = "assertion"
+	SignResponse  = "response"
+	SignBoth      = "both"
+)
+
+// Settings of the audit log of issued assertions
+type Audit struct {
+	// File entries are appended to. Logins fail rather than go unrecorded if it can't be written. Without
+	// a file the chain starts over each time the IdP starts.
+	File string
+	// Megabytes and hours after which the file is renamed with the time and a new one started. Zero never
+	// rotates.
+	MaxSize int
+	MaxAge  int
+	// Rotated files kept. Zero keeps them all.
+	MaxBackups int
+	// Collectors entries are also sent to. Their failures are logged and retried without failing logins.
+	Syslog *AuditSyslog
+	HTTP   *AuditHTTP
+	// Entries queued for each collector. Defaults to 1000.
+	Buffer int
+	// What happens when a collector's queue is full: OverflowBlock holds up logins until there's room,
+	// OverflowDrop discards the entry. Defaults to OverflowBlock.
+	Overflow string
+}
+
+// Behavior of a full audit queue
+const (
+	OverflowBlock = "block"
+	OverflowDrop  = "drop"
+)
+
+func (audit Audit) WithDefaults() Audit {
+	if audit.Buffer == 0 {
+		audit.Buffer = 1000
+	}
+	if audit.Overflow == "" {
+		audit.Overflow = OverflowBlock
+	}
+	return audit
+}
+
+// A syslog collector receiving RFC 5424 messages framed by octet counting
+type AuditSyslog struct {
+	// host:port of the collector
+	Address string
+	// Connects with TLS, as in RFC 5425
+	TLS bool
+	// Trusted CAs for the collector's certificate. Defaults to the system's.
+	CACertificate string
+	// Defaults to 13, log audit
+	Facility int
+	// APP-NAME of messages. Defaults to lite-idp.
+	AppName string
+}
+
+// A collector receiving entries as JSON arrays POSTed in batches
+type AuditHTTP struct {
+	URL string
+	// Sent as the Authorization header
+	Authorization string
+	// Trusted CAs for the collector's certificate. Defaults to the system's.
+	CACertificate string
+	// Entries per request. Defaults to 100.
+	BatchSize int
+	// Seconds before a partial batch is sent. Defaults to 5.
+	FlushInterval int
+}
+
+// Access logging. Unlike the audit log it records every kind of request, may be sampled and isn't tamper
+// evident.
+type AccessLog struct {
+	// File lines are appended to. Defaults to standard output.
+	File string
+	// text or json. Defaults to json.
+	Format string
+	// Fraction of successful requests logged, such as 0.1. Defaults to 1. Failed and slow requests are
+	// always logged.
+	SampleRate float64
+	// Requests taking at least this many milliseconds are always logged. No threshold when 0.
+	SlowThreshold int
+	// Paths that aren't logged, such as /healthz
+	ExcludePaths []string
+}
+
+// Returns the settings with defaults applied
+func (settings AccessLog) WithDefaults() AccessLog {
+	if settings.Format == "" {
+		settings.Format = "json"
+	}
+	if settings.SampleRate == 0 {
+		settings.SampleRate = 1
+	}
+	return settings
+}
+
+// Export of OpenTelemetry traces over OTLP/HTTP. Trace context sent by callers is continued and passed on
+// to HTTP and SQL attribute sources.
+type Telemetry struct {
+	// Collector URL, such as https://collector.example.com:4318/v1/traces
+	Endpoint string
+	// Headers sent with each export, such as an API key
+	Headers map[string]string
+	// Defaults to lite-idp
+	ServiceName string
+	// Fraction of traces started by the IdP that are recorded, such as 0.1. Defaults to 1. Traces
+	// continued from a caller follow the caller's decision.
+	SampleRatio float64
+}
+
+// Returns the settings with defaults applied
+func (settings Telemetry) WithDefaults() Telemetry {
+	if settings.ServiceName == "" {
+		settings.ServiceName = "lite-idp"
+	}
+	if settings.SampleRatio == 0 {
+		settings.SampleRatio = 1
+	}
+	return settings
+}
+
+// Pages shown to users in place of bare HTTP errors. SPs whose endpoint is known are sent a SAML error
+// response instead.
+type ErrorPages struct {
+	// html/template file rendered with the page's Status, Title, Message, RequestID, ServiceProvider and
+	// Help. Read at startup, unless ReloadTemplates is set. Defaults to a built-in page.
+	Template string
+	// Shown when the SP has no ErrorHelp of its own, such as how to reach the help desk
+	Help string
+}
+
+// The message tracer. Captured messages contain personal data, so only enable it while it's needed.
+type Debug struct {
+	// Number of exchanges kept. Defaults to 100.
+	Messages int
+	// Endpoint listing the captured exchanges
+	Path string
+	// Bearer token required by the endpoint
+	Token string
+}
+
+// Protocol behavior negotiated with an SP
+type Profile struct {
+	// Rejects AuthnRequests without a valid signature from a key in the SP's metadata. Also enabled by
+	// AuthnRequestsSigned in the metadata.
+	RequireSignedRequests bool
+	// One of SignAssertion, SignResponse or SignBoth. Defaults to SignAssertion, or SignBoth when the
+	// response is signed and the metadata sets WantAssertionsSigned. Error responses are always signed.
+	Sign string
+	// Sends the assertion as an EncryptedAssertion for the SP's metadata encryption key
+	EncryptAssertion bool
+	// NameID formats the SP may be issued. Empty allows any.
+	NameIDFormats []string
+	// Bindings responses may be sent with. Empty allows any the IdP supports.
+	Bindings []string
+}
+
+func (profile Profile) SignsAssertion() bool {
+	return profile.Sign != SignResponse
+}
+
+func (profile Profile) SignsResponse() bool {
+	return profile.Sign == SignResponse || profile.Sign == SignBoth
+}
+
+// Reports whether the NameID format may be issued
+func (profile Profile) AllowsNameIDFormat(format string) bool {
+	return len(profile.NameIDFormats) == 0 || contains(profile.NameIDFormats, format)
+}
+
+// Returns the bindings from the list the profile allows
+func (profile Profile) AllowedBindings(bindings []string) []string {
+	if len(profile.Bindings) == 0 {
+		return bindings
+	}
+	var allowed []string
+	for _, binding := range bindings {
+		if contains(profile.Bindings, binding) {
+			allowed = append(allowed, binding)
+		}
+	}
+	return allowed
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type Delegation struct {
+	Targets []string
+}
+
+// Reports whether the SP may request delegated assertions for the target
+func (sp *ServiceProvider) MayDelegateTo(target string) bool {
+	return sp.Delegation != nil && contains(sp.Delegation.Targets, target)
+}
+
+type ProxyRestriction struct {
+	// Maximum number of proxy hops. Omitted when nil.
+	Count     *int
+	Audiences []string
+}
+
+func (sp *ServiceProvider) loadMetadata() error {
+	descriptor, err := metadata.Load(sp.Metadata)
+	if err != nil {
+		return err
+	}
+	sp.applyDescriptor(descriptor)
+	return nil
+}
+
+// Uses metadata held in memory rather than the Metadata file
+func (sp *ServiceProvider) LoadMetadataFrom(data []byte) error {
+	descriptor, err := metadata.Parse(data)
+	if err != nil {
+		return err
+	}
+	sp.applyDescriptor(descriptor)
+	return nil
+}
+
+func (sp *ServiceProvider) applyDescriptor(descriptor *metadata.EntityDescriptor) {
+	if sp.EntityId == "" {
+		sp.EntityId = descriptor.EntityID
+	}
+	if descriptor.SPSSODescriptor != nil {
+		sp.AssertionConsumerServices = append(sp.AssertionConsumerServices,
+			descriptor.SPSSODescriptor.AssertionConsumerServices...)
+	}
+	sp.Descriptor = descriptor
+}
+
+// Returns the SP with the entity ID. Configurations built in code rather than loaded are searched in full.
+func (config *Configuration) ServiceProvider(entityId string) *ServiceProvider {
+	config = config.Current()
+	if config.byEntityId != nil {
+		return config.byEntityId[entityId]
+	}
+	for _, sp := range config.ServiceProviders {
+		if sp.EntityId == entityId {
+			return sp
+		}
+	}
+	return nil
+}
+
+// Returns the SP whose metadata contains the DER encoded certificate
+func (config *Configuration) ServiceProviderByCertificate(raw []byte) *ServiceProvider {
+	config = config.Current()
+	if config.byCertificate != nil {
+		return config.byCertificate[string(raw)]
+	}
+	for _, sp := range config.ServiceProviders {
+		if sp.Descriptor != nil && sp.Descriptor.SPSSODescriptor != nil &&
+			sp.Descriptor.SPSSODescriptor.HasCertificate(raw) {
+			return sp
+		}
+	}
+	return nil
+}
+
+// Returns the clock skew tolerance for the SP or the global default
+func (config *Configuration) ClockSkewFor(entityId string) time.Duration {
+	config = config.Current()
+	skew := config.ClockSkew
+	if sp := config.ServiceProvider(entityId); sp != nil && sp.ClockSkew != 0 {
+		skew = sp.ClockSkew
+	}
+	return time.Duration(skew) * time.Second
+}
+
+// Returns the NotBefore offset, assertion lifetime and subject confirmation lifetime for the SP
+func (config *Configuration) ValidityFor(entityId string) (time.Duration, time.Duration, time.Duration) {
+	config = config.Current()
+	validity := config.Validity
+	if sp := config.ServiceProvider(entityId); sp != nil {
+		if sp.Validity.NotBefore != 0 {
+			validity.NotBefore = sp.Validity.NotBefore
+		}
+		if sp.Validity.NotOnOrAfter != 0 {
+			validity.NotOnOrAfter = sp.Validity.NotOnOrAfter
+		}
+		if sp.Validity.SubjectConfirmation != 0 {
+			validity.SubjectConfirmation = sp.Validity.SubjectConfirmation
+		}
+	}
+	if validity.NotOnOrAfter == 0 {
+		validity.NotOnOrAfter = defaultAssertionLifetime
+	}
+	if validity.SubjectConfirmation == 0 {
+		validity.SubjectConfirmation = validity.NotOnOrAfter
+	}
+	return time.Duration(validity.NotBefore) * time.Second, time.Duration(validity.NotOnOrAfter) * time.Second,
+		time.Duration(validity.SubjectConfirmation) * time.Second
+}
+
+type Vault struct {
+	// Such as https://vault.example.com:8200. Defaults to VAULT_ADDR.
+	Address string
+	// Defaults to VAULT_TOKEN. TokenFile is read when neither is set, as where a Vault Agent writes the token.
+	Token     string
+	TokenFile string
+	// Enterprise namespace of the secrets and keys
+	Namespace string
+	// CA certificate of Vault's listener. Defaults to the system's roots.
+	CACertificate string
+	// Reference to the PEM signing key in the KV engine, such as secret/data/idp#key, read instead of the
+	// Key file
+	Key string
+	// Signs with a key kept by the Transit engine instead, so the private key never leaves Vault
+	Transit *Transit
+}
+
+type Transit struct {
+	// Path the engine is mounted at. Defaults to transit.
+	Mount string
+	// Name of the signing key. Certificate names the file of its certificate.
+	Key string
+}
+
+func (transit Transit) WithDefaults() Transit {
+	if transit.Mount == "" {
+		transit.Mount = "transit"
+	}
+	return transit
+}
+
+type PKCS11 struct {
+	// Path to the PKCS#11 module
+	Module     string
+	TokenLabel string
+	Pin        string
+	// Label of the signing key pair on the token
+	KeyLabel string
+}
+
+// Settings for acting as an SP toward upstream IdPs
+type Proxy struct {
+	// Path of the assertion consumer service receiving responses from upstream IdPs
+	AssertionConsumerService string
+	Upstreams                []*Upstream
+	Routes                   []*ProxyRoute
+}
+
+type Upstream struct {
+	EntityId string
+	// HTTP-Redirect SingleSignOnService location
+	SingleSignOnService string
+	// Path to the PEM encoded certificate the IdP signs responses with
+	Certificate string
+}
+
+// Determines which upstream IdP authenticates users of downstream SPs and how its assertions are translated
+type ProxyRoute struct {
+	// Downstream SPs using the route. A route without any is used for SPs no other route lists.
+	ServiceProviders []string
+	Upstream         string
+	// Attribute whose value becomes the NameID. The upstream NameID is used when empty.
+	NameIDAttribute string
+	// Format of the NameID. Defaults to the upstream format when NameIDAttribute is empty.
+	NameIDFormat string
+	// Renames upstream attributes. When set, attributes not listed are dropped.
+	Attributes map[string]string
+}
+
+func (proxy *Proxy) Upstream(entityId string) *Upstream {
+	for _, upstream := range proxy.Upstreams {
+		if upstream.EntityId == entityId {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// Returns the route for the downstream SP or nil if there isn't one
+func (proxy *Proxy) RouteFor(entityId string) *ProxyRoute {
+	var fallback *ProxyRoute
+	for _, route := range proxy.Routes {
+		if len(route.ServiceProviders) == 0 && fallback == nil {
+			fallback = route
+		}
+		for _, sp := range route.ServiceProviders {
+			if sp == entityId {
+				return route
+			}
+		}
+	}
+	return fallback
 }
 
 type Authenticator struct {
@@ -88,18 +1361,199 @@ type Form struct {
 	Error     string
 	Context   string
 	Action    string
+	// JSON file mapping local user names to bcrypt password hashes, maintained with lite-idp user add.
+	// Read at each sign in, so changes apply straight away.
+	Users string
+	// Checks passwords against the accounts the search finds in the directory configured by LDAP rather than
+	// the users file, by binding as them. Its Resolution isn't used.
+	LDAP *LDAPAttributes
 }
 
 type AttributeProviders struct {
-	JsonStore *JsonStore
+	// How values from several providers are combined: union, first or priority. Defaults to union.
+	Merge string
+	// Providers in the order consulted, named authenticator, json, scim, ldap, sql and http. Defaults to that
+	// order.
+	Order []string
+	// Attributes asserted by the authenticator, such as those from an upstream IdP
+	Authenticator Resolution
+	JsonStore     *JsonStore
+	// Provides the mail, givenName, sn, displayName and groups attributes of users provisioned through SCIM
+	SCIM *Resolution
+	// Looks attributes up in the directory configured by LDAP
+	LDAP *LDAPAttributes
+	SQL  *SQLAttributes
+	HTTP *HTTPAttributes
+	// Attributes derived from the resolved ones, evaluated in order
+	Computed []*ComputedAttribute
+	// Changes to attribute values applied in order once attributes are resolved, before release
+	Transforms []*Transform
+	// Seconds the LDAP, SQL and HTTP providers' results are cached for each principal. Zero disables caching.
+	CacheLifetime int
+	// Seconds the last values are kept for providers that fall back to them. Defaults to a week.
+	FallbackLifetime int
+}
+
+// An attribute built with a text/template expression, such as {{.givenName}} {{.sn}}
+type ComputedAttribute struct {
+	Name     string
+	Template string
+	// Evaluates the template once for each value of this attribute, available as {{.value}}
+	ForEach string
+	// Either skip or fail. Defaults to skip.
+	OnError string
+}
+
+// A change to the values of an attribute
+type Transform struct {
+	Attribute string
+	// lowercase, uppercase, replace, scope or base64
+	Type string
+	// Regular expression and replacement for replace, which may refer to groups as $1. Values that don't
+	// match are left unchanged.
+	Pattern     string
+	Replacement string
+	// Domain appended by scope as user@Scope. Values that already have a scope are left unchanged.
+	Scope string
+}
+
+// How a provider takes part in attribute resolution
+type Resolution struct {
+	// Providers with higher priorities win under the priority merge strategy
+	Priority int
+	// Same as an OnFailure of fail
+	Required bool
+	// What happens when the provider is unavailable: fail the login, omit its attributes or use the cached
+	// values it last returned. Defaults to omit, or fail when Required is set.
+	OnFailure string
+}
+
+// Returns the OnFailure policy, taking Required into account
+func (resolution Resolution) FailurePolicy() string {
+	if resolution.OnFailure == "" && resolution.Required {
+		return "fail"
+	}
+	return resolution.OnFailure
 }
 
 type JsonStore struct {
+	Resolution
 	File string
 }
 
+// Connection settings for an LDAP directory
+type LDAP struct {
+	// ldap:// or ldaps:// URL of the server
+	URL string
+	// Upgrades ldap:// connections with StartTLS
+	StartTLS bool
+	// Trusted CAs for the server certificate. Defaults to the system roots.
+	CACertificate string
+	// Service account used for searches. Anonymous when empty.
+	BindDN       string
+	BindPassword string
+	// Idle connections kept open. Defaults to 4.
+	PoolSize int
+	// Seconds to wait for the server
+	Timeout int
+}
+
+// Queries for the authenticated user's attributes in a SQL database
+type SQLAttributes struct {
+	Resolution
+	// Either postgres or mysql
+	Driver     string
+	DataSource string
+	Queries    []*SQLQuery
+	// Seconds allowed for all queries to complete. Defaults to 5.
+	Timeout int
+}
+
+type SQLQuery struct {
+	// Statement with a single placeholder for the principal name, such as SELECT mail FROM users WHERE uid = $1
+	Statement string
+	// Attribute names for result columns. Other columns are named as they appear in the result.
+	Columns map[string]string
+}
+
+// A REST endpoint returning a JSON document about the authenticated user
+type HTTPAttributes struct {
+	Resolution
+	// URL with {user} in place of the principal name, escaped for the path or the query string
+	URL string
+	// Value of the Authorization header, such as a bearer token
+	Authorization string
+	// Seconds to wait for a response. Defaults to 5.
+	Timeout int
+	// Attribute names mapped to paths into the document, such as $.emails[*].address
+	Fields map[string]string
+}
+
+// An LDAP search for the authenticated user's attributes
+type LDAPAttributes struct {
+	Resolution
+	Base string
+	// Filter with {user} in place of the principal name, such as (uid={user})
+	Filter string
+	// Attributes to return. Empty returns all user attributes.
+	Attributes []string
+}
+
 type Redis struct {
 	Address string
+	// Sent with AUTH when set
+	Password string
+	// Idle connections kept open. Defaults to 3.
+	MaxIdle int
+	// Seconds before an idle connection is closed. Defaults to 240.
+	IdleTimeout int
+}
+
+func (redis Redis) WithDefaults() Redis {
+	if redis.MaxIdle == 0 {
+		redis.MaxIdle = 3
+	}
+	if redis.IdleTimeout == 0 {
+		redis.IdleTimeout = 240
+	}
+	return redis
+}
+
+// Lifetimes and cookie names of the state the IdP keeps for browsers
+type Sessions struct {
+	// Seconds a user's IdP session lasts. Defaults to 28800.
+	Lifetime int
+	// Seconds a user has to sign in before the SP's request is abandoned. Defaults to 300.
+	RequestLifetime int
+	// Default to lidp-user, lidp-rs and lidp-consent
+	Cookie        string
+	RequestCookie string
+	ConsentCookie string
+	// Page where signed in users review their sessions and sign out of them. Not served when empty.
+	Dashboard string
+	// Sessions that may wait to be saved in the background, so logins aren't held up by a slow store. Once
+	// that many are waiting, or when it's 0 as by default, sessions are saved before the login is answered.
+	// Other instances sharing the store don't see a session until it's saved.
+	WriteQueue int
+}
+
+func (sessions Sessions) WithDefaults() Sessions {
+	if sessions.Lifetime == 0 {
+		sessions.Lifetime = 28800
+	}
+	if sessions.RequestLifetime == 0 {
+		sessions.RequestLifetime = 300
+	}
+	if sessions.Cookie == "" {
+		sessions.Cookie = "lidp-user"
+	}
+	if sessions.RequestCookie == "" {
+		sessions.RequestCookie = "lidp-rs"
+	}
+	if sessions.ConsentCookie == "" {
+		sessions.ConsentCookie = "lidp-consent"
+	}
+	return sessions
 }
 
 type Services struct {
@@ -107,4 +1561,253 @@ type Services struct {
 	ArtifactResolution string
 	AttributeQuery     string
 	Metadata           string
+	// Optional SAML 1.1 browser/POST endpoint for legacy Shibboleth SPs
+	SAML11Authentication string
+	// Optional SOAP endpoint issuing delegated assertions
+	Delegation string
+	// Optional SOAP endpoint where SPs end the IdP session of a user signing out of them, authenticating with
+	// the TLS client certificate in their metadata
+	SingleLogout string
+	// Optional endpoint where SPs fetch the JWTs issued alongside their assertions, authenticating with
+	// the TLS client certificate in their metadata
+	JWT string
+	// Optional WS-Federation passive requestor endpoint for relying parties that can't speak SAML 2.0 Web
+	// SSO, such as SharePoint
+	WSFederation string
+}
+
+// Returns the AuthnContextClassRef for the authentication methods used or an empty string if none match
+func (config *Configuration) AuthnContextFor(entityId string, methods []string) string {
+	config = config.Current()
+	mappings := config.AuthnContexts
+	if sp := config.ServiceProvider(entityId); sp != nil && len(sp.AuthnContexts) > 0 {
+		mappings = sp.AuthnContexts
+	}
+	used := make(map[string]bool)
+	for _, method := range methods {
+		used[method] = true
+	}
+	for _, mapping := range mappings {
+		matched := len(mapping.Methods) > 0
+		for _, method := range mapping.Methods {
+			if !used[method] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return mapping.ClassRef
+		}
+	}
+	return ""
+}
+
+// Returns the NameQualifier and SPNameQualifier for NameIDs issued to the SP
+func (config *Configuration) NameQualifiersFor(entityId string) (string, string) {
+	config = config.Current()
+	nameQualifier, spNameQualifier := config.NameQualifier, entityId
+	if nameQualifier == "" {
+		nameQualifier = config.EntityId
+	}
+	if sp := config.ServiceProvider(entityId); sp != nil {
+		if sp.NameQualifier != "" {
+			nameQualifier = sp.NameQualifier
+		}
+		if sp.SPNameQualifier != "" {
+			spNameQualifier = sp.SPNameQualifier
+		}
+	}
+	return nameQualifier, spNameQualifier
+}
+
+// Returns the attribute encodings for the SP keyed by source attribute
+func (config *Configuration) AttributeEncodingsFor(entityId string) map[string][]*saml.AttributeEncoding {
+	config = config.Current()
+	encodings := make(map[string][]*saml.AttributeEncoding)
+	for _, encoding := range config.Attributes {
+		encodings[encoding.Source] = append(encodings[encoding.Source], encoding)
+	}
+	if sp := config.ServiceProvider(entityId); sp != nil {
+		// The SP's encodings of a source replace all of the global ones
+		replaced := make(map[string]bool)
+		for _, encoding := range sp.Attributes {
+			if !replaced[encoding.Source] {
+				encodings[encoding.Source] = nil
+				replaced[encoding.Source] = true
+			}
+			encodings[encoding.Source] = append(encodings[encoding.Source], encoding)
+		}
+	}
+	return encodings
+}
+
+// Returns the profile for the SP with settings from its metadata applied
+func (config *Configuration) ProfileFor(entityId string) Profile {
+	config = config.Current()
+	profile := config.Profile
+	sp := config.ServiceProvider(entityId)
+	if sp != nil && sp.Profile != nil {
+		profile = *sp.Profile
+	}
+	if sp != nil && sp.Descriptor != nil && sp.Descriptor.SPSSODescriptor != nil {
+		descriptor := sp.Descriptor.SPSSODescriptor
+		profile.RequireSignedRequests = profile.RequireSignedRequests || descriptor.AuthnRequestsSigned
+		if profile.Sign == SignResponse && descriptor.WantAssertionsSigned {
+			profile.Sign = SignBoth
+		}
+	}
+	if profile.Sign == "" {
+		profile.Sign = SignAssertion
+	}
+	return profile
+}
+
+// Returns the SP's encryption certificate from its metadata, or nil, with the algorithms to use
+func (config *Configuration) EncryptionFor(entityId string) (*x509.Certificate, xmlenc.Options) {
+	sp := config.ServiceProvider(entityId)
+	if sp == nil {
+		return nil, xmlenc.Options{}
+	}
+	options := xmlenc.Options{DataAlgorithm: sp.EncryptionAlgorithm, KeyAlgorithm: sp.KeyTransportAlgorithm}
+	if sp.Descriptor == nil || sp.Descriptor.SPSSODescriptor == nil {
+		return nil, options
+	}
+	return sp.Descriptor.SPSSODescriptor.EncryptionCertificate(), options
+}
+
+// Returns the InclusiveNamespaces prefixes to use when signing for the SP
+func (config *Configuration) InclusiveNamespacesFor(entityId string) []string {
+	if sp := config.ServiceProvider(entityId); sp != nil && sp.InclusiveNamespaces != nil {
+		return sp.InclusiveNamespaces
+	}
+	return config.InclusiveNamespaces
+}
+
+// Returns the signature and digest algorithms to use for the SP
+func (config *Configuration) SignatureAlgorithmsFor(entityId string) (string, string) {
+	signature, digest := config.SignatureAlgorithm, config.DigestAlgorithm
+	if sp := config.ServiceProvider(entityId); sp != nil {
+		if sp.SignatureAlgorithm != "" {
+			signature = sp.SignatureAlgorithm
+		}
+		if sp.DigestAlgorithm != "" {
+			digest = sp.DigestAlgorithm
+		}
+	}
+	return signature, digest
+}
+
+// Returns the absolute URL of one of the IdP's services as the client of the request reached it.
+// Back-channel services with a BaseURL of their own are always published there.
+func (config *Configuration) EndpointURL(request *http.Request, service string) string {
+	if config.IsBackChannel(service) && config.BackChannel.BaseURL != "" {
+		return config.BackChannel.BaseURL + service
+	}
+	return config.BaseURLFor(request) + service
+}
+
+// Reports whether the service is served by the back-channel listener
+func (config *Configuration) IsBackChannel(service string) bool {
+	if config.BackChannel == nil || service == "" {
+		return false
+	}
+	services := config.Services
+	return service == services.ArtifactResolution || service == services.AttributeQuery ||
+		service == services.Delegation || service == services.JWT || service == services.SingleLogout
+}
+
+type namedTLS struct {
+	name     string
+	settings *TLS
+}
+
+// Returns the TLS settings of each listener. Tenants share the main configuration's listeners.
+func (config *Configuration) listenerTLS() []namedTLS {
+	if config.tenant {
+		return nil
+	}
+	listeners := []namedTLS{{"TLS", &config.TLS}}
+	if config.BackChannel != nil {
+		listeners = append(listeners, namedTLS{"BackChannel.TLS", &config.BackChannel.TLS})
+	}
+	return listeners
+}
+
+// Settings of scheduled signing key rotation
+type KeyRotation struct {
+	// Directory keeping the keys, named by when each starts signing. Keys no longer published are moved to
+	// its archive subdirectory rather than deleted. Instances sharing a store must share the directory, as
+	// only one of them rotates the keys.
+	Directory string
+	// Days each key signs. Defaults to 365.
+	Interval int
+	// Days a new key is published in metadata before it signs, so SPs have time to refresh. Defaults to 30.
+	Publish int
+	// Days a replaced key stays in metadata so assertions it signed can still be validated. Defaults to 7.
+	Retain int
+	// Size of generated RSA keys. Defaults to 2048.
+	Bits int
+}
+
+func (rotation KeyRotation) WithDefaults() KeyRotation {
+	if rotation.Interval == 0 {
+		rotation.Interval = 365
+	}
+	if rotation.Publish == 0 {
+		rotation.Publish = 30
+	}
+	if rotation.Retain == 0 {
+		rotation.Retain = 7
+	}
+	if rotation.Bits == 0 {
+		rotation.Bits = 2048
+	}
+	return rotation
+}
+
+// Protocol settings of an HTTPS listener
+type TLS struct {
+	// Certificate and key of the listener. Default to the signing Certificate and Key.
+	Certificate string
+	Key         string
+	// Obtains and renews the listener's certificate from an ACME CA instead
+	ACME *ACME
+	// Oldest protocol version accepted: 1.0, 1.1, 1.2 or 1.3. Defaults to 1.2.
+	MinVersion string
+	// Cipher suites offered up to TLS 1.2, by their crypto/tls names such as
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites aren't configurable. Defaults to Go's.
+	CipherSuites []string
+	// Key exchange curves, most preferred first: X25519, P256, P384 or P521. Defaults to Go's.
+	CurvePreferences []string
+	// CAs client certificates must chain to. Without it certificates are requested but not verified,
+	// leaving it to SP metadata to vouch for them, and any certificate is accepted for PKI logins.
+	ClientCA string
+	// Rejects connections without a client certificate from ClientCA
+	RequireClientCertificate bool
+}
+
+// Settings for obtaining a listener's certificate from an ACME CA such as Let's Encrypt. The SAML signing
+// key is unaffected.
+type ACME struct {
+	// Names certificates are obtained for. Connections for other names fail.
+	Domains []string
+	// Contact for notices about the account and expiring certificates
+	Email string
+	// Directory keeping the account key and certificates, so restarts don't run into the CA's rate limits
+	Cache string
+	// Directory URL of the CA. Defaults to Let's Encrypt.
+	DirectoryURL string
+	// Address answering HTTP-01 challenges, such as :80, and redirecting other requests to HTTPS. Without
+	// it only TLS-ALPN-01 challenges are answered, which requires the listener to be on port 443.
+	HTTPAddress string
+	// Agrees to the CA's terms of service, which is required to obtain certificates
+	AcceptTerms bool
+}
+
+// A listener for the SOAP services, such as a port only SPs can reach that requires mutual TLS
+type BackChannel struct {
+	Address string
+	// Base of the service URLs published in metadata. Defaults to BaseURL.
+	BaseURL string
+	TLS     TLS
 }
@@ -0,0 +1,185 @@
+package config
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// How a trusted proxy says the client reached the IdP
+type forwarded struct {
+	proto  string
+	host   string
+	prefix string
+	// Whether the proxy sent a prefix, as an empty one replaces the path of BaseURL
+	hasPrefix bool
+}
+
+type forwardedKey struct{}
+
+func (config *Configuration) trusts(ip net.IP) bool {
+	for _, network := range config.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses TrustedProxies, accepting single addresses as well as CIDR ranges
+func (config *Configuration) parseTrustedProxies() error {
+	config.trustedProxies = nil
+	for _, proxy := range config.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return err
+		}
+		config.trustedProxies = append(config.trustedProxies, network)
+	}
+	return nil
+}
+
+// Applies what trusted proxies say about the client: its address replaces the request's remote address,
+// and the scheme, host and prefix it used shape the endpoint URLs. Headers from other peers are ignored.
+func (config *Configuration) TrustProxies(handler http.Handler) http.Handler {
+	if len(config.trustedProxies) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !config.trusts(remoteIP(request.RemoteAddr)) {
+			handler.ServeHTTP(writer, request)
+			return
+		}
+		info, client := config.forwardedBy(request)
+		request = request.WithContext(context.WithValue(request.Context(), forwardedKey{}, info))
+		if client != nil {
+			request.RemoteAddr = net.JoinHostPort(client.String(), "0")
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Reads the Forwarded header, or the X-Forwarded ones when it's absent. Entries are read from the nearest
+// proxy back while they come from trusted proxies, so clients can't supply their own.
+func (config *Configuration) forwardedBy(request *http.Request) (*forwarded, net.IP) {
+	info := &forwarded{}
+	var client net.IP
+	if header := strings.Join(request.Header.Values("Forwarded"), ","); header != "" {
+		elements := strings.Split(header, ",")
+		for i := len(elements) - 1; i >= 0; i-- {
+			values := forwardedPairs(elements[i])
+			info.proto, info.host = values["proto"], values["host"]
+			client = forwardedNode(values["for"])
+			if client == nil || !config.trusts(client) {
+				break
+			}
+		}
+	} else {
+		addresses := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			client = forwardedNode(addresses[i])
+			if client == nil || !config.trusts(client) {
+				break
+			}
+		}
+		info.proto = lastValue(request.Header.Values("X-Forwarded-Proto"))
+		info.host = lastValue(request.Header.Values("X-Forwarded-Host"))
+	}
+	if prefixes := request.Header.Values("X-Forwarded-Prefix"); len(prefixes) > 0 {
+		info.prefix, info.hasPrefix = lastValue(prefixes), true
+	}
+	// Values that couldn't have come from a client's URL are dropped
+	info.proto = strings.ToLower(info.proto)
+	if info.proto != "http" && info.proto != "https" {
+		info.proto = ""
+	}
+	if target, err := url.Parse("//" + info.host); err != nil || target.Host != info.host || target.User != nil {
+		info.host = ""
+	}
+	if info.hasPrefix {
+		if strings.HasPrefix(info.prefix, "/") {
+			info.prefix = strings.TrimSuffix(path.Clean(info.prefix), "/")
+		} else {
+			info.prefix, info.hasPrefix = "", false
+		}
+	}
+	return info, client
+}
+
+// Splits a Forwarded element into its lowercased parameters
+func forwardedPairs(element string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(element, ";") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(parts) == 2 {
+			values[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+		}
+	}
+	return values
+}
+
+// Returns the address of a node such as 192.0.2.1, "[2001:db8::1]:4711" or unknown, which has none
+func forwardedNode(node string) net.IP {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	return net.ParseIP(strings.Trim(node, "[]"))
+}
+
+func lastValue(headers []string) string {
+	values := strings.Split(strings.Join(headers, ","), ",")
+	return strings.TrimSpace(values[len(values)-1])
+}
+
+func remoteIP(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(address)
+}
+
+// Returns the base URL the client reached the IdP at: BaseURL, adjusted by what a trusted proxy forwarded.
+// A nil request gives BaseURL.
+func (config *Configuration) BaseURLFor(request *http.Request) string {
+	if request == nil {
+		return config.BaseURL
+	}
+	info, ok := request.Context().Value(forwardedKey{}).(*forwarded)
+	if !ok {
+		return config.BaseURL
+	}
+	base, err := url.Parse(config.BaseURL)
+	if err != nil {
+		return config.BaseURL
+	}
+	if info.proto != "" {
+		base.Scheme = info.proto
+	}
+	if info.host != "" {
+		base.Host = info.host
+	}
+	if info.hasPrefix {
+		base.Path = info.prefix
+	}
+	return strings.TrimSuffix(base.String(), "/")
+}
+
+// Returns the path of the service as the client sees it, for cookies and redirects
+func (config *Configuration) EndpointPath(request *http.Request, service string) string {
+	target, err := url.Parse(config.EndpointURL(request, service))
+	if err != nil || target.Path == "" {
+		return service
+	}
+	return target.Path
+}
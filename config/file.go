@@ -0,0 +1,84 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Reads the configuration file. YAML (.yaml or .yml) and TOML (.toml) files are converted to JSON first, so
+// every format uses the same field names. Unknown fields are rejected so misspelled settings aren't ignored.
+func readConfiguration(path string) (*Configuration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	converted := false
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		data, err = json.Marshal(stringKeys(document))
+		converted = true
+	case ".toml":
+		var document map[string]interface{}
+		if err := toml.Unmarshal(data, &document); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		data, err = json.Marshal(document)
+		converted = true
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var config Configuration
+	if err := decoder.Decode(&config); err != nil {
+		return nil, describeError(path, data, converted, err)
+	}
+	return &config, nil
+}
+
+// YAML decodes mappings with interface{} keys, which JSON can't encode
+func stringKeys(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, element := range value {
+			converted[fmt.Sprint(key)] = stringKeys(element)
+		}
+		return converted
+	case []interface{}:
+		for i, element := range value {
+			value[i] = stringKeys(element)
+		}
+	}
+	return value
+}
+
+// Adds the location of a decoding error. Offsets only correspond to lines in JSON files.
+func describeError(path string, data []byte, converted bool, err error) error {
+	var offset int64
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		offset = err.Offset
+	case *json.UnmarshalTypeError:
+		if err.Field != "" {
+			return fmt.Errorf("%s: %s should be a %s, not a %s", path, err.Field, err.Type, err.Value)
+		}
+		offset = err.Offset
+	}
+	if offset == 0 || converted {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	return fmt.Errorf("%s line %d: %s", path, line, err)
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Prefix of environment variables overriding settings, such as LIDP_REDIS_ADDRESS for Redis.Address
+const environmentPrefix = "LIDP_"
+
+// Settings given with -set Path=value, applied after the environment
+type assignments []string
+
+func (values *assignments) String() string {
+	return strings.Join(*values, ",")
+}
+
+func (values *assignments) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("%s should be Path=value", value)
+	}
+	*values = append(*values, value)
+	return nil
+}
+
+var flagOverrides assignments
+
+// Shorthand flags for the settings most often injected by container deployments
+var shorthands = map[string]string{
+	"address":     "Address",
+	"base-url":    "BaseURL",
+	"certificate": "Certificate",
+	"key":         "Key",
+	"redis":       "Redis.Address",
+}
+
+var shorthandValues = make(map[string]*string)
+
+func init() {
+	flag.Var(&flagOverrides, "set", "overrides a setting, such as -set Redis.Address=redis:6379. May be repeated.")
+	for name, path := range shorthands {
+		shorthandValues[name] = flag.String(name, "", "overrides "+path)
+	}
+}
+
+// Layers settings from the environment and then the command line over those from the file
+func applyOverrides(config *Configuration) error {
+	for _, variable := range os.Environ() {
+		parts := strings.SplitN(variable, "=", 2)
+		name := parts[0]
+		if !strings.HasPrefix(name, environmentPrefix) || name == environmentPrefix+"CONFIG" {
+			continue
+		}
+		path := strings.Split(strings.TrimPrefix(name, environmentPrefix), "_")
+		if err := setSetting(config, path, parts[1]); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	for _, assignment := range flagOverrides {
+		parts := strings.SplitN(assignment, "=", 2)
+		if err := setSetting(config, strings.Split(parts[0], "."), parts[1]); err != nil {
+			return fmt.Errorf("-set %s: %s", parts[0], err)
+		}
+	}
+	for name, value := range shorthandValues {
+		if *value == "" {
+			continue
+		}
+		if err := setSetting(config, strings.Split(shorthands[name], "."), *value); err != nil {
+			return fmt.Errorf("-%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Sets the field at the path of field names, which are matched ignoring case. Missing sections are created.
+// Strings, numbers, booleans and comma separated lists of strings can be set.
+func setSetting(config *Configuration, path []string, value string) error {
+	field := reflect.ValueOf(config).Elem()
+	for _, name := range path {
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				field.Set(reflect.New(field.Type().Elem()))
+			}
+			field = field.Elem()
+		}
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("%s isn't a section", name)
+		}
+		found := false
+		for i := 0; i < field.NumField(); i++ {
+			structField := field.Type().Field(i)
+			if structField.PkgPath == "" && structField.Tag.Get("json") != "-" &&
+				strings.EqualFold(structField.Name, name) {
+				field, found = field.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown setting %s", name)
+		}
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%s isn't a number", value)
+		}
+		field.SetInt(int64(number))
+	case reflect.Bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%s isn't true or false", value)
+		}
+		field.SetBool(enabled)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the configuration file")
+		}
+		field.Set(reflect.ValueOf(strings.Split(value, ",")))
+	default:
+		return fmt.Errorf("can only be set in the configuration file")
+	}
+	return nil
+}
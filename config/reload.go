@@ -0,0 +1,197 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Reloads and runtime registrations publish a new snapshot of the configuration rather than changing the one
+// requests are reading, so neither waits for the other and no request sees a change half applied
+type snapshots struct {
+	// Held while a change builds the next snapshot, so changes made at once aren't lost
+	mutex    sync.Mutex
+	current  atomic.Pointer[Configuration]
+	reloaded []func() error
+}
+
+// Starts publishing snapshots. Called while the IdP is built, before requests are served.
+func (config *Configuration) publish() *snapshots {
+	if config.snapshots == nil {
+		config.snapshots = &snapshots{}
+		config.snapshots.current.Store(config.copy())
+	}
+	return config.snapshots
+}
+
+func (config *Configuration) copy() *Configuration {
+	next := *config
+	next.snapshots = nil
+	return &next
+}
+
+// Returns the latest snapshot. Service providers, release policies and the other settings Reload lists must be
+// read from it, or from the one For returns, as the configuration itself keeps those it was loaded with.
+func (config *Configuration) Current() *Configuration {
+	if config.snapshots == nil {
+		return config
+	}
+	return config.snapshots.current.Load()
+}
+
+type snapshotKey struct {
+	config *Configuration
+}
+
+// Returns the snapshot the request is handled with, so the settings it reads all come from the same one. Outside
+// Guard it's the latest.
+func (config *Configuration) For(request *http.Request) *Configuration {
+	if snapshot, ok := request.Context().Value(snapshotKey{config}).(*Configuration); ok {
+		return snapshot
+	}
+	return config.Current()
+}
+
+// Builds the next snapshot from the latest with the change and publishes it, unless the change fails
+func (config *Configuration) change(apply func(next *Configuration) error) error {
+	snapshots := config.publish()
+	snapshots.mutex.Lock()
+	defer snapshots.mutex.Unlock()
+	next := snapshots.current.Load().copy()
+	if err := apply(next); err != nil {
+		return err
+	}
+	next.merge()
+	snapshots.current.Store(next)
+	return nil
+}
+
+// Reads the configuration file again and replaces the settings that can change while running: service
+// providers and their metadata, attribute release and naming, authentication contexts, assertion
+// validity and protocol profiles. Pages read from files, such as the login form, are read again too. Keys,
+// endpoints, the store and attribute providers need a restart. The current settings are kept if the file is
+// invalid.
+func (config *Configuration) Reload() error {
+	fresh, err := load(config.file, config.tenant)
+	if err != nil {
+		return err
+	}
+	// A failed change publishes nothing, so the previous snapshot stays in use
+	err = config.change(func(next *Configuration) error {
+		next.fileProviders = fresh.fileProviders
+		next.filePolicies = fresh.filePolicies
+		next.Attributes = fresh.Attributes
+		next.GroupMappings = fresh.GroupMappings
+		next.Pairwise = fresh.Pairwise
+		next.NameQualifier = fresh.NameQualifier
+		next.AuthnContexts = fresh.AuthnContexts
+		next.AuthnContextOrder = fresh.AuthnContextOrder
+		next.Profile = fresh.Profile
+		next.Validity = fresh.Validity
+		next.ClockSkew = fresh.ClockSkew
+		next.RequestLimits = fresh.RequestLimits
+		next.RelayState = fresh.RelayState
+		next.RequireClientCertificates = fresh.RequireClientCertificates
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	config.snapshots.mutex.Lock()
+	reloaded := config.snapshots.reloaded
+	config.snapshots.mutex.Unlock()
+	var failed error
+	for _, reload := range reloaded {
+		failed = errors.Join(failed, reload())
+	}
+	return failed
+}
+
+// Calls the function whenever Reload has read the file again, so components can read their own files again,
+// such as page templates. They should keep what they have if that fails, as Reload reports the error.
+func (config *Configuration) OnReload(reload func() error) {
+	snapshots := config.publish()
+	snapshots.mutex.Lock()
+	defer snapshots.mutex.Unlock()
+	snapshots.reloaded = append(snapshots.reloaded, reload)
+}
+
+// Replaces the service providers registered at runtime. They take precedence over those in the file.
+func (config *Configuration) SetManagedServiceProviders(managed []*ServiceProvider) {
+	config.change(func(next *Configuration) error {
+		next.managed = managed
+		return nil
+	})
+}
+
+// Replaces the release policies set at runtime, which apply in addition to those in the file
+func (config *Configuration) SetManagedReleasePolicies(policies []*ReleasePolicy) error {
+	for _, policy := range policies {
+		if err := policy.compile(); err != nil {
+			return err
+		}
+	}
+	return config.change(func(next *Configuration) error {
+		next.managedPolicies = policies
+		return nil
+	})
+}
+
+// Reports whether the SP was registered at runtime rather than in the file
+func (config *Configuration) IsManaged(entityId string) bool {
+	for _, sp := range config.Current().managed {
+		if sp.EntityId == entityId {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *Configuration) merge() {
+	config.ReleasePolicies = append(config.filePolicies[:len(config.filePolicies):len(config.filePolicies)],
+		config.managedPolicies...)
+	providers := make([]*ServiceProvider, 0, len(config.fileProviders)+len(config.managed))
+	replaced := make(map[string]bool, len(config.managed))
+	for _, sp := range config.managed {
+		replaced[sp.EntityId] = true
+	}
+	for _, sp := range config.fileProviders {
+		if !replaced[sp.EntityId] {
+			providers = append(providers, sp)
+		}
+	}
+	config.ServiceProviders = append(providers, config.managed...)
+	config.index()
+}
+
+// Indexes the service providers, so finding the one a request is from doesn't mean searching them all. The
+// first SP with an entity ID or certificate wins, as it did when they were searched in order.
+func (config *Configuration) index() {
+	config.byEntityId = make(map[string]*ServiceProvider, len(config.ServiceProviders))
+	config.byCertificate = make(map[string]*ServiceProvider)
+	for _, sp := range config.ServiceProviders {
+		if _, found := config.byEntityId[sp.EntityId]; !found {
+			config.byEntityId[sp.EntityId] = sp
+		}
+		if sp.Descriptor == nil || sp.Descriptor.SPSSODescriptor == nil {
+			continue
+		}
+		for _, cert := range sp.Descriptor.SPSSODescriptor.SigningCertificates() {
+			if _, found := config.byCertificate[string(cert.Raw)]; !found {
+				config.byCertificate[string(cert.Raw)] = sp
+			}
+		}
+	}
+}
+
+// Wraps the handler so each request is handled with the snapshot that's latest when it starts, which For
+// returns. Changes published while it's handled apply from the next request.
+func (config *Configuration) Guard(handler http.Handler) http.Handler {
+	config.publish()
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), snapshotKey{config}, config.Current())
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a configuration with the clock skew to the file
+func writeConfig(t *testing.T, path string, skew int) {
+	writeSettings(t, path, map[string]interface{}{"ClockSkew": skew})
+}
+
+// Writes a configuration with the settings added to the file
+func writeSettings(t *testing.T, path string, added map[string]interface{}) {
+	settings := map[string]interface{}{
+		"EntityId":           "https://idp.example.com/idp",
+		"BaseURL":            "https://idp.example.com",
+		"Address":            ":0",
+		"Redis":              map[string]string{"Address": "localhost:6379"},
+		"AttributeProviders": map[string]interface{}{},
+		"Services": map[string]string{"Authentication": "/SAML2/Redirect/SSO",
+			"ArtifactResolution": "/SAML2/SOAP/ArtifactResolution", "AttributeQuery": "/SAML2/SOAP/AttributeQuery",
+			"Metadata": "/Metadata"},
+		"Authenticator": map[string]interface{}{"Fallback": map[string]interface{}{"Form": map[string]string{
+			"Directory": filepath.Dir(path), "Form": "form.html", "Error": "error.html", "Context": "/form/",
+			"Action": "/authenticate"}}},
+	}
+	for name, value := range added {
+		settings[name] = value
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A reload while a request is handled applies from the next request
+func TestReloadKeepsRequestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, 60)
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := 0
+	config.OnReload(func() error {
+		reloads++
+		return nil
+	})
+	handled := false
+	config.Guard(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeConfig(t, path, 3600)
+		if err := config.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if skew := config.For(request).ClockSkewFor(""); skew != time.Minute {
+			t.Errorf("request sees a clock skew of %s after reloading", skew)
+		}
+		if skew := config.ClockSkewFor(""); skew != time.Hour {
+			t.Errorf("reload published a clock skew of %s", skew)
+		}
+		handled = true
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !handled {
+		t.Fatal("request wasn't handled")
+	}
+	if reloads != 1 {
+		t.Errorf("reload hook called %d times", reloads)
+	}
+}
@@ -0,0 +1,109 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An IdP hosted alongside the main one, with its own entity ID, keys, service providers and login form
+type Tenant struct {
+	// Keeps the tenant's stored state apart and names its cookies
+	Name string
+	// Configuration file of the tenant's IdP. The listeners, logging and Redis come from the main
+	// configuration, and settings for them in this file are ignored.
+	Config string
+	// Requests for this host are served by the tenant
+	Host string
+	// Requests under this path are served by the tenant. Its service, form and API paths must start with it.
+	PathPrefix string
+}
+
+// Loads the configuration of each tenant in order. Tenants publish back-channel endpoints at the main
+// configuration's address unless they set their own BackChannel.BaseURL.
+func (config *Configuration) LoadTenants() ([]*Configuration, error) {
+	var tenants []*Configuration
+	for _, tenant := range config.Tenants {
+		loaded, err := load(tenant.Config, true)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %s", tenant.Name, err)
+		}
+		if err := tenant.checkPaths(loaded); err != nil {
+			return nil, err
+		}
+		if config.BackChannel != nil {
+			loaded.BackChannel = &BackChannel{BaseURL: config.BackChannel.BaseURL}
+		}
+		// Tenants sharing a host would otherwise overwrite each other's cookies
+		sessions, defaults := &loaded.Sessions, Sessions{}.WithDefaults()
+		if sessions.Cookie == "" {
+			sessions.Cookie = defaults.Cookie + "-" + tenant.Name
+		}
+		if sessions.RequestCookie == "" {
+			sessions.RequestCookie = defaults.RequestCookie + "-" + tenant.Name
+		}
+		if sessions.ConsentCookie == "" {
+			sessions.ConsentCookie = defaults.ConsentCookie + "-" + tenant.Name
+		}
+		tenants = append(tenants, loaded)
+	}
+	return tenants, nil
+}
+
+// Reports whether the request is for the tenant
+func (tenant *Tenant) Matches(host, path string) bool {
+	if tenant.Host != "" && !strings.EqualFold(tenant.Host, host) {
+		return false
+	}
+	return tenant.PathPrefix == "" || path == tenant.PathPrefix || strings.HasPrefix(path, tenant.prefix())
+}
+
+// The path prefix with a trailing slash
+func (tenant *Tenant) prefix() string {
+	return strings.TrimSuffix(tenant.PathPrefix, "/") + "/"
+}
+
+// Confirms a tenant routed by path only serves paths under its prefix
+func (tenant *Tenant) checkPaths(config *Configuration) error {
+	if tenant.PathPrefix == "" {
+		return nil
+	}
+	services := config.Services
+	paths := []string{services.Authentication, services.ArtifactResolution, services.AttributeQuery,
+		services.Metadata, services.SAML11Authentication, services.Delegation, services.WSFederation,
+		services.SingleLogout, services.JWT}
+	if form := config.Authenticator.Fallback.Form; form != nil {
+		paths = append(paths, form.Context, form.Action)
+	}
+	if config.Consent != nil {
+		paths = append(paths, config.Consent.Prompt, config.Consent.API)
+	}
+	if config.Proxy != nil {
+		paths = append(paths, config.Proxy.AssertionConsumerService)
+	}
+	if config.Debug != nil {
+		paths = append(paths, config.Debug.Path)
+	}
+	paths = append(paths, config.Sessions.Dashboard)
+	if config.Admin != nil {
+		paths = append(paths, config.Admin.Path)
+	}
+	if config.SCIM != nil {
+		paths = append(paths, config.SCIM.WithDefaults().Path)
+	}
+	if config.CAS != nil {
+		paths = append(paths, config.CAS.WithDefaults().Path)
+	}
+	// Discovery is always served at the root, so a tenant routed by path can't serve OpenID Connect
+	if config.OIDC != nil {
+		oidc := config.OIDC.WithDefaults()
+		paths = append(paths, oidc.Authorization, oidc.Token, oidc.UserInfo, oidc.Introspection, oidc.Revocation,
+			oidc.JWKS, OIDCDiscovery)
+	}
+	for _, path := range paths {
+		if path != "" && !strings.HasPrefix(path, tenant.prefix()) {
+			return fmt.Errorf("tenant %s serves %s outside its path prefix %s", tenant.Name, path,
+				tenant.PathPrefix)
+		}
+	}
+	return nil
+}
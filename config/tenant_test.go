@@ -0,0 +1,54 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// Returns a tenant configuration whose SAML services are all under /a
+func prefixedTenant() *Configuration {
+	return &Configuration{Services: Services{Authentication: "/a/SAML2/Redirect/SSO",
+		ArtifactResolution: "/a/SAML2/SOAP/ArtifactResolution", AttributeQuery: "/a/SAML2/SOAP/AttributeQuery",
+		Metadata: "/a/Metadata"}, Authenticator: &Authenticator{Fallback: &PasswordAuthenticator{
+		Form: &Form{Context: "/a/form/", Action: "/a/authenticate"}}}}
+}
+
+// A tenant routed by path can't serve OpenID Connect, as discovery is only served at the root
+func TestTenantPathsIncludeOIDC(t *testing.T) {
+	tenant := &Tenant{Name: "a", PathPrefix: "/a"}
+	config := prefixedTenant()
+	if err := tenant.checkPaths(config); err != nil {
+		t.Fatal(err)
+	}
+	config.OIDC = &OIDC{Authorization: "/a/oidc/authorize", Token: "/a/oidc/token", UserInfo: "/a/oidc/userinfo",
+		Introspection: "/a/oidc/introspect", Revocation: "/a/oidc/revoke", JWKS: "/a/oidc/jwks"}
+	if err := tenant.checkPaths(config); err == nil || !strings.Contains(err.Error(), OIDCDiscovery) {
+		t.Errorf("OpenID Connect accepted under a path prefix: %v", err)
+	}
+	config.OIDC = &OIDC{}
+	if err := tenant.checkPaths(config); err == nil || !strings.Contains(err.Error(), "/oidc/") {
+		t.Errorf("default OpenID Connect paths accepted outside the prefix: %v", err)
+	}
+}
+
+func TestTenantPathsIncludeCAS(t *testing.T) {
+	tenant := &Tenant{Name: "a", PathPrefix: "/a"}
+	config := prefixedTenant()
+	config.CAS = &CAS{}
+	if err := tenant.checkPaths(config); err == nil || !strings.Contains(err.Error(), "/cas") {
+		t.Errorf("CAS served outside the prefix: %v", err)
+	}
+	config.CAS.Path = "/a/cas"
+	if err := tenant.checkPaths(config); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTenantPathsIncludeJWT(t *testing.T) {
+	tenant := &Tenant{Name: "a", PathPrefix: "/a"}
+	config := prefixedTenant()
+	config.Services.JWT = "/jwt"
+	if err := tenant.checkPaths(config); err == nil || !strings.Contains(err.Error(), "/jwt") {
+		t.Errorf("JWT endpoint served outside the prefix: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+// Protocol versions by their configured names
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Key exchange curves by their configured names
+var Curves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// Returns the ID of the named cipher suite. Suites Go considers insecure aren't found.
+func CipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the server configuration for the settings. Client certificates are always requested, as PKI
+// logins and SOAP clients identify themselves with them.
+func (settings TLS) Config() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, ClientAuth: tls.RequestClientCert}
+	if settings.MinVersion != "" {
+		version, found := TLSVersions[settings.MinVersion]
+		if !found {
+			return nil, errors.New("unknown TLS version " + settings.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	for _, name := range settings.CipherSuites {
+		suite, found := CipherSuite(name)
+		if !found {
+			return nil, errors.New("unknown cipher suite " + name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+	for _, name := range settings.CurvePreferences {
+		curve, found := Curves[name]
+		if !found {
+			return nil, errors.New("unknown curve " + name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+	if settings.ClientCA != "" {
+		data, err := ioutil.ReadFile(settings.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + settings.ClientCA)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if settings.RequireClientCertificate {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
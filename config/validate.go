@@ -0,0 +1,376 @@
+package config
+
+import (
+	"fmt"
+	"github.com/amdonov/lite-idp/vault"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Checks for settings the IdP can't start without or doesn't understand, reporting every problem at once
+func (config *Configuration) validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	required := func(value, name string) {
+		if value == "" {
+			problem("%s is required", name)
+		}
+	}
+	file := func(path, name string) {
+		if path == "" {
+			problem("%s is required", name)
+		} else if _, err := os.Stat(path); err != nil {
+			problem("%s: %s", name, err)
+		}
+	}
+	required(config.EntityId, "EntityId")
+	if !config.tenant {
+		required(config.Address, "Address")
+		required(config.Redis.Address, "Redis.Address")
+	} else if len(config.Tenants) > 0 || config.BackChannel != nil || config.RateLimits != nil ||
+		config.AccessLog != nil || config.Telemetry != nil {
+		problem("Tenants, BackChannel, RateLimits, AccessLog and Telemetry can only be set in the main " +
+			"configuration")
+	}
+	if target, err := url.Parse(config.BaseURL); err != nil || !target.IsAbs() {
+		problem("BaseURL must be an absolute URL such as https://idp.example.com")
+	}
+	if err := config.parseTrustedProxies(); err != nil {
+		problem("TrustedProxies: %s", err)
+	}
+	file(config.Certificate, "Certificate")
+	for _, listener := range config.listenerTLS() {
+		name, settings := listener.name, listener.settings
+		validateTLS(*settings, name, problem)
+		if settings.ClientCA != "" {
+			file(settings.ClientCA, name+".ClientCA")
+		}
+		if settings.Certificate != "" || settings.Key != "" {
+			file(settings.Certificate, name+".Certificate")
+			file(settings.Key, name+".Key")
+		}
+	}
+	if config.BackChannel != nil {
+		required(config.BackChannel.Address, "BackChannel.Address")
+		if config.BackChannel.Address == config.Address {
+			problem("BackChannel.Address must differ from Address")
+		}
+		if config.BackChannel.BaseURL != "" {
+			if target, err := url.Parse(config.BackChannel.BaseURL); err != nil || !target.IsAbs() {
+				problem("BackChannel.BaseURL must be an absolute URL such as https://idp.example.com:8443")
+			}
+		}
+	}
+	if !config.ExternalKey() {
+		file(config.Key, "Key")
+	}
+	if settings := config.Vault; settings != nil {
+		if settings.Key != "" && settings.Transit != nil {
+			problem("Vault.Key and Vault.Transit can't both be set")
+		}
+		if settings.Key != "" {
+			if _, _, ok := vault.ParseReference(vault.Scheme + settings.Key); !ok {
+				problem("Vault.Key must be the path and field of the key, such as secret/data/idp#key")
+			}
+		}
+		if settings.Transit != nil {
+			required(settings.Transit.Key, "Vault.Transit.Key")
+		}
+		if settings.TokenFile != "" {
+			file(settings.TokenFile, "Vault.TokenFile")
+		}
+		if settings.CACertificate != "" {
+			file(settings.CACertificate, "Vault.CACertificate")
+		}
+	}
+	if config.PKCS11 != nil && config.Vault != nil && (config.Vault.Key != "" || config.Vault.Transit != nil) {
+		problem("PKCS11 can't be combined with a signing key in Vault")
+	}
+	if rotation := config.KeyRotation; rotation != nil {
+		required(rotation.Directory, "KeyRotation.Directory")
+		if config.ExternalKey() || config.NextKey != "" {
+			problem("KeyRotation can't be combined with PKCS11, a signing key in Vault or NextKey")
+		}
+		defaults := rotation.WithDefaults()
+		if defaults.Publish >= defaults.Interval {
+			problem("KeyRotation.Publish must be shorter than the Interval")
+		}
+	}
+	if config.NextKey != "" {
+		file(config.NextCertificate, "NextCertificate")
+		file(config.NextKey, "NextKey")
+		if config.KeyRollover.IsZero() {
+			problem("NextKey needs a KeyRollover time to start signing with it")
+		}
+	} else if !config.KeyRollover.IsZero() || config.NextCertificate != "" {
+		problem("KeyRollover and NextCertificate are only used with NextKey")
+	}
+	required(config.Services.Authentication, "Services.Authentication")
+	required(config.Services.ArtifactResolution, "Services.ArtifactResolution")
+	required(config.Services.AttributeQuery, "Services.AttributeQuery")
+	required(config.Services.Metadata, "Services.Metadata")
+	if config.Authenticator == nil || config.Authenticator.Fallback == nil || config.Authenticator.Fallback.Form == nil {
+		problem("Authenticator.Fallback.Form is required")
+	} else {
+		form := config.Authenticator.Fallback.Form
+		file(form.Directory, "Authenticator.Fallback.Form.Directory")
+		required(form.Context, "Authenticator.Fallback.Form.Context")
+		required(form.Action, "Authenticator.Fallback.Form.Action")
+		if form.LDAP != nil {
+			required(form.LDAP.Filter, "Authenticator.Fallback.Form.LDAP.Filter")
+			if config.LDAP == nil {
+				problem("Authenticator.Fallback.Form.LDAP needs LDAP connection settings")
+			}
+		}
+	}
+	if config.AttributeProviders == nil {
+		problem("AttributeProviders is required")
+	}
+	validateProfile(config.Profile, "Profile", problem)
+	seen := make(map[string]bool)
+	for i, sp := range config.ServiceProviders {
+		if sp.EntityId == "" {
+			problem("ServiceProviders[%d].EntityId is required", i)
+		} else if seen[sp.EntityId] {
+			problem("ServiceProvider %s is configured more than once", sp.EntityId)
+		}
+		seen[sp.EntityId] = true
+		if sp.Profile != nil {
+			validateProfile(*sp.Profile, "Profile of "+sp.EntityId, problem)
+		}
+		if issuance := sp.JWT; issuance != nil {
+			switch issuance.WithDefaults().Delivery {
+			case JWTDeliveryForm:
+			case JWTDeliveryEndpoint:
+				if config.Services.JWT == "" {
+					problem("ServiceProvider %s fetches JWTs from Services.JWT, which isn't set", sp.EntityId)
+				}
+			default:
+				problem("ServiceProvider %s: JWT.Delivery must be %s or %s", sp.EntityId, JWTDeliveryForm,
+					JWTDeliveryEndpoint)
+			}
+		}
+		if provisioning := sp.Provisioning; provisioning != nil {
+			if target, err := url.Parse(provisioning.URL); err != nil || !target.IsAbs() || target.Host == "" {
+				problem("ServiceProvider %s: Provisioning.URL must be an absolute URL with a host", sp.EntityId)
+			}
+		}
+		if rp := sp.WSFederation; rp != nil {
+			if config.Services.WSFederation == "" {
+				problem("ServiceProvider %s is a WS-Federation relying party, which needs Services.WSFederation",
+					sp.EntityId)
+			}
+			if tokenType := rp.WithDefaults().TokenType; tokenType != WSFedSAML11Token && tokenType != WSFedSAML2Token {
+				problem("ServiceProvider %s: WSFederation.TokenType must be %s or %s", sp.EntityId,
+					WSFedSAML11Token, WSFedSAML2Token)
+			}
+		}
+		if service := sp.CAS; service != nil {
+			if config.CAS == nil {
+				problem("ServiceProvider %s is a CAS application, which needs CAS settings", sp.EntityId)
+			}
+			if len(service.Services) == 0 {
+				problem("ServiceProvider %s needs CAS.Services", sp.EntityId)
+			}
+			for _, prefix := range service.Services {
+				if target, err := url.Parse(prefix); err != nil || !target.IsAbs() || target.Host == "" {
+					problem("ServiceProvider %s: CAS service %q must be an absolute URL with a host", sp.EntityId,
+						prefix)
+				}
+			}
+		}
+		if client := sp.OIDC; client != nil {
+			if config.OIDC == nil {
+				problem("ServiceProvider %s is an OpenID Connect client, which needs OIDC settings", sp.EntityId)
+			}
+			for _, uri := range client.RedirectURIs {
+				if target, err := url.Parse(uri); err != nil || !target.IsAbs() || target.Fragment != "" {
+					problem("ServiceProvider %s: redirect URI %q must be an absolute URL without a fragment",
+						sp.EntityId, uri)
+				}
+			}
+		}
+	}
+	if config.Consent != nil {
+		required(config.Consent.Prompt, "Consent.Prompt")
+	}
+	if config.Debug != nil {
+		required(config.Debug.Path, "Debug.Path")
+		required(config.Debug.Token, "Debug.Token")
+	}
+	if config.Audit != nil {
+		if config.Audit.File == "" && config.Audit.Syslog == nil && config.Audit.HTTP == nil {
+			problem("Audit needs a File, Syslog or HTTP destination")
+		}
+		if config.Audit.Syslog != nil {
+			required(config.Audit.Syslog.Address, "Audit.Syslog.Address")
+		}
+		if config.Audit.HTTP != nil {
+			required(config.Audit.HTTP.URL, "Audit.HTTP.URL")
+		}
+		switch config.Audit.Overflow {
+		case "", OverflowBlock, OverflowDrop:
+		default:
+			problem("Audit.Overflow must be %s or %s", OverflowBlock, OverflowDrop)
+		}
+	}
+	for i, webhook := range config.Webhooks {
+		if target, err := url.Parse(webhook.URL); err != nil || !target.IsAbs() || target.Host == "" {
+			problem("Webhooks[%d].URL must be an absolute URL", i)
+		}
+		for _, event := range webhook.Events {
+			if !webhookEvents[event] {
+				problem("Webhooks[%d] lists unknown event %s", i, event)
+			}
+		}
+		if webhook.Timeout < 0 || webhook.Retries < 0 || webhook.Buffer < 0 {
+			problem("Webhooks[%d] can't have a negative Timeout, Retries or Buffer", i)
+		}
+	}
+	if streaming := config.Streaming; streaming != nil {
+		if (streaming.Kafka == nil) == (streaming.NATS == nil) {
+			problem("Streaming needs either Kafka or NATS")
+		}
+		if streaming.Kafka != nil {
+			if len(streaming.Kafka.Brokers) == 0 {
+				problem("Streaming.Kafka.Brokers is required")
+			}
+			required(streaming.Kafka.Topic, "Streaming.Kafka.Topic")
+		}
+		if streaming.NATS != nil {
+			required(streaming.NATS.URL, "Streaming.NATS.URL")
+			required(streaming.NATS.Subject, "Streaming.NATS.Subject")
+			if streaming.NATS.Credentials != "" {
+				file(streaming.NATS.Credentials, "Streaming.NATS.Credentials")
+			}
+		}
+		switch streaming.Format {
+		case "", StreamJSON, StreamAvro:
+		default:
+			problem("Streaming.Format must be %s or %s", StreamJSON, StreamAvro)
+		}
+		for _, event := range streaming.Events {
+			if !webhookEvents[event] {
+				problem("Streaming lists unknown event %s", event)
+			}
+		}
+		if streaming.Retries < 0 || streaming.Buffer < 0 {
+			problem("Streaming can't have negative Retries or Buffer")
+		}
+	}
+	if accessLog := config.AccessLog; accessLog != nil {
+		switch strings.ToLower(accessLog.Format) {
+		case "", "text", "json":
+		default:
+			problem("AccessLog.Format must be text or json")
+		}
+		if accessLog.SampleRate < 0 || accessLog.SampleRate > 1 {
+			problem("AccessLog.SampleRate must be between 0 and 1")
+		}
+	}
+	if telemetry := config.Telemetry; telemetry != nil {
+		if target, err := url.Parse(telemetry.Endpoint); err != nil || !target.IsAbs() {
+			problem("Telemetry.Endpoint must be an absolute URL such as https://collector.example.com:4318/v1/traces")
+		}
+		if telemetry.SampleRatio < 0 || telemetry.SampleRatio > 1 {
+			problem("Telemetry.SampleRatio must be between 0 and 1")
+		}
+	}
+	if limits := config.RateLimits; limits != nil {
+		if limits.MaxConcurrentLogins < 0 {
+			problem("RateLimits.MaxConcurrentLogins can't be negative")
+		}
+		paths := make(map[string]bool)
+		for i, limit := range limits.Endpoints {
+			if !strings.HasPrefix(limit.Path, "/") {
+				problem("RateLimits.Endpoints[%d].Path must be a path such as /SAML2/Redirect/SSO", i)
+			} else if paths[limit.Path] {
+				problem("RateLimits for %s are configured more than once", limit.Path)
+			}
+			paths[limit.Path] = true
+			if limit.Rate <= 0 || limit.Burst < 0 {
+				problem("RateLimits.Endpoints[%d] needs a positive Rate and a Burst that isn't negative", i)
+			}
+		}
+	}
+	names := make(map[string]bool)
+	for i, tenant := range config.Tenants {
+		if tenant.Name == "" {
+			problem("Tenants[%d].Name is required", i)
+		} else if names[tenant.Name] {
+			problem("Tenant %s is configured more than once", tenant.Name)
+		}
+		names[tenant.Name] = true
+		file(tenant.Config, fmt.Sprintf("Tenants[%d].Config", i))
+		if tenant.Host == "" && tenant.PathPrefix == "" {
+			problem("Tenants[%d] needs a Host or PathPrefix to route requests by", i)
+		}
+		if tenant.PathPrefix != "" && !strings.HasPrefix(tenant.PathPrefix, "/") {
+			problem("Tenants[%d].PathPrefix must start with /", i)
+		}
+	}
+	if config.Admin != nil {
+		required(config.Admin.Path, "Admin.Path")
+		required(config.Admin.Token, "Admin.Token")
+	}
+	if config.SCIM != nil {
+		required(config.SCIM.Token, "SCIM.Token")
+		required(config.SCIM.File, "SCIM.File")
+		authenticator := config.Authenticator
+		if authenticator == nil || authenticator.Fallback == nil || authenticator.Fallback.Form == nil ||
+			authenticator.Fallback.Form.Users == "" {
+			problem("SCIM provisions the login form's accounts, which needs Authenticator.Fallback.Form.Users")
+		}
+	}
+	if providers := config.AttributeProviders; providers != nil && providers.SCIM != nil && config.SCIM == nil {
+		problem("AttributeProviders.SCIM needs SCIM settings")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration in %s:\n  %s", config.file, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+func validateTLS(settings TLS, name string, problem func(string, ...interface{})) {
+	if _, found := TLSVersions[settings.MinVersion]; settings.MinVersion != "" && !found {
+		problem("%s.MinVersion must be 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	for _, suite := range settings.CipherSuites {
+		if _, found := CipherSuite(suite); !found {
+			problem("%s.CipherSuites: unknown or insecure suite %s", name, suite)
+		}
+	}
+	for _, curve := range settings.CurvePreferences {
+		if _, found := Curves[curve]; !found {
+			problem("%s.CurvePreferences: unknown curve %s", name, curve)
+		}
+	}
+	if settings.RequireClientCertificate && settings.ClientCA == "" {
+		problem("%s.RequireClientCertificate needs a ClientCA", name)
+	}
+	if acme := settings.ACME; acme != nil {
+		if len(acme.Domains) == 0 {
+			problem("%s.ACME.Domains is required", name)
+		}
+		if acme.Cache == "" {
+			problem("%s.ACME.Cache is required", name)
+		}
+		if !acme.AcceptTerms {
+			problem("%s.ACME.AcceptTerms must be set to agree to the CA's terms of service", name)
+		}
+		if settings.Certificate != "" {
+			problem("%s.Certificate can't be combined with ACME", name)
+		}
+	}
+}
+
+func validateProfile(profile Profile, name string, problem func(string, ...interface{})) {
+	switch profile.Sign {
+	case "", SignAssertion, SignResponse, SignBoth:
+	default:
+		problem("%s.Sign must be %s, %s or %s", name, SignAssertion, SignResponse, SignBoth)
+	}
+}
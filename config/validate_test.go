@@ -0,0 +1,30 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A next key is only used from the time of the rollover, so it can't be configured without one
+func TestNextKeyNeedsRollover(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	// Creates the signing key the next key is copied from
+	writeConfig(t, path, 0)
+	if _, err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	next := map[string]interface{}{"NextCertificate": filepath.Join(dir, defaultCertificate),
+		"NextKey": filepath.Join(dir, defaultKey)}
+	writeSettings(t, path, next)
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "KeyRollover") {
+		t.Errorf("loaded NextKey without KeyRollover: %v", err)
+	}
+	next["KeyRollover"] = time.Now().Add(time.Hour)
+	writeSettings(t, path, next)
+	if _, err := Load(path); err != nil {
+		t.Errorf("rejected NextKey with KeyRollover: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/vault"
+	"reflect"
+	"strings"
+)
+
+// A setting naming a secret in Vault
+type secretReference struct {
+	// Path of the setting, such as LDAP.BindPassword
+	setting string
+	value   string
+	set     func(string)
+}
+
+// Reports whether the signing key is kept outside the Key file, in a PKCS#11 token or in Vault
+func (config *Configuration) ExternalKey() bool {
+	return config.PKCS11 != nil || config.Vault != nil && (config.Vault.Key != "" || config.Vault.Transit != nil)
+}
+
+// Returns a client of the configured Vault server
+func (settings *Vault) NewClient() (*vault.Client, error) {
+	return vault.NewClient(settings.Address, settings.Token, settings.TokenFile, settings.Namespace,
+		settings.CACertificate)
+}
+
+// Replaces settings written as vault:path#field with the secrets they name. Each secret is read once.
+func (config *Configuration) resolveSecrets() error {
+	var references []*secretReference
+	collectReferences(reflect.ValueOf(config).Elem(), "", &references)
+	if len(references) == 0 {
+		return nil
+	}
+	if config.Vault == nil {
+		return errors.New(references[0].setting + " refers to Vault, which isn't configured")
+	}
+	client, err := config.Vault.NewClient()
+	if err != nil {
+		return err
+	}
+	secrets := make(map[string]map[string]interface{})
+	for _, reference := range references {
+		path, field, _ := vault.ParseReference(reference.value)
+		fields, read := secrets[path]
+		if !read {
+			if fields, err = client.Read(context.Background(), path); err != nil {
+				return fmt.Errorf("%s: %s", reference.setting, err)
+			}
+			secrets[path] = fields
+		}
+		value, ok := fields[field].(string)
+		if !ok {
+			return fmt.Errorf("%s: the secret at %s has no field %s", reference.setting, path, field)
+		}
+		reference.set(value)
+	}
+	return nil
+}
+
+// Finds the string settings holding references. The Vault section itself isn't searched, as it says how
+// to reach Vault.
+func collectReferences(value reflect.Value, setting string, references *[]*secretReference) {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !value.IsNil() {
+			collectReferences(value.Elem(), setting, references)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" || field.Tag.Get("json") == "-" || field.Type == reflect.TypeOf(&Vault{}) {
+				continue
+			}
+			collectReferences(value.Field(i), strings.TrimPrefix(setting+"."+field.Name, "."), references)
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			collectReferences(value.Index(i), fmt.Sprintf("%s[%d]", setting, i), references)
+		}
+	case reflect.Map:
+		// Map elements can't be set in place, so they're replaced
+		if value.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, key := range value.MapKeys() {
+			element := value.MapIndex(key).String()
+			if _, _, ok := vault.ParseReference(element); ok {
+				key := key
+				set := func(secret string) {
+					value.SetMapIndex(key, reflect.ValueOf(secret).Convert(value.Type().Elem()))
+				}
+				*references = append(*references, &secretReference{fmt.Sprintf("%s[%v]", setting, key), element, set})
+			}
+		}
+	case reflect.String:
+		if _, _, ok := vault.ParseReference(value.String()); ok && value.CanSet() {
+			*references = append(*references, &secretReference{setting, value.String(), value.SetString})
+		}
+	}
+}
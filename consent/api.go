@@ -0,0 +1,78 @@
+package consent
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/webhook"
+	"net/http"
+	"strings"
+)
+
+// Creates a handler letting signed in users manage their consent. Relative to the path it's mounted at:
+//
+//	GET grants                    lists current grants by SP
+//	GET history                   lists decisions, newest first
+//	DELETE grants?entityId=<SP>   revokes the grant, so the user is asked again at their next login
+func NewAPI(registry *Registry, store store.Storer, path string) http.Handler {
+	return http.StripPrefix(path, &api{registry, store})
+}
+
+type api struct {
+	registry *Registry
+	store    store.Storer
+}
+
+func (api *api) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	user := authentication.CurrentUser(request, api.store)
+	if user == nil {
+		http.Error(writer, "Unauthorized", 401)
+		return
+	}
+	var result interface{}
+	var err error
+	switch strings.Trim(request.URL.Path, "/") {
+	case "grants":
+		switch request.Method {
+		case "GET":
+			result, err = api.registry.Grants(user.Name)
+		case "DELETE":
+			entityId := request.URL.Query().Get("entityId")
+			revoked, revokeErr := api.registry.Revoke(user.Name, entityId)
+			if revokeErr == nil && !revoked {
+				http.Error(writer, "No consent given to "+entityId, 404)
+				return
+			}
+			if revokeErr == nil {
+				logging.FromRequest(request).Info("Revoked consent", "user", user.Name, "sp", entityId)
+				webhook.Notify(request, &webhook.Event{Type: config.EventConsentRevoked, User: user.Name,
+					ServiceProvider: entityId})
+				writer.WriteHeader(204)
+				return
+			}
+			err = revokeErr
+		default:
+			http.Error(writer, "Method Not Allowed", 405)
+			return
+		}
+	case "history":
+		if request.Method != "GET" {
+			http.Error(writer, "Method Not Allowed", 405)
+			return
+		}
+		result, err = api.registry.History(user.Name)
+	default:
+		http.NotFound(writer, request)
+		return
+	}
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to read consent", "user", user.Name, "err", err)
+		http.Error(writer, "Unable to read consent", 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(writer).Encode(result)
+}
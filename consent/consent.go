@@ -0,0 +1,217 @@
+// Package consent asks users before their attributes are released to an SP and keeps a history of their
+// decisions, which they can review and revoke
+package consent
+
+import (
+	"errors"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/satori/go.uuid"
+	"sort"
+	"time"
+)
+
+// Actions recorded in a user's history
+const (
+	Granted = "granted"
+	Denied  = "denied"
+	Revoked = "revoked"
+)
+
+// How long a user's decisions are kept after their last change
+const recordLifetime = 10 * 365 * 24 * 60 * 60
+
+// Oldest history entries are dropped beyond this
+const maxHistory = 500
+
+// Seconds a user's record stays locked if the instance changing it fails
+const lockLifetime = 30
+
+// How long a change waits for the record to be unlocked
+const lockWait = 5 * time.Second
+
+// A choice the user made about an SP
+type Decision struct {
+	ServiceProvider string
+	// Names of the attributes the user was asked about
+	Attributes []string
+	Action     string
+	Time       time.Time
+}
+
+// Standing permission to release attributes to an SP
+type Grant struct {
+	Attributes []string
+	Time       time.Time
+	Expires    time.Time
+}
+
+type record struct {
+	Grants  map[string]*Grant
+	History []Decision
+}
+
+// Keeps users' consent decisions in the store
+type Registry struct {
+	store store.Storer
+	// Days a grant lasts
+	lifetime int
+}
+
+func NewRegistry(store store.Storer, lifetime int) *Registry {
+	if lifetime <= 0 {
+		lifetime = 365
+	}
+	return &Registry{store, lifetime}
+}
+
+func key(user string) string {
+	return "consent:" + user
+}
+
+func (registry *Registry) load(user string) (*record, error) {
+	rec := &record{}
+	err := registry.store.Retrieve(key(user), rec)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	if rec.Grants == nil {
+		rec.Grants = make(map[string]*Grant)
+	}
+	return rec, nil
+}
+
+// Takes the lock on the user's record shared by every instance, returning the function releasing it. Decisions
+// made at the same time, such as logins to two SPs, would otherwise overwrite each other.
+func (registry *Registry) lock(user string) (func(), error) {
+	deadline := time.Now().Add(lockWait)
+	token := uuid.NewV4().String()
+	for {
+		acquired, err := registry.store.StoreIfAbsent(key(user)+":lock", token, lockLifetime)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			return func() {
+				registry.store.DeleteIfEqual(key(user)+":lock", token)
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("the user's consent is being changed elsewhere")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Changes the user's record under the lock. It's saved when change reports it changed.
+func (registry *Registry) update(user string, change func(*record) bool) error {
+	unlock, err := registry.lock(user)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	rec, err := registry.load(user)
+	if err != nil {
+		return err
+	}
+	if !change(rec) {
+		return nil
+	}
+	return registry.save(user, rec)
+}
+
+func (registry *Registry) save(user string, rec *record) error {
+	if len(rec.History) > maxHistory {
+		rec.History = rec.History[len(rec.History)-maxHistory:]
+	}
+	return registry.store.Store(key(user), rec, recordLifetime)
+}
+
+// Reports whether the user has an unexpired grant covering every one of the attributes
+func (registry *Registry) Covers(user, entityId string, attributes []string) (bool, error) {
+	rec, err := registry.load(user)
+	if err != nil {
+		return false, err
+	}
+	grant, found := rec.Grants[entityId]
+	if !found || time.Now().After(grant.Expires) {
+		return false, nil
+	}
+	allowed := make(map[string]bool, len(grant.Attributes))
+	for _, name := range grant.Attributes {
+		allowed[name] = true
+	}
+	for _, name := range attributes {
+		if !allowed[name] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Records the user's answer to the prompt. Granting replaces any earlier grant for the SP.
+func (registry *Registry) Decide(user, entityId string, attributes []string, granted bool) error {
+	return registry.update(user, func(rec *record) bool {
+		now := time.Now()
+		action := Denied
+		if granted {
+			action = Granted
+			rec.Grants[entityId] = &Grant{Attributes: attributes, Time: now,
+				Expires: now.AddDate(0, 0, registry.lifetime)}
+		}
+		rec.History = append(rec.History, Decision{entityId, attributes, action, now})
+		return true
+	})
+}
+
+// Withdraws the user's grant for the SP, so they're asked again at their next login. Returns false if
+// there was no grant.
+func (registry *Registry) Revoke(user, entityId string) (bool, error) {
+	found := false
+	err := registry.update(user, func(rec *record) bool {
+		var grant *Grant
+		if grant, found = rec.Grants[entityId]; found {
+			delete(rec.Grants, entityId)
+			rec.History = append(rec.History, Decision{entityId, grant.Attributes, Revoked, time.Now()})
+		}
+		return found
+	})
+	return found && err == nil, err
+}
+
+// Returns the user's current grants by SP entity ID
+func (registry *Registry) Grants(user string) (map[string]*Grant, error) {
+	rec, err := registry.load(user)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for entityId, grant := range rec.Grants {
+		if now.After(grant.Expires) {
+			delete(rec.Grants, entityId)
+		}
+	}
+	return rec.Grants, nil
+}
+
+// Returns the user's decisions, newest first
+func (registry *Registry) History(user string) ([]Decision, error) {
+	rec, err := registry.load(user)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]Decision, len(rec.History))
+	for i, decision := range rec.History {
+		history[len(history)-1-i] = decision
+	}
+	return history, nil
+}
+
+// Returns the sorted names of the attributes
+func Names(attributes map[string][]string) []string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,50 @@
+package consent
+
+import (
+	"fmt"
+	"github.com/amdonov/lite-idp/store"
+	"sync"
+	"testing"
+)
+
+// Decisions made at the same time, such as logins to several SPs, are all kept
+func TestDecideKeepsConcurrentDecisions(t *testing.T) {
+	registry := NewRegistry(store.NewMemory(), 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(sp string) {
+			defer wg.Done()
+			if err := registry.Decide("jdoe", sp, []string{"mail"}, true); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("https://sp%d.example.com", i))
+	}
+	wg.Wait()
+	grants, err := registry.Grants("jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := registry.History("jdoe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 10 || len(history) != 10 {
+		t.Errorf("kept %d grants and %d decisions of 10", len(grants), len(history))
+	}
+}
+
+func TestRevokeReportsMissingGrant(t *testing.T) {
+	registry := NewRegistry(store.NewMemory(), 0)
+	if err := registry.Decide("jdoe", "https://sp.example.com", []string{"mail"}, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []bool{true, false} {
+		if revoked, err := registry.Revoke("jdoe", "https://sp.example.com"); err != nil || revoked != expected {
+			t.Errorf("revoked %t: %v", revoked, err)
+		}
+	}
+	if covered, _ := registry.Covers("jdoe", "https://sp.example.com", []string{"mail"}); covered {
+		t.Error("revoked grant still covers the attributes")
+	}
+}
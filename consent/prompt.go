@@ -0,0 +1,160 @@
+package consent
+
+import (
+	_ "embed"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/webhook"
+	"github.com/satori/go.uuid"
+	"html/template"
+	"net/http"
+)
+
+// How long the user has to answer the prompt
+const pendingLifetime = 300
+
+// A login waiting on the user's decision
+type Pending struct {
+	AuthnRequest *protocol.AuthnRequest
+	RelayState   string
+	User         *protocol.AuthenticatedUser
+	// Every attribute retrieved for the user
+	Attributes map[string][]string
+	// The attributes that will be released to the SP, which the user is asked about
+	Released map[string][]string
+}
+
+// Resumes a login once the user has decided
+type ContinueFunc func(*Pending, http.ResponseWriter, *http.Request)
+
+// Asks users to approve the release of their attributes. Serves the prompt page at the configured path.
+type Prompter struct {
+	registry *Registry
+	store    store.Storer
+	config   *config.Configuration
+	approve  ContinueFunc
+	deny     ContinueFunc
+	template *template.Template
+	cookie   string
+}
+
+func NewPrompter(registry *Registry, store store.Storer, config *config.Configuration, approve,
+	deny ContinueFunc) *Prompter {
+	return &Prompter{registry, store, config, approve, deny, template.Must(template.New("consent").Parse(page)),
+		config.Sessions.WithDefaults().ConsentCookie}
+}
+
+// Reports whether the user must be asked before the login continues. They aren't asked when nothing is
+// released, the SP is exempt or they already agreed to release the same attributes.
+func (prompter *Prompter) Required(pending *Pending, request *http.Request) bool {
+	entityId := pending.AuthnRequest.Issuer
+	if sp := prompter.config.ServiceProvider(entityId); sp != nil && sp.SkipConsent {
+		return false
+	}
+	if len(pending.Released) == 0 {
+		return false
+	}
+	covered, err := prompter.registry.Covers(pending.User.Name, entityId, Names(pending.Released))
+	if err != nil {
+		// Asking again is safer than releasing without consent
+		logging.FromRequest(request).Error("Failed to read consent", "user", pending.User.Name, "err", err)
+	}
+	return !covered
+}
+
+// Saves the login and sends the user to the prompt page
+func (prompter *Prompter) Prompt(pending *Pending, writer http.ResponseWriter, request *http.Request) {
+	key := uuid.NewV4().String()
+	if err := prompter.store.Store("consent-pending:"+key, pending, pendingLifetime); err != nil {
+		logging.FromRequest(request).Error("Failed to save login awaiting consent", "err", err)
+		errorpage.Error(writer, request, "Unable to ask for consent", 500)
+		return
+	}
+	// Behind a proxy the prompt is reached under its prefix
+	prompt := prompter.config.EndpointPath(request, prompter.config.Consent.Prompt)
+	http.SetCookie(writer, &http.Cookie{Name: prompter.cookie, Value: key, Path: prompt, HttpOnly: true,
+		Secure: true})
+	http.Redirect(writer, request, prompt, http.StatusFound)
+}
+
+type promptPage struct {
+	State           string
+	ServiceProvider string
+	Attributes      []promptAttribute
+}
+
+type promptAttribute struct {
+	Name   string
+	Values []string
+}
+
+func (prompter *Prompter) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	cookie, err := request.Cookie(prompter.cookie)
+	if err != nil {
+		errorpage.Error(writer, request, "No login is awaiting consent", 400)
+		return
+	}
+	var pending Pending
+	if err := prompter.store.Retrieve("consent-pending:"+cookie.Value, &pending); err != nil ||
+		pending.AuthnRequest == nil {
+		errorpage.Error(writer, request, "The login has expired. Return to the site and try again.", 400)
+		return
+	}
+	errorpage.SetServiceProvider(request, pending.AuthnRequest.Issuer)
+	switch request.Method {
+	case "GET":
+		page := promptPage{State: cookie.Value, ServiceProvider: pending.AuthnRequest.Issuer}
+		for _, name := range Names(pending.Released) {
+			page.Attributes = append(page.Attributes, promptAttribute{name, pending.Released[name]})
+		}
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		prompter.template.Execute(writer, page)
+	case "POST":
+		// The form repeats the cookie so other sites can't submit a decision for the user
+		if request.PostFormValue("state") != cookie.Value {
+			errorpage.Error(writer, request, "Bad Request", 400)
+			return
+		}
+		// The decision is only good once, even when it's submitted twice at the same time
+		unused, err := prompter.store.StoreIfAbsent("consent-used:"+cookie.Value, true, pendingLifetime)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to record consent", "user", pending.User.Name, "err", err)
+			errorpage.Error(writer, request, "Unable to record consent", 500)
+			return
+		}
+		if !unused {
+			errorpage.Error(writer, request, "The login has expired. Return to the site and try again.", 400)
+			return
+		}
+		prompter.store.Delete("consent-pending:" + cookie.Value)
+		http.SetCookie(writer, &http.Cookie{Name: prompter.cookie, Value: "",
+			Path: prompter.config.EndpointPath(request, prompter.config.Consent.Prompt), MaxAge: -1, HttpOnly: true,
+			Secure: true})
+		granted := request.PostFormValue("decision") == "accept"
+		err = prompter.registry.Decide(pending.User.Name, pending.AuthnRequest.Issuer, Names(pending.Released),
+			granted)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to record consent", "user", pending.User.Name, "err", err)
+		}
+		event := &webhook.Event{Type: config.EventConsentDeclined, User: pending.User.Name,
+			ServiceProvider: pending.AuthnRequest.Issuer}
+		if granted {
+			event.Type = config.EventConsentGranted
+		}
+		webhook.Notify(request, event)
+		if granted {
+			prompter.approve(&pending, writer, request)
+		} else {
+			prompter.deny(&pending, writer, request)
+		}
+	default:
+		errorpage.Error(writer, request, "Method Not Allowed", 405)
+	}
+}
+
+//go:embed prompt.html
+var page string
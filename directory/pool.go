@@ -0,0 +1,106 @@
+// Package directory manages connections to an LDAP directory shared by the components that read from it
+package directory
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"gopkg.in/ldap.v2"
+	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+// Bound connections kept for reuse. Connections are bound as the service account, so callers that bind as
+// a user must close the connection rather than return it.
+type Pool struct {
+	config    *config.LDAP
+	tlsConfig *tls.Config
+	idle      chan *ldap.Conn
+}
+
+func NewPool(config *config.LDAP) (*Pool, error) {
+	size := config.PoolSize
+	if size <= 0 {
+		size = 4
+	}
+	target, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: target.Hostname()}
+	if config.CACertificate != "" {
+		data, err := ioutil.ReadFile(config.CACertificate)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + config.CACertificate)
+		}
+	}
+	return &Pool{config, tlsConfig, make(chan *ldap.Conn, size)}, nil
+}
+
+// Returns an idle connection or opens a new one
+func (pool *Pool) Get() (*ldap.Conn, error) {
+	select {
+	case conn := <-pool.idle:
+		return conn, nil
+	default:
+		return pool.dial()
+	}
+}
+
+// Returns a healthy connection to the pool. Connections that failed should be closed instead.
+func (pool *Pool) Put(conn *ldap.Conn) {
+	select {
+	case pool.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (pool *Pool) dial() (*ldap.Conn, error) {
+	target, err := url.Parse(pool.config.URL)
+	if err != nil {
+		return nil, err
+	}
+	var conn *ldap.Conn
+	switch target.Scheme {
+	case "ldaps":
+		conn, err = ldap.DialTLS("tcp", hostPort(target, "636"), pool.tlsConfig)
+	case "ldap":
+		conn, err = ldap.Dial("tcp", hostPort(target, "389"))
+		if err == nil && pool.config.StartTLS {
+			err = conn.StartTLS(pool.tlsConfig)
+		}
+	default:
+		err = errors.New("unsupported LDAP URL scheme " + target.Scheme)
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	if pool.config.Timeout > 0 {
+		conn.SetTimeout(time.Duration(pool.config.Timeout) * time.Second)
+	}
+	if pool.config.BindDN != "" {
+		err = conn.Bind(pool.config.BindDN, pool.config.BindPassword)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func hostPort(target *url.URL, defaultPort string) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	return target.Hostname() + ":" + defaultPort
+}
@@ -0,0 +1,79 @@
+package dsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"fmt"
+	"strings"
+)
+
+const (
+	ExclusiveC14N       = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	EnvelopedSignature  = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	RSASHA1             = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	RSASHA256           = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA384           = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha384"
+	RSASHA512           = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	ECDSASHA1           = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1"
+	ECDSASHA256         = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	ECDSASHA384         = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"
+	ECDSASHA512         = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+	SHA1                = "http://www.w3.org/2000/09/xmldsig#sha1"
+	SHA256              = "http://www.w3.org/2001/04/xmlenc#sha256"
+	SHA384              = "http://www.w3.org/2001/04/xmldsig-more#sha384"
+	SHA512              = "http://www.w3.org/2001/04/xmlenc#sha512"
+	DefaultSignatureAlg = RSASHA256
+	DefaultDigestAlg    = SHA256
+)
+
+var signatureHashes = map[string]crypto.Hash{
+	RSASHA1:     crypto.SHA1,
+	RSASHA256:   crypto.SHA256,
+	RSASHA384:   crypto.SHA384,
+	RSASHA512:   crypto.SHA512,
+	ECDSASHA1:   crypto.SHA1,
+	ECDSASHA256: crypto.SHA256,
+	ECDSASHA384: crypto.SHA384,
+	ECDSASHA512: crypto.SHA512,
+}
+
+var digestHashes = map[string]crypto.Hash{
+	SHA1:   crypto.SHA1,
+	SHA256: crypto.SHA256,
+	SHA384: crypto.SHA384,
+	SHA512: crypto.SHA512,
+}
+
+func signatureHash(algorithm string) (crypto.Hash, error) {
+	hash, found := signatureHashes[algorithm]
+	if !found {
+		return 0, fmt.Errorf("unsupported signature algorithm %s", algorithm)
+	}
+	return hash, nil
+}
+
+// Picks the default signature algorithm for the key, matching the hash strength to EC curves
+func defaultSignatureAlgorithm(key crypto.PublicKey) string {
+	if ecKey, ok := key.(*ecdsa.PublicKey); ok {
+		if ecKey.Curve.Params().BitSize > 256 {
+			return ECDSASHA384
+		}
+		return ECDSASHA256
+	}
+	return DefaultSignatureAlg
+}
+
+func isECDSA(algorithm string) bool {
+	return strings.Contains(algorithm, "#ecdsa-")
+}
+
+func digestHash(algorithm string) (crypto.Hash, error) {
+	hash, found := digestHashes[algorithm]
+	if !found {
+		return 0, fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+	return hash, nil
+}
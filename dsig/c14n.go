@@ -0,0 +1,305 @@
+package dsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Returns the exclusive canonical form, without comments, of the root element of the document. Prefixes
+// listed in inclusive are treated as in the InclusiveNamespaces PrefixList, with #default for the default namespace.
+func Canonicalize(data []byte, inclusive []string) ([]byte, error) {
+	canonical, _, err := canonicalizeElement(data, "", inclusive)
+	return canonical, err
+}
+
+// Canonicalizes the element with the given ID attribute, or the root if id is empty, in the context of
+// the namespaces declared by its ancestors. Also returns the offset where an enveloped signature
+// belongs: after the element's Issuer child if it has one, otherwise directly after its start tag.
+func canonicalizeElement(data []byte, id string, inclusive []string) ([]byte, int64, error) {
+	canonical, offset, err := canonicalizeMatching(data, func(c *canonicalizer, path []xml.StartElement) bool {
+		return hasID(path[len(path)-1], id)
+	}, inclusive, false)
+	if err == errNoMatch {
+		if id != "" {
+			return nil, 0, errors.New("no element found with ID " + id)
+		}
+		return nil, 0, errors.New("document has no root element")
+	}
+	return canonical, offset, err
+}
+
+var errNoMatch = errors.New("no matching element")
+
+// Canonicalizes the first element for which match returns true. Match is given the path from the root
+// to the element. When enveloped is set the element's first ds:Signature child is left out, as the
+// enveloped signature transform requires.
+func canonicalizeMatching(data []byte, match func(*canonicalizer, []xml.StartElement) bool, inclusive []string,
+	enveloped bool) ([]byte, int64, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var buffer bytes.Buffer
+	c := &canonicalizer{inclusive: make(map[string]bool)}
+	for _, prefix := range inclusive {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		c.inclusive[prefix] = true
+	}
+	var path []xml.StartElement
+	// depth is zero until the element is found
+	depth := 0
+	// depth within the enveloped signature being left out
+	skipping := 0
+	signatureSkipped := false
+	var offset int64
+	issuerChecked := false
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		// Comments, processing instructions and directives are not part of the canonical form
+		switch t := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				path = append(path, t)
+				c.push(t)
+				if !match(c, path) {
+					continue
+				}
+				c.pop()
+			}
+			if skipping > 0 {
+				skipping++
+				continue
+			}
+			if depth == 1 && enveloped && !signatureSkipped && c.is(t, dsigNamespace, "Signature") {
+				signatureSkipped = true
+				skipping = 1
+				continue
+			}
+			if depth == 1 && !issuerChecked {
+				issuerChecked = true
+				if t.Name.Local == "Issuer" {
+					offset = -1
+				}
+			}
+			c.start(&buffer, t)
+			depth++
+			if depth == 1 {
+				offset = decoder.InputOffset()
+			}
+		case xml.EndElement:
+			if depth == 0 {
+				c.pop()
+				path = path[:len(path)-1]
+				continue
+			}
+			if skipping > 0 {
+				skipping--
+				continue
+			}
+			c.end(&buffer, t)
+			depth--
+			if depth == 1 && offset == -1 {
+				offset = decoder.InputOffset()
+			}
+			if depth == 0 {
+				return buffer.Bytes(), offset, nil
+			}
+		case xml.CharData:
+			if depth > 0 && skipping == 0 {
+				escapeText(&buffer, string(t))
+			}
+		}
+	}
+	return nil, 0, errNoMatch
+}
+
+const dsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+func hasID(element xml.StartElement, id string) bool {
+	if id == "" {
+		return true
+	}
+	for _, attr := range element.Attr {
+		// SAML 1.1 uses ResponseID and AssertionID
+		if attr.Name.Space == "" && (attr.Name.Local == "ID" || attr.Name.Local == "ResponseID" ||
+			attr.Name.Local == "AssertionID") {
+			return attr.Value == id
+		}
+	}
+	return false
+}
+
+// Namespace declarations made on a single element in the source and in the output
+type namespaceFrame struct {
+	declared map[string]string
+	rendered map[string]string
+}
+
+type canonicalizer struct {
+	frames    []namespaceFrame
+	inclusive map[string]bool
+}
+
+// Reports whether the raw element has the namespace and local name, resolving its prefix with its own
+// declarations and those of its ancestors
+func (c *canonicalizer) is(element xml.StartElement, namespace, local string) bool {
+	if element.Name.Local != local {
+		return false
+	}
+	for _, attr := range element.Attr {
+		if (attr.Name.Space == "xmlns" && attr.Name.Local == element.Name.Space) ||
+			(element.Name.Space == "" && attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			return attr.Value == namespace
+		}
+	}
+	uri, _ := c.declared(element.Name.Space)
+	return uri == namespace
+}
+
+func (c *canonicalizer) declared(prefix string) (string, bool) {
+	for i := len(c.frames) - 1; i >= 0; i-- {
+		if uri, found := c.frames[i].declared[prefix]; found {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+func (c *canonicalizer) rendered(prefix string) (string, bool) {
+	for i := len(c.frames) - 1; i >= 0; i-- {
+		if uri, found := c.frames[i].rendered[prefix]; found {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+type canonicalAttr struct {
+	uri   string
+	name  string
+	value string
+}
+
+// Records the namespaces declared by an element and returns its remaining attributes
+func (c *canonicalizer) push(element xml.StartElement) (namespaceFrame, []xml.Attr) {
+	frame := namespaceFrame{make(map[string]string), make(map[string]string)}
+	var attrs []xml.Attr
+	for _, attr := range element.Attr {
+		switch {
+		case attr.Name.Space == "xmlns":
+			frame.declared[attr.Name.Local] = attr.Value
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			frame.declared[""] = attr.Value
+		default:
+			attrs = append(attrs, attr)
+		}
+	}
+	c.frames = append(c.frames, frame)
+	return frame, attrs
+}
+
+func (c *canonicalizer) pop() {
+	c.frames = c.frames[:len(c.frames)-1]
+}
+
+func (c *canonicalizer) start(buffer *bytes.Buffer, element xml.StartElement) {
+	frame, attrs := c.push(element)
+
+	// Only namespaces visibly used by the element or its attributes, and inclusive prefixes, are rendered
+	utilized := map[string]bool{element.Name.Space: true}
+	for prefix := range c.inclusive {
+		utilized[prefix] = true
+	}
+	for _, attr := range attrs {
+		if attr.Name.Space != "" && attr.Name.Space != "xml" {
+			utilized[attr.Name.Space] = true
+		}
+	}
+	var prefixes []string
+	for prefix := range utilized {
+		uri, found := c.declared(prefix)
+		if !found && prefix != "" {
+			continue
+		}
+		previous, _ := c.rendered(prefix)
+		if uri != previous {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+
+	buffer.WriteString("<")
+	buffer.WriteString(qualifiedName(element.Name))
+	for _, prefix := range prefixes {
+		uri, _ := c.declared(prefix)
+		frame.rendered[prefix] = uri
+		if prefix == "" {
+			buffer.WriteString(` xmlns="`)
+		} else {
+			buffer.WriteString(` xmlns:` + prefix + `="`)
+		}
+		escapeAttr(buffer, uri)
+		buffer.WriteString(`"`)
+	}
+	// Attributes are sorted by namespace URI and then local name
+	sorted := make([]canonicalAttr, 0, len(attrs))
+	for _, attr := range attrs {
+		uri := ""
+		if attr.Name.Space == "xml" {
+			uri = "http://www.w3.org/XML/1998/namespace"
+		} else if attr.Name.Space != "" {
+			uri, _ = c.declared(attr.Name.Space)
+		}
+		sorted = append(sorted, canonicalAttr{uri, qualifiedName(attr.Name), attr.Value})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].uri != sorted[j].uri {
+			return sorted[i].uri < sorted[j].uri
+		}
+		return localName(sorted[i].name) < localName(sorted[j].name)
+	})
+	for _, attr := range sorted {
+		buffer.WriteString(" " + attr.name + `="`)
+		escapeAttr(buffer, attr.value)
+		buffer.WriteString(`"`)
+	}
+	buffer.WriteString(">")
+}
+
+func (c *canonicalizer) end(buffer *bytes.Buffer, element xml.EndElement) {
+	buffer.WriteString("</" + qualifiedName(element.Name) + ">")
+	c.pop()
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+func localName(name string) string {
+	return name[strings.Index(name, ":")+1:]
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;",
+	"\r", "&#xD;")
+
+func escapeText(buffer *bytes.Buffer, text string) {
+	textEscaper.WriteString(buffer, text)
+}
+
+func escapeAttr(buffer *bytes.Buffer, value string) {
+	attrEscaper.WriteString(buffer, value)
+}
@@ -0,0 +1,79 @@
+package dsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Signers that also issue JSON Web Tokens, such as OpenID Connect ID tokens
+type TokenSigner interface {
+	// Signs the JSON encoded claims with the active key, returning a JWS in compact serialization whose
+	// header names the key with KeyID
+	SignJWT(claims []byte) (string, error)
+}
+
+// Returns the JWS algorithm used with the key and its hash. RSA keys use RS256 and ECDSA keys the
+// algorithm matching their curve.
+func JWSAlgorithm(key crypto.PublicKey) (string, crypto.Hash, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256", crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().BitSize {
+		case 256:
+			return "ES256", crypto.SHA256, nil
+		case 384:
+			return "ES384", crypto.SHA384, nil
+		case 521:
+			return "ES512", crypto.SHA512, nil
+		}
+	}
+	return "", 0, errors.New("no JWS algorithm for the key")
+}
+
+// Returns the key ID of the certificate's key, the base64url encoded SHA-256 thumbprint of the certificate
+func KeyID(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (s *signer) SignJWT(claims []byte) (string, error) {
+	algorithm, hash, err := JWSAlgorithm(s.key.Public())
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(map[string]string{"alg": algorithm, "typ": "JWT", "kid": KeyID(s.certificate)})
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := hash.New()
+	digest.Write([]byte(input))
+	value, err := s.key.Sign(rand.Reader, digest.Sum(nil), hash)
+	if err != nil {
+		return "", err
+	}
+	// JWS uses the same raw r and s values as XML Signature
+	if ecKey, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		value, err = ecdsaSignatureValue(value, ecKey)
+		if err != nil {
+			return "", err
+		}
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(value), nil
+}
+
+func (s *rolloverSigner) SignJWT(claims []byte) (string, error) {
+	tokens, ok := s.active().(TokenSigner)
+	if !ok {
+		return "", errors.New("the active key can't sign tokens")
+	}
+	return tokens.SignJWT(claims)
+}
@@ -0,0 +1,36 @@
+package dsig
+
+import (
+	"crypto"
+	"expvar"
+	"io"
+	"time"
+)
+
+// Signing statistics published at /debug/vars, keyed by the name given to NewTimedKey
+var signingStats = expvar.NewMap("signing")
+
+// Wraps a key to record the number, failures and latency of signing operations under name
+func NewTimedKey(key crypto.Signer, name string) crypto.Signer {
+	return &timedKey{key, name}
+}
+
+type timedKey struct {
+	crypto.Signer
+	name string
+}
+
+func (key *timedKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	start := time.Now()
+	signature, err := key.Signer.Sign(rand, digest, opts)
+	elapsed := time.Since(start).Nanoseconds()
+	signingStats.Add(key.name+".count", 1)
+	signingStats.Add(key.name+".nanoseconds", elapsed)
+	last := new(expvar.Int)
+	last.Set(elapsed)
+	signingStats.Set(key.name+".lastNanoseconds", last)
+	if err != nil {
+		signingStats.Add(key.name+".errors", 1)
+	}
+	return signature, err
+}
@@ -0,0 +1,56 @@
+package dsig
+
+import (
+	"crypto/x509"
+	"time"
+)
+
+// Creates a signer that uses current until the rollover time and next afterwards, so a new key can be
+// published in metadata ahead of being used
+func NewRolloverSigner(current, next Signer, rollover time.Time) Signer {
+	return &rolloverSigner{current, next, rollover}
+}
+
+type rolloverSigner struct {
+	current  Signer
+	next     Signer
+	rollover time.Time
+}
+
+func (s *rolloverSigner) active() Signer {
+	if time.Now().Before(s.rollover) {
+		return s.current
+	}
+	return s.next
+}
+
+func (s *rolloverSigner) SignElement(doc []byte, id string) ([]byte, error) {
+	return s.active().SignElement(doc, id)
+}
+
+func (s *rolloverSigner) WithOptions(options Options) (Signer, error) {
+	current, err := s.current.WithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	next, err := s.next.WithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+	return &rolloverSigner{current, next, s.rollover}, nil
+}
+
+func (s *rolloverSigner) Options() Options {
+	return s.active().Options()
+}
+
+// Returns the certificates of both keys, so the next one is published ahead of the rollover
+func (s *rolloverSigner) Certificates() []*x509.Certificate {
+	var certificates []*x509.Certificate
+	for _, signer := range []Signer{s.current, s.next} {
+		if keys, ok := signer.(KeySet); ok {
+			certificates = append(certificates, keys.Certificates()...)
+		}
+	}
+	return certificates
+}
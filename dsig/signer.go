@@ -0,0 +1,237 @@
+package dsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Algorithms used when signing. Empty values select defaults suited to the key.
+type Options struct {
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+	// Prefixes canonicalized with inclusive semantics, for SPs that re-serialize signed content
+	InclusiveNamespaces []string
+}
+
+type Signer interface {
+	// Adds an enveloped signature to the element with the given ID, or the root element when id is empty.
+	// The signature is inserted after the element's Issuer or as its first child. The document should
+	// already be in its final form, such as the output of xmlutil.Marshal.
+	SignElement(doc []byte, id string) ([]byte, error)
+	// Returns a signer using the same key with different algorithms
+	WithOptions(Options) (Signer, error)
+	// The algorithms in use
+	Options() Options
+}
+
+// Creates a signer from PEM encoded key and certificate. Use NewSignerFromKey for keys held elsewhere,
+// such as in an HSM.
+func NewSigner(key io.Reader, cert io.Reader, options Options) (Signer, error) {
+	keyData, err := ioutil.ReadAll(key)
+	if err != nil {
+		return nil, err
+	}
+	certData, err := ioutil.ReadAll(cert)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := ParseCertificate(certData)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignerFromKey(privateKey, certificate, options)
+}
+
+func NewSignerFromKey(key crypto.Signer, cert *x509.Certificate, options Options) (Signer, error) {
+	s := &signer{key: key, certificate: cert, cert: base64.StdEncoding.EncodeToString(cert.Raw),
+		variants: &sync.Map{}}
+	s.ecKey, _ = key.Public().(*ecdsa.PublicKey)
+	return s.WithOptions(options)
+}
+
+// Parses the first PEM encoded certificate
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Parses the first PEM encoded RSA or EC private key
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		block, rest := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM encoded private key found")
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				return key, nil
+			case *ecdsa.PrivateKey:
+				return key, nil
+			}
+			return nil, errors.New("unsupported PKCS #8 private key")
+		}
+		// Skip other blocks such as EC PARAMETERS
+		data = rest
+	}
+}
+
+type signer struct {
+	key         crypto.Signer
+	certificate *x509.Certificate
+	// Base64 encoded for KeyInfo
+	cert string
+	// Set for ECDSA keys, whose signatures need converting
+	ecKey      *ecdsa.PublicKey
+	options    Options
+	sigHash    crypto.Hash
+	digestHash crypto.Hash
+	// Signers using the same key with other options, shared by them all so each combination is only
+	// checked once. Responses ask for the SP's options every time they're signed.
+	variants *sync.Map
+}
+
+func (s *signer) WithOptions(options Options) (Signer, error) {
+	key := options.SignatureAlgorithm + " " + options.DigestAlgorithm + " " +
+		strings.Join(options.InclusiveNamespaces, " ")
+	if variant, found := s.variants.Load(key); found {
+		return variant.(*signer), nil
+	}
+	if options.SignatureAlgorithm == "" {
+		options.SignatureAlgorithm = defaultSignatureAlgorithm(s.key.Public())
+	}
+	if options.DigestAlgorithm == "" {
+		options.DigestAlgorithm = DefaultDigestAlg
+	}
+	sigHash, err := signatureHash(options.SignatureAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if (s.ecKey != nil) != isECDSA(options.SignatureAlgorithm) {
+		return nil, errors.New("signature algorithm " + options.SignatureAlgorithm + " doesn't match the key type")
+	}
+	digestHash, err := digestHash(options.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	variant, _ := s.variants.LoadOrStore(key, &signer{s.key, s.certificate, s.cert, s.ecKey, options, sigHash,
+		digestHash, s.variants})
+	return variant.(*signer), nil
+}
+
+func (s *signer) Options() Options {
+	return s.options
+}
+
+func (s *signer) Certificates() []*x509.Certificate {
+	return []*x509.Certificate{s.certificate}
+}
+
+func (s *signer) SignElement(doc []byte, id string) ([]byte, error) {
+	canonical, offset, err := canonicalizeElement(doc, id, s.options.InclusiveNamespaces)
+	if err != nil {
+		return nil, err
+	}
+	uri := ""
+	if id != "" {
+		uri = "#" + id
+	}
+	signature, err := s.sign(canonical, uri)
+	if err != nil {
+		return nil, err
+	}
+	sigData, err := xmlutil.Marshal(signature)
+	if err != nil {
+		return nil, err
+	}
+	signed := make([]byte, 0, len(doc)+len(sigData))
+	signed = append(signed, doc[:offset]...)
+	signed = append(signed, sigData...)
+	return append(signed, doc[offset:]...), nil
+}
+
+func (s *signer) sign(canonical []byte, uri string) (*Signature, error) {
+	digest := s.digestHash.New()
+	digest.Write(canonical)
+	signature := &Signature{}
+	info := &signature.SignedInfo
+	info.CanonicalizationMethod.Algorithm = ExclusiveC14N
+	info.SignatureMethod.Algorithm = s.options.SignatureAlgorithm
+	info.Reference.URI = uri
+	c14n := Method{Algorithm: ExclusiveC14N}
+	if len(s.options.InclusiveNamespaces) > 0 {
+		c14n.InclusiveNamespaces = &InclusiveNamespaces{PrefixList: strings.Join(s.options.InclusiveNamespaces, " ")}
+	}
+	info.Reference.Transforms.Transform = []Method{{Algorithm: EnvelopedSignature}, c14n}
+	info.Reference.DigestMethod.Algorithm = s.options.DigestAlgorithm
+	info.Reference.DigestValue = base64.StdEncoding.EncodeToString(digest.Sum(nil))
+
+	infoData, err := xmlutil.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	canonicalInfo, err := Canonicalize(infoData, nil)
+	if err != nil {
+		return nil, err
+	}
+	hash := s.sigHash.New()
+	hash.Write(canonicalInfo)
+	value, err := s.key.Sign(rand.Reader, hash.Sum(nil), s.sigHash)
+	if err != nil {
+		return nil, err
+	}
+	if s.ecKey != nil {
+		value, err = ecdsaSignatureValue(value, s.ecKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	signature.SignatureValue = base64.StdEncoding.EncodeToString(value)
+	signature.KeyInfo = &KeyInfo{X509Data: X509Data{X509Certificate: s.cert}}
+	return signature, nil
+}
+
+// XML Signature expects the raw r and s values rather than the ASN.1 structure returned by crypto.Signer
+func ecdsaSignatureValue(der []byte, key *ecdsa.PublicKey) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	_, err := asn1.Unmarshal(der, &sig)
+	if err != nil {
+		return nil, err
+	}
+	size := (key.Curve.Params().BitSize + 7) / 8
+	value := make([]byte, 2*size)
+	sig.R.FillBytes(value[:size])
+	sig.S.FillBytes(value[size:])
+	return value, nil
+}
@@ -0,0 +1,32 @@
+package dsig
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Signs a typical response's assertion with one signer shared by every goroutine, as logins share it. Signing
+// dominates the cost of issuing an assertion, so this bounds login throughput. Run it with -cpu to see how it
+// scales and -benchmem for the allocations each signature takes.
+func BenchmarkSignElement(b *testing.B) {
+	key, cert, err := GenerateSelfSigned("bench", nil, 2048, time.Hour)
+	if err != nil {
+		b.Fatal(err)
+	}
+	signer, err := NewSigner(bytes.NewReader(key), bytes.NewReader(cert), Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	doc := []byte(testResponse)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := signer.SignElement(doc, "_a1"); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,16 @@
+#!/bin/sh
+# Signs assertion.xml with libxml2's exclusive canonicalization and openssl rather than the dsig package, so
+# the package's verification is checked against an independent implementation. Run from this directory.
+set -e
+work=$(mktemp -d)
+trap 'rm -rf "$work"' EXIT
+openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj /CN=libxml2 -keyout "$work/key.pem" \
+	-out libxml2.crt 2>/dev/null
+digest=$(xmllint --exc-c14n assertion.xml | openssl dgst -sha256 -binary | base64)
+signedinfo='<ds:SignedInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/><ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/><ds:Reference URI="#_a1"><ds:Transforms><ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/><ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/></ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/><ds:DigestValue>'$digest'</ds:DigestValue></ds:Reference></ds:SignedInfo>'
+echo "$signedinfo" > "$work/signedinfo.xml"
+value=$(xmllint --exc-c14n "$work/signedinfo.xml" | openssl dgst -sha256 -sign "$work/key.pem" | base64 | tr -d '\n')
+signature='<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">'$(echo "$signedinfo" |
+	sed 's/ xmlns:ds="[^"]*"//')'<ds:SignatureValue>'$value'</ds:SignatureValue></ds:Signature>'
+# The signature goes after the Issuer
+sed "s|</saml:Issuer>|</saml:Issuer>$signature|" assertion.xml > libxml2-signed.xml
@@ -0,0 +1,50 @@
+package dsig
+
+import "encoding/xml"
+
+type Signature struct {
+	XMLName        xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	SignedInfo     SignedInfo
+	SignatureValue string `xml:"http://www.w3.org/2000/09/xmldsig# SignatureValue"`
+	KeyInfo        *KeyInfo
+}
+
+type SignedInfo struct {
+	XMLName                xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# SignedInfo"`
+	CanonicalizationMethod Method   `xml:"http://www.w3.org/2000/09/xmldsig# CanonicalizationMethod"`
+	SignatureMethod        Method   `xml:"http://www.w3.org/2000/09/xmldsig# SignatureMethod"`
+	Reference              Reference
+}
+
+type Method struct {
+	Algorithm           string `xml:",attr"`
+	InclusiveNamespaces *InclusiveNamespaces
+}
+
+type InclusiveNamespaces struct {
+	XMLName    xml.Name `xml:"http://www.w3.org/2001/10/xml-exc-c14n# InclusiveNamespaces"`
+	PrefixList string   `xml:",attr"`
+}
+
+type Reference struct {
+	XMLName      xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Reference"`
+	URI          string   `xml:",attr"`
+	Transforms   Transforms
+	DigestMethod Method `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod"`
+	DigestValue  string `xml:"http://www.w3.org/2000/09/xmldsig# DigestValue"`
+}
+
+type Transforms struct {
+	XMLName   xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Transforms"`
+	Transform []Method `xml:"http://www.w3.org/2000/09/xmldsig# Transform"`
+}
+
+type KeyInfo struct {
+	XMLName  xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	X509Data X509Data
+}
+
+type X509Data struct {
+	XMLName         xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# X509Data"`
+	X509Certificate string   `xml:"http://www.w3.org/2000/09/xmldsig# X509Certificate"`
+}
@@ -0,0 +1,169 @@
+package dsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+)
+
+// Verifies the enveloped signature of the element with the given ID against the certificate. Only
+// exclusive canonicalization with the enveloped signature transform is accepted, and the ID must be
+// unique within the document. Returns the canonical form of the verified element without its signature, which
+// callers should decode what they go on to read from. Decoding the whole document instead lets encoding/xml
+// merge an unsigned element into the signed one.
+func Verify(doc []byte, id string, cert *x509.Certificate) ([]byte, error) {
+	count, err := countID(doc, id)
+	if err != nil {
+		return nil, err
+	}
+	if count != 1 {
+		return nil, errors.New("ID " + id + " must appear exactly once")
+	}
+	// The Signature and its SignedInfo must be children of the signed element
+	sigData, _, err := canonicalizeMatching(doc, func(c *canonicalizer, path []xml.StartElement) bool {
+		n := len(path)
+		return n > 1 && c.is(path[n-1], dsigNamespace, "Signature") && hasID(path[n-2], id)
+	}, nil, false)
+	if err == errNoMatch {
+		return nil, errors.New("element " + id + " is not signed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var signature Signature
+	err = xml.Unmarshal(sigData, &signature)
+	if err != nil {
+		return nil, err
+	}
+	info := signature.SignedInfo
+	if info.Reference.URI != "#"+id {
+		return nil, errors.New("signature does not reference " + id)
+	}
+	if info.CanonicalizationMethod.Algorithm != ExclusiveC14N {
+		return nil, errors.New("unsupported canonicalization " + info.CanonicalizationMethod.Algorithm)
+	}
+	var inclusive []string
+	for _, transform := range info.Reference.Transforms.Transform {
+		switch transform.Algorithm {
+		case EnvelopedSignature:
+		case ExclusiveC14N:
+			inclusive = prefixList(transform.InclusiveNamespaces)
+		default:
+			return nil, errors.New("unsupported transform " + transform.Algorithm)
+		}
+	}
+
+	// Check the digest of the element
+	canonical, _, err := canonicalizeMatching(doc, func(c *canonicalizer, path []xml.StartElement) bool {
+		return hasID(path[len(path)-1], id)
+	}, inclusive, true)
+	if err != nil {
+		return nil, err
+	}
+	digestHash, err := digestHash(info.Reference.DigestMethod.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(info.Reference.DigestValue))
+	if err != nil {
+		return nil, err
+	}
+	digest := digestHash.New()
+	digest.Write(canonical)
+	if !bytes.Equal(digest.Sum(nil), expected) {
+		return nil, errors.New("digest of " + id + " does not match")
+	}
+
+	// Check the signature over SignedInfo
+	canonicalInfo, _, err := canonicalizeMatching(doc, func(c *canonicalizer, path []xml.StartElement) bool {
+		n := len(path)
+		return n > 2 && c.is(path[n-1], dsigNamespace, "SignedInfo") &&
+			c.is(path[n-2], dsigNamespace, "Signature") && hasID(path[n-3], id)
+	}, prefixList(info.CanonicalizationMethod.InclusiveNamespaces), false)
+	if err != nil {
+		return nil, err
+	}
+	sigHash, err := signatureHash(info.SignatureMethod.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	value, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signature.SignatureValue), ""))
+	if err != nil {
+		return nil, err
+	}
+	hash := sigHash.New()
+	hash.Write(canonicalInfo)
+	err = verifySignature(cert.PublicKey, info.SignatureMethod.Algorithm, sigHash, hash.Sum(nil), value)
+	if err != nil {
+		return nil, err
+	}
+	return canonical, nil
+}
+
+func verifySignature(key crypto.PublicKey, algorithm string, hash crypto.Hash, hashed, value []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if isECDSA(algorithm) {
+			break
+		}
+		return rsa.VerifyPKCS1v15(key, hash, hashed, value)
+	case *ecdsa.PublicKey:
+		if !isECDSA(algorithm) {
+			break
+		}
+		size := len(value) / 2
+		r := new(big.Int).SetBytes(value[:size])
+		s := new(big.Int).SetBytes(value[size:])
+		if !ecdsa.Verify(key, hashed, r, s) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+	default:
+		return errors.New("unsupported public key type")
+	}
+	return errors.New("signature algorithm " + algorithm + " doesn't match the key type")
+}
+
+func prefixList(inclusive *InclusiveNamespaces) []string {
+	if inclusive == nil {
+		return nil
+	}
+	return strings.Fields(inclusive.PrefixList)
+}
+
+// Counts the elements carrying the ID, so signature wrapping can't introduce a second element
+func countID(doc []byte, id string) (int, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(doc))
+	count := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if start, ok := token.(xml.StartElement); ok && id != "" && hasID(start, id) {
+			count++
+		}
+	}
+}
+
+// Verifies a signature over raw data, such as the query string of a redirect binding message
+func VerifyBytes(data []byte, algorithm string, value []byte, cert *x509.Certificate) error {
+	sigHash, err := signatureHash(algorithm)
+	if err != nil {
+		return err
+	}
+	hash := sigHash.New()
+	hash.Write(data)
+	return verifySignature(cert.PublicKey, algorithm, sigHash, hash.Sum(nil), value)
+}
@@ -0,0 +1,299 @@
+package dsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const assertionID = "urn:oasis:names:tc:SAML:2.0:assertion:Assertion"
+
+// A response whose assertion declares namespaces in the places canonicalization has to get right: in use
+// on the assertion, declared above it, only referred to in an attribute value, and not used at all
+const testResponse = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ` +
+	`xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:unused="urn:unused" ID="_r1" Version="2.0" ` +
+	`IssueInstant="2026-01-01T00:00:00Z"><saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` +
+	`https://idp.example.com/idp</saml:Issuer><saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ` +
+	`xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" Version="2.0" ID="_a1" ` +
+	`IssueInstant="2026-01-01T00:00:00Z"><saml:Issuer>https://idp.example.com/idp</saml:Issuer>` +
+	`<saml:Subject><saml:NameID>jdoe &amp; &lt;co&gt;</saml:NameID></saml:Subject><saml:AttributeStatement>` +
+	`<saml:Attribute Name="mail"><saml:AttributeValue xsi:type="xs:string">jdoe@example.com</saml:AttributeValue>` +
+	`</saml:Attribute></saml:AttributeStatement></saml:Assertion></samlp:Response>`
+
+// Signs the assertion of testResponse with a new key, returning the signed document and the PEM encoded key
+// and certificate
+func signTestResponse(t *testing.T, options Options) ([]byte, []byte, []byte) {
+	return signTestDocument(t, options, []byte(testResponse))
+}
+
+func signTestDocument(t *testing.T, options Options, doc []byte) ([]byte, []byte, []byte) {
+	key, cert, err := GenerateSelfSigned("test", nil, 2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(bytes.NewReader(key), bytes.NewReader(cert), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := signer.SignElement(doc, "_a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed, key, cert
+}
+
+// Cuts the signed assertion out of the response as an SP keeping it would, declaring the namespaces in scope
+// above it on itself and moving xsi down to the element using it. Exclusive canonicalization is meant to give
+// the same result either way.
+func reserialize(t *testing.T, signed []byte) []byte {
+	doc := string(signed)
+	start := strings.Index(doc, "<saml:Assertion ")
+	end := strings.Index(doc, "</saml:Assertion>")
+	if start < 0 || end < 0 {
+		t.Fatal("no assertion in the signed document")
+	}
+	assertion := doc[start : end+len("</saml:Assertion>")]
+	xsi := ` xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance"`
+	assertion = strings.Replace(assertion, xsi,
+		` xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:unused="urn:unused"`, 1)
+	return []byte(strings.Replace(assertion, "<saml:AttributeValue ", "<saml:AttributeValue"+xsi+" ", 1))
+}
+
+// Returns testResponse with prefixes other than those xmlutil uses, rewritten by xmlutil.Normalize as
+// documents are before they're signed
+func normalizedResponse(t *testing.T) []byte {
+	prefixed := strings.NewReplacer("samlp:", "p:", "saml:", "a:", "xmlns:samlp=", "xmlns:p=",
+		"xmlns:saml=", "xmlns:a=").Replace(testResponse)
+	normalized, err := xmlutil.Normalize([]byte(prefixed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(normalized, []byte("<saml:Assertion ")) {
+		t.Fatalf("prefixes weren't normalized: %s", normalized)
+	}
+	return normalized
+}
+
+// Returns the path of the tool, skipping the test when it isn't installed
+func tool(t *testing.T, name string) string {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skip(name + " is not installed")
+	}
+	return path
+}
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+var signingOptions = map[string]Options{
+	"defaults":            {},
+	"inclusive xs":        {InclusiveNamespaces: []string{"xs"}},
+	"rsa-sha512":          {SignatureAlgorithm: RSASHA512, DigestAlgorithm: SHA512},
+	"inclusive #default":  {InclusiveNamespaces: []string{"#default", "xs"}},
+	"inclusive unused xs": {InclusiveNamespaces: []string{"unused", "xs"}},
+}
+
+func TestVerifySignedElement(t *testing.T) {
+	for name, options := range signingOptions {
+		t.Run(name, func(t *testing.T) {
+			signed, _, cert := signTestResponse(t, options)
+			parsed, err := ParseCertificate(cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(signed, "_a1", parsed); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(reserialize(t, signed), "_a1", parsed); err != nil {
+				t.Fatalf("re-serialized: %s", err)
+			}
+			normalized, _, cert := signTestDocument(t, options, normalizedResponse(t))
+			if parsed, err = ParseCertificate(cert); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(normalized, "_a1", parsed); err != nil {
+				t.Fatalf("normalized: %s", err)
+			}
+		})
+	}
+}
+
+// The verified element is returned without its signature, and decodes on its own
+func TestVerifyReturnsSignedElement(t *testing.T) {
+	signed, _, cert := signTestResponse(t, Options{})
+	parsed, err := ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	element, err := Verify(signed, "_a1", parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var assertion struct {
+		XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+		ID        string   `xml:",attr"`
+		Signature *Signature
+		NameID    string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject>NameID"`
+	}
+	if err := xml.Unmarshal(element, &assertion); err != nil {
+		t.Fatal(err)
+	}
+	if assertion.ID != "_a1" || assertion.Signature != nil || assertion.NameID != "jdoe & <co>" {
+		t.Errorf("unexpected element %s", element)
+	}
+}
+
+func TestVerifyRejectsAlteredElement(t *testing.T) {
+	signed, _, cert := signTestResponse(t, Options{})
+	parsed, err := ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	altered := bytes.Replace(signed, []byte("jdoe &amp;"), []byte("root &amp;"), 1)
+	if _, err := Verify(altered, "_a1", parsed); err == nil {
+		t.Fatal("altered assertion verified")
+	}
+}
+
+// testdata/libxml2-signed.xml was signed by sign-libxml2.sh with libxml2's canonicalization and openssl
+func TestVerifyLibxml2Signature(t *testing.T) {
+	signed, err := ioutil.ReadFile("testdata/libxml2-signed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("testdata/libxml2.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ParseCertificate(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(signed, "_a1", cert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Documents canonicalized by both this package and xmllint, which shares xmlsec1's canonicalization
+var canonicalizationDocuments = map[string]string{
+	"response": testResponse,
+	"assertion": `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" b="2" a="1" ` +
+		`xmlns:xs="http://www.w3.org/2001/XMLSchema" ID="_a1"><saml:Issuer>a&amp;b</saml:Issuer><saml:Empty/>` +
+		`</saml:Assertion>`,
+	"escaping": `<root attr="x&quot;y&#9;z&#13;&#10;&lt;&amp;&gt;">text &lt;&gt; &amp; "quoted" &#13;</root>`,
+	"default namespace": `<root xmlns="urn:one"><child xmlns="urn:two"><leaf xmlns=""/></child>` +
+		`<other xmlns="urn:one" xml:lang="en"/></root>`,
+	"prefixed attributes": `<a:root xmlns:a="urn:a" xmlns:b="urn:b" xmlns:c="urn:c" c:z="1" b:y="2" x="3">` +
+		`<a:child xmlns:a="urn:a"/></a:root>`,
+}
+
+func TestCanonicalizationMatchesXmllint(t *testing.T) {
+	xmllint := tool(t, "xmllint")
+	for name, doc := range canonicalizationDocuments {
+		t.Run(name, func(t *testing.T) {
+			expected, err := exec.Command(xmllint, "--exc-c14n", writeFile(t, "doc.xml", []byte(doc))).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			canonical, _, err := canonicalizeMatching([]byte(doc), func(c *canonicalizer,
+				path []xml.StartElement) bool {
+				return len(path) == 1
+			}, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(canonical, expected) {
+				t.Errorf("canonicalized as\n%s\nrather than\n%s", canonical, expected)
+			}
+		})
+	}
+}
+
+// Signatures made here verify with xmlsec1, as they're kept by the SP, re-serialized and after prefix
+// normalization
+func TestXMLSecVerifiesSignature(t *testing.T) {
+	xmlsec := tool(t, "xmlsec1")
+	for name, options := range signingOptions {
+		t.Run(name, func(t *testing.T) {
+			signed, _, cert := signTestResponse(t, options)
+			normalized, _, normalizedCert := signTestDocument(t, options, normalizedResponse(t))
+			documents := map[string][]byte{"signed": signed, "re-serialized": reserialize(t, signed)}
+			for kind, doc := range documents {
+				verifyWithXMLSec(t, xmlsec, kind, doc, cert)
+			}
+			verifyWithXMLSec(t, xmlsec, "normalized", normalized, normalizedCert)
+		})
+	}
+}
+
+func verifyWithXMLSec(t *testing.T, xmlsec, kind string, doc, cert []byte) {
+	output, err := exec.Command(xmlsec, "--verify", "--pubkey-cert-pem", writeFile(t, "cert.pem", cert),
+		"--id-attr:ID", assertionID, writeFile(t, "signed.xml", doc)).CombinedOutput()
+	if err != nil {
+		t.Errorf("%s: %s\n%s", kind, err, output)
+	}
+}
+
+// A signature template filled in by xmlsec1, which canonicalizes with the listed inclusive prefixes
+const xmlsecTemplate = `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo>` +
+	`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>` +
+	`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>` +
+	`<ds:Reference URI="#_a1"><ds:Transforms>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>` +
+	`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#">%s</ds:Transform></ds:Transforms>` +
+	`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/><ds:DigestValue/></ds:Reference>` +
+	`</ds:SignedInfo><ds:SignatureValue/></ds:Signature>`
+
+// Signatures made by xmlsec1 verify here, as sent and re-serialized
+func TestVerifyXMLSecSignature(t *testing.T) {
+	xmlsec := tool(t, "xmlsec1")
+	transforms := map[string]string{
+		"defaults": "",
+		"inclusive xs": `<ec:InclusiveNamespaces xmlns:ec="http://www.w3.org/2001/10/xml-exc-c14n#" ` +
+			`PrefixList="xs"/>`,
+	}
+	for name, transform := range transforms {
+		t.Run(name, func(t *testing.T) {
+			key, cert, err := GenerateSelfSigned("xmlsec1", nil, 2048, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signature := strings.Replace(xmlsecTemplate, "%s", transform, 1)
+			template := strings.Replace(testResponse, "https://idp.example.com/idp</saml:Issuer><saml:Subject>",
+				"https://idp.example.com/idp</saml:Issuer>"+signature+"<saml:Subject>", 1)
+			output := filepath.Join(t.TempDir(), "signed.xml")
+			result, err := exec.Command(xmlsec, "--sign", "--privkey-pem",
+				writeFile(t, "key.pem", key)+","+writeFile(t, "cert.pem", cert), "--id-attr:ID", assertionID,
+				"--output", output, writeFile(t, "template.xml", []byte(template))).CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s\n%s", err, result)
+			}
+			signed, err := ioutil.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := ParseCertificate(cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(signed, "_a1", parsed); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Verify(reserialize(t, signed), "_a1", parsed); err != nil {
+				t.Fatalf("re-serialized: %s", err)
+			}
+		})
+	}
+}
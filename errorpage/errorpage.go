@@ -0,0 +1,134 @@
+// Package errorpage shows users a page explaining why the IdP couldn't handle their request, with help
+// for the SP they came from and the correlation ID support staff can find the request's messages by
+package errorpage
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+)
+
+// What an error page is rendered with
+type Page struct {
+	Status int
+	// Status text, such as Bad Request
+	Title   string
+	Message string
+	// Correlation ID of the request
+	RequestID string
+	// Entity ID of the SP the request came from, when known
+	ServiceProvider string
+	// The SP's ErrorHelp, or else the deployment's
+	Help string
+}
+
+// Renders the error pages of one IdP
+type Pages struct {
+	config   *config.Configuration
+	template atomic.Pointer[template.Template]
+}
+
+// Loads the configured template, or the built-in one. It's loaded again when the configuration reloads.
+func New(config *config.Configuration) (*Pages, error) {
+	pages := &Pages{config: config}
+	if err := pages.reload(); err != nil {
+		return nil, err
+	}
+	config.OnReload(pages.reload)
+	return pages, nil
+}
+
+// Parses the template again, keeping the one already parsed if it can't be
+func (pages *Pages) reload() error {
+	tmpl, err := parse(pages.config)
+	if err != nil {
+		return err
+	}
+	pages.template.Store(tmpl)
+	return nil
+}
+
+func parse(config *config.Configuration) (*template.Template, error) {
+	text := defaultPage
+	if config.ErrorPages.Template != "" {
+		data, err := ioutil.ReadFile(config.ErrorPages.Template)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	return template.New("error").Parse(text)
+}
+
+// Returns the template pages are rendered with, read again when templates reload
+func (pages *Pages) current() (*template.Template, error) {
+	if !pages.config.ReloadTemplates {
+		return pages.template.Load(), nil
+	}
+	return parse(pages.config)
+}
+
+// What handlers learn about a request while handling it
+type state struct {
+	pages           *Pages
+	serviceProvider string
+}
+
+type contextKey struct{}
+
+// Wraps the handler so its errors are shown with these pages
+func (pages *Pages) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), contextKey{}, &state{pages: pages})
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Notes the SP the request came from, so its help is shown should the request fail
+func SetServiceProvider(request *http.Request, entityID string) {
+	if state, ok := request.Context().Value(contextKey{}).(*state); ok {
+		state.serviceProvider = entityID
+	}
+}
+
+// Replies with an error page. Like http.Error, the handler shouldn't write anything more. Outside
+// Handler, or when the page can't be rendered, a plain text error is sent.
+func Error(writer http.ResponseWriter, request *http.Request, message string, status int) {
+	state, ok := request.Context().Value(contextKey{}).(*state)
+	if !ok {
+		http.Error(writer, message, status)
+		return
+	}
+	page := Page{Status: status, Title: http.StatusText(status), Message: message,
+		RequestID: writer.Header().Get(logging.RequestIDHeader), ServiceProvider: state.serviceProvider,
+		Help: state.pages.config.ErrorPages.Help}
+	if sp := state.pages.config.ServiceProvider(state.serviceProvider); sp != nil && sp.ErrorHelp != "" {
+		page.Help = sp.ErrorHelp
+	}
+	var body bytes.Buffer
+	tmpl, err := state.pages.current()
+	if err == nil {
+		err = tmpl.Execute(&body, page)
+	}
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to render error page", "err", err)
+		http.Error(writer, message, status)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	writer.Write(body.Bytes())
+}
+
+// The page shown unless ErrorPages.Template replaces it
+//
+//go:embed error.html
+var defaultPage string
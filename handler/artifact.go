@@ -2,35 +2,68 @@ package handler
 
 import (
 	"encoding/xml"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/protocol"
 	"github.com/amdonov/lite-idp/saml"
 	"github.com/amdonov/lite-idp/store"
-	"github.com/amdonov/xmlsig"
+	"github.com/amdonov/lite-idp/xmlutil"
 	"net/http"
 	"time"
 )
 
-func NewArtifactHandler(store store.Storer, signer xmlsig.Signer, entityId string) http.Handler {
-	return &artifactHandler{store, signer, entityId}
+func NewArtifactHandler(store store.Storer, signer dsig.Signer, replay protocol.ReplayDetector,
+	config *config.Configuration) http.Handler {
+	return &artifactHandler{store, signer, replay, config}
 }
 
 type artifactHandler struct {
-	store    store.Storer
-	signer   xmlsig.Signer
-	entityId string
+	store  store.Storer
+	signer dsig.Signer
+	replay protocol.ReplayDetector
+	config *config.Configuration
 }
 
 func (handler *artifactHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	identity, err := clientIdentity(handler.config, request)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
 	decoder := xml.NewDecoder(request.Body)
 	var resolveEnv protocol.ArtifactResolveEnvelope
-	err := decoder.Decode(&resolveEnv)
+	err = decoder.Decode(&resolveEnv)
 	// TODO confirm appropriate error response for this service
 	if err != nil {
 		http.Error(writer, err.Error(), 500)
 		return
 	}
 	// TODO validate resolveEnv before proceeding
-	artifact := resolveEnv.Body.ArtifactResolve.Artifact
+	resolve := resolveEnv.Body.ArtifactResolve
+	accesslog.SetServiceProvider(request, resolve.Issuer)
+	err = checkClientIdentity(identity, resolve.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	err = protocol.ValidateIssueInstant(resolve.IssueInstant, handler.config.ClockSkewFor(resolve.Issuer))
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = protocol.ValidateDestination(resolve.Destination,
+		handler.config.EndpointURL(request, handler.config.Services.ArtifactResolution), false)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = handler.replay.ConsumeRequest(resolve.Issuer, resolve.ID)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	artifact := resolve.Artifact
 	var response protocol.Response
 	err = handler.store.Retrieve(artifact, &response)
 	// TODO confirm appropriate error response for this service
@@ -45,21 +78,28 @@ func (handler *artifactHandler) ServeHTTP(writer http.ResponseWriter, request *h
 	artResponse.IssueInstant = now
 	artResponse.InResponseTo = resolveEnv.Body.ArtifactResolve.ID
 	artResponse.Version = "2.0"
-	artResponse.Issuer = saml.NewIssuer(handler.entityId)
+	artResponse.Issuer = saml.NewIssuer(handler.config.EntityId)
 	artResponse.Status = protocol.NewStatus(true)
-	artResponse.Response = response
+	protected, err := protocol.ProtectResponse(handler.signer, handler.config, resolve.Issuer, &response)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	artResponse.Response = *protected
 
-	signature, err := handler.signer.Sign(response.Assertion)
+	data, err := xmlutil.Marshal(artResponseEnv)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	data, err = protocol.SignResponse(handler.signer, handler.config, resolve.Issuer, data, protected)
 	// TODO confirm appropriate error response for this service
 	if err != nil {
 		http.Error(writer, err.Error(), 500)
 		return
 	}
-	response.Assertion.Signature = signature
 	// TODO handle these errors. Probably can't do anything besides log, as we've already started to write the
 	// response.
 	_, err = writer.Write([]byte(xml.Header))
-	encoder := xml.NewEncoder(writer)
-	err = encoder.Encode(artResponseEnv)
-	err = encoder.Flush()
+	_, err = writer.Write(data)
 }
@@ -1,27 +1,95 @@
 package handler
 
 import (
+	"github.com/amdonov/lite-idp/accesslog"
 	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/errorpage"
 	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/ratelimit"
+	"github.com/amdonov/lite-idp/telemetry"
+	"go.opentelemetry.io/otel/attribute"
 	"net/http"
 )
 
-func NewAuthenticationHandler(requestParser protocol.RequestParser, authenticator authentication.Authenticator) http.Handler {
-	return &authHandler{requestParser, authenticator}
+func NewAuthenticationHandler(requestParser protocol.RequestParser, authenticator authentication.Authenticator,
+	fail authentication.ErrorFunc, replay protocol.ReplayDetector, logins ratelimit.Concurrency,
+	config *config.Configuration) http.Handler {
+	return &authHandler{requestParser, authenticator, fail, replay, logins, config}
 }
 
 type authHandler struct {
 	requestParser protocol.RequestParser
 	authenticator authentication.Authenticator
+	fail          authentication.ErrorFunc
+	replay        protocol.ReplayDetector
+	logins        ratelimit.Concurrency
+	config        *config.Configuration
 }
 
 func (handler *authHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	// Parse and validate the request
+	_, span := telemetry.Start(request.Context(), "saml.parse_request")
 	authRequest, relayState, err := handler.requestParser.Parse(request)
+	telemetry.End(span, err)
+	if authRequest != nil {
+		accesslog.SetServiceProvider(request, authRequest.Issuer)
+		errorpage.SetServiceProvider(request, authRequest.Issuer)
+	}
+	if err != nil {
+		if authRequest == nil {
+			errorpage.Error(writer, request, err.Error(), 500)
+			return
+		}
+		handler.reject(authRequest, relayState, err, writer, request)
+		return
+	}
+	// When too many logins are in progress the SP hears the IdP is busy rather than the user waiting
+	if !handler.logins.Acquire() {
+		handler.reject(authRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, "",
+			"too many logins in progress"), writer, request)
+		return
+	}
+	defer handler.logins.Release()
+	// Each request may only be used once
+	err = handler.replay.ConsumeRequest(authRequest.Issuer, authRequest.ID)
+	if err != nil {
+		handler.reject(authRequest, relayState,
+			protocol.NewStatusError(protocol.StatusRequester, protocol.StatusRequestDenied, err.Error()),
+			writer, request)
+		return
+	}
+	// Only send the response to an endpoint registered for the SP
+	acs, err := protocol.ResolveACSWithBindings(handler.config.ServiceProvider(authRequest.Issuer), authRequest,
+		handler.config.ProfileFor(authRequest.Issuer).AllowedBindings(protocol.ResponseBindings))
+	if err != nil {
+		handler.reject(authRequest, relayState, err, writer, request)
+		return
+	}
+	authRequest.AssertionConsumerServiceURL = acs.Location
+	authRequest.ProtocolBinding = acs.Binding
+	err = protocol.ValidateNameIDPolicy(handler.config, authRequest)
 	if err != nil {
-		http.Error(writer, err.Error(), 500)
+		handler.reject(authRequest, relayState, err, writer, request)
 		return
 	}
 
+	request, span = telemetry.StartRequest(request, "authenticate",
+		attribute.String("saml.issuer", authRequest.Issuer))
+	defer span.End()
 	handler.authenticator.Authenticate(authRequest, relayState, writer, request)
 }
+
+// Reports the error to the SP's default endpoint. An unknown SP has no endpoint the response can safely
+// be sent to, so it gets an HTTP error instead.
+func (handler *authHandler) reject(authRequest *protocol.AuthnRequest, relayState string, err error,
+	writer http.ResponseWriter, request *http.Request) {
+	acs, acsErr := protocol.DefaultACS(handler.config.ServiceProvider(authRequest.Issuer))
+	if acsErr != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	authRequest.AssertionConsumerServiceURL = acs.Location
+	authRequest.ProtocolBinding = acs.Binding
+	handler.fail(authRequest, relayState, err, writer, request)
+}
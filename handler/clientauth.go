@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"net/http"
+)
+
+// Identifies the SP calling a back-channel service by its TLS client certificate. Returns an empty
+// entity ID when client certificates aren't required.
+func clientIdentity(config *config.Configuration, request *http.Request) (string, error) {
+	if !config.Current().RequireClientCertificates {
+		return "", nil
+	}
+	return identifyClient(config, request)
+}
+
+// Returns the entity ID of the SP the TLS client certificate belongs to
+func identifyClient(config *config.Configuration, request *http.Request) (string, error) {
+	if request.TLS == nil || len(request.TLS.PeerCertificates) == 0 {
+		return "", errors.New("a client certificate is required")
+	}
+	sp := config.ServiceProviderByCertificate(request.TLS.PeerCertificates[0].Raw)
+	if sp == nil {
+		return "", errors.New("client certificate is not registered for any service provider")
+	}
+	return sp.EntityId, nil
+}
+
+// Confirms the message was sent by the SP the client certificate belongs to
+func checkClientIdentity(identity, issuer string) error {
+	if identity != "" && identity != issuer {
+		return fmt.Errorf("client certificate belongs to %s, not %s", identity, issuer)
+	}
+	return nil
+}
+
+// Returns the base64 encoded TLS client certificate. identifyClient must have succeeded.
+func clientCertificate(request *http.Request) string {
+	return base64.StdEncoding.EncodeToString(request.TLS.PeerCertificates[0].Raw)
+}
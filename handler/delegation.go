@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/attributes"
+	"github.com/amdonov/lite-idp/audit"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	delegationNamespace = "urn:oasis:names:tc:SAML:2.0:conditions:delegation"
+	holderOfKey         = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+	entityFormat        = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
+	// Limits the size of delegation requests read into memory
+	maxDelegationRequest = 1 << 20
+)
+
+// Creates a handler that exchanges an assertion issued to an SP for one addressed to a backend SP, so the
+// first SP can call the backend on the user's behalf. Callers authenticate with their TLS client certificate
+// and may only obtain assertions for the targets listed in their delegation policy.
+func NewDelegationHandler(signer dsig.Signer, retriever attributes.Retriever, replay protocol.ReplayDetector,
+	audit *audit.Log, config *config.Configuration) (http.Handler, error) {
+	var certificates []*x509.Certificate
+	for _, file := range []string{config.Certificate, config.NextCertificate} {
+		if file == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := dsig.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, cert)
+	}
+	return &delegationHandler{signer, retriever, replay, audit, config, certificates}, nil
+}
+
+type delegationHandler struct {
+	signer       dsig.Signer
+	retriever    attributes.Retriever
+	replay       protocol.ReplayDetector
+	audit        *audit.Log
+	config       *config.Configuration
+	certificates []*x509.Certificate
+}
+
+func (handler *delegationHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// Delegation always requires a client certificate, as the caller acts for the user
+	identity, err := identifyClient(handler.config, request)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(request.Body, maxDelegationRequest))
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	var env protocol.DelegationRequestEnvelope
+	err = xml.Unmarshal(data, &env)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	authnRequest := &env.Body.AuthnRequest
+	accesslog.SetServiceProvider(request, authnRequest.Issuer)
+	err = checkClientIdentity(identity, authnRequest.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	skew := handler.config.ClockSkewFor(authnRequest.Issuer)
+	err = protocol.ValidateIssueInstant(authnRequest.IssueInstant, skew)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = handler.replay.ConsumeRequest(authnRequest.Issuer, authnRequest.ID)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	response := handler.delegate(data, authnRequest, &env.Header.Security.Assertion, request)
+	signer, err := protocol.SignerFor(handler.signer, handler.config, authnRequest.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	out, err := xmlutil.Marshal(protocol.ResponseEnvelope{Body: protocol.ResponseBody{Response: *response}})
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	out, err = signer.SignElement(out, response.SignedID())
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	// TODO handle these errors. Probably can't do anything besides log, as we've already started to write the
+	// response.
+	_, err = writer.Write([]byte(xml.Header))
+	_, err = writer.Write(out)
+}
+
+// Builds the response to a delegation request, reporting failures as SAML status codes
+func (handler *delegationHandler) delegate(data []byte, authnRequest *protocol.AuthnRequest, token *saml.Assertion,
+	request *http.Request) *protocol.Response {
+	response := &protocol.Response{}
+	response.Version = "2.0"
+	response.ID = protocol.NewID()
+	now := time.Now()
+	response.IssueInstant = now
+	response.InResponseTo = authnRequest.ID
+	response.Issuer = saml.NewIssuer(handler.config.EntityId)
+	assertion, err := handler.exchange(data, authnRequest, token, request, now)
+	if err != nil {
+		response.Status = protocol.NewErrorStatus(err)
+		return response
+	}
+	// The target was checked when the assertion was issued
+	target := authnRequest.Conditions.AudienceRestriction.Audience[0]
+	err = handler.replay.RecordAssertion(target, assertion.ID, authnRequest.ID)
+	if err != nil {
+		response.Status = protocol.NewErrorStatus(protocol.NewStatusError(protocol.StatusResponder, "", err.Error()))
+		return response
+	}
+	err = handler.audit.Record(audit.NewEntry(audit.ViaDelegation, token.Subject.NameID.Value, target, nil,
+		assertion))
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to audit assertion", "err", err)
+		response.Status = protocol.NewErrorStatus(protocol.NewStatusError(protocol.StatusResponder, "",
+			"unable to issue assertion"))
+		return response
+	}
+	response.Status = protocol.NewStatus(true)
+	response.Assertion = assertion
+	return response
+}
+
+func (handler *delegationHandler) exchange(data []byte, authnRequest *protocol.AuthnRequest, token *saml.Assertion,
+	request *http.Request, now time.Time) (*saml.Assertion, error) {
+	requester := authnRequest.Issuer
+	sp := handler.config.ServiceProvider(requester)
+	if authnRequest.Conditions == nil || authnRequest.Conditions.AudienceRestriction == nil ||
+		len(authnRequest.Conditions.AudienceRestriction.Audience) != 1 {
+		return nil, protocol.NewStatusError(protocol.StatusRequester, "",
+			"the request must name exactly one target audience")
+	}
+	target := authnRequest.Conditions.AudienceRestriction.Audience[0]
+	if sp == nil || !sp.MayDelegateTo(target) || handler.config.ServiceProvider(target) == nil {
+		return nil, protocol.NewStatusError(protocol.StatusRequester, protocol.StatusRequestDenied,
+			requester+" may not obtain assertions for "+target)
+	}
+	err := handler.checkToken(data, token, requester, now)
+	if err != nil {
+		return nil, protocol.NewStatusError(protocol.StatusRequester, protocol.StatusRequestDenied, err.Error())
+	}
+	user := &protocol.AuthenticatedUser{Name: token.Subject.NameID.Value, Format: token.Subject.NameID.Format}
+	atts, err := handler.retriever.Retrieve(request.Context(), user)
+	if err != nil {
+		return nil, protocol.NewStatusError(protocol.StatusResponder, "", err.Error())
+	}
+	skew := handler.config.ClockSkewFor(target)
+	notBefore, lifetime, _ := handler.config.ValidityFor(target)
+	a := &saml.Assertion{}
+	a.ID = protocol.NewID()
+	a.Version = "2.0"
+	a.IssueInstant = now
+	a.Issuer = saml.NewIssuer(handler.config.EntityId)
+	nameId := *token.Subject.NameID
+	nameId.NameQualifier, nameId.SPNameQualifier = handler.config.NameQualifiersFor(target)
+	// The backend confirms the subject by the requester's certificate
+	confirmation := &saml.SubjectConfirmation{Method: holderOfKey}
+	confirmation.SubjectConfirmationData = &saml.SubjectConfirmationData{
+		Type:         xmlutil.Prefixes["urn:oasis:names:tc:SAML:2.0:assertion"] + ":KeyInfoConfirmationDataType",
+		NotOnOrAfter: now.Add(lifetime + skew),
+		KeyInfo:      &dsig.KeyInfo{X509Data: dsig.X509Data{X509Certificate: clientCertificate(request)}},
+	}
+	a.Subject = &saml.Subject{NameID: &nameId, SubjectConfirmation: confirmation}
+	a.Conditions = protocol.NewConditions(handler.config, target, now.Add(-notBefore-skew), now.Add(lifetime+skew))
+	// Extend any existing chain with the requester
+	delegation := &saml.DelegationRestriction{
+		Type: xmlutil.Prefixes[delegationNamespace] + ":DelegationRestrictionType"}
+	if token.Conditions.Delegation != nil {
+		delegation.Delegate = append(delegation.Delegate, token.Conditions.Delegation.Delegate...)
+	}
+	delegation.Delegate = append(delegation.Delegate, saml.Delegate{DelegationInstant: now,
+		ConfirmationMethod: holderOfKey, NameID: &saml.NameID{Format: entityFormat, Value: requester}})
+	a.Conditions.Delegation = delegation
+	// Carry over how and when the user originally authenticated
+	a.AuthnStatement = token.AuthnStatement
+	a.AttributeStatement, err = protocol.NewAttributeStatement(handler.config, target, user, atts)
+	if err != nil {
+		return nil, protocol.NewStatusError(protocol.StatusResponder, "", err.Error())
+	}
+	return a, nil
+}
+
+// Checks the presented assertion was issued by this IdP to the requester and is still valid. The token is
+// replaced with the signed element, so nothing unsigned is read from it afterwards.
+func (handler *delegationHandler) checkToken(data []byte, token *saml.Assertion, requester string, now time.Time) error {
+	// A second assertion beside the signed one would be merged into it when decoding
+	count, err := xmlutil.Count(data, saml.Namespace, "Assertion")
+	if err != nil {
+		return err
+	}
+	if count != 1 || token.ID == "" {
+		return errors.New("exactly one assertion is required")
+	}
+	err = errors.New("the assertion isn't signed by this identity provider")
+	certificates := handler.certificates
+	// Rotated keys that signed recently are still trusted
+	if keys, rotating := handler.signer.(dsig.KeySet); rotating {
+		certificates = keys.Certificates()
+	}
+	var signed []byte
+	for _, cert := range certificates {
+		if signed, err = dsig.Verify(data, token.ID, cert); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	*token = saml.Assertion{}
+	if err := xml.Unmarshal(signed, token); err != nil {
+		return err
+	}
+	if token.Subject == nil || token.Subject.NameID == nil || token.Conditions == nil ||
+		token.Conditions.AudienceRestriction == nil {
+		return errors.New("an assertion is required")
+	}
+	if token.Issuer == nil || token.Issuer.Value != handler.config.EntityId {
+		return errors.New("the assertion wasn't issued by this identity provider")
+	}
+	skew := handler.config.ClockSkewFor(requester)
+	conditions := token.Conditions
+	if now.Add(skew).Before(conditions.NotBefore) || !now.Add(-skew).Before(conditions.NotOnOrAfter) {
+		return errors.New("the assertion has expired")
+	}
+	var self, issuedTo bool
+	for _, audience := range conditions.AudienceRestriction.Audience {
+		self = self || audience == handler.config.EntityId
+		issuedTo = issuedTo || audience == requester
+	}
+	if !self || !issuedTo {
+		return errors.New("the assertion wasn't issued to " + requester + " for delegation")
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdP       = "https://idp.example.com/idp"
+	testRequester = "https://portal.example.com/sp"
+)
+
+// Returns a delegation request carrying an assertion for the user signed by a freshly generated key, and a
+// handler trusting that key
+func delegationRequest(t *testing.T, name string) (*delegationHandler, []byte) {
+	key, cert, err := dsig.GenerateSelfSigned("idp", nil, 2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dsig.NewSigner(bytes.NewReader(key), bytes.NewReader(cert), dsig.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := dsig.ParseCertificate(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	env := protocol.DelegationRequestEnvelope{}
+	token := &env.Header.Security.Assertion
+	token.ID = "_a1"
+	token.Version = "2.0"
+	token.IssueInstant = now
+	token.Issuer = saml.NewIssuer(testIdP)
+	token.Subject = &saml.Subject{NameID: &saml.NameID{Value: name}}
+	token.Conditions = &saml.Conditions{NotBefore: now.Add(-time.Minute), NotOnOrAfter: now.Add(time.Hour),
+		AudienceRestriction: &saml.AudienceRestriction{Audience: []string{testRequester, testIdP}}}
+	data, err := xmlutil.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = signer.SignElement(data, token.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &delegationHandler{signer: signer, config: &config.Configuration{EntityId: testIdP},
+		certificates: []*x509.Certificate{certificate}}, data
+}
+
+func checkDelegationToken(handler *delegationHandler, data []byte) (*saml.Assertion, error) {
+	var env protocol.DelegationRequestEnvelope
+	if err := xml.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	token := &env.Header.Security.Assertion
+	return token, handler.checkToken(data, token, testRequester, time.Now())
+}
+
+func TestDelegationAcceptsSignedToken(t *testing.T) {
+	handler, data := delegationRequest(t, "jdoe")
+	token, err := checkDelegationToken(handler, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := token.Subject.NameID.Value; name != "jdoe" {
+		t.Errorf("delegating for %s rather than jdoe", name)
+	}
+}
+
+// An unsigned assertion without an ID after the signed one is merged into it by encoding/xml, so it must
+// not be able to replace the signed subject
+func TestDelegationRejectsWrappedToken(t *testing.T) {
+	handler, data := delegationRequest(t, "jdoe")
+	end := strings.Index(string(data), "</saml:Assertion>") + len("</saml:Assertion>")
+	forged := `<saml:Assertion><saml:Subject><saml:NameID>victim</saml:NameID></saml:Subject></saml:Assertion>`
+	wrapped := string(data[:end]) + forged + string(data[end:])
+	token, err := checkDelegationToken(handler, []byte(wrapped))
+	if err == nil {
+		t.Fatalf("wrapped token accepted for %s", token.Subject.NameID.Value)
+	}
+}
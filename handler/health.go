@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/store"
+	"net/http"
+)
+
+// Paths of the probes
+const (
+	HealthPath    = "/healthz"
+	ReadinessPath = "/readyz"
+)
+
+// Result of a probe. Checks are only present for readiness.
+type health struct {
+	Status string
+	Checks map[string]check `json:",omitempty"`
+}
+
+type check struct {
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// Creates a handler reporting that the process is up and serving requests
+func NewHealthHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writeHealth(writer, health{Status: "ok"})
+	})
+}
+
+// Creates a handler reporting whether the IdP can handle logins: the store answers, the signing key signs
+// and every SP's metadata was parsed. Replies 503 when a check fails.
+func NewReadinessHandler(store store.Storer, signer dsig.Signer, config *config.Configuration) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		result := health{Status: "ok", Checks: map[string]check{
+			"store":    checkStore(store),
+			"signer":   checkSigner(signer),
+			"metadata": checkMetadata(config),
+		}}
+		for _, check := range result.Checks {
+			if check.Status != "ok" {
+				result.Status = "unavailable"
+			}
+		}
+		writeHealth(writer, result)
+	})
+}
+
+func checkStore(shared store.Storer) check {
+	var value interface{}
+	// A missing key still shows the store answered
+	if err := shared.Retrieve("readiness-probe", &value); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return failed(err.Error())
+	}
+	return check{Status: "ok"}
+}
+
+func checkSigner(signer dsig.Signer) check {
+	// Signing a document exercises the key, including one held in an HSM
+	if _, err := signer.SignElement([]byte(`<Probe ID="probe"/>`), "probe"); err != nil {
+		return failed(err.Error())
+	}
+	return check{Status: "ok"}
+}
+
+func checkMetadata(config *config.Configuration) check {
+	for _, sp := range config.Current().ServiceProviders {
+		if sp.Metadata != "" && sp.Descriptor == nil {
+			return failed("metadata of " + sp.EntityId + " isn't loaded")
+		}
+	}
+	return check{Status: "ok"}
+}
+
+func failed(reason string) check {
+	return check{Status: "failed", Error: reason}
+}
+
+func writeHealth(writer http.ResponseWriter, result health) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	if result.Status != "ok" {
+		writer.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(writer).Encode(result)
+}
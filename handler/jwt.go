@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"net/http"
+)
+
+// Hands SPs the JWTs issued alongside their assertions, each once, in exchange for the assertion's
+// SessionIndex. SPs are identified by their TLS client certificate, so a JWT only goes to its audience.
+func NewJWTHandler(store store.Storer, config *config.Configuration) http.Handler {
+	return &jwtHandler{store, config}
+}
+
+type jwtHandler struct {
+	store  store.Storer
+	config *config.Configuration
+}
+
+func (handler *jwtHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	identity, err := identifyClient(handler.config, request)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	accesslog.SetServiceProvider(request, identity)
+	sessionIndex := request.URL.Query().Get("SessionIndex")
+	if sessionIndex == "" {
+		http.Error(writer, "SessionIndex is required", 400)
+		return
+	}
+	key := protocol.JWTKey(identity, sessionIndex)
+	var token string
+	if err := handler.store.Retrieve(key, &token); err != nil {
+		http.Error(writer, "no JWT is waiting for the SessionIndex", 404)
+		return
+	}
+	if err := handler.store.Delete(key); err != nil {
+		logging.FromRequest(request).Error("Failed to remove collected JWT", "err", err)
+	}
+	writer.Header().Set("Content-Type", "application/jwt")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Write([]byte(token))
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"encoding/xml"
+	"errors"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/webhook"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"io"
+	"net/http"
+	"time"
+)
+
+const maxLogoutRequest = 1 << 16
+
+// Creates the SOAP single logout service. SPs end the IdP session a user signed in to them with by sending
+// the SessionIndex of their assertion.
+func NewLogoutHandler(signer dsig.Signer, replay protocol.ReplayDetector, store store.Storer,
+	config *config.Configuration) http.Handler {
+	return &logoutHandler{signer, replay, store, config}
+}
+
+type logoutHandler struct {
+	signer dsig.Signer
+	replay protocol.ReplayDetector
+	store  store.Storer
+	config *config.Configuration
+}
+
+func (handler *logoutHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	// Ending sessions always requires a client certificate, so one SP can't sign users out of another
+	identity, err := identifyClient(handler.config, request)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	var env protocol.LogoutRequestEnvelope
+	err = xml.NewDecoder(io.LimitReader(request.Body, maxLogoutRequest)).Decode(&env)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	logoutRequest := &env.Body.LogoutRequest
+	accesslog.SetServiceProvider(request, logoutRequest.Issuer)
+	err = checkClientIdentity(identity, logoutRequest.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	err = protocol.ValidateIssueInstant(logoutRequest.IssueInstant, handler.config.ClockSkewFor(logoutRequest.Issuer))
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = protocol.ValidateDestination(logoutRequest.Destination,
+		handler.config.EndpointURL(request, handler.config.Services.SingleLogout), false)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = handler.replay.ConsumeRequest(logoutRequest.Issuer, logoutRequest.ID)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	var reply protocol.LogoutResponseEnvelope
+	response := &reply.Body.LogoutResponse
+	response.ID = protocol.NewID()
+	response.Version = "2.0"
+	response.IssueInstant = time.Now()
+	response.InResponseTo = logoutRequest.ID
+	response.Issuer = saml.NewIssuer(handler.config.EntityId)
+	response.Status = protocol.NewStatus(true)
+	if err := handler.logout(request, logoutRequest); err != nil {
+		response.Status = protocol.NewErrorStatus(err)
+	}
+	signer, err := protocol.SignerFor(handler.signer, handler.config, logoutRequest.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	data, err := xmlutil.Marshal(reply)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	data, err = signer.SignElement(data, response.ID)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	writer.Write([]byte(xml.Header))
+	writer.Write(data)
+}
+
+// Ends the sessions the request's SessionIndexes were issued from. Sessions that have already ended are
+// reported as logged out.
+func (handler *logoutHandler) logout(request *http.Request, logoutRequest *protocol.LogoutRequest) error {
+	if logoutRequest.NameID == nil || len(logoutRequest.SessionIndex) == 0 {
+		return protocol.NewStatusError(protocol.StatusRequester, protocol.StatusRequestUnsupported,
+			"a NameID and SessionIndex are required")
+	}
+	logger := logging.FromRequest(request)
+	partial := false
+	for _, index := range logoutRequest.SessionIndex {
+		entry, err := authentication.LookupSessionIndex(handler.store, index)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			logger.Error("Failed to look up session index", "err", err)
+			partial = true
+			continue
+		}
+		// Indexes are only sent to the SP they were issued to. The NameID isn't compared, as the SP may have
+		// been sent a pairwise identifier rather than the user's name.
+		if entry.EntityId != logoutRequest.Issuer {
+			return protocol.NewStatusError(protocol.StatusRequester, protocol.StatusRequestDenied,
+				"the SessionIndex wasn't issued to "+logoutRequest.Issuer)
+		}
+		if err := authentication.RevokeSession(handler.store, entry.SessionID); err != nil {
+			logger.Error("Failed to end session", "user", entry.Name, "err", err)
+			partial = true
+			continue
+		}
+		logger.Info("Signed out", "user", entry.Name, "sp", logoutRequest.Issuer)
+		webhook.Notify(request, &webhook.Event{Type: config.EventLogout, User: entry.Name,
+			ServiceProvider: logoutRequest.Issuer})
+	}
+	if partial {
+		return protocol.NewStatusError(protocol.StatusResponder, protocol.StatusPartialLogout,
+			"not every session could be ended")
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"errors"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Returns a handler whose store holds a session for jdoe, with the SessionIndex sent to the requester
+func logoutSession(t *testing.T) (*logoutHandler, store.Storer) {
+	storer := store.NewMemory()
+	if err := storer.Store("_s1", "session", 3600); err != nil {
+		t.Fatal(err)
+	}
+	user := &protocol.AuthenticatedUser{Name: "jdoe", SessionID: "_s1", SessionExpires: time.Now().Add(time.Hour)}
+	if err := authentication.RecordSessionIndex(storer, user, testRequester, "_i1"); err != nil {
+		t.Fatal(err)
+	}
+	return &logoutHandler{store: storer, config: &config.Configuration{EntityId: testIdP}}, storer
+}
+
+func logoutRequest(issuer string, indexes ...string) *protocol.LogoutRequest {
+	request := &protocol.LogoutRequest{NameID: &saml.NameID{Value: "a pairwise id"}, SessionIndex: indexes}
+	request.Issuer = issuer
+	return request
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	handler, storer := logoutSession(t)
+	err := handler.logout(httptest.NewRequest("POST", "/logout", nil), logoutRequest(testRequester, "_i1", "_i2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session string
+	if err := storer.Retrieve("_s1", &session); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("session still present after logout: %v", err)
+	}
+}
+
+// The SessionIndex is the only thing tying the request to the session, so another SP can't use it
+func TestLogoutRejectsOtherServiceProvider(t *testing.T) {
+	handler, storer := logoutSession(t)
+	request := logoutRequest("https://other.example.com", "_i1")
+	err := handler.logout(httptest.NewRequest("POST", "/logout", nil), request)
+	if err == nil {
+		t.Fatal("logout accepted from an SP the SessionIndex wasn't sent to")
+	}
+	var session string
+	if err := storer.Retrieve("_s1", &session); err != nil {
+		t.Errorf("session ended by another SP: %v", err)
+	}
+}
@@ -1,11 +1,16 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/pem"
+	"encoding/xml"
+	"errors"
 	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/xmlutil"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"text/template"
 )
@@ -13,57 +18,138 @@ import (
 type metadataHandler struct {
 	template      *template.Template
 	Configuration *config.Configuration
-	Certificate   string
+	// Current and, during a rollover, next signing certificates
+	certificates []string
+	Algorithms   dsig.Options
+	signer       dsig.Signer
 }
 
-func NewMetadataHandler(config *config.Configuration) (http.Handler, error) {
-	handler := &metadataHandler{Configuration: config}
-	data, err := ioutil.ReadFile(config.Certificate)
-	if err != nil {
-		return nil, err
+func NewMetadataHandler(config *config.Configuration, signer dsig.Signer) (http.Handler, error) {
+	handler := &metadataHandler{Configuration: config, Algorithms: signer.Options(), signer: signer}
+	if _, rotating := signer.(dsig.KeySet); rotating {
+		return handler, handler.parse()
+	}
+	paths := []string{config.Certificate}
+	if config.NextCertificate != "" {
+		paths = append(paths, config.NextCertificate)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cert, _ := pem.Decode(data)
+		if cert == nil {
+			return nil, errors.New("no PEM encoded certificate found in " + path)
+		}
+		handler.certificates = append(handler.certificates, base64.StdEncoding.EncodeToString(cert.Bytes))
+	}
+	return handler, handler.parse()
+}
+
+// Returns the base64 encoded signing certificates to publish
+func (handler *metadataHandler) Certificates() []string {
+	keys, rotating := handler.signer.(dsig.KeySet)
+	if !rotating {
+		return handler.certificates
+	}
+	var certificates []string
+	for _, cert := range keys.Certificates() {
+		certificates = append(certificates, base64.StdEncoding.EncodeToString(cert.Raw))
 	}
-	cert, _ := pem.Decode(data)
-	handler.Certificate = base64.StdEncoding.EncodeToString(cert.Bytes)
+	return certificates
+}
+
+func (handler *metadataHandler) parse() error {
 	handler.template = template.New("metadata")
-	handler.template.Parse(`<?xml version="1.0" encoding="UTF-8"?>
-<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#"
+	_, err := handler.template.Parse(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:ds="http://www.w3.org/2000/09/xmldsig#"
+                  xmlns:alg="urn:oasis:names:tc:SAML:metadata:algsupport"
                   entityID="{{ .Configuration.EntityId }}">
+    <Extensions>
+        <alg:DigestMethod Algorithm="{{ .Algorithms.DigestAlgorithm }}"/>
+        <alg:SigningMethod Algorithm="{{ .Algorithms.SignatureAlgorithm }}"/>
+    </Extensions>
     <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
-        <KeyDescriptor>
+        {{ range .Certificates }}<KeyDescriptor use="signing">
             <ds:KeyInfo>
                 <ds:X509Data>
                     <ds:X509Certificate>
-                        {{ .Certificate }}
+                        {{ . }}
                     </ds:X509Certificate>
                 </ds:X509Data>
             </ds:KeyInfo>
         </KeyDescriptor>
-        <ArtifactResolutionService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
-                                   Location="{{ .Configuration.BaseURL }}{{ .Configuration.Services.ArtifactResolution }}" index="1"/>
-        <NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName</NameIDFormat>
+        {{ end }}        <ArtifactResolutionService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+                                   Location="{{ .URL .Configuration.Services.ArtifactResolution }}" index="1"/>
+        {{ if .Configuration.Services.SingleLogout }}<SingleLogoutService
+                             Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+                             Location="{{ .URL .Configuration.Services.SingleLogout }}"/>
+        {{ end }}<NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName</NameIDFormat>
         <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
-                             Location="{{ .Configuration.BaseURL }}{{ .Configuration.Services.Authentication }}"/>
+                             Location="{{ .URL .Configuration.Services.Authentication }}"/>
     </IDPSSODescriptor>
-    <AttributeAuthorityDescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
-        <KeyDescriptor>
+    {{ if .Configuration.Proxy }}<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+        {{ range .Certificates }}<KeyDescriptor use="signing">
+            <ds:KeyInfo>
+                <ds:X509Data>
+                    <ds:X509Certificate>
+                        {{ . }}
+                    </ds:X509Certificate>
+                </ds:X509Data>
+            </ds:KeyInfo>
+        </KeyDescriptor>
+        {{ end }}<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+                                  Location="{{ .URL .Configuration.Proxy.AssertionConsumerService }}" index="1"/>
+    </SPSSODescriptor>
+    {{ end }}    <AttributeAuthorityDescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+        {{ range .Certificates }}<KeyDescriptor use="signing">
             <ds:KeyInfo>
                 <ds:X509Data>
                     <ds:X509Certificate>
-                        {{ .Certificate }}
+                        {{ . }}
                     </ds:X509Certificate>
                 </ds:X509Data>
             </ds:KeyInfo>
         </KeyDescriptor>
-        <AttributeService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
-                          Location="{{ .Configuration.BaseURL }}{{ .Configuration.Services.AttributeQuery }}"/>
+        {{ end }}        <AttributeService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+                          Location="{{ .URL .Configuration.Services.AttributeQuery }}"/>
         <NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName</NameIDFormat>
     </AttributeAuthorityDescriptor>
 </EntityDescriptor>`)
-	return handler, nil
+	return err
 }
+
+// The metadata as seen by the client of a request, which may have come through a proxy
+type metadataView struct {
+	*metadataHandler
+	request *http.Request
+}
+
+// Returns the absolute URL of the service
+func (view metadataView) URL(service string) string {
+	return view.Configuration.EndpointURL(view.request, service)
+}
+
 func (handler *metadataHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	err := handler.template.Execute(writer, handler)
+	var buffer bytes.Buffer
+	err := handler.template.Execute(&buffer, metadataView{handler, request})
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to render metadata", "err", err)
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	doc, err := xmlutil.Normalize(buffer.Bytes())
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to render metadata", "err", err)
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	signed, err := handler.signer.SignElement(doc, "")
 	if err != nil {
-		log.Printf("Failed to render metadata, %s\n", err.Error())
+		logging.FromRequest(request).Error("Failed to sign metadata", "err", err)
+		http.Error(writer, err.Error(), 500)
+		return
 	}
+	writer.Write([]byte(xml.Header))
+	writer.Write(signed)
 }
@@ -2,28 +2,41 @@ package handler
 
 import (
 	"encoding/xml"
+	"github.com/amdonov/lite-idp/accesslog"
 	"github.com/amdonov/lite-idp/attributes"
+	"github.com/amdonov/lite-idp/audit"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
 	"github.com/amdonov/lite-idp/protocol"
 	"github.com/amdonov/lite-idp/saml"
-	"github.com/amdonov/xmlsig"
+	"github.com/amdonov/lite-idp/xmlutil"
 	"net/http"
 	"time"
 )
 
-func NewQueryHandler(signer xmlsig.Signer, retriever attributes.Retriever, entityId string) http.Handler {
-	return &queryHandler{signer, retriever, entityId}
+func NewQueryHandler(signer dsig.Signer, retriever attributes.Retriever, replay protocol.ReplayDetector,
+	audit *audit.Log, config *config.Configuration) http.Handler {
+	return &queryHandler{signer, retriever, replay, audit, config}
 }
 
 type queryHandler struct {
-	signer    xmlsig.Signer
+	signer    dsig.Signer
 	retriever attributes.Retriever
-	entityId  string
+	replay    protocol.ReplayDetector
+	audit     *audit.Log
+	config    *config.Configuration
 }
 
 func (handler *queryHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	identity, err := clientIdentity(handler.config, request)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
 	decoder := xml.NewDecoder(request.Body)
 	var attributeEnv attributes.AttributeQueryEnv
-	err := decoder.Decode(&attributeEnv)
+	err = decoder.Decode(&attributeEnv)
 	// TODO determine if this is the appropriate error response
 	if err != nil {
 		http.Error(writer, err.Error(), 500)
@@ -31,10 +44,33 @@ func (handler *queryHandler) ServeHTTP(writer http.ResponseWriter, request *http
 	}
 	// TODO validate attributeEnv before proceeding
 	query := attributeEnv.Body.Query
+	accesslog.SetServiceProvider(request, query.Issuer)
+	err = checkClientIdentity(identity, query.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 403)
+		return
+	}
+	skew := handler.config.ClockSkewFor(query.Issuer)
+	err = protocol.ValidateIssueInstant(query.IssueInstant, skew)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = protocol.ValidateDestination(query.Destination,
+		handler.config.EndpointURL(request, handler.config.Services.AttributeQuery), false)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
+	err = handler.replay.ConsumeRequest(query.Issuer, query.ID)
+	if err != nil {
+		http.Error(writer, err.Error(), 400)
+		return
+	}
 	name := query.Subject.NameID.Value
 	format := query.Subject.NameID.Format
 	user := &protocol.AuthenticatedUser{Name: name, Format: format}
-	atts, err := handler.retriever.Retrieve(user)
+	atts, err := handler.retriever.Retrieve(request.Context(), user)
 	// TODO determine if this is the appropriate error response
 	if err != nil {
 		http.Error(writer, err.Error(), 500)
@@ -47,7 +83,7 @@ func (handler *queryHandler) ServeHTTP(writer http.ResponseWriter, request *http
 	resp.Version = "2.0"
 	now := time.Now()
 	resp.IssueInstant = now
-	resp.Issuer = saml.NewIssuer(handler.entityId)
+	resp.Issuer = saml.NewIssuer(handler.config.EntityId)
 	a := &saml.Assertion{}
 	a.Issuer = resp.Issuer
 	a.IssueInstant = now
@@ -55,27 +91,46 @@ func (handler *queryHandler) ServeHTTP(writer http.ResponseWriter, request *http
 	a.Version = "2.0"
 	a.Subject = &saml.Subject{}
 	a.Subject.NameID = query.Subject.NameID
-	a.AttributeStatement = saml.NewAttributeStatement(atts)
-	a.Conditions = &saml.Conditions{}
-	a.Conditions.NotBefore = now
-	fiveMinutes, _ := time.ParseDuration("5m")
-	fiveFromNow := now.Add(fiveMinutes)
-	a.Conditions.NotOnOrAfter = fiveFromNow
-	a.Conditions.AudienceRestriction = &saml.AudienceRestriction{Audience: query.Issuer}
+	a.AttributeStatement, err = protocol.NewAttributeStatement(handler.config, query.Issuer, user, atts)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	notBefore, lifetime, _ := handler.config.ValidityFor(query.Issuer)
+	a.Conditions = protocol.NewConditions(handler.config, query.Issuer, now.Add(-notBefore-skew),
+		now.Add(lifetime+skew))
 	resp.Status = protocol.NewStatus(true)
 	resp.Assertion = a
+	err = handler.replay.RecordAssertion(query.Issuer, a.ID, query.ID)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	err = handler.audit.Record(audit.NewEntry(audit.ViaQuery, name, query.Issuer, nil, a))
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to audit assertion", "err", err)
+		http.Error(writer, "unable to issue assertion", 500)
+		return
+	}
 
-	signature, err := handler.signer.Sign(a)
+	signer, err := protocol.SignerFor(handler.signer, handler.config, query.Issuer)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	data, err := xmlutil.Marshal(attrResp)
+	if err != nil {
+		http.Error(writer, err.Error(), 500)
+		return
+	}
+	data, err = signer.SignElement(data, a.ID)
 	// TODO determine if this is the appropriate error response
 	if err != nil {
 		http.Error(writer, err.Error(), 500)
 		return
 	}
-	a.Signature = signature
 	// TODO handle these errors. Probably can't do anything besides log, as we've already started to write the
 	// response.
 	_, err = writer.Write([]byte(xml.Header))
-	encoder := xml.NewEncoder(writer)
-	err = encoder.Encode(attrResp)
-	err = encoder.Flush()
+	_, err = writer.Write(data)
 }
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml11"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handles Shibboleth 1.x authentication requests, which are plain query parameters rather than XML
+func NewSAML11AuthenticationHandler(authenticator authentication.Authenticator,
+	config *config.Configuration) http.Handler {
+	return &saml11AuthHandler{authenticator, config}
+}
+
+type saml11AuthHandler struct {
+	authenticator authentication.Authenticator
+	config        *config.Configuration
+}
+
+func (handler *saml11AuthHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	err := request.ParseForm()
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	providerId := request.Form.Get("providerId")
+	shire := request.Form.Get("shire")
+	errorpage.SetServiceProvider(request, providerId)
+	if providerId == "" || shire == "" {
+		errorpage.Error(writer, request, "providerId and shire are required", 400)
+		return
+	}
+	// The time parameter is optional, but when present it must be recent
+	if requestTime := request.Form.Get("time"); requestTime != "" {
+		seconds, err := strconv.ParseInt(requestTime, 10, 64)
+		if err != nil {
+			errorpage.Error(writer, request, "invalid time parameter", 400)
+			return
+		}
+		err = protocol.ValidateIssueInstant(time.Unix(seconds, 0).UTC().Format(time.RFC3339),
+			handler.config.ClockSkewFor(providerId))
+		if err != nil {
+			errorpage.Error(writer, request, err.Error(), 400)
+			return
+		}
+	}
+	// Present the request to the authenticators as if it were a SAML 2 request
+	authRequest := &protocol.AuthnRequest{AssertionConsumerServiceURL: shire,
+		ProtocolBinding: saml11.BrowserPOSTBinding}
+	authRequest.Issuer = providerId
+	authRequest.ID = protocol.NewID()
+	acs, err := protocol.ResolveACSWithBindings(handler.config.ServiceProvider(providerId), authRequest,
+		handler.config.ProfileFor(providerId).AllowedBindings([]string{saml11.BrowserPOSTBinding}))
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	authRequest.AssertionConsumerServiceURL = acs.Location
+	handler.authenticator.Authenticate(authRequest, request.Form.Get("target"), writer, request)
+}
@@ -0,0 +1,80 @@
+// Package hooks lets programs embedding the IdP run their own functions at points in a login, to apply
+// policy the configuration can't express without forking the IdP.
+package hooks
+
+import (
+	"context"
+	"github.com/amdonov/lite-idp/protocol"
+	"net/http"
+)
+
+// Functions called during a login. Any of them may be nil. Errors are reported to the SP as the reason
+// the login failed, so a protocol.StatusError chooses the status it's sent.
+type Hooks struct {
+	// Called before the user is shown the login form or sent to an upstream IdP. An error stops the login.
+	BeforeLogin func(request *http.Request, authnRequest *protocol.AuthnRequest) error
+	// Called once the user has signed in, before their attributes are looked up. The user may be changed,
+	// such as to normalize their name. An error stops the login.
+	AfterAuthentication func(request *http.Request, authnRequest *protocol.AuthnRequest,
+		user *protocol.AuthenticatedUser) error
+	// Called before the response is recorded and sent. Its assertion may be enriched, such as with
+	// attributes, as it's signed afterwards. An error vetoes it and the SP is sent the error instead.
+	BeforeIssue func(request *http.Request, authnRequest *protocol.AuthnRequest, user *protocol.AuthenticatedUser,
+		response *protocol.Response) error
+	// Called once a response, successful or not, has been written to the browser
+	AfterResponse func(request *http.Request, authnRequest *protocol.AuthnRequest, response *protocol.Response)
+}
+
+type contextKey struct{}
+
+// Makes the hooks available to the handler's requests. The handler is returned as is by nil Hooks.
+func (hooks *Hooks) Handler(handler http.Handler) http.Handler {
+	if hooks == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), contextKey{}, hooks)))
+	})
+}
+
+func fromRequest(request *http.Request) *Hooks {
+	hooks, _ := request.Context().Value(contextKey{}).(*Hooks)
+	if hooks == nil {
+		return &Hooks{}
+	}
+	return hooks
+}
+
+// Runs the BeforeLogin hook of the IdP handling the request, if it has one. Authenticators showing a
+// login page of their own call it too.
+func BeforeLogin(request *http.Request, authnRequest *protocol.AuthnRequest) error {
+	if hook := fromRequest(request).BeforeLogin; hook != nil {
+		return hook(request, authnRequest)
+	}
+	return nil
+}
+
+// Runs the AfterAuthentication hook of the IdP handling the request, if it has one
+func AfterAuthentication(request *http.Request, authnRequest *protocol.AuthnRequest,
+	user *protocol.AuthenticatedUser) error {
+	if hook := fromRequest(request).AfterAuthentication; hook != nil {
+		return hook(request, authnRequest, user)
+	}
+	return nil
+}
+
+// Runs the BeforeIssue hook of the IdP handling the request, if it has one
+func BeforeIssue(request *http.Request, authnRequest *protocol.AuthnRequest, user *protocol.AuthenticatedUser,
+	response *protocol.Response) error {
+	if hook := fromRequest(request).BeforeIssue; hook != nil {
+		return hook(request, authnRequest, user, response)
+	}
+	return nil
+}
+
+// Runs the AfterResponse hook of the IdP handling the request, if it has one
+func AfterResponse(request *http.Request, authnRequest *protocol.AuthnRequest, response *protocol.Response) {
+	if hook := fromRequest(request).AfterResponse; hook != nil {
+		hook(request, authnRequest, response)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package hsm
+
+import (
+	"crypto"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+)
+
+// PKCS#11 requires cgo, so it's only included when building with -tags pkcs11
+func NewKey(config *config.PKCS11) (crypto.Signer, error) {
+	return nil, errors.New("PKCS#11 support is not included in this build, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,28 @@
+//go:build pkcs11
+// +build pkcs11
+
+package hsm
+
+import (
+	"crypto"
+	"errors"
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/amdonov/lite-idp/config"
+)
+
+// Opens the token and finds the signing key with the configured label
+func NewKey(config *config.PKCS11) (crypto.Signer, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{Path: config.Module, TokenLabel: config.TokenLabel,
+		Pin: config.Pin})
+	if err != nil {
+		return nil, err
+	}
+	key, err := ctx.FindKeyPair(nil, []byte(config.KeyLabel))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, errors.New("no key pair labelled " + config.KeyLabel + " found on the token")
+	}
+	return key, nil
+}
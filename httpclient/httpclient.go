@@ -0,0 +1,22 @@
+// Package httpclient holds the transport the IdP calls other services with, such as attribute services,
+// webhook receivers, SCIM servers and audit collectors. Sharing it lets calls reuse connections and resume TLS
+// sessions rather than setting up new ones.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+)
+
+// Shared by calls to services with publicly trusted certificates
+var Transport = New(nil)
+
+// Returns a transport tuned for calls to a few services, many at once, trusting the roots or the system's when
+// nil. Connections are pooled by transport, so keep the one returned rather than creating one per call.
+func New(roots *x509.CertPool) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots, ClientSessionCache: tls.NewLRUClientSessionCache(64)}
+	return transport
+}
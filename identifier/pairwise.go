@@ -0,0 +1,104 @@
+// Package identifier derives stable per-SP identifiers for users
+package identifier
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Secret salts by version. The newest version is used unless an SP is pinned to an older one, so rotating
+// the salt doesn't change identifiers SPs already hold.
+type Salts struct {
+	salts  map[int][]byte
+	newest int
+}
+
+// Reads salts from a file of version:base64 lines. A missing file is created with a random salt as
+// version 1. Losing the file changes every identifier, so it must be backed up.
+func LoadSalts(path string) (*Salts, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return createSalts(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	salts := &Salts{salts: make(map[int][]byte)}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed salt in %s", path)
+		}
+		version, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed salt version in %s", path)
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("malformed salt in %s", path)
+		}
+		salts.salts[version] = salt
+		if version > salts.newest {
+			salts.newest = version
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(salts.salts) == 0 {
+		return nil, fmt.Errorf("no salts found in %s", path)
+	}
+	return salts, nil
+}
+
+func createSalts(path string) (*Salts, error) {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	// Fails rather than overwriting a file created in the meantime
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(file, "1:%s\n", base64.StdEncoding.EncodeToString(salt))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Salts{salts: map[int][]byte{1: salt}, newest: 1}, nil
+}
+
+// Returns the identifier for the principal at the relying party using the salt version, or the newest
+// salt when version is zero. The result is an uppercase base32 string.
+func (salts *Salts) Pairwise(version int, principal, relyingParty string) (string, error) {
+	if version == 0 {
+		version = salts.newest
+	}
+	salt, found := salts.salts[version]
+	if !found {
+		return "", fmt.Errorf("unknown salt version %d", version)
+	}
+	mac := hmac.New(sha256.New, salt)
+	// Separated so different splits of the same characters don't collide
+	mac.Write([]byte(relyingParty))
+	mac.Write([]byte{0})
+	mac.Write([]byte(principal))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(mac.Sum(nil)), nil
+}
@@ -2,18 +2,33 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/amdonov/lite-idp/cli"
 	"github.com/amdonov/lite-idp/server"
 	"log"
+	"os"
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), cli.Usage(), "\nOptions:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
+	// Operational commands run instead of the IdP
+	if flag.NArg() > 0 && flag.Arg(0) != "serve" {
+		if err := cli.Run(flag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	server, err := server.New()
 	if err != nil {
 		log.Fatal("Failed to configure server.", err)
 	}
-	server.Start()
 	if err := server.Start(); err != nil {
 		log.Fatal("Failed to start server.", err)
 	}
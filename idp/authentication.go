@@ -0,0 +1,224 @@
+package idp
+
+import (
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/activity"
+	"github.com/amdonov/lite-idp/attributes"
+	"github.com/amdonov/lite-idp/audit"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/consent"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/hooks"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/provisioning"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/telemetry"
+	"github.com/amdonov/lite-idp/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"time"
+)
+
+type authnresponder struct {
+	config      *config.Configuration
+	retriever   attributes.Retriever
+	generator   protocol.ResponseGenerator
+	marshallers map[string]protocol.ResponseMarshaller
+	replay      protocol.ReplayDetector
+	store       store.Storer
+	// Signs JWTs issued alongside assertions
+	signer dsig.Signer
+	// Asks users before releasing attributes, when enabled
+	consent *consent.Prompter
+	// Creates accounts at SPs that need them before they get an assertion
+	provisioner *provisioning.Provisioner
+	// Figures for the admin console
+	activity *activity.Monitor
+	audit    *audit.Log
+}
+
+func (responder *authnresponder) completeAuth(authnRequest *protocol.AuthnRequest, relayState string,
+	user *protocol.AuthenticatedUser,
+	writer http.ResponseWriter, request *http.Request) {
+	// Holder-of-key confirmation binds the assertion to the certificate on this connection
+	if request.TLS != nil && len(request.TLS.PeerCertificates) > 0 {
+		user.Certificate = request.TLS.PeerCertificates[0].Raw
+	}
+	if err := hooks.AfterAuthentication(request, authnRequest, user); err != nil {
+		responder.failAuth(authnRequest, relayState, err, writer, request)
+		return
+	}
+	if sp := responder.config.ServiceProvider(authnRequest.Issuer); sp != nil && sp.HolderOfKey &&
+		user.Certificate == nil {
+		responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder,
+			protocol.StatusAuthnFailed, "a client certificate is required"), writer, request)
+		return
+	}
+	if !responder.config.ProfileFor(authnRequest.Issuer).AllowsNameIDFormat(user.Format) {
+		responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder,
+			protocol.StatusInvalidNameIDPolicy, "NameID format "+user.Format+" is not allowed"), writer, request)
+		return
+	}
+	// Look up any attributes. Only sources marked as required stop the login.
+	ctx, span := telemetry.Start(request.Context(), "attributes.resolve")
+	atts, err := responder.retriever.Retrieve(ctx, user)
+	telemetry.End(span, err)
+	if err != nil {
+		responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, "",
+			err.Error()), writer, request)
+		return
+	}
+	if responder.consent != nil {
+		pending := &consent.Pending{AuthnRequest: authnRequest, RelayState: relayState, User: user,
+			Attributes: atts, Released: protocol.ReleaseAttributes(responder.config, authnRequest.Issuer, atts)}
+		if responder.consent.Required(pending, request) {
+			if authnRequest.IsPassive {
+				responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder,
+					protocol.StatusNoPassive, "consent is required"), writer, request)
+				return
+			}
+			responder.consent.Prompt(pending, writer, request)
+			return
+		}
+	}
+	responder.issue(authnRequest, relayState, user, atts, writer, request)
+}
+
+// Sends the SP an assertion for the user
+func (responder *authnresponder) issue(authnRequest *protocol.AuthnRequest, relayState string,
+	user *protocol.AuthenticatedUser, atts map[string][]string, writer http.ResponseWriter, request *http.Request) {
+	// Create a SAML Response, signing the assertion
+	_, span := telemetry.Start(request.Context(), "saml.generate_response",
+		attribute.String("saml.issuer", authnRequest.Issuer))
+	response, err := responder.generator.Generate(user, authnRequest, atts)
+	telemetry.End(span, err)
+	if err != nil {
+		responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, "",
+			err.Error()), writer, request)
+		return
+	}
+	if err := hooks.BeforeIssue(request, authnRequest, user, response); err != nil {
+		responder.failAuth(authnRequest, relayState, err, writer, request)
+		return
+	}
+	// Refuse to issue an assertion whose ID has already been used
+	_, span = telemetry.Start(request.Context(), "store.record_assertion")
+	err = responder.replay.RecordAssertion(authnRequest.Issuer, response.Assertion.ID,
+		response.InResponseTo)
+	telemetry.End(span, err)
+	if err != nil {
+		responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, "",
+			"unable to issue assertion"), writer, request)
+		return
+	}
+	// Assertions that can't be audited aren't issued
+	_, span = telemetry.Start(request.Context(), "audit.record")
+	err = responder.audit.Record(audit.NewEntry(audit.ViaSSO, user.Name, authnRequest.Issuer, user.IP,
+		response.Assertion))
+	telemetry.End(span, err)
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to audit assertion", "err", err)
+		responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, "",
+			"unable to issue assertion"), writer, request)
+		return
+	}
+	// Failing to provision only stops the login when the SP can't do without the account
+	err = responder.provisioner.Provision(request.Context(), authnRequest.Issuer,
+		response.Assertion.Subject.NameID.Value, protocol.ReleaseAttributes(responder.config, authnRequest.Issuer, atts))
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to provision account", "sp", authnRequest.Issuer, "err", err)
+		if sp := responder.config.ServiceProvider(authnRequest.Issuer); sp.Provisioning.Required {
+			responder.failAuth(authnRequest, relayState, protocol.NewStatusError(protocol.StatusResponder, "",
+				"unable to provision the account"), writer, request)
+			return
+		}
+	}
+	// Track the SessionIndex issued to this SP
+	_, span = telemetry.Start(request.Context(), "store.record_session_index")
+	err = authentication.RecordSessionIndex(authentication.SessionStore(request, responder.store), user,
+		authnRequest.Issuer, response.Assertion.AuthnStatement.SessionIndex)
+	telemetry.End(span, err)
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to record session index", "err", err)
+	}
+	responder.holdJWT(request, authnRequest.Issuer, response)
+	responder.activity.Session(user.SessionID, user.SessionExpires)
+	succeeded := &webhook.Event{Type: config.EventLoginSucceeded, User: user.Name,
+		ServiceProvider: authnRequest.Issuer, AssertionID: response.Assertion.ID}
+	if authnContext := response.Assertion.AuthnStatement.AuthnContext; authnContext != nil {
+		succeeded.AuthnContext = authnContext.AuthnContextClassRef
+	}
+	webhook.Notify(request, succeeded)
+	responder.marshal(writer, request, response, authnRequest, relayState)
+}
+
+// Keeps a JWT for the SP to fetch when it collects them rather than receiving them in the form. The login
+// continues without one if it can't be issued, as the SP still gets the assertion.
+func (responder *authnresponder) holdJWT(request *http.Request, entityId string, response *protocol.Response) {
+	sp := responder.config.ServiceProvider(entityId)
+	if sp == nil || sp.JWT == nil || sp.JWT.WithDefaults().Delivery != config.JWTDeliveryEndpoint {
+		return
+	}
+	token, err := protocol.NewJWT(responder.signer, responder.config, entityId, response)
+	if err == nil {
+		lifetime := int(time.Until(response.Assertion.Conditions.NotOnOrAfter)/time.Second) + 1
+		err = responder.store.Store(protocol.JWTKey(entityId, response.Assertion.AuthnStatement.SessionIndex),
+			token, lifetime)
+	}
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to issue JWT", "sp", entityId, "err", err)
+	}
+}
+
+// Continues a login the user consented to
+func (responder *authnresponder) consented(pending *consent.Pending, writer http.ResponseWriter,
+	request *http.Request) {
+	responder.issue(pending.AuthnRequest, pending.RelayState, pending.User, pending.Attributes, writer, request)
+}
+
+// Tells the SP the user declined to release their attributes
+func (responder *authnresponder) declined(pending *consent.Pending, writer http.ResponseWriter,
+	request *http.Request) {
+	responder.failAuth(pending.AuthnRequest, pending.RelayState, protocol.NewStatusError(protocol.StatusResponder,
+		protocol.StatusRequestDenied, "the user declined to release their attributes"), writer, request)
+}
+
+// Sends the SP a response explaining why the request failed
+func (responder *authnresponder) failAuth(authnRequest *protocol.AuthnRequest, relayState string, err error,
+	writer http.ResponseWriter, request *http.Request) {
+	logging.FromRequest(request).Warn("Authentication failed", "sp", authnRequest.Issuer, "err", err)
+	responder.activity.Fail(authnRequest.Issuer, err.Error())
+	event := &webhook.Event{Type: config.EventLoginFailed, ServiceProvider: authnRequest.Issuer, Reason: err.Error()}
+	if user := authentication.CurrentUser(request, responder.store); user != nil {
+		event.User = user.Name
+	}
+	webhook.Notify(request, event)
+	response := responder.generator.GenerateError(authnRequest, err)
+	responder.marshal(writer, request, response, authnRequest, relayState)
+}
+
+// Returns the response based upon binding with the SP's original RelayState
+func (responder *authnresponder) marshal(writer http.ResponseWriter, request *http.Request,
+	response *protocol.Response, authnRequest *protocol.AuthnRequest, relayState string) {
+	accesslog.SetServiceProvider(request, authnRequest.Issuer)
+	errorpage.SetServiceProvider(request, authnRequest.Issuer)
+	marshaler, found := responder.marshallers[authnRequest.ProtocolBinding]
+	if !found {
+		errorpage.Error(writer, request, "Unsupported Binding", 500)
+		return
+	}
+	relayState, err := protocol.RestoreRelayState(responder.store, relayState)
+	if err != nil {
+		errorpage.Error(writer, request, "Failed to restore RelayState.", 500)
+		return
+	}
+	// Bindings that sign the whole response do so here
+	request, span := telemetry.StartRequest(request, "saml.marshal_response",
+		attribute.String("saml.binding", authnRequest.ProtocolBinding))
+	defer span.End()
+	marshaler.Marshal(writer, request, response, authnRequest, relayState)
+	hooks.AfterResponse(request, authnRequest, response)
+}
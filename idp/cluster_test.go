@@ -0,0 +1,158 @@
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/store"
+	"html"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const clusterSP = "https://sp.example.com/shibboleth"
+
+// Writes a configuration with the sample login form and one SP, as each instance of a cluster would share
+func clusterConfig(t *testing.T) *config.Configuration {
+	form, err := filepath.Abs(filepath.Join("..", "sample", "authentication-form"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := map[string]interface{}{
+		"EntityId": "https://idp.example.com/idp",
+		"BaseURL":  "https://idp.example.com",
+		"Address":  ":0",
+		// Never dialled, as the store is replaced
+		"Redis":              map[string]string{"Address": "localhost:6379"},
+		"AttributeProviders": map[string]interface{}{},
+		"Services": map[string]string{"Authentication": "/SAML2/Redirect/SSO",
+			"ArtifactResolution": "/SAML2/SOAP/ArtifactResolution", "AttributeQuery": "/SAML2/SOAP/AttributeQuery",
+			"Metadata": "/Metadata"},
+		"Authenticator": map[string]interface{}{"Fallback": map[string]interface{}{"Form": map[string]string{
+			"Directory": form, "Form": "form.html", "Error": "error.html", "Context": "/form/",
+			"Action": "/authenticate"}}},
+		"ServiceProviders": []map[string]interface{}{{"EntityId": clusterSP,
+			"AssertionConsumerServices": []map[string]interface{}{{
+				"Binding":  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+				"Location": "https://sp.example.com/Shibboleth.sso/SAML2/POST", "Index": 1, "IsDefault": true}}}},
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := config.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+// Returns a deflated, encoded AuthnRequest for the redirect binding
+func redirectRequest(t *testing.T, id string) string {
+	xml := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" `+
+		`xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="%s" Version="2.0" IssueInstant="%s">`+
+		`<saml:Issuer>%s</saml:Issuer></samlp:AuthnRequest>`, id, time.Now().UTC().Format(time.RFC3339), clusterSP)
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(xml))
+	writer.Close()
+	return url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes()))
+}
+
+var samlResponse = regexp.MustCompile(`name="SAMLResponse"\s+value="([^"]+)"`)
+
+// Reads the page, failing unless it carries a successful SAML response
+func checkSucceeded(t *testing.T, response *http.Response, step string) {
+	t.Helper()
+	page, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := samlResponse.FindSubmatch(page)
+	if match == nil {
+		t.Fatalf("%s: no SAML response in the page:\n%s", step, page)
+	}
+	data, err := base64.StdEncoding.DecodeString(html.UnescapeString(string(match[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("status:Success")) {
+		t.Fatalf("%s: the response isn't successful:\n%s", step, data)
+	}
+}
+
+// Walks a login across two instances sharing a store, as a load balancer without sticky sessions would
+// send it, so each step depends on state saved by the other instance
+func TestLoginAcrossInstances(t *testing.T) {
+	key, cert, err := dsig.GenerateSelfSigned("idp.example.com", nil, 2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dsig.NewSigner(bytes.NewReader(key), bytes.NewReader(cert), dsig.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := store.NewMemory()
+	var servers [2]*httptest.Server
+	for i := range servers {
+		instance, err := New(clusterConfig(t), WithStore(shared), WithSigner(signer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer instance.Close()
+		servers[i] = httptest.NewTLSServer(instance)
+		defer servers[i].Close()
+	}
+	// Cookies are kept by host, so the browser sends both instances the same ones
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser := &http.Client{Jar: jar, Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	// The first instance saves the request and shows the login form
+	response, err := browser.Get(servers[0].URL + "/SAML2/Redirect/SSO?SAMLRequest=" + redirectRequest(t, "_q1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	if !strings.Contains(string(page), `name="pwd"`) {
+		t.Fatalf("the login form wasn't shown:\n%s", page)
+	}
+	// The second finds the saved request when the form is submitted
+	response, err = browser.PostForm(servers[1].URL+"/authenticate", url.Values{"uid": {"jdoe"}, "pwd": {"secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSucceeded(t, response, "signing in")
+	// The session created by the second is used by the first without signing in again
+	response, err = browser.Get(servers[0].URL + "/SAML2/Redirect/SSO?SAMLRequest=" + redirectRequest(t, "_q2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSucceeded(t, response, "reusing the session")
+}
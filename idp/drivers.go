@@ -0,0 +1,7 @@
+package idp
+
+// Database drivers available to the SQL attribute provider
+import (
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
@@ -0,0 +1,631 @@
+// Package idp builds the whole IdP, with its tenants, as an http.Handler so it can be embedded in another Go
+// program. The handler may be mounted at a sub-path with http.StripPrefix as long as the BaseURL in the
+// configuration ends with that path. Listeners, signals, logging and tracing are left to the program, as the
+// lite-idp server does for itself.
+package idp
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/activity"
+	"github.com/amdonov/lite-idp/admin"
+	"github.com/amdonov/lite-idp/attributes"
+	"github.com/amdonov/lite-idp/audit"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/cas"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/consent"
+	"github.com/amdonov/lite-idp/directory"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/handler"
+	"github.com/amdonov/lite-idp/hsm"
+	"github.com/amdonov/lite-idp/keyring"
+	"github.com/amdonov/lite-idp/leader"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/oidc"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/provisioning"
+	"github.com/amdonov/lite-idp/ratelimit"
+	"github.com/amdonov/lite-idp/registry"
+	"github.com/amdonov/lite-idp/saml11"
+	"github.com/amdonov/lite-idp/scim"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/stream"
+	"github.com/amdonov/lite-idp/telemetry"
+	"github.com/amdonov/lite-idp/tracer"
+	"github.com/amdonov/lite-idp/vault"
+	"github.com/amdonov/lite-idp/webhook"
+	"github.com/amdonov/lite-idp/wsfed"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often registrations made through another instance are checked for
+const registryRefresh = 30 * time.Second
+
+// How often the metadata of registrations made with a URL is fetched again
+const metadataRefresh = 6 * time.Hour
+
+// An IdP and its tenants, ready to be served
+type IdP struct {
+	// The main configuration followed by those of the tenants, whose names are in the same order
+	configs []*config.Configuration
+	tenants []string
+	handler http.Handler
+	// SOAP services when they have a listener of their own
+	backChannel http.Handler
+	// Closed to stop the work started in the background
+	stop      chan struct{}
+	closeOnce sync.Once
+	// Sessions waiting to be saved, which are saved on Close
+	queued []io.Closer
+	logger *slog.Logger
+}
+
+// Builds the IdP the configuration describes, with any components the options replace. Close it once it's
+// no longer served.
+func New(settings *config.Configuration, opts ...Option) (*IdP, error) {
+	var replaced options
+	for _, option := range opts {
+		option(&replaced)
+	}
+	logger := slog.Default()
+	if replaced.logger != nil {
+		logger = logging.New(replaced.logger)
+	}
+	idp := &IdP{configs: []*config.Configuration{settings}, stop: make(chan struct{}), logger: logger}
+	if err := idp.build(settings, &replaced, logger); err != nil {
+		idp.Close()
+		return nil, err
+	}
+	return idp, nil
+}
+
+func (idp *IdP) build(config *config.Configuration, replaced *options, logger *slog.Logger) error {
+	// Create a session store
+	shared := replaced.store
+	if shared == nil {
+		redis := config.Redis.WithDefaults()
+		shared = store.New(redis.Address, redis.Password, redis.MaxIdle,
+			time.Duration(redis.IdleTimeout)*time.Second)
+	}
+	// Tenants share the cap with the main IdP, as they share the store
+	logins := ratelimit.NewConcurrency(config.RateLimits)
+	main, err := newSite(config, shared, idp.sessionStore(config, shared, logger), logins, replaced, logger,
+		idp.stop)
+	if err != nil {
+		return err
+	}
+	front, back := main.front, main.back
+	if len(config.Tenants) > 0 {
+		tenants, err := config.LoadTenants()
+		if err != nil {
+			return err
+		}
+		frontRoutes, backRoutes := &router{fallback: front}, &router{fallback: back}
+		for i, tenant := range config.Tenants {
+			// Messages about a tenant name it, including those logged while handling its requests
+			prefixed := store.WithPrefix(shared, "tenant:"+tenant.Name+":")
+			tenantLogger := logger.With("tenant", tenant.Name)
+			site, err := newSite(tenants[i], prefixed, idp.sessionStore(tenants[i], prefixed, tenantLogger), logins,
+				&options{}, tenantLogger, idp.stop)
+			if err != nil {
+				return fmt.Errorf("tenant %s: %s", tenant.Name, err)
+			}
+			frontRoutes.add(tenant, site.front)
+			backRoutes.add(tenant, site.back)
+			idp.configs = append(idp.configs, tenants[i])
+			idp.tenants = append(idp.tenants, tenant.Name)
+		}
+		front, back = frontRoutes, backRoutes
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", ratelimit.Handler(config.RateLimits, front))
+	// Liveness doesn't depend on the configuration
+	health := handler.NewHealthHandler()
+	mux.Handle(handler.HealthPath, health)
+	mux.Handle(handler.ReadinessPath, main.readiness)
+	accessLog, err := accesslog.New(config.AccessLog)
+	if err != nil {
+		return err
+	}
+	// Every request's messages share a correlation ID. Proxy headers are applied first so the client's
+	// address is logged and traced.
+	idp.handler = config.TrustProxies(telemetry.Handler(logging.Handler(logger, accessLog.Handler(mux))))
+	if config.BackChannel != nil {
+		backMux := http.NewServeMux()
+		backMux.Handle("/", ratelimit.Handler(config.RateLimits, back))
+		backMux.Handle(handler.HealthPath, health)
+		backMux.Handle(handler.ReadinessPath, main.readiness)
+		idp.backChannel = config.TrustProxies(telemetry.Handler(logging.Handler(logger,
+			accessLog.Handler(backMux))))
+	}
+	return nil
+}
+
+// Serves the browser-facing services, and the SOAP services too unless they have a listener of their own
+func (idp *IdP) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	idp.handler.ServeHTTP(writer, request)
+}
+
+// Returns the handler serving the SOAP services on a listener of their own, or nil when BackChannel isn't
+// configured
+func (idp *IdP) BackChannel() http.Handler {
+	return idp.backChannel
+}
+
+// Returns the logger the IdP logs to, the one given with WithLogger or else the default
+func (idp *IdP) Logger() *slog.Logger {
+	return idp.logger
+}
+
+// Reloads the configuration files of the IdP and its tenants. Requests already being handled finish with
+// the configuration they started with.
+func (idp *IdP) Reload() error {
+	var failed error
+	for i, config := range idp.configs {
+		if err := config.Reload(); err != nil {
+			if i > 0 {
+				err = fmt.Errorf("tenant %s: %s", idp.tenants[i-1], err)
+			}
+			failed = errors.Join(failed, err)
+		}
+	}
+	return failed
+}
+
+// Stops watching for registrations made through other instances and rotating signing keys, and saves the
+// sessions waiting to be saved
+func (idp *IdP) Close() error {
+	var failed error
+	idp.closeOnce.Do(func() {
+		close(idp.stop)
+		for _, queued := range idp.queued {
+			failed = errors.Join(failed, queued.Close())
+		}
+	})
+	return failed
+}
+
+// The handlers of one IdP
+type site struct {
+	// Browser-facing services, and the SOAP services too unless they have a listener of their own
+	front http.Handler
+	// SOAP services for the back-channel listener, if there is one
+	back      http.Handler
+	readiness http.Handler
+}
+
+// Builds the services of the IdP the configuration describes, using the components replaced in its place.
+// Sessions are kept in their own store, which may save them in the background.
+func newSite(config *config.Configuration, store, sessions store.Storer, logins ratelimit.Concurrency,
+	replaced *options, logger *slog.Logger, stop <-chan struct{}) (*site, error) {
+	services := http.NewServeMux()
+	// Add the service providers registered through the admin API
+	providers := registry.New(store, config)
+	if err := providers.Apply(); err != nil {
+		return nil, err
+	}
+	// Instances sharing the store pick up each other's registrations
+	providers.Watch(registryRefresh, stop, logger)
+	// One of them fetches registered metadata again, and the others pick up its changes
+	providers.RefreshMetadata(metadataRefresh, leader.New(store, "metadata-refresh", leader.Lease, logger), stop,
+		logger)
+
+	var auditLog *audit.Log
+	var err error
+	if config.Audit != nil {
+		auditLog, err = audit.New(config.Audit, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Configure the XML signer
+	signer := replaced.signer
+	if signer == nil {
+		if config.GeneratedKey() {
+			logger.Warn("Generated a self-signed signing key for evaluation", "certificate", config.Certificate,
+				"key", config.Key)
+		}
+		if signer, err = getSigner(config, auditLog, store, logger, stop); err != nil {
+			return nil, err
+		}
+	}
+	// Accounts provisioned through SCIM, which the API changes and the attribute pipeline reads
+	var provisioned *scim.Directory
+	if config.SCIM != nil {
+		provisioned = scim.NewDirectory(config.SCIM.File, config.Authenticator.Fallback.Form.Users, sessions)
+		services.Handle(config.SCIM.WithDefaults().Path+"/", accesslog.Binding("scim", scim.New(provisioned, config)))
+	}
+	// The directory's connections are shared by the user store and the attribute provider
+	var pool *directory.Pool
+	if config.LDAP != nil {
+		if pool, err = directory.NewPool(config.LDAP); err != nil {
+			return nil, err
+		}
+	}
+	users := replaced.users
+	if form := config.Authenticator.Fallback.Form; users == nil && form.LDAP != nil {
+		users = authentication.NewLDAPUserStore(pool, form.LDAP)
+	}
+	retriever := replaced.retriever
+	if retriever == nil {
+		if retriever, err = getRetriever(config, store, provisioned, pool, logger); err != nil {
+			return nil, err
+		}
+	}
+	var messages *tracer.Tracer
+	if config.Debug != nil {
+		size := config.Debug.Messages
+		if size <= 0 {
+			size = 100
+		}
+		messages = tracer.New(size)
+		services.Handle(config.Debug.Path, messages.NewEndpoint(config.Debug.Token))
+	}
+	// Protocol endpoints are traced and their binding noted in the access log
+	endpoint := func(binding string, handler http.Handler) http.Handler {
+		return accesslog.Binding(binding, messages.Handler(binding, handler))
+	}
+	requestParser := protocol.NewRedirectRequestParser(config, store)
+	marshallers := make(map[string]protocol.ResponseMarshaller)
+	marshallers[protocol.HTTPArtifactBinding] = protocol.NewArtifactResponseMarshaller(store)
+	marshallers[protocol.HTTPPostBinding] = protocol.NewPOSTResponseMarshaller(signer, config)
+	generator := protocol.NewDefaultGenerator(config)
+	replay := protocol.NewReplayDetector(store, config)
+	monitor := activity.New(50)
+	responder := &authnresponder{config: config, retriever: retriever, generator: generator,
+		marshallers: marshallers, replay: replay, store: store, signer: signer, activity: monitor, audit: auditLog,
+		provisioner: provisioning.New(config, store)}
+	if config.Consent != nil {
+		registry := consent.NewRegistry(store, config.Consent.Lifetime)
+		responder.consent = consent.NewPrompter(registry, store, config, responder.consented, responder.declined)
+		services.Handle(config.Consent.Prompt, logins.Handler(responder.consent))
+		if config.Consent.API != "" {
+			services.Handle(config.Consent.API, consent.NewAPI(registry, store, config.Consent.API))
+		}
+	}
+	if config.Sessions.Dashboard != "" {
+		services.Handle(config.Sessions.Dashboard, authentication.NewDashboard(sessions, config))
+	}
+	policy := protocol.NewAuthnContextPolicy(config)
+	var authenticator authentication.Authenticator
+	var passwordAuth authentication.HandlerAuthenticator
+	if replaced.authenticator != nil {
+		authenticator = replaced.authenticator(responder.completeAuth, responder.failAuth, policy, store)
+	} else {
+		passwordAuth, err = authentication.NewPasswordAuthenticator(responder.completeAuth, responder.failAuth,
+			policy, store, config.Authenticator.Fallback.Form, users, config.ReloadTemplates)
+		if err != nil {
+			return nil, fmt.Errorf("login form: %s", err)
+		}
+		if reloader, ok := passwordAuth.(authentication.Reloader); ok {
+			config.OnReload(reloader.Reload)
+		}
+		authenticator = authentication.NewPKIAuthenticator(responder.completeAuth, responder.failAuth, policy, store,
+			passwordAuth)
+	}
+	if config.Proxy != nil && replaced.authenticator == nil {
+		proxyAuth, err := authentication.NewProxyAuthenticator(responder.completeAuth, responder.failAuth, policy,
+			store, config)
+		if err != nil {
+			return nil, err
+		}
+		services.Handle(config.Proxy.AssertionConsumerService, endpoint(protocol.HTTPPostBinding,
+			logins.Handler(proxyAuth)))
+		authenticator = proxyAuth
+	}
+	authHandler := handler.NewAuthenticationHandler(requestParser, authenticator, responder.failAuth, replay, logins,
+		config)
+	services.Handle(config.Services.Authentication, endpoint(protocol.HTTPRedirectBinding, authHandler))
+	if config.Services.SAML11Authentication != "" {
+		marshallers[saml11.BrowserPOSTBinding] = saml11.NewPOSTResponseMarshaller(signer, config)
+		services.Handle(config.Services.SAML11Authentication, endpoint(saml11.BrowserPOSTBinding,
+			logins.Handler(handler.NewSAML11AuthenticationHandler(authenticator, config))))
+	}
+	if config.Services.WSFederation != "" {
+		wsfedServer := wsfed.New(authenticator, signer, store, config)
+		marshallers[wsfed.Binding] = wsfedServer
+		services.Handle(config.Services.WSFederation, endpoint(wsfed.Binding, logins.Handler(wsfedServer)))
+	}
+	if config.OIDC != nil {
+		provider, err := oidc.New(authenticator, signer, store, config)
+		if err != nil {
+			return nil, err
+		}
+		marshallers[oidc.CodeBinding] = provider
+		settings := config.OIDC.WithDefaults()
+		services.Handle(settings.Authorization, accesslog.Binding("oidc",
+			logins.Handler(http.HandlerFunc(provider.Authorize))))
+		services.Handle(settings.Token, accesslog.Binding("oidc", http.HandlerFunc(provider.Token)))
+		services.Handle(settings.UserInfo, accesslog.Binding("oidc", http.HandlerFunc(provider.UserInfo)))
+		services.Handle(settings.Introspection, accesslog.Binding("oidc", http.HandlerFunc(provider.Introspect)))
+		services.Handle(settings.Revocation, accesslog.Binding("oidc", http.HandlerFunc(provider.Revoke)))
+		services.HandleFunc(settings.JWKS, provider.Keys)
+		services.HandleFunc(oidc.DiscoveryPath, provider.Discovery)
+	}
+	if config.CAS != nil {
+		casServer := cas.New(authenticator, store, config)
+		marshallers[cas.Binding] = casServer
+		path := config.CAS.WithDefaults().Path
+		services.Handle(path+"/login", accesslog.Binding("cas", logins.Handler(http.HandlerFunc(casServer.Login))))
+		services.Handle(path+"/serviceValidate", accesslog.Binding("cas",
+			http.HandlerFunc(casServer.ServiceValidate)))
+		services.Handle(path+"/p3/serviceValidate", accesslog.Binding("cas",
+			http.HandlerFunc(casServer.ServiceValidateV3)))
+	}
+	// SOAP services share the browser listener unless they have one of their own
+	backChannel := services
+	if config.BackChannel != nil {
+		backChannel = http.NewServeMux()
+	}
+	queryHandler := handler.NewQueryHandler(signer, retriever, replay, auditLog, config)
+	artHandler := handler.NewArtifactHandler(store, signer, replay, config)
+	backChannel.Handle(config.Services.ArtifactResolution, endpoint(protocol.SOAPBinding, artHandler))
+	backChannel.Handle(config.Services.AttributeQuery, endpoint(protocol.SOAPBinding, queryHandler))
+	if config.Services.Delegation != "" {
+		delegationHandler, err := handler.NewDelegationHandler(signer, retriever, replay, auditLog, config)
+		if err != nil {
+			return nil, err
+		}
+		backChannel.Handle(config.Services.Delegation, endpoint(protocol.SOAPBinding, delegationHandler))
+	}
+	if config.Services.SingleLogout != "" {
+		backChannel.Handle(config.Services.SingleLogout, endpoint(protocol.SOAPBinding,
+			handler.NewLogoutHandler(signer, replay, sessions, config)))
+	}
+	if config.Services.JWT != "" {
+		backChannel.Handle(config.Services.JWT, accesslog.Binding("jwt", handler.NewJWTHandler(store, config)))
+	}
+	metadataHandler, err := handler.NewMetadataHandler(config, signer)
+	if err != nil {
+		return nil, err
+	}
+	services.Handle(config.Services.Metadata, metadataHandler)
+	if passwordAuth != nil {
+		form := config.Authenticator.Fallback.Form
+		services.Handle(form.Context, http.StripPrefix(form.Context, http.FileServer(http.Dir(form.Directory))))
+		// Responses to SPs are sent once the login form is submitted
+		services.Handle(form.Action, endpoint("login form", logins.Handler(passwordAuth)))
+	}
+	// Requests keep the configuration snapshot they start with, so a reload can't change it under them
+	mux := http.NewServeMux()
+	mux.Handle("/", config.Guard(services))
+	if config.Admin != nil {
+		mux.Handle(config.Admin.Path, admin.New(config, providers, monitor, sessions))
+	}
+	pages, err := errorpage.New(config)
+	if err != nil {
+		return nil, fmt.Errorf("error page template: %s", err)
+	}
+	// Events are only raised by browser-facing services
+	var publishers []webhook.Publisher
+	if config.Streaming != nil {
+		publisher, err := stream.New(config.Streaming, logger)
+		if err != nil {
+			return nil, fmt.Errorf("event streaming: %s", err)
+		}
+		publishers = append(publishers, publisher)
+	}
+	notifier := webhook.New(config.Webhooks, logger, publishers...)
+	// Sessions are read, ended and listed through the one store, so one ended while waiting to be saved isn't
+	// saved afterwards
+	site := &site{front: authentication.WithSessions(config.Sessions, authentication.WithSessionStore(sessions,
+		notifier.Handler(replaced.hooks.Handler(pages.Handler(mux))))),
+		readiness: config.Guard(handler.NewReadinessHandler(store, signer, config))}
+	if config.BackChannel != nil {
+		site.back = config.Guard(backChannel)
+	}
+	return site, nil
+}
+
+// Saves sessions in the background when the configuration lets some wait
+func (idp *IdP) sessionStore(config *config.Configuration, shared store.Storer, logger *slog.Logger) store.Storer {
+	if config.Sessions.WriteQueue <= 0 {
+		return shared
+	}
+	queued := store.WriteBehind(shared, config.Sessions.WriteQueue, logger)
+	idp.queued = append(idp.queued, queued)
+	return queued
+}
+
+// Combines the configured attribute providers into a pipeline
+func getRetriever(config *config.Configuration, store store.Storer, provisioned *scim.Directory,
+	pool *directory.Pool, logger *slog.Logger) (attributes.Retriever, error) {
+	providers := config.AttributeProviders
+	sources := map[string]attributes.Source{"authenticator": {Name: "authenticator",
+		Retriever: attributes.NewAuthenticatorRetriever(), Priority: providers.Authenticator.Priority,
+		OnFailure: providers.Authenticator.FailurePolicy()}}
+	if jsonStore := providers.JsonStore; jsonStore != nil {
+		// Load the JSON Attribute Store
+		logger.Info("Loading JSON attribute store", "file", jsonStore.File)
+		people, err := os.Open(jsonStore.File)
+		if err != nil {
+			return nil, err
+		}
+		defer people.Close()
+		retriever, err := attributes.NewJSONRetriever(people)
+		if err != nil {
+			return nil, err
+		}
+		sources["json"] = newSource("json", retriever, jsonStore.Resolution, store, config)
+	}
+	if resolution := providers.SCIM; resolution != nil && provisioned != nil {
+		sources["scim"] = newSource("scim", provisioned, *resolution, store, config)
+	}
+	if search := providers.LDAP; search != nil {
+		if pool == nil {
+			return nil, errors.New("LDAP attribute provider requires LDAP connection settings")
+		}
+		sources["ldap"] = newSource("ldap", cached(attributes.NewLDAPRetriever(pool, search), store, "ldap", config),
+			search.Resolution, store, config)
+	}
+	if queries := providers.SQL; queries != nil {
+		retriever, err := attributes.NewSQLRetriever(queries)
+		if err != nil {
+			return nil, err
+		}
+		sources["sql"] = newSource("sql", cached(retriever, store, "sql", config), queries.Resolution, store, config)
+	}
+	if service := providers.HTTP; service != nil {
+		sources["http"] = newSource("http", cached(attributes.NewHTTPRetriever(service), store, "http", config),
+			service.Resolution, store, config)
+	}
+	order := providers.Order
+	if len(order) == 0 {
+		order = []string{"authenticator", "json", "scim", "ldap", "sql", "http"}
+	}
+	var pipeline []attributes.Source
+	for _, name := range order {
+		if source, found := sources[name]; found {
+			pipeline = append(pipeline, source)
+		}
+	}
+	retriever, err := attributes.NewPipeline(providers.Merge, pipeline)
+	if err == nil && len(providers.Computed) > 0 {
+		retriever, err = attributes.NewComputedRetriever(retriever, providers.Computed)
+	}
+	if err == nil && len(providers.Transforms) > 0 {
+		retriever, err = attributes.NewTransformingRetriever(retriever, providers.Transforms)
+	}
+	return retriever, err
+}
+
+// Creates a pipeline source, remembering the provider's results if it falls back to them
+func newSource(name string, retriever attributes.Retriever, resolution config.Resolution, store store.Storer,
+	config *config.Configuration) attributes.Source {
+	onFailure := resolution.FailurePolicy()
+	if onFailure == attributes.OnFailureCached {
+		lifetime := config.AttributeProviders.FallbackLifetime
+		if lifetime <= 0 {
+			lifetime = 7 * 24 * 60 * 60
+		}
+		retriever = attributes.NewFallbackRetriever(retriever, store, name, lifetime)
+	}
+	return attributes.Source{Name: name, Retriever: retriever, Priority: resolution.Priority, OnFailure: onFailure}
+}
+
+// Caches a remote provider's results when configured
+func cached(retriever attributes.Retriever, store store.Storer, name string,
+	config *config.Configuration) attributes.Retriever {
+	if config.AttributeProviders.CacheLifetime <= 0 {
+		return retriever
+	}
+	return attributes.NewCachingRetriever(retriever, store, name, config.AttributeProviders.CacheLifetime)
+}
+
+func getSigner(config *config.Configuration, auditLog *audit.Log, store store.Storer, logger *slog.Logger,
+	stop <-chan struct{}) (dsig.Signer, error) {
+	options := dsig.Options{SignatureAlgorithm: config.SignatureAlgorithm,
+		DigestAlgorithm: config.DigestAlgorithm, InclusiveNamespaces: config.InclusiveNamespaces}
+	if config.KeyRotation != nil {
+		ring, err := keyring.Open(config, options, auditLog, store, logger)
+		if err != nil {
+			return nil, err
+		}
+		go ring.Run(stop)
+		return ring, nil
+	}
+	var signer dsig.Signer
+	var err error
+	switch {
+	case config.PKCS11 != nil:
+		signer, err = loadHSMSigner(config.PKCS11, config.Certificate, options)
+	case config.ExternalKey():
+		signer, err = loadVaultSigner(config.Vault, config.Certificate, options)
+	default:
+		// Software keys are fine for development
+		signer, err = loadSigner(config.Key, config.Certificate, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if config.NextKey == "" {
+		return signer, nil
+	}
+	next, err := loadSigner(config.NextKey, config.NextCertificate, options)
+	if err != nil {
+		return nil, err
+	}
+	return dsig.NewRolloverSigner(signer, next, config.KeyRollover), nil
+}
+
+func loadSigner(keyPath, certPath string, options dsig.Options) (dsig.Signer, error) {
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := dsig.ParseCertificate(certData)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := dsig.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+	// Signatures made with another key wouldn't verify against the published certificate
+	if public, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !public.Equal(cert.PublicKey) {
+		return nil, fmt.Errorf("%s doesn't match its certificate %s", keyPath, certPath)
+	}
+	return dsig.NewSignerFromKey(dsig.NewTimedKey(key, "software"), cert, options)
+}
+
+func loadHSMSigner(pkcs11 *config.PKCS11, certPath string, options dsig.Options) (dsig.Signer, error) {
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := dsig.ParseCertificate(certData)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hsm.NewKey(pkcs11)
+	if err != nil {
+		return nil, err
+	}
+	return dsig.NewSignerFromKey(dsig.NewTimedKey(key, "pkcs11"), cert, options)
+}
+
+// Reads the key from the KV engine, or signs with the Transit engine so the key stays in Vault
+func loadVaultSigner(settings *config.Vault, certPath string, options dsig.Options) (dsig.Signer, error) {
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := dsig.ParseCertificate(certData)
+	if err != nil {
+		return nil, err
+	}
+	client, err := settings.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	if settings.Transit != nil {
+		transit := settings.Transit.WithDefaults()
+		key := vault.NewTransitKey(client, transit.Mount, transit.Key, cert.PublicKey)
+		return dsig.NewSignerFromKey(dsig.NewTimedKey(key, "transit"), cert, options)
+	}
+	path, field, _ := vault.ParseReference(vault.Scheme + settings.Key)
+	keyData, err := client.Field(context.Background(), path, field)
+	if err != nil {
+		return nil, err
+	}
+	key, err := dsig.ParsePrivateKey([]byte(keyData))
+	if err != nil {
+		return nil, err
+	}
+	return dsig.NewSignerFromKey(dsig.NewTimedKey(key, "vault"), cert, options)
+}
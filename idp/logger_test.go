@@ -0,0 +1,58 @@
+package idp
+
+import (
+	"bytes"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/store"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Messages logged while handling a request go to the IdP's own logger, tagged with the correlation ID
+func TestLoggerPerIdP(t *testing.T) {
+	key, cert, err := dsig.GenerateSelfSigned("idp.example.com", nil, 2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dsig.NewSigner(bytes.NewReader(key), bytes.NewReader(cert), dsig.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs [2]bytes.Buffer
+	var servers [2]*httptest.Server
+	for i := range servers {
+		logger := slog.New(slog.NewTextHandler(&logs[i], &slog.HandlerOptions{Level: slog.LevelDebug}))
+		instance, err := New(clusterConfig(t), WithStore(store.NewMemory()), WithSigner(signer), WithLogger(logger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer instance.Close()
+		servers[i] = httptest.NewTLSServer(instance)
+		defer servers[i].Close()
+	}
+	// Signing in with a request state that was never saved logs the failure to load it
+	form := url.Values{"uid": {"jdoe"}, "pwd": {"secret"}}
+	request, err := http.NewRequest("POST", servers[0].URL+"/authenticate", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(&http.Cookie{Name: "lidp-rs", Value: "missing"})
+	response, err := servers[0].Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	id := response.Header.Get("X-Request-ID")
+	if !strings.Contains(logs[0].String(), "request_id="+id) {
+		t.Errorf("the IdP's logger didn't receive the request's messages:\n%s", logs[0].String())
+	}
+	if logs[1].Len() > 0 {
+		t.Errorf("another IdP's logger received messages:\n%s", logs[1].String())
+	}
+}
@@ -0,0 +1,85 @@
+package idp
+
+import (
+	"github.com/amdonov/lite-idp/attributes"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/hooks"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+)
+
+// Replaces a component the configuration would otherwise describe. Components replaced this way are used by
+// the main IdP; tenants are built from their own configuration files.
+type Option func(*options)
+
+type options struct {
+	store         store.Storer
+	authenticator AuthenticatorFactory
+	retriever     attributes.Retriever
+	signer        dsig.Signer
+	hooks         *hooks.Hooks
+	users         authentication.UserStore
+	logger        logging.Logger
+}
+
+// Creates the authenticator users sign in with. It reports the signed in user to complete, or a failure to
+// fail, and should honour the policy's view of whether an existing session satisfies the request.
+type AuthenticatorFactory func(complete authentication.AuthFunc, fail authentication.ErrorFunc,
+	policy protocol.AuthnContextPolicy, store store.Storer) authentication.Authenticator
+
+// Keeps sessions and other shared state in the store rather than the Redis server in the configuration.
+// Tenants keep theirs in the same store under a prefix.
+func WithStore(store store.Storer) Option {
+	return func(options *options) {
+		options.store = store
+	}
+}
+
+// Signs users in with the authenticator the factory creates rather than the certificate, password and
+// proxy authenticators in the configuration. The login form isn't served.
+func WithAuthenticator(factory AuthenticatorFactory) Option {
+	return func(options *options) {
+		options.authenticator = factory
+	}
+}
+
+// Looks up users' attributes with the retriever rather than the AttributeProviders in the configuration
+func WithAttributeResolver(retriever attributes.Retriever) Option {
+	return func(options *options) {
+		options.retriever = retriever
+	}
+}
+
+// Signs assertions, metadata and tokens with the signer rather than the keys in the configuration. Signers
+// made with dsig.NewSignerFromKey publish their certificate in metadata, so no certificate file is needed.
+func WithSigner(signer dsig.Signer) Option {
+	return func(options *options) {
+		options.signer = signer
+	}
+}
+
+// Checks the passwords submitted to the login form with the user store rather than the configuration's users
+// file. Pair it with WithAttributeResolver(attributes.NewUserStoreRetriever(users)) to assert what the store
+// knows of them too.
+func WithUserStore(users authentication.UserStore) Option {
+	return func(options *options) {
+		options.users = users
+	}
+}
+
+// Runs the hooks' functions during logins, so custom policy can inspect, change or stop them
+func WithHooks(hooks *hooks.Hooks) Option {
+	return func(options *options) {
+		options.hooks = hooks
+	}
+}
+
+// Logs through the logger rather than the default slog logger. Tenants log through it too, with their name
+// added to their messages.
+func WithLogger(logger logging.Logger) Option {
+	return func(options *options) {
+		options.logger = logger
+	}
+}
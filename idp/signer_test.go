@@ -0,0 +1,38 @@
+package idp
+
+import (
+	"github.com/amdonov/lite-idp/dsig"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A key is refused unless it belongs to the certificate published for it, as for NextKey
+func TestLoadSignerChecksCertificate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string) (string, string) {
+		key, certificate, err := dsig.GenerateSelfSigned("idp.example.com", nil, 2048, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyPath, certPath := filepath.Join(dir, name+".key"), filepath.Join(dir, name+".crt")
+		if err := os.WriteFile(keyPath, key, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(certPath, certificate, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return keyPath, certPath
+	}
+	currentKey, currentCert := write("current")
+	nextKey, _ := write("next")
+	if _, err := loadSigner(currentKey, currentCert, dsig.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSigner(nextKey, currentCert, dsig.Options{}); err == nil ||
+		!strings.Contains(err.Error(), "doesn't match") {
+		t.Errorf("loaded a key with another key's certificate: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package idp
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"net"
+	"net/http"
+)
+
+// Sends requests to the first tenant they match, or to the main IdP
+type router struct {
+	routes   []route
+	fallback http.Handler
+}
+
+type route struct {
+	tenant  *config.Tenant
+	handler http.Handler
+}
+
+// Adds a tenant, whose messages name it. Tenants without a handler, such as on a listener they have no services
+// on, are skipped.
+func (router *router) add(tenant *config.Tenant, handler http.Handler) {
+	if handler != nil {
+		router.routes = append(router.routes, route{tenant, logging.With(handler, "tenant", tenant.Name)})
+	}
+}
+
+func (router *router) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	host := request.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	for _, route := range router.routes {
+		if route.tenant.Matches(host, request.URL.Path) {
+			route.handler.ServeHTTP(writer, request)
+			return
+		}
+	}
+	router.fallback.ServeHTTP(writer, request)
+}
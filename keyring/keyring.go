@@ -0,0 +1,412 @@
+// Package keyring rotates the IdP's signing keys on a schedule. Each key is published in metadata ahead of
+// signing, signs for an interval, and stays published for a while after it's replaced so assertions it
+// signed can still be validated. IdP instances sharing a store and the key directory elect one of them to
+// rotate the keys; the others pick up its changes.
+package keyring
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"github.com/amdonov/lite-idp/audit"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/leader"
+	"github.com/amdonov/lite-idp/store"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys are named by when they start signing
+const layout = "20060102T150405Z"
+
+// File naming the key that signed when the ring last checked, so activations are recorded once
+const activeFile = "active"
+
+// How often an instance waiting for the first key checks for it
+const firstKeyPoll = 2 * time.Second
+
+type key struct {
+	name        string
+	activation  time.Time
+	certificate *x509.Certificate
+	signer      dsig.Signer
+}
+
+// Signs with whichever published key is active. Also a dsig.KeySet of the published keys.
+type Ring struct {
+	mutex     sync.RWMutex
+	settings  config.KeyRotation
+	hostName  string
+	dnsNames  []string
+	options   dsig.Options
+	audit     *audit.Log
+	directory string
+	// Decides which instance rotates the keys
+	election *leader.Election
+	// Published keys, oldest first
+	keys   []*key
+	logger *slog.Logger
+}
+
+// Opens the keys in the rotation directory. When this instance rotates the keys, it starts the directory
+// with the configured Key if it's empty and brings the ring up to date; otherwise it waits for the directory to
+// be started. Changes to the keys are logged to the
+// logger.
+func Open(config *config.Configuration, options dsig.Options, audit *audit.Log, store store.Storer,
+	logger *slog.Logger) (*Ring, error) {
+	settings := config.KeyRotation.WithDefaults()
+	ring := &Ring{settings: settings, hostName: config.HostName(), dnsNames: config.DNSNames(), options: options,
+		audit: audit, directory: settings.Directory, election: leader.New(store, "key-rotation", leader.Lease, logger),
+		logger: logger}
+	if err := os.MkdirAll(filepath.Join(ring.directory, "archive"), 0700); err != nil {
+		return nil, err
+	}
+	leading, err := ring.election.Lead()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ring.load()
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 && !leading {
+		// The instance rotating keys adds the first when it starts, or this one does if that one stops first
+		logger.Info("Waiting for the instance rotating signing keys to add the first", "directory", ring.directory)
+	}
+	for len(keys) == 0 && !leading {
+		time.Sleep(firstKeyPoll)
+		if leading, err = ring.election.Lead(); err != nil {
+			return nil, err
+		}
+		if keys, err = ring.load(); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		if err := ring.importKey(config.Key, config.Certificate); err != nil {
+			return nil, err
+		}
+		if keys, err = ring.load(); err != nil {
+			return nil, err
+		}
+	}
+	ring.keys = keys
+	if leading {
+		if err := ring.Rotate(time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+// Reads the published keys
+func (ring *Ring) load() ([]*key, error) {
+	matches, err := filepath.Glob(filepath.Join(ring.directory, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*key
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), ".crt")
+		activation, err := time.Parse(layout, name)
+		if err != nil {
+			continue
+		}
+		key, err := ring.loadKey(name, activation)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].activation.Before(keys[j].activation)
+	})
+	return keys, nil
+}
+
+func (ring *Ring) loadKey(name string, activation time.Time) (*key, error) {
+	base := filepath.Join(ring.directory, name)
+	certData, err := ioutil.ReadFile(base + ".crt")
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := dsig.ParseCertificate(certData)
+	if err != nil {
+		return nil, err
+	}
+	keyData, err := ioutil.ReadFile(base + ".key")
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := dsig.ParsePrivateKey(keyData)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := dsig.NewSignerFromKey(dsig.NewTimedKey(privateKey, "software"), certificate, ring.options)
+	if err != nil {
+		return nil, err
+	}
+	return &key{name, activation, certificate, signer}, nil
+}
+
+// Copies the configured key into the ring as the one signing from now on
+func (ring *Ring) importKey(keyPath, certPath string) error {
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	certData, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	return ring.write(time.Now().UTC().Format(layout), keyData, certData)
+}
+
+// Writes the key before the certificate, as keys are found by their certificates
+func (ring *Ring) write(name string, keyData, certData []byte) error {
+	base := filepath.Join(ring.directory, name)
+	if err := writeNewFile(base+".key", keyData, 0600); err != nil {
+		return err
+	}
+	return writeNewFile(base+".crt", certData, 0644)
+}
+
+// Generates, activates and archives keys as the schedule requires
+func (ring *Ring) Rotate(now time.Time) error {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	active := ring.activeAt(now)
+	if err := ring.noteActivation(ring.keys[active]); err != nil {
+		return err
+	}
+	if active == len(ring.keys)-1 {
+		current := ring.keys[active]
+		if !now.Before(current.activation.AddDate(0, 0, ring.settings.Interval-ring.settings.Publish)) {
+			// SPs get the full publication period even when the ring has fallen behind
+			activation := current.activation.AddDate(0, 0, ring.settings.Interval)
+			if earliest := now.AddDate(0, 0, ring.settings.Publish); activation.Before(earliest) {
+				activation = earliest
+			}
+			if err := ring.generate(activation); err != nil {
+				return err
+			}
+		}
+	}
+	// A replaced key is archived once its successor has signed for the retention period
+	for active > 0 && !now.Before(ring.keys[1].activation.AddDate(0, 0, ring.settings.Retain)) {
+		if err := ring.archive(ring.keys[0]); err != nil {
+			return err
+		}
+		ring.keys = ring.keys[1:]
+		active--
+	}
+	return nil
+}
+
+// Returns the index of the key signing at the time. Before the first activation, the first key signs.
+func (ring *Ring) activeAt(now time.Time) int {
+	active := 0
+	for i, key := range ring.keys {
+		if !now.Before(key.activation) {
+			active = i
+		}
+	}
+	return active
+}
+
+func (ring *Ring) noteActivation(key *key) error {
+	path := filepath.Join(ring.directory, activeFile)
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if strings.TrimSpace(string(previous)) == key.name {
+		return nil
+	}
+	if err := ring.audit.Record(audit.NewKeyEvent(audit.EventKeyActivated, fingerprint(key))); err != nil {
+		return err
+	}
+	ring.logger.Info("Signing key activated", "key", key.name)
+	return ioutil.WriteFile(path, []byte(key.name+"\n"), 0600)
+}
+
+func (ring *Ring) generate(activation time.Time) error {
+	settings := ring.settings
+	// Valid while it's published, signing and retained, with a margin for a late rotation
+	lifetime := time.Duration(settings.Publish+settings.Interval+settings.Retain+30) * 24 * time.Hour
+	keyData, certData, err := dsig.GenerateSelfSigned(ring.hostName, ring.dnsNames, settings.Bits, lifetime)
+	if err != nil {
+		return err
+	}
+	name := activation.UTC().Format(layout)
+	if err := ring.write(name, keyData, certData); err != nil {
+		return err
+	}
+	key, err := ring.loadKey(name, activation.UTC().Truncate(time.Second))
+	if err != nil {
+		return err
+	}
+	ring.keys = append(ring.keys, key)
+	ring.logger.Info("Generated signing key", "key", name)
+	return ring.audit.Record(audit.NewKeyEvent(audit.EventKeyGenerated, fingerprint(key)))
+}
+
+// Moves the key's files out of the ring. They're kept in case an old signature needs to be checked.
+func (ring *Ring) archive(key *key) error {
+	for _, extension := range []string{".crt", ".key"} {
+		from := filepath.Join(ring.directory, key.name+extension)
+		if err := os.Rename(from, filepath.Join(ring.directory, "archive", key.name+extension)); err != nil {
+			return err
+		}
+	}
+	ring.logger.Info("Archived signing key", "key", key.name)
+	return ring.audit.Record(audit.NewKeyEvent(audit.EventKeyArchived, fingerprint(key)))
+}
+
+// Keeps the ring up to date, waking when the next key activates or often enough to renew the lease on
+// rotating keys. Keys are rotated by the leading instance and read back from the directory by the others.
+// Returns once stop is closed.
+func (ring *Ring) Run(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(ring.untilNextChange(time.Now())):
+		}
+		// A new leader starts from whatever the last one left
+		if err := ring.reload(); err != nil {
+			ring.logger.Error("Failed to read signing keys", "err", err)
+			continue
+		}
+		leading, err := ring.election.Lead()
+		if err != nil {
+			ring.logger.Error("Failed to check which instance rotates signing keys", "err", err)
+		}
+		if !leading {
+			continue
+		}
+		if err := ring.Rotate(time.Now()); err != nil {
+			ring.logger.Error("Failed to rotate signing keys", "err", err)
+		}
+	}
+}
+
+// Replaces the ring's keys with those in the directory
+func (ring *Ring) reload() error {
+	keys, err := ring.load()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("no keys in " + ring.directory)
+	}
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	ring.keys = keys
+	return nil
+}
+
+func (ring *Ring) untilNextChange(now time.Time) time.Duration {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	wait := leader.Renewal
+	for _, key := range ring.keys {
+		if until := key.activation.Sub(now); until > 0 && until < wait {
+			wait = until
+		}
+	}
+	return wait
+}
+
+func (ring *Ring) active() *key {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	return ring.keys[ring.activeAt(time.Now())]
+}
+
+func (ring *Ring) SignElement(doc []byte, id string) ([]byte, error) {
+	return ring.active().signer.SignElement(doc, id)
+}
+
+// Returns a signer with the options that follows the ring as keys rotate
+func (ring *Ring) WithOptions(options dsig.Options) (dsig.Signer, error) {
+	return &optionsView{ring, options}, nil
+}
+
+func (ring *Ring) Options() dsig.Options {
+	return ring.active().signer.Options()
+}
+
+func (ring *Ring) SignJWT(claims []byte) (string, error) {
+	return ring.active().signer.(dsig.TokenSigner).SignJWT(claims)
+}
+
+func (ring *Ring) Certificates() []*x509.Certificate {
+	ring.mutex.RLock()
+	defer ring.mutex.RUnlock()
+	certificates := make([]*x509.Certificate, len(ring.keys))
+	for i, key := range ring.keys {
+		certificates[i] = key.certificate
+	}
+	return certificates
+}
+
+// The ring with different algorithms
+type optionsView struct {
+	ring    *Ring
+	options dsig.Options
+}
+
+func (view *optionsView) SignElement(doc []byte, id string) ([]byte, error) {
+	signer, err := view.ring.active().signer.WithOptions(view.options)
+	if err != nil {
+		return nil, err
+	}
+	return signer.SignElement(doc, id)
+}
+
+func (view *optionsView) WithOptions(options dsig.Options) (dsig.Signer, error) {
+	return &optionsView{view.ring, options}, nil
+}
+
+func (view *optionsView) Options() dsig.Options {
+	signer, err := view.ring.active().signer.WithOptions(view.options)
+	if err != nil {
+		return view.options
+	}
+	return signer.Options()
+}
+
+func (view *optionsView) SignJWT(claims []byte) (string, error) {
+	return view.ring.SignJWT(claims)
+}
+
+func (view *optionsView) Certificates() []*x509.Certificate {
+	return view.ring.Certificates()
+}
+
+func fingerprint(key *key) string {
+	sum := sha256.Sum256(key.certificate.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Writes data to a new file, failing rather than overwriting one created in the meantime
+func writeNewFile(path string, data []byte, mode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
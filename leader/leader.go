@@ -0,0 +1,67 @@
+// Package leader picks one of the IdP instances sharing a store to run each background job, such as key
+// rotation and metadata refresh, so the job runs once rather than on every instance. The leader holds a lease
+// in the store that it renews whenever it checks; when it stops, another instance takes over once the lease
+// runs out.
+package leader
+
+import (
+	"github.com/amdonov/lite-idp/store"
+	"github.com/satori/go.uuid"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// How long a lease lasts without being renewed, and so how long a job waits for another instance to take it
+// over when its leader stops
+const Lease = 90 * time.Second
+
+// How often leaders should check in, well within the Lease so a slow store doesn't cost them the lease
+const Renewal = 30 * time.Second
+
+// Identifies this process to the other instances. The host name helps operators tell who leads.
+var instance = func() string {
+	host, _ := os.Hostname()
+	return host + "/" + uuid.NewV4().String()
+}()
+
+// Leadership of one job
+type Election struct {
+	store store.Storer
+	key   string
+	lease int
+	// Whether this instance led when it last checked, so changes are logged
+	leading bool
+	logger  *slog.Logger
+}
+
+// Creates the election for a job, logging changes of leadership to the logger. The leader must check in more
+// often than the lease, or another instance takes over. A nil Election always leads, for IdPs running without
+// peers.
+func New(store store.Storer, job string, lease time.Duration, logger *slog.Logger) *Election {
+	seconds := int(lease / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &Election{store: store, key: "leader:" + job, lease: seconds, logger: logger}
+}
+
+// Reports whether this instance leads, renewing its lease or taking a lapsed one. Calls must not overlap.
+func (election *Election) Lead() (bool, error) {
+	if election == nil {
+		return true, nil
+	}
+	leading, err := election.store.Extend(election.key, instance, election.lease)
+	if err == nil && !leading {
+		leading, err = election.store.StoreIfAbsent(election.key, instance, election.lease)
+	}
+	if err != nil {
+		// Without the store there's no knowing whether another instance leads, so none should
+		leading = false
+	}
+	if leading != election.leading {
+		election.logger.Info("Leadership changed", "job", election.key, "instance", instance, "leading", leading)
+		election.leading = leading
+	}
+	return leading, err
+}
@@ -0,0 +1,169 @@
+// Package logging sets up structured, leveled logging and tags the messages logged while handling a
+// request with a correlation ID
+package logging
+
+import (
+	"context"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/satori/go.uuid"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Header carrying the correlation ID. IDs sent by a proxy in front of the IdP are kept.
+const RequestIDHeader = "X-Request-ID"
+
+// Sets the default logger from the Log, LogLevel and LogFormat settings
+func Configure(config *config.Configuration) error {
+	var level slog.Level
+	switch strings.ToLower(config.LogLevel) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return fmt.Errorf("unknown log level %s", config.LogLevel)
+	}
+	var output io.Writer = os.Stderr
+	if config.Log != "" {
+		file, err := os.OpenFile(config.Log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return err
+		}
+		output = file
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(config.LogFormat) {
+	case "", "text":
+		handler = slog.NewTextHandler(output, options)
+	case "json":
+		handler = slog.NewJSONHandler(output, options)
+	default:
+		return fmt.Errorf("unknown log format %s", config.LogFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+type contextKey struct{}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Gives each request a correlation ID, returned in the X-Request-ID header and added to messages logged
+// through FromRequest, which logs them to the logger
+func Handler(logger *slog.Logger, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.NewV4().String()
+		}
+		writer.Header().Set(RequestIDHeader, id)
+		ctx := context.WithValue(request.Context(), contextKey{}, logger.With("request_id", id))
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Adds the key-value pairs to the messages logged through FromRequest while the handler handles a request,
+// such as the tenant it's for
+func With(handler http.Handler, args ...any) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), contextKey{}, FromRequest(request).With(args...))
+		handler.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// Returns the logger for the request's context, or the default logger outside a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Returns the logger tagging messages with the request's correlation ID
+func FromRequest(request *http.Request) *slog.Logger {
+	return FromContext(request.Context())
+}
+
+// Leveled logging with key-value pairs, which *slog.Logger provides. Programs embedding the IdP can send its
+// messages to zap, zerolog or another library with a Logger adapting it, or with an slog.Handler of their own.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Returns an slog logger sending its messages to the logger, which decides which levels are written
+func New(logger Logger) *slog.Logger {
+	if slogger, ok := logger.(*slog.Logger); ok {
+		return slogger
+	}
+	return slog.New(&adapter{logger: logger})
+}
+
+// Passes slog records to a Logger, flattening groups into dotted keys
+type adapter struct {
+	logger Logger
+	args   []any
+	group  string
+}
+
+func (handler *adapter) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (handler *adapter) Handle(ctx context.Context, record slog.Record) error {
+	args := append([]any{}, handler.args...)
+	record.Attrs(func(attr slog.Attr) bool {
+		args = handler.append(args, handler.group, attr)
+		return true
+	})
+	switch {
+	case record.Level >= slog.LevelError:
+		handler.logger.Error(record.Message, args...)
+	case record.Level >= slog.LevelWarn:
+		handler.logger.Warn(record.Message, args...)
+	case record.Level >= slog.LevelInfo:
+		handler.logger.Info(record.Message, args...)
+	default:
+		handler.logger.Debug(record.Message, args...)
+	}
+	return nil
+}
+
+func (handler *adapter) append(args []any, group string, attr slog.Attr) []any {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			group += attr.Key + "."
+		}
+		for _, member := range value.Group() {
+			args = handler.append(args, group, member)
+		}
+		return args
+	}
+	return append(args, group+attr.Key, value.Any())
+}
+
+func (handler *adapter) WithAttrs(attrs []slog.Attr) slog.Handler {
+	args := append([]any{}, handler.args...)
+	for _, attr := range attrs {
+		args = handler.append(args, handler.group, attr)
+	}
+	return &adapter{logger: handler.logger, args: args, group: handler.group}
+}
+
+func (handler *adapter) WithGroup(name string) slog.Handler {
+	return &adapter{logger: handler.logger, args: handler.args, group: handler.group + name + "."}
+}
@@ -0,0 +1,222 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/dsig"
+	"os"
+	"strings"
+	"time"
+)
+
+type EntityDescriptor struct {
+	XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID         string   `xml:"entityID,attr"`
+	ValidUntil       string   `xml:"validUntil,attr"`
+	Extensions       *Extensions
+	SPSSODescriptor  *SPSSODescriptor
+	IDPSSODescriptor *IDPSSODescriptor
+}
+
+type Extensions struct {
+	XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	EntityAttributes *EntityAttributes
+}
+
+type EntityAttributes struct {
+	XMLName    xml.Name          `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+	Attributes []EntityAttribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+type EntityAttribute struct {
+	Name   string   `xml:",attr"`
+	Values []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+}
+
+// Returns when the metadata stops being valid, if it says
+func (descriptor *EntityDescriptor) Expires() (time.Time, bool) {
+	if descriptor.ValidUntil == "" {
+		return time.Time{}, false
+	}
+	expires, err := time.Parse(time.RFC3339, descriptor.ValidUntil)
+	return expires, err == nil
+}
+
+// Name of the entity attribute listing entity categories
+const EntityCategory = "http://macedir.org/entity-category"
+
+// Returns the entity categories the entity declares, such as Research & Scholarship
+func (descriptor *EntityDescriptor) EntityCategories() []string {
+	if descriptor.Extensions == nil || descriptor.Extensions.EntityAttributes == nil {
+		return nil
+	}
+	var categories []string
+	for _, attribute := range descriptor.Extensions.EntityAttributes.Attributes {
+		if attribute.Name == EntityCategory {
+			for _, value := range attribute.Values {
+				categories = append(categories, strings.TrimSpace(value))
+			}
+		}
+	}
+	return categories
+}
+
+type SPSSODescriptor struct {
+	XMLName                   xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+	AuthnRequestsSigned       bool              `xml:",attr"`
+	WantAssertionsSigned      bool              `xml:",attr"`
+	KeyDescriptors            []KeyDescriptor   `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+	NameIDFormats             []string          `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+	AssertionConsumerServices []IndexedEndpoint `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+}
+
+// The IdP role, read by the test SP from the metadata lite-idp publishes
+type IDPSSODescriptor struct {
+	XMLName              xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	KeyDescriptors       []KeyDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+	SingleSignOnServices []Endpoint      `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+}
+
+type Endpoint struct {
+	Binding  string `xml:",attr"`
+	Location string `xml:",attr"`
+}
+
+// Returns the location of the single sign-on service with the binding, or an empty string if there isn't one
+func (descriptor *IDPSSODescriptor) SingleSignOnService(binding string) string {
+	for _, endpoint := range descriptor.SingleSignOnServices {
+		if endpoint.Binding == binding {
+			return endpoint.Location
+		}
+	}
+	return ""
+}
+
+// Returns the certificates in KeyDescriptors usable for signing
+func (descriptor *IDPSSODescriptor) SigningCertificates() []*x509.Certificate {
+	return signingCertificates(descriptor.KeyDescriptors)
+}
+
+type KeyDescriptor struct {
+	Use     string `xml:"use,attr"`
+	KeyInfo dsig.KeyInfo
+	// Decoded when the metadata is loaded, so requests don't parse it again
+	parsed *x509.Certificate
+}
+
+// An endpoint registered in metadata or configured directly
+type IndexedEndpoint struct {
+	Binding   string `xml:",attr"`
+	Location  string `xml:",attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault *bool  `xml:"isDefault,attr"`
+}
+
+// Reports whether the certificate appears in one of the descriptor's KeyDescriptors not restricted
+// to encryption
+func (descriptor *SPSSODescriptor) HasCertificate(raw []byte) bool {
+	for _, key := range descriptor.KeyDescriptors {
+		if key.Use == "encryption" {
+			continue
+		}
+		if cert := key.certificate(); cert != nil && bytes.Equal(cert.Raw, raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the certificates in KeyDescriptors usable for signing
+func (descriptor *SPSSODescriptor) SigningCertificates() []*x509.Certificate {
+	return signingCertificates(descriptor.KeyDescriptors)
+}
+
+func signingCertificates(keys []KeyDescriptor) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, key := range keys {
+		if key.Use == "encryption" {
+			continue
+		}
+		if cert := key.certificate(); cert != nil {
+			certs = append(certs, cert)
+		}
+	}
+	return certs
+}
+
+// Returns the first certificate in a KeyDescriptor usable for encryption, or nil if there isn't one
+func (descriptor *SPSSODescriptor) EncryptionCertificate() *x509.Certificate {
+	for _, key := range descriptor.KeyDescriptors {
+		if key.Use != "" && key.Use != "encryption" {
+			continue
+		}
+		if cert := key.certificate(); cert != nil {
+			return cert
+		}
+	}
+	return nil
+}
+
+func (key *KeyDescriptor) certificate() *x509.Certificate {
+	if key.parsed != nil {
+		return key.parsed
+	}
+	return key.parse()
+}
+
+func (key *KeyDescriptor) parse() *x509.Certificate {
+	encoded := strings.Join(strings.Fields(key.KeyInfo.X509Data.X509Certificate), "")
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+func Load(path string) (*EntityDescriptor, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var descriptor EntityDescriptor
+	err = xml.NewDecoder(file).Decode(&descriptor)
+	if err != nil {
+		return nil, err
+	}
+	descriptor.parseKeys()
+	return &descriptor, nil
+}
+
+// Parses metadata held in memory, such as metadata uploaded through the admin API
+func Parse(data []byte) (*EntityDescriptor, error) {
+	var descriptor EntityDescriptor
+	err := xml.Unmarshal(data, &descriptor)
+	if err != nil {
+		return nil, err
+	}
+	descriptor.parseKeys()
+	return &descriptor, nil
+}
+
+// Decodes the certificates in the KeyDescriptors once, so they're reused until the metadata is replaced
+func (descriptor *EntityDescriptor) parseKeys() {
+	if descriptor.SPSSODescriptor != nil {
+		parseKeys(descriptor.SPSSODescriptor.KeyDescriptors)
+	}
+	if descriptor.IDPSSODescriptor != nil {
+		parseKeys(descriptor.IDPSSODescriptor.KeyDescriptors)
+	}
+}
+
+func parseKeys(keys []KeyDescriptor) {
+	for i := range keys {
+		keys[i].parsed = keys[i].parse()
+	}
+}
@@ -0,0 +1,91 @@
+package oidc
+
+import (
+	"errors"
+	"github.com/amdonov/lite-idp/logging"
+	"net/http"
+)
+
+// RFC 7662 introspection response. Inactive tokens only report active.
+type introspection struct {
+	Active    bool   `json:"active"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Expires   int64  `json:"exp,omitempty"`
+}
+
+// The RFC 7662 introspection endpoint, which tells resource servers whether an access token is still
+// valid and who it was issued to. Callers authenticate as a confidential client.
+func (provider *Provider) Introspect(writer http.ResponseWriter, request *http.Request) {
+	clientID, ok := provider.protectedEndpoint(writer, request, true)
+	if !ok {
+		return
+	}
+	var grant grant
+	token := request.PostForm.Get("token")
+	if token == "" || provider.store.Retrieve(tokenPrefix+token, &grant) != nil {
+		writeJSON(writer, http.StatusOK, &introspection{})
+		return
+	}
+	logging.FromRequest(request).Debug("Introspected access token", "caller", clientID, "client", grant.ClientID)
+	subject, _ := grant.Claims["sub"].(string)
+	writeJSON(writer, http.StatusOK, &introspection{Active: true, ClientID: grant.ClientID, TokenType: "Bearer",
+		Subject: subject, Audience: grant.ClientID, Issuer: provider.issuer(), IssuedAt: grant.IssuedAt,
+		Expires: grant.Expires})
+}
+
+// The RFC 7009 revocation endpoint. Clients may revoke the access tokens issued to them; unknown tokens
+// are ignored, as the specification requires.
+func (provider *Provider) Revoke(writer http.ResponseWriter, request *http.Request) {
+	clientID, ok := provider.protectedEndpoint(writer, request, false)
+	if !ok {
+		return
+	}
+	token := request.PostForm.Get("token")
+	var grant grant
+	if token != "" && provider.store.Retrieve(tokenPrefix+token, &grant) == nil {
+		if grant.ClientID != clientID {
+			writeJSON(writer, http.StatusBadRequest, &tokenError{"unauthorized_client",
+				"the token was issued to another client"})
+			return
+		}
+		if err := provider.store.Delete(tokenPrefix + token); err != nil {
+			logging.FromRequest(request).Error("Failed to revoke access token", "err", err)
+			writeJSON(writer, http.StatusServiceUnavailable, &tokenError{"temporarily_unavailable",
+				"the token couldn't be revoked"})
+			return
+		}
+		logging.FromRequest(request).Info("Revoked access token", "client", clientID)
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(http.StatusOK)
+}
+
+// Checks the method and client of an introspection or revocation request, answering it when they're
+// wrong. Returns the client ID.
+func (provider *Provider) protectedEndpoint(writer http.ResponseWriter, request *http.Request,
+	confidential bool) (string, bool) {
+	if request.Method != "POST" {
+		writeJSON(writer, http.StatusMethodNotAllowed, &tokenError{"invalid_request", "only POST is accepted"})
+		return "", false
+	}
+	if err := request.ParseForm(); err != nil {
+		writeJSON(writer, http.StatusBadRequest, &tokenError{"invalid_request", err.Error()})
+		return "", false
+	}
+	clientID, client, err := provider.authenticateClient(request)
+	if err == nil && confidential && client.SecretHash == "" {
+		err = errors.New("public clients can't use this endpoint")
+	}
+	if err != nil {
+		logging.FromRequest(request).Warn("Rejected client", "path", request.URL.Path, "err", err)
+		writer.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		writeJSON(writer, http.StatusUnauthorized, &tokenError{"invalid_client", err.Error()})
+		return "", false
+	}
+	return clientID, true
+}
@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	resourceServer = "https://api.example.com"
+	resourceSecret = "resource-secret"
+	// bcrypt hash of resourceSecret
+	resourceHash = "$2a$04$AbQB.dS9d2y6CqR55MkUFugcTRCtPpFZdxqTipSOdng09ZOyzaQRi"
+)
+
+// Returns a provider with a confidential resource server added, and an access token issued to the test client
+func newIntrospectionProvider(t *testing.T) (*Provider, string) {
+	provider, _ := newTestProvider(t)
+	provider.config.ServiceProviders = append(provider.config.ServiceProviders, &config.ServiceProvider{
+		EntityId: resourceServer, OIDC: &config.OIDCClient{SecretHash: resourceHash}})
+	token := newSecret()
+	issued := &grant{ClientID: testClient, Claims: map[string]interface{}{"sub": "jdoe"}}
+	if err := provider.store.Store(tokenPrefix+token, issued, 60); err != nil {
+		t.Fatal(err)
+	}
+	return provider, token
+}
+
+// Posts the token to the endpoint as the client, using its secret when it has one
+func postToken(endpoint http.HandlerFunc, clientID, secret, token string) *httptest.ResponseRecorder {
+	form := url.Values{"client_id": {clientID}, "client_secret": {secret}, "token": {token}}
+	request := httptest.NewRequest("POST", "/oidc/introspect", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	endpoint(recorder, request)
+	return recorder
+}
+
+func introspect(t *testing.T, provider *Provider, token string) *introspection {
+	recorder := postToken(provider.Introspect, resourceServer, resourceSecret, token)
+	var result introspection
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("introspection answered with %d: %s", recorder.Code, recorder.Body)
+	}
+	return &result
+}
+
+func TestIntrospectReportsActiveTokens(t *testing.T) {
+	provider, token := newIntrospectionProvider(t)
+	if result := introspect(t, provider, token); !result.Active || result.Subject != "jdoe" ||
+		result.ClientID != testClient {
+		t.Errorf("issued token introspected as %+v", result)
+	}
+	if result := introspect(t, provider, "unknown"); result.Active || result.Subject != "" {
+		t.Errorf("unknown token introspected as %+v", result)
+	}
+}
+
+// Only confidential clients may introspect, so tokens can't be probed by anyone who knows a client ID
+func TestIntrospectRequiresConfidentialClient(t *testing.T) {
+	provider, token := newIntrospectionProvider(t)
+	if recorder := postToken(provider.Introspect, testClient, "", token); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("public client answered with %d", recorder.Code)
+	}
+	if recorder := postToken(provider.Introspect, resourceServer, "wrong", token); recorder.Code != 401 {
+		t.Errorf("wrong secret answered with %d", recorder.Code)
+	}
+}
+
+func TestRevokeOnlyByIssuedClient(t *testing.T) {
+	provider, token := newIntrospectionProvider(t)
+	if recorder := postToken(provider.Revoke, resourceServer, resourceSecret, token); recorder.Code != 400 {
+		t.Errorf("another client's revocation answered with %d", recorder.Code)
+	}
+	if !introspect(t, provider, token).Active {
+		t.Fatal("another client revoked the token")
+	}
+	if recorder := postToken(provider.Revoke, testClient, "", token); recorder.Code != http.StatusOK {
+		t.Errorf("revocation answered with %d: %s", recorder.Code, recorder.Body)
+	}
+	if introspect(t, provider, token).Active {
+		t.Error("revoked token is still active")
+	}
+	// Unknown tokens are ignored
+	if recorder := postToken(provider.Revoke, testClient, "", token); recorder.Code != http.StatusOK {
+		t.Errorf("revoking again answered with %d", recorder.Code)
+	}
+}
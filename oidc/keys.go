@@ -0,0 +1,120 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
+	"math/big"
+	"net/http"
+)
+
+// A public key in JWK form
+type jsonWebKey struct {
+	KeyType   string   `json:"kty"`
+	Use       string   `json:"use"`
+	Algorithm string   `json:"alg"`
+	KeyID     string   `json:"kid"`
+	N         string   `json:"n,omitempty"`
+	E         string   `json:"e,omitempty"`
+	Curve     string   `json:"crv,omitempty"`
+	X         string   `json:"x,omitempty"`
+	Y         string   `json:"y,omitempty"`
+	Chain     []string `json:"x5c"`
+}
+
+type discovery struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	RevocationEndpoint                string   `json:"revocation_endpoint"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	SigningAlgorithmsSupported        []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+// Serves the JWK set clients verify ID tokens with. Keys about to sign or recently retired are included,
+// as in the SAML metadata.
+func (provider *Provider) Keys(writer http.ResponseWriter, request *http.Request) {
+	var keys []*jsonWebKey
+	for _, certificate := range provider.published() {
+		key, err := newJSONWebKey(certificate)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to publish key", "err", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	writeJSON(writer, http.StatusOK, map[string][]*jsonWebKey{"keys": keys})
+}
+
+// Serves the discovery document, with endpoint URLs as seen by the client
+func (provider *Provider) Discovery(writer http.ResponseWriter, request *http.Request) {
+	settings := provider.settings()
+	algorithms := make([]string, 0, 1)
+	seen := make(map[string]bool)
+	for _, certificate := range provider.published() {
+		if algorithm, _, err := dsig.JWSAlgorithm(certificate.PublicKey); err == nil && !seen[algorithm] {
+			algorithms = append(algorithms, algorithm)
+			seen[algorithm] = true
+		}
+	}
+	url := func(path string) string {
+		return provider.config.EndpointURL(request, path)
+	}
+	writeJSON(writer, http.StatusOK, &discovery{
+		Issuer:                            provider.issuer(),
+		AuthorizationEndpoint:             url(settings.Authorization),
+		TokenEndpoint:                     url(settings.Token),
+		UserInfoEndpoint:                  url(settings.UserInfo),
+		JWKSURI:                           url(settings.JWKS),
+		IntrospectionEndpoint:             url(settings.Introspection),
+		RevocationEndpoint:                url(settings.Revocation),
+		ScopesSupported:                   []string{"openid"},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		SigningAlgorithmsSupported:        algorithms,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	})
+}
+
+// Returns the certificates of the keys that sign now, will sign soon or signed recently
+func (provider *Provider) published() []*x509.Certificate {
+	if provider.keys != nil {
+		return provider.keys.Certificates()
+	}
+	return provider.certificates
+}
+
+func newJSONWebKey(certificate *x509.Certificate) (*jsonWebKey, error) {
+	algorithm, _, err := dsig.JWSAlgorithm(certificate.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	key := &jsonWebKey{Use: "sig", Algorithm: algorithm, KeyID: dsig.KeyID(certificate),
+		Chain: []string{base64.StdEncoding.EncodeToString(certificate.Raw)}}
+	switch public := certificate.PublicKey.(type) {
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		key.KeyType = "EC"
+		key.Curve = public.Curve.Params().Name
+		key.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+		key.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+	}
+	return key, nil
+}
@@ -0,0 +1,268 @@
+// Package oidc serves OpenID Connect's authorization code flow alongside SAML. Authorization requests are
+// handed to the authenticators as AuthnRequests with CodeBinding, and the responses generated for them are
+// turned into authorization codes, so clients share the users' sessions and the attributes released to
+// SAML SPs.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Binding of the AuthnRequests made for authorization requests. The Provider is its marshaller.
+	CodeBinding = "urn:lite-idp:oidc:authorization-code"
+	// Where the discovery document is served
+	DiscoveryPath = config.OIDCDiscovery
+	// Store key prefixes
+	requestPrefix  = "oidc-request:"
+	codePrefix     = "oidc-code:"
+	redeemedPrefix = "oidc-redeemed:"
+	tokenPrefix    = "oidc-token:"
+)
+
+// An authorization request waiting for the user to sign in, stored under the AuthnRequest's ID
+type pendingRequest struct {
+	RedirectURI   string
+	State         string
+	Nonce         string
+	CodeChallenge string
+}
+
+// What an authorization code or access token was issued for
+type grant struct {
+	ClientID      string
+	RedirectURI   string
+	Nonce         string
+	CodeChallenge string
+	AuthTime      int64
+	ACR           string
+	// sub and the released attributes
+	Claims map[string]interface{}
+	// When an access token was issued and expires, in seconds since the epoch
+	IssuedAt int64
+	Expires  int64
+}
+
+type Provider struct {
+	authenticator authentication.Authenticator
+	signer        dsig.TokenSigner
+	store         store.Storer
+	config        *config.Configuration
+	// Published keys, which come from the signer when it rotates them
+	keys         dsig.KeySet
+	certificates []*x509.Certificate
+}
+
+// Creates the provider. Register it as the marshaller of CodeBinding and serve its Authorize, Token,
+// UserInfo, Keys and Discovery handlers at the configured paths.
+func New(authenticator authentication.Authenticator, signer dsig.Signer, store store.Storer,
+	config *config.Configuration) (*Provider, error) {
+	tokens, ok := signer.(dsig.TokenSigner)
+	if !ok {
+		return nil, errors.New("the signing key can't sign ID tokens")
+	}
+	provider := &Provider{authenticator: authenticator, signer: tokens, store: store, config: config}
+	if keys, rotating := signer.(dsig.KeySet); rotating {
+		provider.keys = keys
+		return provider, nil
+	}
+	paths := []string{config.Certificate}
+	if config.NextCertificate != "" {
+		paths = append(paths, config.NextCertificate)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		certificate, err := dsig.ParseCertificate(data)
+		if err != nil {
+			return nil, err
+		}
+		provider.certificates = append(provider.certificates, certificate)
+	}
+	return provider, nil
+}
+
+func (provider *Provider) settings() config.OIDC {
+	return provider.config.OIDC.WithDefaults()
+}
+
+// Returns the client's settings, or nil if the SP isn't an OpenID Connect client
+func (provider *Provider) client(clientID string) *config.OIDCClient {
+	if sp := provider.config.ServiceProvider(clientID); sp != nil {
+		return sp.OIDC
+	}
+	return nil
+}
+
+// The authorization endpoint. Requests from unknown clients or with unregistered redirect URIs are shown
+// an error page; other problems are reported to the client.
+func (provider *Provider) Authorize(writer http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	form := request.Form
+	clientID := form.Get("client_id")
+	accesslog.SetServiceProvider(request, clientID)
+	errorpage.SetServiceProvider(request, clientID)
+	client := provider.client(clientID)
+	if client == nil {
+		errorpage.Error(writer, request, "The application isn't registered with the IdP.", 400)
+		return
+	}
+	redirectURI := form.Get("redirect_uri")
+	if !client.AllowsRedirect(redirectURI) {
+		errorpage.Error(writer, request, "The application's redirect_uri isn't registered with the IdP.", 400)
+		return
+	}
+	pending := &pendingRequest{RedirectURI: redirectURI, State: form.Get("state"), Nonce: form.Get("nonce"),
+		CodeChallenge: form.Get("code_challenge")}
+	fail := func(code, description string) {
+		logging.FromRequest(request).Warn("Rejected authorization request", "client", clientID, "error", code,
+			"description", description)
+		redirect(writer, request, pending, url.Values{"error": {code}, "error_description": {description}})
+	}
+	switch {
+	case form.Get("response_type") != "code":
+		fail("unsupported_response_type", "only the authorization code flow is supported")
+	case !hasScope(form.Get("scope"), "openid"):
+		fail("invalid_scope", "the openid scope is required")
+	case form.Get("request") != "" || form.Get("request_uri") != "":
+		fail("request_not_supported", "request objects aren't supported")
+	case pending.CodeChallenge != "" && form.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "code_challenge_method must be S256")
+	case pending.CodeChallenge == "" && client.SecretHash == "":
+		fail("invalid_request", "public clients must send a PKCE code_challenge")
+	default:
+		// Present the request to the authenticators as if it were a SAML request
+		authnRequest := &protocol.AuthnRequest{AssertionConsumerServiceURL: redirectURI,
+			ProtocolBinding: CodeBinding, IsPassive: hasScope(form.Get("prompt"), "none")}
+		authnRequest.ID = protocol.NewID()
+		authnRequest.Version = "2.0"
+		authnRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+		authnRequest.Issuer = clientID
+		lifetime := provider.config.Sessions.WithDefaults().RequestLifetime
+		if err := provider.store.Store(requestPrefix+authnRequest.ID, pending, lifetime); err != nil {
+			logging.FromRequest(request).Error("Failed to save authorization request", "err", err)
+			fail("server_error", "the request couldn't be saved")
+			return
+		}
+		provider.authenticator.Authenticate(authnRequest, "", writer, request)
+	}
+}
+
+// Sends the user back to the client with an authorization code, or the error the request failed with
+func (provider *Provider) Marshal(writer http.ResponseWriter, request *http.Request, response *protocol.Response,
+	authnRequest *protocol.AuthnRequest, relayState string) {
+	var pending pendingRequest
+	if err := provider.store.Retrieve(requestPrefix+authnRequest.ID, &pending); err != nil {
+		errorpage.Error(writer, request, "The sign in took too long. Return to the application and try again.", 400)
+		return
+	}
+	provider.store.Delete(requestPrefix + authnRequest.ID)
+	if response.Status == nil || response.Status.StatusCode.Value != protocol.StatusSuccess ||
+		response.Assertion == nil {
+		code, description := oauthError(response.Status)
+		redirect(writer, request, &pending, url.Values{"error": {code}, "error_description": {description}})
+		return
+	}
+	grant := provider.newGrant(authnRequest.Issuer, &pending, response)
+	code := newSecret()
+	if err := provider.store.Store(codePrefix+code, grant, provider.settings().CodeLifetime); err != nil {
+		logging.FromRequest(request).Error("Failed to save authorization code", "err", err)
+		redirect(writer, request, &pending, url.Values{"error": {"server_error"},
+			"error_description": {"the authorization code couldn't be saved"}})
+		return
+	}
+	redirect(writer, request, &pending, url.Values{"code": {code}})
+}
+
+// Collects the claims about the user from the assertion generated for the client
+func (provider *Provider) newGrant(clientID string, pending *pendingRequest, response *protocol.Response) *grant {
+	assertion := response.Assertion
+	grant := &grant{ClientID: clientID, RedirectURI: pending.RedirectURI, Nonce: pending.Nonce,
+		CodeChallenge: pending.CodeChallenge, Claims: protocol.Claims(assertion, provider.client(clientID).Claims)}
+	if statement := assertion.AuthnStatement; statement != nil {
+		grant.AuthTime = statement.AuthnInstant.Unix()
+		if statement.AuthnContext != nil {
+			grant.ACR = statement.AuthnContext.AuthnContextClassRef
+		}
+	}
+	return grant
+}
+
+// Converts a SAML status into an OAuth error code and description
+func oauthError(status *protocol.Status) (string, string) {
+	if status == nil {
+		return "server_error", "no status"
+	}
+	description := status.StatusMessage
+	if description == "" {
+		description = status.StatusCode.Value
+	}
+	if status.StatusCode.StatusCode != nil {
+		switch status.StatusCode.StatusCode.Value {
+		case protocol.StatusNoPassive:
+			return "login_required", description
+		case protocol.StatusRequestDenied, protocol.StatusAuthnFailed, protocol.StatusNoAuthnContext:
+			return "access_denied", description
+		}
+	}
+	if status.StatusCode.Value == protocol.StatusRequester {
+		return "invalid_request", description
+	}
+	return "server_error", description
+}
+
+// Redirects to the client with the parameters and its state
+func redirect(writer http.ResponseWriter, request *http.Request, pending *pendingRequest, parameters url.Values) {
+	target, err := url.Parse(pending.RedirectURI)
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 500)
+		return
+	}
+	query := target.Query()
+	for name, values := range parameters {
+		query[name] = values
+	}
+	if pending.State != "" {
+		query.Set("state", pending.State)
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(writer, request, target.String(), http.StatusFound)
+}
+
+// Reports whether the space separated list contains the value
+func hasScope(list, value string) bool {
+	for _, item := range strings.Fields(list) {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a random value for codes and tokens
+func newSecret() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
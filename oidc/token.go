@@ -0,0 +1,183 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// An OAuth error response
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+}
+
+// The token endpoint, which exchanges an authorization code for an ID token and an access token.
+// Confidential clients authenticate with HTTP Basic or client_secret in the body.
+func (provider *Provider) Token(writer http.ResponseWriter, request *http.Request) {
+	fail := func(status int, code, description string) {
+		logging.FromRequest(request).Warn("Rejected token request", "error", code, "description", description)
+		if status == http.StatusUnauthorized {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeJSON(writer, status, &tokenError{code, description})
+	}
+	if request.Method != "POST" {
+		fail(http.StatusMethodNotAllowed, "invalid_request", "the token endpoint only accepts POST")
+		return
+	}
+	if err := request.ParseForm(); err != nil {
+		fail(http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, _, err := provider.authenticateClient(request)
+	if err != nil {
+		fail(http.StatusUnauthorized, "invalid_client", err.Error())
+		return
+	}
+	if grantType := request.PostForm.Get("grant_type"); grantType != "authorization_code" {
+		fail(http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	code := request.PostForm.Get("code")
+	var grant grant
+	if err := provider.store.Retrieve(codePrefix+code, &grant); err != nil {
+		fail(http.StatusBadRequest, "invalid_grant", "the code is unknown or has expired")
+		return
+	}
+	// Codes may only be redeemed once
+	settings := provider.settings()
+	first, err := provider.store.StoreIfAbsent(redeemedPrefix+code, clientID, settings.CodeLifetime)
+	if err != nil {
+		logging.FromRequest(request).Error("Failed to redeem authorization code", "err", err)
+		fail(http.StatusInternalServerError, "server_error", "the code couldn't be redeemed")
+		return
+	}
+	provider.store.Delete(codePrefix + code)
+	switch {
+	case !first:
+		fail(http.StatusBadRequest, "invalid_grant", "the code has already been used")
+	case grant.ClientID != clientID:
+		fail(http.StatusBadRequest, "invalid_grant", "the code was issued to another client")
+	case grant.RedirectURI != request.PostForm.Get("redirect_uri"):
+		fail(http.StatusBadRequest, "invalid_grant", "redirect_uri doesn't match the authorization request")
+	case grant.CodeChallenge != "" && !verifies(request.PostForm.Get("code_verifier"), grant.CodeChallenge):
+		fail(http.StatusBadRequest, "invalid_grant", "the code_verifier doesn't match the code_challenge")
+	default:
+		now := time.Now()
+		idToken, err := provider.idToken(&grant, now, settings.TokenLifetime)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to sign ID token", "err", err)
+			fail(http.StatusInternalServerError, "server_error", "the ID token couldn't be signed")
+			return
+		}
+		accessToken := newSecret()
+		grant.IssuedAt = now.Unix()
+		grant.Expires = now.Add(time.Duration(settings.TokenLifetime) * time.Second).Unix()
+		if err := provider.store.Store(tokenPrefix+accessToken, &grant, settings.TokenLifetime); err != nil {
+			logging.FromRequest(request).Error("Failed to save access token", "err", err)
+			fail(http.StatusInternalServerError, "server_error", "the access token couldn't be saved")
+			return
+		}
+		writeJSON(writer, http.StatusOK, &tokenResponse{AccessToken: accessToken, TokenType: "Bearer",
+			ExpiresIn: settings.TokenLifetime, IDToken: idToken})
+	}
+}
+
+// The UserInfo endpoint, which returns the claims of the user an access token was issued for
+func (provider *Provider) UserInfo(writer http.ResponseWriter, request *http.Request) {
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+	var grant grant
+	if token == "" || provider.store.Retrieve(tokenPrefix+token, &grant) != nil {
+		writer.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(writer, http.StatusUnauthorized, &tokenError{"invalid_token",
+			"the access token is unknown or has expired"})
+		return
+	}
+	accesslog.SetServiceProvider(request, grant.ClientID)
+	writeJSON(writer, http.StatusOK, grant.Claims)
+}
+
+// Identifies the client from HTTP Basic credentials or client_id and client_secret in the form, checking
+// the secret of confidential clients. The form must already be parsed.
+func (provider *Provider) authenticateClient(request *http.Request) (string, *config.OIDCClient, error) {
+	clientID, secret, basic := request.BasicAuth()
+	if basic {
+		// The credentials are form encoded before they're put in the header
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = request.PostForm.Get("client_id"), request.PostForm.Get("client_secret")
+	}
+	accesslog.SetServiceProvider(request, clientID)
+	client := provider.client(clientID)
+	if client == nil {
+		return "", nil, errors.New("unknown client")
+	}
+	if client.SecretHash != "" && bcrypt.CompareHashAndPassword([]byte(client.SecretHash), []byte(secret)) != nil {
+		return "", nil, errors.New("wrong client secret")
+	}
+	return clientID, client, nil
+}
+
+// Signs an ID token for the grant
+func (provider *Provider) idToken(grant *grant, now time.Time, lifetime int) (string, error) {
+	claims := make(map[string]interface{}, len(grant.Claims)+7)
+	for name, value := range grant.Claims {
+		claims[name] = value
+	}
+	claims["iss"] = provider.issuer()
+	claims["aud"] = grant.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Duration(lifetime) * time.Second).Unix()
+	if grant.AuthTime != 0 {
+		claims["auth_time"] = grant.AuthTime
+	}
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+	if grant.ACR != "" {
+		claims["acr"] = grant.ACR
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return provider.signer.SignJWT(payload)
+}
+
+// Checks a PKCE verifier against an S256 challenge
+func verifies(verifier, challenge string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+func (provider *Provider) issuer() string {
+	return strings.TrimSuffix(provider.config.BaseURL, "/")
+}
+
+// Writes an uncacheable JSON response
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(value)
+}
@@ -0,0 +1,86 @@
+package oidc
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/store"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClient   = "https://app.example.com"
+	testRedirect = "https://app.example.com/callback"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// Returns a provider with one public client, and the code it issued for the client's request
+func newTestProvider(t *testing.T) (*Provider, string) {
+	key, cert, err := dsig.GenerateSelfSigned("idp", nil, 2048, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dsig.NewSigner(bytes.NewReader(key), bytes.NewReader(cert), dsig.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &config.Configuration{BaseURL: "https://idp.example.com", OIDC: &config.OIDC{},
+		ServiceProviders: []*config.ServiceProvider{{EntityId: testClient,
+			OIDC: &config.OIDCClient{RedirectURIs: []string{testRedirect}}}}}
+	provider := &Provider{signer: signer.(dsig.TokenSigner), store: store.NewMemory(), config: settings}
+	sum := sha256.Sum256([]byte(testVerifier))
+	code := newSecret()
+	issued := &grant{ClientID: testClient, RedirectURI: testRedirect,
+		CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]), Claims: map[string]interface{}{"sub": "jdoe"}}
+	if err := provider.store.Store(codePrefix+code, issued, 60); err != nil {
+		t.Fatal(err)
+	}
+	return provider, code
+}
+
+// Redeems the code at the token endpoint, returning the status and the OAuth error if there is one
+func redeem(provider *Provider, code, redirectURI, verifier string) (int, string) {
+	form := url.Values{"grant_type": {"authorization_code"}, "client_id": {testClient}, "code": {code},
+		"redirect_uri": {redirectURI}, "code_verifier": {verifier}}
+	request := httptest.NewRequest("POST", "/oidc/token", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	recorder := httptest.NewRecorder()
+	provider.Token(recorder, request)
+	var failure tokenError
+	json.Unmarshal(recorder.Body.Bytes(), &failure)
+	return recorder.Code, failure.Error
+}
+
+func TestTokenRedeemsCodeOnce(t *testing.T) {
+	provider, code := newTestProvider(t)
+	if status, failure := redeem(provider, code, testRedirect, testVerifier); status != 200 {
+		t.Fatalf("code redeemed with status %d: %s", status, failure)
+	}
+	if status, failure := redeem(provider, code, testRedirect, testVerifier); status != 400 ||
+		failure != "invalid_grant" {
+		t.Errorf("reused code returned status %d: %s", status, failure)
+	}
+}
+
+func TestTokenChecksPKCEVerifier(t *testing.T) {
+	provider, code := newTestProvider(t)
+	if status, failure := redeem(provider, code, testRedirect, "wrong-verifier"); status != 400 ||
+		failure != "invalid_grant" {
+		t.Errorf("wrong code_verifier returned status %d: %s", status, failure)
+	}
+}
+
+func TestTokenChecksRedirectURI(t *testing.T) {
+	provider, code := newTestProvider(t)
+	status, failure := redeem(provider, code, "https://attacker.example.com/callback", testVerifier)
+	if status != 400 || failure != "invalid_grant" {
+		t.Errorf("another redirect_uri returned status %d: %s", status, failure)
+	}
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/metadata"
+)
+
+const (
+	HTTPPostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	HTTPArtifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+	HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	SOAPBinding         = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+)
+
+// Bindings the IdP can deliver responses with
+var ResponseBindings = []string{HTTPPostBinding, HTTPArtifactBinding}
+
+// Determines where the response for the request should be sent. Only endpoints registered for the SP are
+// trusted. An AssertionConsumerServiceIndex selects that endpoint, an AssertionConsumerServiceURL must match
+// a registered location, and otherwise the SP's default endpoint is used. A ProtocolBinding in the request
+// limits the choice to endpoints using that binding.
+func ResolveACS(sp *config.ServiceProvider, request *AuthnRequest) (*metadata.IndexedEndpoint, error) {
+	return ResolveACSWithBindings(sp, request, ResponseBindings)
+}
+
+// Resolves the endpoint as ResolveACS does, considering only endpoints with one of the bindings
+func ResolveACSWithBindings(sp *config.ServiceProvider, request *AuthnRequest,
+	bindings []string) (*metadata.IndexedEndpoint, error) {
+	if sp == nil {
+		return nil, fmt.Errorf("unknown service provider %s", request.Issuer)
+	}
+	var endpoints []metadata.IndexedEndpoint
+	for _, endpoint := range sp.AssertionConsumerServices {
+		if supportedBinding(endpoint.Binding, bindings) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no usable assertion consumer services registered for %s", sp.EntityId)
+	}
+	if request.AssertionConsumerServiceIndex != nil {
+		for i := range endpoints {
+			if endpoints[i].Index == *request.AssertionConsumerServiceIndex {
+				return &endpoints[i], nil
+			}
+		}
+		return nil, fmt.Errorf("no assertion consumer service with index %d", *request.AssertionConsumerServiceIndex)
+	}
+	if request.ProtocolBinding != "" {
+		var matching []metadata.IndexedEndpoint
+		for _, endpoint := range endpoints {
+			if endpoint.Binding == request.ProtocolBinding {
+				matching = append(matching, endpoint)
+			}
+		}
+		if len(matching) == 0 {
+			return nil, NewStatusError(StatusRequester, StatusUnsupportedBinding,
+				"no assertion consumer service supports binding "+request.ProtocolBinding)
+		}
+		endpoints = matching
+	}
+	if request.AssertionConsumerServiceURL != "" {
+		for i := range endpoints {
+			if endpoints[i].Location == request.AssertionConsumerServiceURL {
+				return &endpoints[i], nil
+			}
+		}
+		return nil, errors.New("AssertionConsumerServiceURL is not registered for the service provider")
+	}
+	return defaultEndpoint(endpoints), nil
+}
+
+// Returns the SP's default endpoint, used to report errors when the requested endpoint can't be trusted
+func DefaultACS(sp *config.ServiceProvider) (*metadata.IndexedEndpoint, error) {
+	return ResolveACS(sp, &AuthnRequest{})
+}
+
+func supportedBinding(binding string, bindings []string) bool {
+	for _, supported := range bindings {
+		if binding == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// Picks the endpoint marked isDefault, else the first not marked false, else the first
+func defaultEndpoint(endpoints []metadata.IndexedEndpoint) *metadata.IndexedEndpoint {
+	var candidate *metadata.IndexedEndpoint
+	for i := range endpoints {
+		isDefault := endpoints[i].IsDefault
+		if isDefault != nil && *isDefault {
+			return &endpoints[i]
+		}
+		if isDefault == nil && candidate == nil {
+			candidate = &endpoints[i]
+		}
+	}
+	if candidate == nil {
+		candidate = &endpoints[0]
+	}
+	return candidate
+}
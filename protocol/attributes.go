@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// Creates the attribute statement for the SP using its encodings, encrypting sensitive attributes to the
+// encryption key in its metadata. Only attributes the release policies allow are included, along with the
+// SP's static attributes and the user's identifiers for the SP.
+func NewAttributeStatement(config *config.Configuration, entityId string, user *AuthenticatedUser,
+	attributes map[string][]string) (*saml.AttributeStatement, error) {
+	cert, options := config.EncryptionFor(entityId)
+	released := ReleaseAttributes(config, entityId, attributes)
+	if sp := config.ServiceProvider(entityId); sp != nil && len(sp.StaticAttributes) > 0 {
+		combined := make(map[string][]string, len(released)+len(sp.StaticAttributes))
+		for name, values := range released {
+			combined[name] = values
+		}
+		for name, values := range sp.StaticAttributes {
+			combined[name] = values
+		}
+		released = combined
+	}
+	stmt, err := saml.NewAttributeStatement(released, config.AttributeEncodingsFor(entityId), cert, options)
+	if err != nil {
+		return nil, err
+	}
+	identifiers, err := identifierAttributes(config, entityId, user)
+	if err != nil || len(identifiers) == 0 {
+		return stmt, err
+	}
+	if stmt == nil {
+		stmt = &saml.AttributeStatement{}
+	}
+	stmt.Attributes = append(stmt.Attributes, identifiers...)
+	return stmt, nil
+}
+
+// Returns the attributes and values the release policies allow the SP to receive once its group mappings
+// are applied. Every attribute is released when no policies are configured. Attributes left without values
+// are omitted.
+func ReleaseAttributes(config *config.Configuration, entityId string,
+	attributes map[string][]string) map[string][]string {
+	config = config.Current()
+	attributes = mapGroups(config, entityId, attributes)
+	if len(config.ReleasePolicies) == 0 || attributes == nil {
+		return attributes
+	}
+	categories := config.EntityCategoriesFor(entityId)
+	released := make(map[string]bool)
+	denied := make(map[string]bool)
+	all := false
+	matched := config.ReleasePolicies[:0:0]
+	for _, policy := range config.ReleasePolicies {
+		if !policy.Matches(entityId, categories) {
+			continue
+		}
+		matched = append(matched, policy)
+		for _, name := range policy.Attributes {
+			all = all || name == "*"
+			released[name] = true
+		}
+		for _, name := range policy.Deny {
+			denied[name] = true
+		}
+	}
+	filtered := make(map[string][]string)
+	for name, values := range attributes {
+		if (all || released[name]) && !denied[name] {
+			if values = releaseValues(matched, name, values); len(values) > 0 {
+				filtered[name] = values
+			}
+		}
+	}
+	return filtered
+}
+
+// Returns the values permitted by the value rules of the policies
+func releaseValues(policies []*config.ReleasePolicy, name string, values []string) []string {
+	var kept []string
+	for _, value := range values {
+		restricted, permitted, denied := false, false, false
+		for _, policy := range policies {
+			limits, permits := policy.PermitsValue(name, value)
+			restricted = restricted || limits
+			permitted = permitted || permits
+			denied = denied || policy.DeniesValue(name, value)
+		}
+		if (!restricted || permitted) && !denied {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
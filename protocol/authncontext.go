@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/config"
+)
+
+const (
+	ComparisonExact   = "exact"
+	ComparisonMinimum = "minimum"
+	ComparisonMaximum = "maximum"
+	ComparisonBetter  = "better"
+)
+
+type RequestedAuthnContext struct {
+	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
+	Comparison           string   `xml:",attr,omitempty"`
+	AuthnContextClassRef []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+}
+
+// Reports whether the context class satisfies the request. Order ranks classes from weakest to strongest
+// and is used for minimum, maximum and better comparisons. Classes missing from it only match exactly.
+func (requested *RequestedAuthnContext) Satisfied(classRef string, order []string) bool {
+	if len(requested.AuthnContextClassRef) == 0 {
+		return true
+	}
+	exact := false
+	for _, ref := range requested.AuthnContextClassRef {
+		if ref == classRef {
+			exact = true
+		}
+	}
+	switch requested.Comparison {
+	case "", ComparisonExact:
+		return exact
+	case ComparisonMinimum, ComparisonMaximum:
+		if exact {
+			return true
+		}
+	}
+	rank := indexOf(order, classRef)
+	if rank < 0 {
+		return false
+	}
+	for _, ref := range requested.AuthnContextClassRef {
+		requestedRank := indexOf(order, ref)
+		if requestedRank < 0 {
+			continue
+		}
+		switch requested.Comparison {
+		case ComparisonMinimum:
+			if rank >= requestedRank {
+				return true
+			}
+		case ComparisonMaximum:
+			if rank <= requestedRank {
+				return true
+			}
+		case ComparisonBetter:
+			if rank > requestedRank {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the context class for the authentication methods, using the configured mapping or the
+// authenticator's default context when no mapping matches
+func ClassRefFor(config *config.Configuration, entityId string, methods []string, context string) string {
+	classRef := config.AuthnContextFor(entityId, methods)
+	if classRef == "" {
+		classRef = context
+	}
+	return classRef
+}
+
+// Decides whether authentication methods are acceptable for a request
+type AuthnContextPolicy interface {
+	// Reports whether authenticating with the methods, whose default context is given, satisfies the
+	// request's RequestedAuthnContext
+	Permits(request *AuthnRequest, methods []string, context string) bool
+}
+
+func NewAuthnContextPolicy(config *config.Configuration) AuthnContextPolicy {
+	return &authnContextPolicy{config}
+}
+
+type authnContextPolicy struct {
+	config *config.Configuration
+}
+
+func (policy *authnContextPolicy) Permits(request *AuthnRequest, methods []string, context string) bool {
+	if request.RequestedAuthnContext == nil {
+		return true
+	}
+	config := policy.config.Current()
+	classRef := ClassRefFor(config, request.Issuer, methods, context)
+	return request.RequestedAuthnContext.Satisfied(classRef, config.AuthnContextOrder)
+}
+
+// Returned when no available authentication method satisfies the RequestedAuthnContext
+var ErrNoAuthnContext = NewStatusError(StatusRequester, StatusNoAuthnContext,
+	"the requested authentication context cannot be satisfied")
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/saml"
+	"time"
+)
+
+// Builds the assertion conditions for the audience, applying any restrictions configured for that SP
+func NewConditions(config *config.Configuration, audience string, notBefore, notOnOrAfter time.Time) *saml.Conditions {
+	conditions := &saml.Conditions{NotBefore: notBefore, NotOnOrAfter: notOnOrAfter}
+	audiences := []string{audience}
+	sp := config.ServiceProvider(audience)
+	if sp != nil {
+		audiences = append(audiences, sp.Audiences...)
+		if sp.OneTimeUse {
+			conditions.OneTimeUse = &saml.OneTimeUse{}
+		}
+		// SPs that delegate present their assertion back to the IdP
+		if sp.Delegation != nil && len(sp.Delegation.Targets) > 0 {
+			audiences = append(audiences, config.EntityId)
+		}
+		if sp.ProxyRestriction != nil {
+			conditions.ProxyRestriction = &saml.ProxyRestriction{Count: sp.ProxyRestriction.Count,
+				Audience: sp.ProxyRestriction.Audiences}
+		}
+	}
+	conditions.AudienceRestriction = &saml.AudienceRestriction{Audience: audiences}
+	return conditions
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"regexp"
+	"strings"
+)
+
+// Applies the SP's group mappings, replacing each source attribute with the values its groups map to
+func mapGroups(config *config.Configuration, entityId string, attributes map[string][]string) map[string][]string {
+	mappings := config.GroupMappingsFor(entityId)
+	if len(mappings) == 0 || attributes == nil {
+		return attributes
+	}
+	mapped := make(map[string][]string, len(attributes))
+	// Values are copied, as mapped groups are appended to them and the user's attributes are shared
+	for name, values := range attributes {
+		mapped[name] = append([]string(nil), values...)
+	}
+	for _, mapping := range mappings {
+		delete(mapped, mapping.Source)
+	}
+	for _, mapping := range mappings {
+		groups := make(map[string][]string, len(mapping.Groups))
+		for dn, values := range mapping.Groups {
+			groups[normalizeDN(dn)] = values
+		}
+		seen := make(map[string]bool)
+		for _, value := range mapped[mapping.Target] {
+			seen[value] = true
+		}
+		for _, dn := range attributes[mapping.Source] {
+			for _, value := range groups[normalizeDN(dn)] {
+				if !seen[value] {
+					seen[value] = true
+					mapped[mapping.Target] = append(mapped[mapping.Target], value)
+				}
+			}
+		}
+	}
+	return mapped
+}
+
+var dnSeparator = regexp.MustCompile(`\s*([,=+])\s*`)
+
+func normalizeDN(dn string) string {
+	return dnSeparator.ReplaceAllString(strings.ToLower(strings.TrimSpace(dn)), "$1")
+}
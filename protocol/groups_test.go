@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"reflect"
+	"testing"
+)
+
+// Mapped groups are added to the target attribute without changing the user's attributes
+func TestMapGroupsLeavesAttributesUnchanged(t *testing.T) {
+	settings := &config.Configuration{GroupMappings: []*config.GroupMapping{{Source: "memberOf",
+		Target: "eduPersonEntitlement", Groups: map[string][]string{"CN=Staff,DC=example,DC=org": {"staff"}}}}}
+	entitlements := make([]string, 1, 4)
+	entitlements[0] = "library"
+	attributes := map[string][]string{"memberOf": {"cn=staff, dc=example, dc=org"},
+		"eduPersonEntitlement": entitlements}
+	first := mapGroups(settings, "https://sp1.example.com", attributes)
+	first["eduPersonEntitlement"] = append(first["eduPersonEntitlement"], "sp1")
+	second := mapGroups(settings, "https://sp2.example.com", attributes)
+	if expected := []string{"library", "staff"}; !reflect.DeepEqual(second["eduPersonEntitlement"], expected) {
+		t.Errorf("mapped entitlements %v", second["eduPersonEntitlement"])
+	}
+	if !reflect.DeepEqual(attributes["eduPersonEntitlement"], []string{"library"}) || entitlements[:2][1] != "" {
+		t.Errorf("user's entitlements changed to %v", entitlements[:2])
+	}
+	if _, found := second["memberOf"]; found {
+		t.Error("group DNs were released")
+	}
+}
@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/saml"
+	"regexp"
+)
+
+// Identifiers that may be sent to SPs as attributes
+const (
+	IdentifierTargetedID = "eduPersonTargetedID"
+	IdentifierPairwise   = "pairwise-id"
+	IdentifierSubject    = "subject-id"
+)
+
+const persistentFormat = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+
+// The unique ID part of subject-id and pairwise-id values
+var uniqueID = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9=-]{0,126}$`)
+
+// Returns the identifier attributes configured for the SP
+func identifierAttributes(config *config.Configuration, entityId string,
+	user *AuthenticatedUser) ([]saml.Attribute, error) {
+	config = config.Current()
+	sp := config.ServiceProvider(entityId)
+	if sp == nil || len(sp.Identifiers) == 0 {
+		return nil, nil
+	}
+	pairwise := config.Pairwise
+	if pairwise == nil {
+		return nil, errors.New("identifiers require the Pairwise settings")
+	}
+	nameQualifier, spNameQualifier := config.NameQualifiersFor(entityId)
+	var attributes []saml.Attribute
+	for _, kind := range sp.Identifiers {
+		var value saml.AttributeValue
+		switch kind {
+		case IdentifierTargetedID, IdentifierPairwise:
+			id, err := pairwise.Salts.Pairwise(sp.SaltVersion, user.Name, spNameQualifier)
+			if err != nil {
+				return nil, err
+			}
+			if kind == IdentifierTargetedID {
+				value.NameID = &saml.NameID{Format: persistentFormat, NameQualifier: nameQualifier,
+					SPNameQualifier: spNameQualifier, Value: id}
+			} else {
+				value.Value = scoped(id, pairwise.Scope)
+			}
+		case IdentifierSubject:
+			if !uniqueID.MatchString(user.Name) {
+				return nil, fmt.Errorf("%s can't be used as a subject-id", user.Name)
+			}
+			value.Value = scoped(user.Name, pairwise.Scope)
+		default:
+			return nil, fmt.Errorf("unknown identifier %s", kind)
+		}
+		attributes = append(attributes, saml.Attribute{Name: identifierNames[kind], FriendlyName: kind,
+			NameFormat: saml.NameFormatURI, AttributeValues: []saml.AttributeValue{value}})
+	}
+	return attributes, nil
+}
+
+// Returns the value with the scope appended. Without a scope it's returned as is rather than ending in @.
+func scoped(value, scope string) string {
+	if scope == "" {
+		return value
+	}
+	return value + "@" + scope
+}
+
+var identifierNames = map[string]string{
+	IdentifierTargetedID: "urn:oid:1.3.6.1.4.1.5923.1.1.1.10",
+	IdentifierPairwise:   "urn:oasis:names:tc:SAML:attribute:pairwise-id",
+	IdentifierSubject:    "urn:oasis:names:tc:SAML:attribute:subject-id",
+}
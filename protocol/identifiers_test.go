@@ -0,0 +1,12 @@
+package protocol
+
+import "testing"
+
+func TestScopedValues(t *testing.T) {
+	if value := scoped("jdoe", "example.org"); value != "jdoe@example.org" {
+		t.Errorf("scoped as %s", value)
+	}
+	if value := scoped("jdoe", ""); value != "jdoe" {
+		t.Errorf("scoped without a scope as %s", value)
+	}
+}
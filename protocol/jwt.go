@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// Returns the assertion's subject as sub and its attributes as claims. Attributes are named by the
+// claims table, keyed by Name or FriendlyName, and otherwise by their FriendlyName or Name. Single
+// values are strings and multiple values arrays.
+func Claims(assertion *saml.Assertion, names map[string]string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if statement := assertion.AttributeStatement; statement != nil {
+		for _, attribute := range statement.Attributes {
+			name := names[attribute.Name]
+			if name == "" {
+				name = names[attribute.FriendlyName]
+			}
+			if name == "" {
+				name = attribute.FriendlyName
+			}
+			if name == "" {
+				name = attribute.Name
+			}
+			var values []string
+			for _, value := range attribute.AttributeValues {
+				if value.NameID != nil {
+					values = append(values, value.NameID.Value)
+				} else {
+					values = append(values, value.Value)
+				}
+			}
+			if len(values) == 1 {
+				claims[name] = values[0]
+			} else {
+				claims[name] = values
+			}
+		}
+	}
+	// Set last so an attribute can't replace the subject
+	if assertion.Subject != nil && assertion.Subject.NameID != nil {
+		claims["sub"] = assertion.Subject.NameID.Value
+	}
+	return claims
+}
+
+// Returns a signed JWT with the same subject, attributes and lifetime as the response's assertion, for
+// SPs configured to receive one alongside it. The jti is the assertion ID and sid its SessionIndex.
+func NewJWT(signer dsig.Signer, config *config.Configuration, entityId string, response *Response) (string,
+	error) {
+	tokens, ok := signer.(dsig.TokenSigner)
+	if !ok {
+		return "", errors.New("the signing key can't sign tokens")
+	}
+	assertion := response.Assertion
+	if assertion == nil {
+		return "", errors.New("the response has no assertion")
+	}
+	var names map[string]string
+	if sp := config.ServiceProvider(entityId); sp != nil && sp.JWT != nil {
+		names = sp.JWT.Claims
+	}
+	claims := Claims(assertion, names)
+	claims["iss"] = config.EntityId
+	claims["aud"] = entityId
+	claims["jti"] = assertion.ID
+	claims["iat"] = assertion.IssueInstant.Unix()
+	if conditions := assertion.Conditions; conditions != nil {
+		claims["nbf"] = conditions.NotBefore.Unix()
+		claims["exp"] = conditions.NotOnOrAfter.Unix()
+	}
+	if statement := assertion.AuthnStatement; statement != nil {
+		claims["sid"] = statement.SessionIndex
+		claims["auth_time"] = statement.AuthnInstant.Unix()
+		if statement.AuthnContext != nil && statement.AuthnContext.AuthnContextClassRef != "" {
+			claims["acr"] = statement.AuthnContext.AuthnContextClassRef
+		}
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	return tokens.SignJWT(data)
+}
+
+// Returns the store key of a JWT awaiting collection by the SP
+func JWTKey(entityId, sessionIndex string) string {
+	return "jwt:" + entityId + ":" + sessionIndex
+}
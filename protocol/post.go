@@ -1,18 +1,19 @@
 package protocol
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/base64"
 	"encoding/xml"
-	"github.com/amdonov/xmlsig"
-	"log"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/xmlutil"
 	"net/http"
+	"strings"
 	"text/template"
 )
 
-func NewPOSTResponseMarshaller(signer xmlsig.Signer) ResponseMarshaller {
-	generator := &postResponseMarshaller{signer: signer}
+func NewPOSTResponseMarshaller(signer dsig.Signer, config *config.Configuration) ResponseMarshaller {
+	generator := &postResponseMarshaller{signer: signer, config: config}
 	generator.template = template.New("postResponse")
 	generator.template.Parse(`<?xml version="1.0" encoding="UTF-8"?>
 <!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN"
@@ -31,7 +32,9 @@ you must press the Continue button once to proceed.
 value="{{ .RelayState }}"/>
 <input type="hidden" name="SAMLResponse"
 value="{{ .SAMLResponse }}"/>
-</div>
+{{ if .JWT }}<input type="hidden" name="{{ .JWTField }}"
+value="{{ .JWT }}"/>
+{{ end }}</div>
 <noscript>
 <div>
 <input type="submit" value="Continue"/>
@@ -45,32 +48,65 @@ value="{{ .SAMLResponse }}"/>
 
 type postResponseMarshaller struct {
 	template *template.Template
-	signer   xmlsig.Signer
+	signer   dsig.Signer
+	config   *config.Configuration
 }
 
 func (gen *postResponseMarshaller) Marshal(writer http.ResponseWriter, request *http.Request,
 	response *Response, authRequest *AuthnRequest, relayState string) {
-	// Don't need to change the response. Go ahead and sign it
-	signature, err := gen.signer.Sign(response.Assertion)
+	logger := logging.FromRequest(request)
+	postResponse := POSTResponse{RelayState: relayState,
+		AssertionConsumerServiceURL: authRequest.AssertionConsumerServiceURL}
+	// Made from the assertion before it's encrypted
+	sp := gen.config.ServiceProvider(authRequest.Issuer)
+	if sp != nil && sp.JWT != nil && response.Assertion != nil {
+		if issuance := sp.JWT.WithDefaults(); issuance.Delivery == config.JWTDeliveryForm {
+			token, err := NewJWT(gen.signer, gen.config, authRequest.Issuer, response)
+			if err != nil {
+				logger.Error("Failed to issue JWT", "err", err)
+				return
+			}
+			postResponse.JWT, postResponse.JWTField = token, issuance.Field
+		}
+	}
+	// Encrypt and sign as the SP expects
+	response, err := ProtectResponse(gen.signer, gen.config, authRequest.Issuer, response)
+	if err != nil {
+		logger.Error("Failed to protect response", "err", err)
+		return
+	}
+	data, err := xmlutil.Marshal(response)
 	if err != nil {
-		log.Println(err)
+		logger.Error("Failed to marshal response", "err", err)
+		return
+	}
+	data, err = SignResponse(gen.signer, gen.config, authRequest.Issuer, data, response)
+	if err != nil {
+		logger.Error("Failed to sign response", "err", err)
 		return
 	}
-	response.Assertion.Signature = signature
-	var xmlbuff bytes.Buffer
-	memWriter := bufio.NewWriter(&xmlbuff)
-	memWriter.Write([]byte(xml.Header))
-	encoder := xml.NewEncoder(memWriter)
-	encoder.Encode(response)
-	memWriter.Flush()
 
-	samlMessage := base64.StdEncoding.EncodeToString(xmlbuff.Bytes())
-	postResponse := POSTResponse{relayState, samlMessage, authRequest.AssertionConsumerServiceURL}
+	postResponse.SAMLResponse = encodePosted(data)
 	gen.template.Execute(writer, postResponse)
 }
 
+// Base64 encodes the document with an XML declaration, straight into a string of the final size rather than
+// copying the document to prepend the declaration
+func encodePosted(data []byte) string {
+	var encoded strings.Builder
+	encoded.Grow(base64.StdEncoding.EncodedLen(len(xml.Header) + len(data)))
+	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
+	encoder.Write([]byte(xml.Header))
+	encoder.Write(data)
+	encoder.Close()
+	return encoded.String()
+}
+
 type POSTResponse struct {
 	RelayState                  string
 	SAMLResponse                string
 	AssertionConsumerServiceURL string
+	// Issued alongside the assertion when the SP is configured for one
+	JWT      string
+	JWTField string
 }
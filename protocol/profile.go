@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/xmlenc"
+	"github.com/amdonov/lite-idp/xmlutil"
+)
+
+// Returns the response to send to the SP. When its profile asks for encryption the assertion is signed on
+// its own, as required, and replaced by an EncryptedAssertion in a copy of the response.
+func ProtectResponse(signer dsig.Signer, config *config.Configuration, entityId string,
+	response *Response) (*Response, error) {
+	profile := config.ProfileFor(entityId)
+	if response.Assertion == nil || !profile.EncryptAssertion {
+		return response, nil
+	}
+	cert, options := config.EncryptionFor(entityId)
+	if cert == nil {
+		return nil, errors.New("no encryption key is registered for " + entityId)
+	}
+	data, err := xmlutil.Marshal(response.Assertion)
+	if err != nil {
+		return nil, err
+	}
+	if profile.SignsAssertion() {
+		signer, err := SignerFor(signer, config, entityId)
+		if err != nil {
+			return nil, err
+		}
+		data, err = signer.SignElement(data, response.Assertion.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	encrypted, err := xmlenc.Encrypt(data, cert, options)
+	if err != nil {
+		return nil, err
+	}
+	protected := *response
+	protected.Assertion = nil
+	protected.EncryptedAssertion = &saml.EncryptedAssertion{EncryptedData: encrypted}
+	return &protected, nil
+}
+
+// Signs the marshalled response as the SP's profile asks. Responses without an assertion are always
+// signed, as there's nothing else to carry a signature.
+func SignResponse(signer dsig.Signer, config *config.Configuration, entityId string, data []byte,
+	response *Response) ([]byte, error) {
+	signer, err := SignerFor(signer, config, entityId)
+	if err != nil {
+		return nil, err
+	}
+	profile := config.ProfileFor(entityId)
+	if response.Assertion != nil && profile.SignsAssertion() {
+		data, err = signer.SignElement(data, response.Assertion.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hasAssertion := response.Assertion != nil || response.EncryptedAssertion != nil
+	if !hasAssertion || profile.SignsResponse() {
+		data, err = signer.SignElement(data, response.ID)
+	}
+	return data, err
+}
@@ -1,14 +1,19 @@
 package protocol
 
 import (
+	"encoding/base64"
 	"net/http"
 	"time"
 
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/xmlutil"
 	"github.com/satori/go.uuid"
 )
 
 type RequestParser interface {
+	// Returns the request along with the error when the request was readable but invalid
 	Parse(request *http.Request) (*AuthnRequest, string, error)
 }
 
@@ -16,13 +21,13 @@ func NewID() string {
 	return "_" + uuid.NewV4().String()
 }
 
+// Use NewErrorStatus for a failure with a specific reason
 func NewStatus(success bool) *Status {
 	s := &Status{}
 	if success {
-		s.StatusCode = StatusCode{Value: "urn:oasis:names:tc:SAML:2.0:status:Success"}
+		s.StatusCode = StatusCode{Value: StatusSuccess}
 	} else {
-		// TODO figure out Failure /Error status codes boolean isn't sufficient argument
-		s.StatusCode = StatusCode{Value: ""}
+		s.StatusCode = StatusCode{Value: StatusResponder}
 	}
 	return s
 }
@@ -32,28 +37,33 @@ type ResponseMarshaller interface {
 }
 
 type ResponseGenerator interface {
-	Generate(*AuthenticatedUser, *AuthnRequest, map[string][]string) *Response
+	Generate(*AuthenticatedUser, *AuthnRequest, map[string][]string) (*Response, error)
+	// Creates a response without an assertion reporting why the request failed
+	GenerateError(*AuthnRequest, error) *Response
 }
 
-func NewDefaultGenerator(entityId string) ResponseGenerator {
-	return &defaultGenerator{entityId}
+func NewDefaultGenerator(config *config.Configuration) ResponseGenerator {
+	return &defaultGenerator{config}
 }
 
 type defaultGenerator struct {
-	entityId string
+	config *config.Configuration
 }
 
-func (generator *defaultGenerator) Generate(user *AuthenticatedUser, authnRequest *AuthnRequest, attributes map[string][]string) *Response {
+func (generator *defaultGenerator) Generate(user *AuthenticatedUser, authnRequest *AuthnRequest, attributes map[string][]string) (*Response, error) {
 	s := &Response{}
 	s.Version = "2.0"
 	s.ID = NewID()
 	now := time.Now()
-	fiveMinutes, _ := time.ParseDuration("5m")
-	fiveFromNow := now.Add(fiveMinutes)
+	// Widen the validity window to tolerate the SP's clock drift
+	skew := generator.config.ClockSkewFor(authnRequest.Issuer)
+	notBefore, lifetime, confirmationLifetime := generator.config.ValidityFor(authnRequest.Issuer)
 	s.IssueInstant = now
 	s.Status = NewStatus(true)
 	s.InResponseTo = authnRequest.ID
-	s.Issuer = saml.NewIssuer(generator.entityId)
+	// The ACS URL has already been checked against the SP's registered endpoints
+	s.Destination = authnRequest.AssertionConsumerServiceURL
+	s.Issuer = saml.NewIssuer(generator.config.EntityId)
 	assertion := &saml.Assertion{}
 	assertion.ID = NewID()
 	assertion.IssueInstant = now
@@ -61,34 +71,71 @@ func (generator *defaultGenerator) Generate(user *AuthenticatedUser, authnReques
 	assertion.Issuer = s.Issuer
 	nameId := &saml.NameID{}
 	nameId.Format = user.Format
-	nameId.NameQualifier = generator.entityId
-	nameId.SPNameQualifier = authnRequest.Issuer
+	nameId.NameQualifier, nameId.SPNameQualifier = generator.config.NameQualifiersFor(authnRequest.Issuer)
+	// Already checked against the SP's affiliations
+	if policy := authnRequest.NameIDPolicy; policy != nil && policy.SPNameQualifier != "" {
+		nameId.SPNameQualifier = policy.SPNameQualifier
+	}
 	nameId.Value = user.Name
 	confirmation := &saml.SubjectConfirmation{}
 	confirmation.Method = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
 	confData := &saml.SubjectConfirmationData{}
+	// The SP checks the user presents the same certificate
+	if sp := generator.config.ServiceProvider(authnRequest.Issuer); sp != nil && sp.HolderOfKey && user.Certificate != nil {
+		confirmation.Method = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+		confData.Type = xmlutil.Prefixes["urn:oasis:names:tc:SAML:2.0:assertion"] + ":KeyInfoConfirmationDataType"
+		confData.KeyInfo = &dsig.KeyInfo{X509Data: dsig.X509Data{
+			X509Certificate: base64.StdEncoding.EncodeToString(user.Certificate)}}
+	}
 	confData.Address = user.IP
 	confData.InResponseTo = authnRequest.ID
 	confData.Recipient = authnRequest.AssertionConsumerServiceURL
-	confData.NotOnOrAfter = fiveFromNow
+	confData.NotOnOrAfter = now.Add(confirmationLifetime + skew)
 	confirmation.SubjectConfirmationData = confData
 	subject := &saml.Subject{NameID: nameId, SubjectConfirmation: confirmation}
 	assertion.Subject = subject
-	conditions := &saml.Conditions{}
-	conditions.NotOnOrAfter = fiveFromNow
-	conditions.NotBefore = now
-	audRestriction := &saml.AudienceRestriction{Audience: authnRequest.Issuer}
-	conditions.AudienceRestriction = audRestriction
-	assertion.Conditions = conditions
+	assertion.Conditions = NewConditions(generator.config, authnRequest.Issuer, now.Add(-notBefore-skew),
+		now.Add(lifetime+skew))
 	authnStatement := &saml.AuthnStatement{}
 	authnStatement.AuthnInstant = now
-	authnStatement.SessionIndex = uuid.NewV4().String()
+	authnStatement.SessionIndex = NewID()
+	// Tell the SP when the IdP session ends
+	if !user.SessionExpires.IsZero() {
+		expires := user.SessionExpires
+		authnStatement.SessionNotOnOrAfter = &expires
+	}
 	subLoc := &saml.SubjectLocality{Address: confData.Address}
 	authnStatement.SubjectLocality = subLoc
-	authContext := &saml.AuthnContext{AuthnContextClassRef: user.Context}
+	// Map the methods used to a context class, falling back to the authenticator's default
+	classRef := ClassRefFor(generator.config, authnRequest.Issuer, user.Methods, user.Context)
+	authContext := &saml.AuthnContext{AuthnContextClassRef: classRef,
+		AuthenticatingAuthority: user.AuthenticatingAuthorities}
 	authnStatement.AuthnContext = authContext
 	assertion.AuthnStatement = authnStatement
-	assertion.AttributeStatement = saml.NewAttributeStatement(attributes)
+	attributeStatement, err := NewAttributeStatement(generator.config, authnRequest.Issuer, user, attributes)
+	if err != nil {
+		return nil, err
+	}
+	assertion.AttributeStatement = attributeStatement
 	s.Assertion = assertion
+	return s, nil
+}
+
+func (generator *defaultGenerator) GenerateError(authnRequest *AuthnRequest, err error) *Response {
+	s := &Response{}
+	s.Version = "2.0"
+	s.ID = NewID()
+	s.IssueInstant = time.Now()
+	s.Status = NewErrorStatus(err)
+	s.InResponseTo = authnRequest.ID
+	s.Destination = authnRequest.AssertionConsumerServiceURL
+	s.Issuer = saml.NewIssuer(generator.config.EntityId)
 	return s
 }
+
+// Returns a signer using the algorithms configured for the SP
+func SignerFor(signer dsig.Signer, config *config.Configuration, entityId string) (dsig.Signer, error) {
+	signatureAlg, digestAlg := config.SignatureAlgorithmsFor(entityId)
+	return signer.WithOptions(dsig.Options{SignatureAlgorithm: signatureAlg, DigestAlgorithm: digestAlg,
+		InclusiveNamespaces: config.InclusiveNamespacesFor(entityId)})
+}
@@ -3,42 +3,204 @@ package protocol
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/tracer"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
-func NewRedirectRequestParser() RequestParser {
-	return &redirectRequestParser{}
+// Returns the location with the message encoded for the HTTP-Redirect binding
+func EncodeRedirect(location string, message interface{}, relayState string) (string, error) {
+	target, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	data, err := xmlutil.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	writer.Write(data)
+	writer.Close()
+	parameters := target.Query()
+	parameters.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buffer.Bytes()))
+	if relayState != "" {
+		parameters.Set("RelayState", relayState)
+	}
+	target.RawQuery = parameters.Encode()
+	return target.String(), nil
+}
+
+// Inflates the data, failing once the output exceeds the maximum size or compression ratio
+func inflate(data []byte, limits config.RequestLimits) ([]byte, error) {
+	limit := int64(limits.MaxSize)
+	if ratioLimit := int64(len(data)) * int64(limits.MaxRatio); ratioLimit < limit {
+		limit = ratioLimit
+	}
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	inflated, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(inflated)) > limit {
+		return nil, errors.New("SAMLRequest inflates beyond the permitted size")
+	}
+	return inflated, nil
+}
+
+func NewRedirectRequestParser(config *config.Configuration, store store.Storer) RequestParser {
+	return &redirectRequestParser{config, store}
 }
 
 type redirectRequestParser struct {
+	config *config.Configuration
+	store  store.Storer
 }
 
 func (parser *redirectRequestParser) Parse(request *http.Request) (loginReq *AuthnRequest,
 	relayState string, err error) {
-	err = request.ParseForm()
+	// The binding carries every parameter in the query string, which is what the signature covers. Form values
+	// would let a POST body replace a signed parameter.
+	query := request.URL.Query()
+	config := parser.config.For(request)
+	// Kept for as long as the request state that will hold the reference
+	relayState, err = ShortenRelayState(parser.store, config.RelayState, query.Get("RelayState"),
+		config.Sessions.WithDefaults().RequestLifetime)
 	if err != nil {
 		return
 	}
-	relayState = request.Form.Get("RelayState")
-	if len(relayState) > 80 {
-		err = errors.New("RelayState cannot be longer than 80 characters.")
+	samlReq := query.Get("SAMLRequest")
+	limits := config.RequestLimits.WithDefaults()
+	// Compressed data larger than the inflated limit isn't worth decoding
+	if len(samlReq) > limits.MaxSize*4/3+4 {
+		err = errors.New("SAMLRequest is too large")
 		return
 	}
-	samlReq := request.Form.Get("SAMLRequest")
 	// URL decoding is already performed
 	// remove base64 encoding
-	reqBytes, err := base64.StdEncoding.DecodeString(samlReq)
+	reqBytes, err := base64.StdEncoding.Strict().DecodeString(samlReq)
 	if err != nil {
 		return
 	}
 	// Remove deflate
-	req := flate.NewReader(bytes.NewReader(reqBytes))
+	reqXML, err := inflate(reqBytes, limits)
+	if err != nil {
+		return
+	}
 	// Read the XML
-	decoder := xml.NewDecoder(req)
+	decoder := xml.NewDecoder(bytes.NewReader(reqXML))
 	loginReq = &AuthnRequest{}
 	err = decoder.Decode(loginReq)
+	if err != nil {
+		// Nothing in a malformed request can be trusted
+		loginReq = nil
+		return
+	}
+	// Requests that decode but fail validation are returned so the SP can be told why
+	if loginReq.Version != "2.0" {
+		// Tell the SP which way it's out, as the core spec suggests
+		subCode := StatusRequestVersionTooLow
+		if loginReq.Version > "2.0" {
+			subCode = StatusRequestVersionTooHigh
+		}
+		err = NewStatusError(StatusVersionMismatch, subCode, "unsupported SAML version "+loginReq.Version)
+		return
+	}
+	err = ValidateIssueInstant(loginReq.IssueInstant, config.ClockSkewFor(loginReq.Issuer))
+	if err != nil {
+		err = NewStatusError(StatusRequester, StatusRequestDenied, err.Error())
+		return
+	}
+	signed := query.Get("Signature") != ""
+	verified, err := parser.checkSignature(request, query, loginReq.Issuer, signed)
+	tracer.Annotate(request, "signature", signatureResult(signed, verified, err))
+	if err != nil {
+		err = NewStatusError(StatusRequester, StatusRequestDenied, err.Error())
+		return
+	}
+	// A signature that couldn't be checked doesn't make the request a signed one
+	err = ValidateDestination(loginReq.Destination,
+		config.EndpointURL(request, config.Services.Authentication), verified)
+	if err != nil {
+		err = NewStatusError(StatusRequester, StatusRequestDenied, err.Error())
+	}
 	return
 }
+
+// Verifies the request signature against the SP's metadata signing keys. Signatures from SPs without
+// registered keys can't be checked and are only rejected when the profile requires signed requests.
+// Reports whether a signature was verified.
+func (parser *redirectRequestParser) checkSignature(request *http.Request, query url.Values, issuer string,
+	signed bool) (bool, error) {
+	required := parser.config.ProfileFor(issuer).RequireSignedRequests
+	if !signed {
+		if required {
+			return false, errors.New("request must be signed")
+		}
+		return false, nil
+	}
+	var certs []*x509.Certificate
+	if sp := parser.config.ServiceProvider(issuer); sp != nil && sp.Descriptor != nil &&
+		sp.Descriptor.SPSSODescriptor != nil {
+		certs = sp.Descriptor.SPSSODescriptor.SigningCertificates()
+	}
+	if len(certs) == 0 {
+		if required {
+			return false, errors.New("no signing keys are registered for " + issuer)
+		}
+		return false, nil
+	}
+	// The signature covers the parameters exactly as the SP encoded them
+	raw := make(map[string]string)
+	for _, pair := range strings.Split(request.URL.RawQuery, "&") {
+		if i := strings.IndexByte(pair, '='); i > 0 {
+			if _, found := raw[pair[:i]]; !found {
+				raw[pair[:i]] = pair[i+1:]
+			}
+		}
+	}
+	signedData := "SAMLRequest=" + raw["SAMLRequest"]
+	if relayState, found := raw["RelayState"]; found {
+		signedData += "&RelayState=" + relayState
+	}
+	signedData += "&SigAlg=" + raw["SigAlg"]
+	value, err := base64.StdEncoding.DecodeString(query.Get("Signature"))
+	if err != nil {
+		return false, err
+	}
+	for _, cert := range certs {
+		err = dsig.VerifyBytes([]byte(signedData), query.Get("SigAlg"), value, cert)
+		if err == nil {
+			return true, nil
+		}
+	}
+	return false, errors.New("invalid request signature: " + err.Error())
+}
+
+// Describes the outcome of checkSignature for the message tracer
+func signatureResult(signed, verified bool, err error) string {
+	switch {
+	case err != nil:
+		return "rejected: " + err.Error()
+	case verified:
+		return "valid"
+	case signed:
+		return "not checked, no signing keys registered"
+	}
+	return "unsigned"
+}
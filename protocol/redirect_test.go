@@ -0,0 +1,125 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/metadata"
+	"github.com/amdonov/lite-idp/store"
+	"math/big"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	redirectSP       = "https://sp.example.com/shibboleth"
+	redirectEndpoint = "https://idp.example.com/SAML2/Redirect/SSO"
+)
+
+// Returns a key and the SP registered with its certificate, which requires signed requests
+func signingSP(t *testing.T) (*rsa.PrivateKey, *config.ServiceProvider) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "sp"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := &metadata.EntityDescriptor{EntityID: redirectSP, SPSSODescriptor: &metadata.SPSSODescriptor{
+		KeyDescriptors: []metadata.KeyDescriptor{{Use: "signing", KeyInfo: dsig.KeyInfo{
+			X509Data: dsig.X509Data{X509Certificate: base64.StdEncoding.EncodeToString(der)}}}}}}
+	return key, &config.ServiceProvider{EntityId: redirectSP, Descriptor: descriptor,
+		Profile: &config.Profile{RequireSignedRequests: true}}
+}
+
+func redirectParser(sp *config.ServiceProvider) RequestParser {
+	settings := &config.Configuration{EntityId: "https://idp.example.com/idp", BaseURL: "https://idp.example.com",
+		Services: config.Services{Authentication: "/SAML2/Redirect/SSO"}, ServiceProviders: []*config.ServiceProvider{sp}}
+	return NewRedirectRequestParser(settings, store.NewMemory())
+}
+
+// Returns the deflated and base64 encoded request
+func encodeRequest(t *testing.T, id string) string {
+	xml := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" `+
+		`xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="%s" Version="2.0" IssueInstant="%s" `+
+		`Destination="%s"><saml:Issuer>%s</saml:Issuer></samlp:AuthnRequest>`, id,
+		time.Now().UTC().Format(time.RFC3339), redirectEndpoint, redirectSP)
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write([]byte(xml))
+	writer.Close()
+	return base64.StdEncoding.EncodeToString(deflated.Bytes())
+}
+
+// Returns the query string of the request signed with the key
+func signedQuery(t *testing.T, key *rsa.PrivateKey, id string) string {
+	query := "SAMLRequest=" + url.QueryEscape(encodeRequest(t, id)) + "&SigAlg=" + url.QueryEscape(dsig.RSASHA256)
+	digest := sha256.Sum256([]byte(query))
+	value, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(value))
+}
+
+func TestRedirectAcceptsSignedRequest(t *testing.T) {
+	key, sp := signingSP(t)
+	request := httptest.NewRequest("GET", "/SAML2/Redirect/SSO?"+signedQuery(t, key, "_r1"), nil)
+	loginReq, _, err := redirectParser(sp).Parse(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loginReq.ID != "_r1" {
+		t.Errorf("parsed request %s", loginReq.ID)
+	}
+}
+
+// A request in a POST body mustn't take the place of the one the signature in the query string covers
+func TestRedirectIgnoresTamperedBody(t *testing.T) {
+	key, sp := signingSP(t)
+	body := url.Values{"SAMLRequest": {encodeRequest(t, "_forged")}}.Encode()
+	request := httptest.NewRequest("POST", "/SAML2/Redirect/SSO?"+signedQuery(t, key, "_r1"),
+		strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	loginReq, _, err := redirectParser(sp).Parse(request)
+	if err == nil && loginReq.ID == "_forged" {
+		t.Fatal("the request in the body was accepted")
+	}
+}
+
+func TestRedirectRejectsStrippedSignature(t *testing.T) {
+	_, sp := signingSP(t)
+	query := "SAMLRequest=" + url.QueryEscape(encodeRequest(t, "_r1"))
+	request := httptest.NewRequest("GET", "/SAML2/Redirect/SSO?"+query, nil)
+	if _, _, err := redirectParser(sp).Parse(request); err == nil {
+		t.Fatal("an unsigned request was accepted from an SP requiring signatures")
+	}
+}
+
+// Without keys to check it with, a signature doesn't satisfy an SP's requirement for signed requests
+func TestRedirectRejectsSignatureWithoutKeys(t *testing.T) {
+	key, sp := signingSP(t)
+	sp.Descriptor.SPSSODescriptor.KeyDescriptors = nil
+	request := httptest.NewRequest("GET", "/SAML2/Redirect/SSO?"+signedQuery(t, key, "_r1"), nil)
+	if _, _, err := redirectParser(sp).Parse(request); err == nil {
+		t.Fatal("a signature was accepted without keys to check it")
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/satori/go.uuid"
+	"strings"
+)
+
+// Marks a RelayState that has been replaced by a reference to the stored value
+const relayStateReference = "lidp-ref:"
+
+var ErrRelayStateTooLong = errors.New("RelayState is too long")
+
+// Enforces the configured RelayState length. Oversized values are rejected or, when permitted, stored for
+// lifetime seconds and replaced with a reference that RestoreRelayState converts back. The lifetime should
+// cover the request the RelayState came with, as the reference is useless once the request is abandoned.
+func ShortenRelayState(store store.Storer, policy config.RelayStatePolicy, relayState string,
+	lifetime int) (string, error) {
+	policy = policy.WithDefaults()
+	if len(relayState) <= policy.MaxLength {
+		return relayState, nil
+	}
+	if !policy.StoreOversized {
+		return "", ErrRelayStateTooLong
+	}
+	reference := uuid.NewV4().String()
+	err := store.Store(relayStateReference+reference, relayState, lifetime)
+	if err != nil {
+		return "", err
+	}
+	return relayStateReference + reference, nil
+}
+
+// Returns the original value of a RelayState that ShortenRelayState replaced with a reference
+func RestoreRelayState(store store.Storer, relayState string) (string, error) {
+	if !strings.HasPrefix(relayState, relayStateReference) {
+		return relayState, nil
+	}
+	var original string
+	err := store.Retrieve(relayState, &original)
+	if err != nil {
+		return "", err
+	}
+	return original, nil
+}
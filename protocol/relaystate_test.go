@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"strings"
+	"testing"
+)
+
+// Records the lifetime values are stored with
+type lifetimes struct {
+	store.Storer
+	stored []int
+}
+
+func (storer *lifetimes) Store(key, value interface{}, time int) error {
+	storer.stored = append(storer.stored, time)
+	return storer.Storer.Store(key, value, time)
+}
+
+// An oversized RelayState is kept for as long as the request it came with, not just the replay window
+func TestShortenRelayStateKeepsForLifetime(t *testing.T) {
+	storer := &lifetimes{Storer: store.NewMemory()}
+	original := strings.Repeat("r", 200)
+	policy := config.RelayStatePolicy{MaxLength: 80, StoreOversized: true}
+	shortened, err := ShortenRelayState(storer, policy, original, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shortened) > 80 {
+		t.Errorf("RelayState is still %d characters", len(shortened))
+	}
+	if len(storer.stored) != 1 || storer.stored[0] != 3600 {
+		t.Errorf("RelayState stored with lifetimes %v rather than 3600", storer.stored)
+	}
+	restored, err := RestoreRelayState(storer, shortened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != original {
+		t.Errorf("restored %q", restored)
+	}
+}
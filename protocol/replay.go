@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"time"
+)
+
+var ErrReplay = errors.New("SAML message has already been processed")
+
+// ReplayDetector records message IDs in the shared store so every IdP node sees them
+type ReplayDetector interface {
+	// Records a consumed request. Returns ErrReplay if the request has been seen before.
+	ConsumeRequest(issuer, id string) error
+	// Records an assertion issued to the SP along with the request it responds to.
+	RecordAssertion(sp, id, inResponseTo string) error
+}
+
+// Messages are remembered for as long as they remain valid, allowing for the clock skew at either end of
+// their validity
+func NewReplayDetector(store store.Storer, config *config.Configuration) ReplayDetector {
+	return &replayDetector{store, config}
+}
+
+type replayDetector struct {
+	store  store.Storer
+	config *config.Configuration
+}
+
+func (detector *replayDetector) ConsumeRequest(issuer, id string) error {
+	if id == "" {
+		return errors.New("SAML request is missing an ID")
+	}
+	return detector.record("replay-request:"+issuer+":"+id, id,
+		requestLifetime+2*detector.config.ClockSkewFor(issuer))
+}
+
+func (detector *replayDetector) RecordAssertion(sp, id, inResponseTo string) error {
+	notBefore, lifetime, _ := detector.config.ValidityFor(sp)
+	return detector.record("replay-assertion:"+id, inResponseTo,
+		notBefore+lifetime+2*detector.config.ClockSkewFor(sp))
+}
+
+func (detector *replayDetector) record(key, value string, window time.Duration) error {
+	stored, err := detector.store.StoreIfAbsent(key, value, int(window.Seconds()))
+	if err != nil {
+		return err
+	}
+	if !stored {
+		return ErrReplay
+	}
+	return nil
+}
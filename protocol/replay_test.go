@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"testing"
+)
+
+// Records the lifetimes values are stored with only if absent
+type windows struct {
+	store.Storer
+	stored []int
+}
+
+func (storer *windows) StoreIfAbsent(key, value interface{}, time int) (bool, error) {
+	storer.stored = append(storer.stored, time)
+	return storer.Storer.StoreIfAbsent(key, value, time)
+}
+
+// Messages are remembered for their configured lifetime and the clock skew at both ends of it
+func TestReplayWindowFollowsConfiguration(t *testing.T) {
+	storer := &windows{Storer: store.NewMemory()}
+	settings := &config.Configuration{ClockSkew: 30, ServiceProviders: []*config.ServiceProvider{{
+		EntityId: redirectSP, ClockSkew: 60, Validity: config.Validity{NotBefore: 10, NotOnOrAfter: 3600}}}}
+	detector := NewReplayDetector(storer, settings)
+	if err := detector.ConsumeRequest(redirectSP, "_r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := detector.RecordAssertion(redirectSP, "_a1", "_r1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := detector.RecordAssertion("https://other.example.com", "_a2", "_r2"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []int{300 + 120, 10 + 3600 + 120, 300 + 60}
+	for i, window := range expected {
+		if i >= len(storer.stored) || storer.stored[i] != window {
+			t.Fatalf("messages remembered for %v rather than %v", storer.stored, expected)
+		}
+	}
+	if err := detector.RecordAssertion(redirectSP, "_a1", "_r3"); err != ErrReplay {
+		t.Errorf("reused assertion ID returned %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package protocol
+
+import "errors"
+
+var ErrProxyCountExceeded = errors.New("SP does not permit the request to be proxied")
+
+// Builds the Scoping to send to an upstream IdP when proxying a request from requester. The SP's
+// IDPList is passed along unchanged, ProxyCount is decremented, and the requester is added to RequesterID.
+func UpstreamScoping(scoping *Scoping, requester string) (*Scoping, error) {
+	upstream := &Scoping{RequesterID: []string{requester}}
+	if scoping == nil {
+		return upstream, nil
+	}
+	if scoping.ProxyCount != nil {
+		if *scoping.ProxyCount <= 0 {
+			return nil, ErrProxyCountExceeded
+		}
+		count := *scoping.ProxyCount - 1
+		upstream.ProxyCount = &count
+	}
+	upstream.IDPList = scoping.IDPList
+	upstream.RequesterID = append(append([]string{}, scoping.RequesterID...), requester)
+	return upstream, nil
+}
+
+// Reports whether the SP's IDPList, if any, allows authentication by the IdP
+func (scoping *Scoping) Allows(providerId string) bool {
+	if scoping == nil || scoping.IDPList == nil || len(scoping.IDPList.IDPEntry) == 0 {
+		return true
+	}
+	for _, entry := range scoping.IDPList.IDPEntry {
+		if entry.ProviderID == providerId {
+			return true
+		}
+	}
+	return false
+}
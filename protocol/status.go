@@ -0,0 +1,70 @@
+package protocol
+
+import "fmt"
+
+// Top-level status codes
+const (
+	StatusSuccess         = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	StatusRequester       = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	StatusResponder       = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	StatusVersionMismatch = "urn:oasis:names:tc:SAML:2.0:status:VersionMismatch"
+)
+
+// Second-level status codes
+const (
+	StatusAuthnFailed              = "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"
+	StatusNoAuthnContext           = "urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext"
+	StatusNoPassive                = "urn:oasis:names:tc:SAML:2.0:status:NoPassive"
+	StatusRequestDenied            = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+	StatusRequestUnsupported       = "urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported"
+	StatusUnsupportedBinding       = "urn:oasis:names:tc:SAML:2.0:status:UnsupportedBinding"
+	StatusUnknownPrincipal         = "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal"
+	StatusProxyCountExceeded       = "urn:oasis:names:tc:SAML:2.0:status:ProxyCountExceeded"
+	StatusInvalidNameIDPolicy      = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+	StatusNoSupportedIDP           = "urn:oasis:names:tc:SAML:2.0:status:NoSupportedIDP"
+	StatusNoAvailableIDP           = "urn:oasis:names:tc:SAML:2.0:status:NoAvailableIDP"
+	StatusPartialLogout            = "urn:oasis:names:tc:SAML:2.0:status:PartialLogout"
+	StatusRequestVersionTooHigh    = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionTooHigh"
+	StatusRequestVersionTooLow     = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionTooLow"
+	StatusRequestVersionDeprecated = "urn:oasis:names:tc:SAML:2.0:status:RequestVersionDeprecated"
+	StatusResourceNotRecognized    = "urn:oasis:names:tc:SAML:2.0:status:ResourceNotRecognized"
+	StatusTooManyResponses         = "urn:oasis:names:tc:SAML:2.0:status:TooManyResponses"
+	StatusUnknownAttrProfile       = "urn:oasis:names:tc:SAML:2.0:status:UnknownAttrProfile"
+)
+
+// Reasons given in a LogoutRequest
+const (
+	LogoutReasonUser  = "urn:oasis:names:tc:SAML:2.0:logout:user"
+	LogoutReasonAdmin = "urn:oasis:names:tc:SAML:2.0:logout:admin"
+)
+
+// An error that should be reported to the SP as a SAML status
+type StatusError struct {
+	Code    string
+	SubCode string
+	Message string
+}
+
+func NewStatusError(code, subCode, message string) *StatusError {
+	return &StatusError{code, subCode, message}
+}
+
+func (err *StatusError) Error() string {
+	if err.SubCode == "" {
+		return fmt.Sprintf("%s: %s", err.Code, err.Message)
+	}
+	return fmt.Sprintf("%s (%s): %s", err.Code, err.SubCode, err.Message)
+}
+
+// Converts an error into a status. Errors that aren't a StatusError are blamed on the requester.
+func NewErrorStatus(err error) *Status {
+	statusErr, ok := err.(*StatusError)
+	if !ok {
+		statusErr = NewStatusError(StatusRequester, "", err.Error())
+	}
+	s := &Status{StatusCode: StatusCode{Value: statusErr.Code}, StatusMessage: statusErr.Message}
+	if statusErr.SubCode != "" {
+		s.StatusCode.StatusCode = &StatusCode{Value: statusErr.SubCode}
+	}
+	return s
+}
@@ -1,6 +1,8 @@
 package protocol
 
+import "bytes"
 import "encoding/xml"
+import "io"
 import "time"
 import "github.com/amdonov/lite-idp/saml"
 import "net"
@@ -10,14 +12,59 @@ type AuthenticatedUser struct {
 	Format  string
 	Context string
 	IP      net.IP
+	// Internal names of the authentication methods used, such as password or x509
+	Methods []string
+	// Upstream IdPs involved in authenticating the user when proxying
+	AuthenticatingAuthorities []string
+	// DER encoded TLS client certificate, used for holder-of-key confirmation
+	Certificate []byte
+	// Attributes asserted by an upstream IdP when proxying
+	Attributes map[string][]string
+	// IdP session the user authenticated with, if any
+	SessionID      string
+	SessionExpires time.Time
 }
 
 type AuthnRequest struct {
 	RequestAbstractType
 	XMLName                        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
 	AssertionConsumerServiceURL    string   `xml:",attr"`
+	AssertionConsumerServiceIndex  *int     `xml:",attr"`
 	ProtocolBinding                string   `xml:",attr"`
-	AttributeConsumingServiceIndex string
+	IsPassive                      bool     `xml:",attr"`
+	ForceAuthn                     bool     `xml:",attr,omitempty"`
+	AttributeConsumingServiceIndex *int     `xml:",attr,omitempty"`
+	RequestedAuthnContext          *RequestedAuthnContext
+	NameIDPolicy                   *NameIDPolicy
+	Conditions                     *saml.Conditions
+	Scoping                        *Scoping
+}
+
+type NameIDPolicy struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	Format          string   `xml:",attr,omitempty"`
+	SPNameQualifier string   `xml:",attr,omitempty"`
+	AllowCreate     *bool    `xml:",attr,omitempty"`
+}
+
+type Scoping struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Scoping"`
+	ProxyCount  *int     `xml:",attr,omitempty"`
+	IDPList     *IDPList
+	RequesterID []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequesterID"`
+}
+
+type IDPList struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPList"`
+	IDPEntry    []IDPEntry
+	GetComplete string `xml:"urn:oasis:names:tc:SAML:2.0:protocol GetComplete,omitempty"`
+}
+
+type IDPEntry struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPEntry"`
+	ProviderID string   `xml:",attr"`
+	Name       string   `xml:",attr,omitempty"`
+	Loc        string   `xml:",attr,omitempty"`
 }
 
 type ArtifactResolveEnvelope struct {
@@ -52,20 +99,109 @@ type ArtifactResponse struct {
 	Response Response
 }
 
+// A SOAP request for an assertion for another SP, carrying the requester's own assertion as its credential
+type DelegationRequestEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Header  DelegationRequestHeader
+	Body    DelegationRequestBody
+}
+
+type DelegationRequestHeader struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+	Security Security
+}
+
+type Security struct {
+	XMLName   xml.Name `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd Security"`
+	Assertion saml.Assertion
+}
+
+type DelegationRequestBody struct {
+	XMLName      xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	AuthnRequest AuthnRequest
+}
+
+type ResponseEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    ResponseBody
+}
+
+type ResponseBody struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Response Response
+}
+
 type Response struct {
 	StatusResponseType
-	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
-	Assertion *saml.Assertion
+	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	Assertion          *saml.Assertion
+	EncryptedAssertion *saml.EncryptedAssertion
+}
+
+// Returns the ID of the element to sign. Error responses carry no assertion so the response itself is signed.
+func (response *Response) SignedID() string {
+	if response.Assertion != nil {
+		return response.Assertion.ID
+	}
+	return response.ID
 }
 
 type Status struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
-	StatusCode StatusCode
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	StatusCode    StatusCode
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
+	StatusDetail  *StatusDetail
+}
+
+// Additional information about an error, in whatever form the sender chose. ADFS describes the failure here.
+type StatusDetail struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusDetail"`
+	Content []byte   `xml:",innerxml"`
+}
+
+// Writes the content as it was read. encoding/xml makes the protocol namespace the default on StatusDetail, so
+// elements without a namespace are given an empty default rather than taking it.
+func (detail StatusDetail) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(detail.Content))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			// The decoder has already applied the declarations to the names
+			var attrs []xml.Attr
+			for _, attr := range t.Attr {
+				if attr.Name.Space != "xmlns" && !(attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+					attrs = append(attrs, attr)
+				}
+			}
+			if t.Name.Space == "" {
+				attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "xmlns"}})
+			}
+			t.Attr = attrs
+			err = encoder.EncodeToken(t)
+		case xml.EndElement, xml.CharData, xml.Comment:
+			err = encoder.EncodeToken(t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
 }
 
 type StatusCode struct {
-	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
-	Value   string   `xml:",attr"`
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	Value      string   `xml:",attr"`
+	StatusCode *StatusCode
 }
 
 type RequestAbstractType struct {
@@ -85,3 +221,38 @@ type StatusResponseType struct {
 	InResponseTo string `xml:",attr"`
 	Status       *Status
 }
+
+// Asks the receiver to end the sessions of the principal, either all of them or those with the session indexes
+type LogoutRequest struct {
+	RequestAbstractType
+	XMLName      xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	Reason       string     `xml:",attr,omitempty"`
+	NotOnOrAfter *time.Time `xml:",attr,omitempty"`
+	NameID       *saml.NameID
+	SessionIndex []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex"`
+}
+
+type LogoutResponse struct {
+	StatusResponseType
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+}
+
+type LogoutRequestEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    LogoutRequestBody
+}
+
+type LogoutRequestBody struct {
+	XMLName       xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	LogoutRequest LogoutRequest
+}
+
+type LogoutResponseEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    LogoutResponseBody
+}
+
+type LogoutResponseBody struct {
+	XMLName        xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	LogoutResponse LogoutResponse
+}
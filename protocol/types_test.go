@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Reads the fixture into the value, checks what was read, then marshals the value and reads it back so that
+// what the IdP writes carries the same content
+func roundTrip(t *testing.T, fixture string, value interface{}, check func()) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := xml.Unmarshal(data, value); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	marshalled, err := xmlutil.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := reflect.New(reflect.TypeOf(value).Elem()).Interface()
+	if err := xml.Unmarshal(marshalled, again); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(value, again) {
+		t.Errorf("content changed by marshalling:\n%+v\n%+v\n%s", value, again, marshalled)
+	}
+}
+
+func TestShibbolethLogoutRequest(t *testing.T) {
+	var env LogoutRequestEnvelope
+	roundTrip(t, "shibboleth-logout-request.xml", &env, func() {
+		request := env.Body.LogoutRequest
+		if request.Issuer != "https://sp.example.org/shibboleth" || request.ID != "_5b3f2a9e1c7d4e0f8a6b2c1d9e7f3a4b" {
+			t.Errorf("wrong issuer or ID: %s %s", request.Issuer, request.ID)
+		}
+		if request.NameID == nil || request.NameID.Value != "AAdzZWNyZXQxAJ8TjR0Wvg" ||
+			request.NameID.SPNameQualifier != "https://sp.example.org/shibboleth" {
+			t.Errorf("wrong NameID: %+v", request.NameID)
+		}
+		if len(request.SessionIndex) != 2 || request.SessionIndex[1] != "_8f7e6d5c4b3a2f1e0d9c8b7a6f5e4d3c" {
+			t.Errorf("wrong SessionIndexes: %v", request.SessionIndex)
+		}
+		notOnOrAfter := time.Date(2024, 3, 5, 14, 27, 31, 0, time.UTC)
+		if request.NotOnOrAfter == nil || !request.NotOnOrAfter.Equal(notOnOrAfter) {
+			t.Errorf("wrong NotOnOrAfter: %v", request.NotOnOrAfter)
+		}
+		if request.Reason != "urn:oasis:names:tc:SAML:2.0:logout:user" {
+			t.Errorf("wrong Reason: %s", request.Reason)
+		}
+	})
+}
+
+func TestADFSLogoutResponse(t *testing.T) {
+	var response LogoutResponse
+	roundTrip(t, "adfs-logout-response.xml", &response, func() {
+		if response.Issuer == nil || response.Issuer.Value != "http://adfs.example.com/adfs/services/trust" {
+			t.Errorf("wrong issuer: %+v", response.Issuer)
+		}
+		if response.InResponseTo != "_5b3f2a9e1c7d4e0f8a6b2c1d9e7f3a4b" {
+			t.Errorf("wrong InResponseTo: %s", response.InResponseTo)
+		}
+		if !response.IssueInstant.Equal(time.Date(2024, 3, 5, 14, 22, 31, 482000000, time.UTC)) {
+			t.Errorf("wrong IssueInstant: %v", response.IssueInstant)
+		}
+		status := response.Status
+		if status == nil || status.StatusCode.Value != StatusResponder || status.StatusCode.StatusCode == nil ||
+			status.StatusCode.StatusCode.Value != StatusPartialLogout {
+			t.Errorf("wrong status: %+v", status)
+		}
+	})
+}
+
+func TestADFSErrorResponse(t *testing.T) {
+	var response Response
+	roundTrip(t, "adfs-error-response.xml", &response, func() {
+		status := response.Status
+		if status == nil || status.StatusCode.StatusCode == nil ||
+			status.StatusCode.StatusCode.Value != StatusInvalidNameIDPolicy {
+			t.Fatalf("wrong status: %+v", status)
+		}
+		if status.StatusMessage != "MSIS7070: The SAML request contained an invalid NameIDPolicy." {
+			t.Errorf("wrong StatusMessage: %s", status.StatusMessage)
+		}
+		cause := "<Cause>The requested NameIDPolicy format is not supported by the relying party trust.</Cause>"
+		if status.StatusDetail == nil || string(status.StatusDetail.Content) != cause {
+			t.Errorf("wrong StatusDetail: %+v", status.StatusDetail)
+		}
+		if response.Assertion != nil || response.EncryptedAssertion != nil {
+			t.Error("error response read with an assertion")
+		}
+	})
+}
+
+// Shibboleth writes booleans as 1 rather than true
+func TestShibbolethAuthnRequest(t *testing.T) {
+	var request AuthnRequest
+	roundTrip(t, "shibboleth-authn-request.xml", &request, func() {
+		if !request.ForceAuthn || request.IsPassive {
+			t.Errorf("wrong ForceAuthn or IsPassive: %v %v", request.ForceAuthn, request.IsPassive)
+		}
+		if request.NameIDPolicy == nil || request.NameIDPolicy.AllowCreate == nil || !*request.NameIDPolicy.AllowCreate {
+			t.Errorf("wrong NameIDPolicy: %+v", request.NameIDPolicy)
+		}
+		if request.AssertionConsumerServiceURL != "https://sp.example.org/Shibboleth.sso/SAML2/POST" ||
+			request.AssertionConsumerServiceIndex != nil {
+			t.Errorf("wrong ACS: %s %v", request.AssertionConsumerServiceURL, request.AssertionConsumerServiceIndex)
+		}
+	})
+}
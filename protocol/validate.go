@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"time"
+)
+
+// NameIDPolicy format leaving the choice to the IdP
+const NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+// Requests older than this are rejected
+const requestLifetime = 5 * time.Minute
+
+// Confirms the request was issued recently, allowing for clock drift between the IdP and SP
+func ValidateIssueInstant(issueInstant string, skew time.Duration) error {
+	instant, err := time.Parse(time.RFC3339, issueInstant)
+	if err != nil {
+		return fmt.Errorf("invalid IssueInstant %q", issueInstant)
+	}
+	now := time.Now()
+	if instant.After(now.Add(skew)) {
+		return errors.New("request IssueInstant is in the future")
+	}
+	if now.After(instant.Add(requestLifetime + skew)) {
+		return errors.New("request has expired")
+	}
+	return nil
+}
+
+// Confirms the SP may be issued the NameID format and SPNameQualifier in its NameIDPolicy. The format
+// must be allowed by the SP's profile. The qualifier must be the SP itself, its configured SPNameQualifier
+// or an affiliation it belongs to.
+func ValidateNameIDPolicy(config *config.Configuration, request *AuthnRequest) error {
+	policy := request.NameIDPolicy
+	if policy == nil {
+		return nil
+	}
+	if policy.Format != "" && policy.Format != NameIDFormatUnspecified &&
+		!config.ProfileFor(request.Issuer).AllowsNameIDFormat(policy.Format) {
+		return NewStatusError(StatusRequester, StatusInvalidNameIDPolicy,
+			"NameID format "+policy.Format+" is not allowed")
+	}
+	if policy.SPNameQualifier == "" || policy.SPNameQualifier == request.Issuer {
+		return nil
+	}
+	sp := config.ServiceProvider(request.Issuer)
+	if sp != nil {
+		if policy.SPNameQualifier == sp.SPNameQualifier {
+			return nil
+		}
+		for _, affiliation := range sp.Affiliations {
+			if policy.SPNameQualifier == affiliation {
+				return nil
+			}
+		}
+	}
+	return NewStatusError(StatusRequester, StatusInvalidNameIDPolicy,
+		"not a member of affiliation "+policy.SPNameQualifier)
+}
+
+// Confirms a message was addressed to this endpoint. Destination is mandatory when required, such as for
+// signed messages.
+func ValidateDestination(destination, endpoint string, required bool) error {
+	if destination == "" {
+		if required {
+			return errors.New("signed request is missing a Destination")
+		}
+		return nil
+	}
+	if destination != endpoint {
+		return fmt.Errorf("request Destination %s does not match %s", destination, endpoint)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// Package provisioning creates and updates users' accounts at SPs through the SPs' SCIM 2.0 APIs when the
+// users sign in, for SPs that need an account to exist before they accept an assertion.
+package provisioning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/httpclient"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/telemetry"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	userSchema = "urn:ietf:params:scim:schemas:core:2.0:User"
+	// Marks accounts provisioned recently, keyed by SP and user name
+	provisionedPrefix = "provisioned:"
+	// Responses larger than this are rejected
+	maxResponse = 1 << 20
+)
+
+// SCIM user attributes with multiple values, which are sent as lists of objects with a value
+var multiValued = map[string]bool{"emails": true, "phoneNumbers": true, "ims": true, "photos": true,
+	"entitlements": true, "roles": true, "x509Certificates": true}
+
+type Provisioner struct {
+	config *config.Configuration
+	store  store.Storer
+	// Calls are limited by each SP's timeout rather than the client's
+	client *http.Client
+}
+
+func New(config *config.Configuration, store store.Storer) *Provisioner {
+	return &Provisioner{config, store, &http.Client{Transport: httpclient.Transport}}
+}
+
+// Creates or updates the user's account at the SP, when it provisions accounts and hasn't had this one
+// provisioned within its refresh interval. The user is named by their NameID, and the rest of the account
+// comes from the attributes released to the SP.
+func (provisioner *Provisioner) Provision(ctx context.Context, entityId, nameID string,
+	released map[string][]string) error {
+	if provisioner == nil {
+		return nil
+	}
+	sp := provisioner.config.ServiceProvider(entityId)
+	if sp == nil || sp.Provisioning == nil {
+		return nil
+	}
+	settings := sp.Provisioning.WithDefaults()
+	user := newUser(nameID, settings.Attributes, released)
+	userName := user["userName"].(string)
+	marker := provisionedPrefix + entityId + ":" + userName
+	var provisioned time.Time
+	if provisioner.store.Retrieve(marker, &provisioned) == nil {
+		return nil
+	}
+	ctx, span := telemetry.Start(ctx, "scim.provision")
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(settings.Timeout)*time.Second)
+	defer cancel()
+	err := provisioner.send(ctx, &settings, user)
+	telemetry.End(span, err)
+	if err != nil {
+		return err
+	}
+	return provisioner.store.Store(marker, time.Now(), settings.Refresh)
+}
+
+// Replaces the account when the SP already has one with the user name and creates it otherwise
+func (provisioner *Provisioner) send(ctx context.Context, settings *config.Provisioning,
+	user map[string]interface{}) error {
+	base := strings.TrimSuffix(settings.URL, "/")
+	filter := "userName eq " + strconv.Quote(user["userName"].(string))
+	var existing struct {
+		Resources []struct {
+			ID string `json:"id"`
+		} `json:"Resources"`
+	}
+	err := provisioner.call(ctx, settings, "GET", base+"/Users?filter="+url.QueryEscape(filter), nil, &existing)
+	if err != nil {
+		return err
+	}
+	if len(existing.Resources) == 0 {
+		return provisioner.call(ctx, settings, "POST", base+"/Users", user, nil)
+	}
+	id := existing.Resources[0].ID
+	user["id"] = id
+	return provisioner.call(ctx, settings, "PUT", base+"/Users/"+url.PathEscape(id), user, nil)
+}
+
+func (provisioner *Provisioner) call(ctx context.Context, settings *config.Provisioning, method, location string,
+	body, result interface{}) error {
+	var content io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, location, content)
+	if err != nil {
+		return err
+	}
+	telemetry.Inject(ctx, request.Header)
+	request.Header.Set("Accept", "application/scim+json, application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/scim+json")
+	}
+	if settings.Authorization != "" {
+		request.Header.Set("Authorization", settings.Authorization)
+	}
+	response, err := provisioner.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Connections are only reused once their response has been read to the end
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, maxResponse))
+		response.Body.Close()
+	}()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var failure struct {
+			Detail string `json:"detail"`
+		}
+		json.NewDecoder(io.LimitReader(response.Body, maxResponse)).Decode(&failure)
+		return fmt.Errorf("SCIM %s %s returned %s %s", method, location, response.Status, failure.Detail)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, maxResponse)).Decode(result)
+}
+
+// Returns the SCIM user for the released attributes. Multi-valued attributes get every value, the first
+// marked primary, and others the first value. Dotted paths such as name.givenName set sub-attributes.
+func newUser(nameID string, mappings map[string]string, released map[string][]string) map[string]interface{} {
+	user := map[string]interface{}{"schemas": []string{userSchema}, "userName": nameID, "active": true}
+	for path, attribute := range mappings {
+		values := released[attribute]
+		if len(values) == 0 {
+			continue
+		}
+		names := strings.Split(path, ".")
+		parent := user
+		for _, name := range names[:len(names)-1] {
+			child, ok := parent[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[name] = child
+			}
+			parent = child
+		}
+		name := names[len(names)-1]
+		if !multiValued[name] || len(names) > 1 {
+			parent[name] = values[0]
+			continue
+		}
+		list := make([]map[string]interface{}, len(values))
+		for i, value := range values {
+			list[i] = map[string]interface{}{"value": value}
+		}
+		list[0]["primary"] = true
+		parent[name] = list
+	}
+	return user
+}
@@ -0,0 +1,157 @@
+// Package ratelimit sheds load before it reaches the store and signing key: token buckets cap request
+// rates by path, and a semaphore caps the logins handled at once.
+package ratelimit
+
+import (
+	"expvar"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rejected requests published at /debug/vars, keyed by path or "logins" for the concurrency cap
+var rejected = expvar.NewMap("rateLimited")
+
+// How often buckets of idle clients are dropped
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets for one path, shared by every client or one per client address
+type Limiter struct {
+	mutex     sync.Mutex
+	settings  config.EndpointLimit
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewLimiter(settings config.EndpointLimit) *Limiter {
+	return &Limiter{settings: settings.WithDefaults(), buckets: make(map[string]*bucket)}
+}
+
+// Takes a token from the client's bucket. When it's empty, returns how long until one is available.
+func (limiter *Limiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	if !limiter.settings.PerClient {
+		client = ""
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.sweep(now)
+	burst := float64(limiter.settings.Burst)
+	current, found := limiter.buckets[client]
+	if !found {
+		current = &bucket{tokens: burst, last: now}
+		limiter.buckets[client] = current
+	}
+	current.tokens = math.Min(burst, current.tokens+now.Sub(current.last).Seconds()*limiter.settings.Rate)
+	current.last = now
+	if current.tokens < 1 {
+		return false, time.Duration((1 - current.tokens) / limiter.settings.Rate * float64(time.Second))
+	}
+	current.tokens--
+	return true, 0
+}
+
+// Drops buckets that have refilled, as they're the same as new ones
+func (limiter *Limiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < sweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+	full := time.Duration(float64(limiter.settings.Burst) / limiter.settings.Rate * float64(time.Second))
+	for client, bucket := range limiter.buckets {
+		if now.Sub(bucket.last) >= full {
+			delete(limiter.buckets, client)
+		}
+	}
+}
+
+// Answers requests to limited paths with 429 once they exceed the limit. Without limits the handler is
+// returned as is.
+func Handler(settings *config.RateLimits, handler http.Handler) http.Handler {
+	if settings == nil || len(settings.Endpoints) == 0 {
+		return handler
+	}
+	limiters := make(map[string]*Limiter)
+	for _, limit := range settings.Endpoints {
+		limiters[limit.Path] = NewLimiter(*limit)
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if limiter, found := limiters[request.URL.Path]; found {
+			if allowed, wait := limiter.Allow(clientOf(request), time.Now()); !allowed {
+				rejected.Add(request.URL.Path, 1)
+				logging.FromRequest(request).Warn("Request rate limited", "path", request.URL.Path)
+				tooManyRequests(writer, wait)
+				return
+			}
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Caps the requests handled at once. A nil Concurrency has no cap.
+type Concurrency chan struct{}
+
+// Returns the cap on concurrent logins, or nil when there isn't one
+func NewConcurrency(settings *config.RateLimits) Concurrency {
+	if settings == nil || settings.MaxConcurrentLogins <= 0 {
+		return nil
+	}
+	return make(Concurrency, settings.MaxConcurrentLogins)
+}
+
+// Claims a slot without waiting, reporting whether one was free. Claimed slots must be released.
+func (concurrency Concurrency) Acquire() bool {
+	if concurrency == nil {
+		return true
+	}
+	select {
+	case concurrency <- struct{}{}:
+		return true
+	default:
+		rejected.Add("logins", 1)
+		return false
+	}
+}
+
+func (concurrency Concurrency) Release() {
+	if concurrency != nil {
+		<-concurrency
+	}
+}
+
+// Answers requests with 429 while every slot is taken
+func (concurrency Concurrency) Handler(handler http.Handler) http.Handler {
+	if concurrency == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !concurrency.Acquire() {
+			logging.FromRequest(request).Warn("Too many logins in progress", "path", request.URL.Path)
+			tooManyRequests(writer, time.Second)
+			return
+		}
+		defer concurrency.Release()
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func tooManyRequests(writer http.ResponseWriter, wait time.Duration) {
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(writer, "Too many requests. Try again shortly.", http.StatusTooManyRequests)
+}
+
+func clientOf(request *http.Request) string {
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		return host
+	}
+	return request.RemoteAddr
+}
@@ -0,0 +1,106 @@
+package ratelimit
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiterAllowsBurstThenRate(t *testing.T) {
+	limiter := NewLimiter(config.EndpointLimit{Path: "/token", Rate: 2, Burst: 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("", now); !allowed {
+			t.Fatalf("request %d of the burst was limited", i+1)
+		}
+	}
+	allowed, wait := limiter.Allow("", now)
+	if allowed || wait != 500*time.Millisecond {
+		t.Errorf("request beyond the burst allowed %t with a wait of %s", allowed, wait)
+	}
+	if allowed, _ := limiter.Allow("", now.Add(500*time.Millisecond)); !allowed {
+		t.Error("token wasn't refilled at the rate")
+	}
+	if allowed, _ := limiter.Allow("", now.Add(500*time.Millisecond)); allowed {
+		t.Error("more than one token was refilled")
+	}
+}
+
+func TestLimiterSeparatesClients(t *testing.T) {
+	now := time.Now()
+	shared := NewLimiter(config.EndpointLimit{Rate: 1})
+	perClient := NewLimiter(config.EndpointLimit{Rate: 1, PerClient: true})
+	for _, limiter := range []*Limiter{shared, perClient} {
+		if allowed, _ := limiter.Allow("192.0.2.1", now); !allowed {
+			t.Fatal("first request was limited")
+		}
+	}
+	if allowed, _ := shared.Allow("192.0.2.2", now); allowed {
+		t.Error("shared limit let another client past it")
+	}
+	if allowed, _ := perClient.Allow("192.0.2.2", now); !allowed {
+		t.Error("per client limit held one client to another's")
+	}
+}
+
+// Buckets of clients that have gone quiet are dropped, so per client limits don't grow without bound
+func TestLimiterSweepsIdleClients(t *testing.T) {
+	limiter := NewLimiter(config.EndpointLimit{Rate: 1, Burst: 5, PerClient: true})
+	now := time.Now()
+	limiter.Allow("192.0.2.1", now)
+	limiter.Allow("192.0.2.2", now.Add(sweepInterval))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets kept after the idle client's refilled", len(limiter.buckets))
+	}
+	// Sweeps happen once an interval, and buckets still refilling are kept
+	limiter.Allow("192.0.2.3", now.Add(2*sweepInterval-time.Second))
+	if _, found := limiter.buckets["192.0.2.2"]; !found {
+		t.Error("bucket was dropped before the next sweep")
+	}
+	limiter.Allow("192.0.2.4", now.Add(2*sweepInterval))
+	if _, found := limiter.buckets["192.0.2.2"]; found {
+		t.Error("refilled bucket wasn't dropped")
+	}
+	if _, found := limiter.buckets["192.0.2.3"]; !found {
+		t.Error("refilling bucket was dropped")
+	}
+}
+
+func TestHandlerLimitsConfiguredPaths(t *testing.T) {
+	handler := Handler(&config.RateLimits{Endpoints: []*config.EndpointLimit{{Path: "/token", Rate: 0.01}}},
+		http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	status := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", path, nil))
+		return recorder
+	}
+	if recorder := status("/token"); recorder.Code != http.StatusOK {
+		t.Fatalf("first request answered with %d", recorder.Code)
+	}
+	recorder := status("/token")
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "100" {
+		t.Errorf("second request answered with %d, Retry-After %q", recorder.Code, recorder.Header().Get("Retry-After"))
+	}
+	if recorder := status("/metadata"); recorder.Code != http.StatusOK {
+		t.Errorf("unlimited path answered with %d", recorder.Code)
+	}
+}
+
+func TestConcurrencyCapsLogins(t *testing.T) {
+	concurrency := NewConcurrency(&config.RateLimits{MaxConcurrentLogins: 1})
+	if !concurrency.Acquire() {
+		t.Fatal("first login was turned away")
+	}
+	if concurrency.Acquire() {
+		t.Error("second login was let in while the first was handled")
+	}
+	concurrency.Release()
+	if !concurrency.Acquire() {
+		t.Error("slot wasn't released")
+	}
+	if NewConcurrency(nil) != nil || !NewConcurrency(nil).Acquire() {
+		t.Error("logins are capped without a limit")
+	}
+}
@@ -0,0 +1,410 @@
+// Package registry keeps the service providers registered through the admin API in the store, so they
+// survive restarts and reach every IdP instance sharing the store
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/httpclient"
+	"github.com/amdonov/lite-idp/leader"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/satori/go.uuid"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	key         = "registry:service-providers"
+	policiesKey = "registry:release-policies"
+	// Changes each time the registry does, so other instances know to apply it again
+	revisionKey = "registry:revision"
+	// Held by the instance changing the registry
+	lockKey = "registry:lock"
+	// When metadata was last fetched again from its URLs, so a new leader doesn't fetch it early
+	refreshedKey = "registry:metadata-refreshed"
+)
+
+// Seconds a lock is held for at most, should its holder stop before releasing it
+const lockLifetime = 30
+
+// How long a change waits for another instance's change to finish
+const lockWait = 10 * time.Second
+
+// Registrations are kept until they're deleted
+const lifetime = 10 * 365 * 24 * 60 * 60
+
+// Largest metadata document fetched from a URL
+const maxMetadata = 10 << 20
+
+// A service provider registered at runtime
+type Entry struct {
+	// Settings as they would appear in the configuration file. Metadata file paths aren't used.
+	ServiceProvider *config.ServiceProvider
+	// Metadata XML, uploaded or fetched from MetadataURL
+	Metadata    string
+	MetadataURL string
+	Updated     time.Time
+}
+
+type Registry struct {
+	// Revision last applied to the configuration. Accessed atomically, and first so it's aligned for that.
+	applied int64
+	store   store.Storer
+	config  *config.Configuration
+	// Serializes changes within the process. The lock in the store serializes them across instances.
+	mutex sync.Mutex
+}
+
+func New(store store.Storer, config *config.Configuration) *Registry {
+	return &Registry{store: store, config: config}
+}
+
+func (registry *Registry) load() (map[string]*Entry, error) {
+	entries := make(map[string]*Entry)
+	err := registry.store.Retrieve(key, &entries)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Returns the registered service providers by entity ID
+func (registry *Registry) List() (map[string]*Entry, error) {
+	return registry.load()
+}
+
+// Registers the service provider or replaces its registration. Metadata is fetched when only a URL is
+// given. The entity ID may be left for the metadata to supply.
+func (registry *Registry) Put(entry *Entry) error {
+	if entry.ServiceProvider == nil {
+		entry.ServiceProvider = &config.ServiceProvider{}
+	}
+	if entry.Metadata == "" && entry.MetadataURL != "" {
+		data, err := fetch(entry.MetadataURL)
+		if err != nil {
+			return fmt.Errorf("fetching metadata: %s", err)
+		}
+		entry.Metadata = string(data)
+	}
+	entry.ServiceProvider.Metadata = ""
+	// Parsed now so bad metadata is rejected rather than stored
+	sp, err := entry.provider()
+	if err != nil {
+		return err
+	}
+	entry.ServiceProvider.EntityId = sp.EntityId
+	entry.Updated = time.Now()
+	unlock, err := registry.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	entries, err := registry.load()
+	if err != nil {
+		return err
+	}
+	entries[sp.EntityId] = entry
+	return registry.save(entries)
+}
+
+// Removes the registration. Returns false if the service provider wasn't registered.
+func (registry *Registry) Delete(entityId string) (bool, error) {
+	unlock, err := registry.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	entries, err := registry.load()
+	if err != nil {
+		return false, err
+	}
+	if _, found := entries[entityId]; !found {
+		return false, nil
+	}
+	delete(entries, entityId)
+	return true, registry.save(entries)
+}
+
+func (registry *Registry) save(entries map[string]*Entry) error {
+	if err := registry.store.Store(key, entries, lifetime); err != nil {
+		return err
+	}
+	if err := registry.bump(); err != nil {
+		return err
+	}
+	return registry.Apply()
+}
+
+// Takes the lock shared by every instance, returning the function releasing it
+func (registry *Registry) lock() (func(), error) {
+	registry.mutex.Lock()
+	deadline := time.Now().Add(lockWait)
+	// Only the holder's own token releases the lock, so one that expired and was taken by another instance
+	// isn't released from under it
+	token := uuid.NewV4().String()
+	for {
+		acquired, err := registry.store.StoreIfAbsent(lockKey, token, lockLifetime)
+		if err != nil {
+			registry.mutex.Unlock()
+			return nil, err
+		}
+		if acquired {
+			return func() {
+				registry.store.DeleteIfEqual(lockKey, token)
+				registry.mutex.Unlock()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			registry.mutex.Unlock()
+			return nil, errors.New("another instance is changing the registry. Try again later.")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Records that the registry changed
+func (registry *Registry) bump() error {
+	return registry.store.Store(revisionKey, time.Now().UnixNano(), lifetime)
+}
+
+func (registry *Registry) revision() (int64, error) {
+	var revision int64
+	err := registry.store.Retrieve(revisionKey, &revision)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return 0, err
+	}
+	return revision, nil
+}
+
+// Applies changes made by other instances, checking for them at the interval until stop is closed. Problems
+// are logged to the logger.
+func (registry *Registry) Watch(interval time.Duration, stop <-chan struct{}, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			revision, err := registry.revision()
+			if err != nil {
+				logger.Warn("Failed to check for registry changes", "err", err)
+				continue
+			}
+			if revision == atomic.LoadInt64(&registry.applied) {
+				continue
+			}
+			if err := registry.Apply(); err != nil {
+				logger.Error("Failed to apply registry changes", "err", err)
+				continue
+			}
+			logger.Info("Applied registry changes made by another instance")
+		}
+	}()
+}
+
+// Fetches the metadata of service providers registered with a MetadataURL again at the interval, until stop is
+// closed. Only the instance leading the election fetches it; the others apply its changes as they do any other.
+// Problems are logged to the logger.
+func (registry *Registry) RefreshMetadata(interval time.Duration, election *leader.Election, stop <-chan struct{},
+	logger *slog.Logger) {
+	ticker := time.NewTicker(leader.Renewal)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			leading, err := election.Lead()
+			if err != nil {
+				logger.Warn("Failed to check which instance refreshes metadata", "err", err)
+			}
+			if !leading {
+				continue
+			}
+			var refreshed int64
+			if err := registry.store.Retrieve(refreshedKey, &refreshed); err != nil &&
+				!errors.Is(err, store.ErrNotFound) {
+				logger.Warn("Failed to check when metadata was refreshed", "err", err)
+				continue
+			}
+			if time.Since(time.Unix(refreshed, 0)) < interval {
+				continue
+			}
+			if err := registry.refresh(logger); err != nil {
+				logger.Error("Failed to refresh registered metadata", "err", err)
+				continue
+			}
+			registry.store.Store(refreshedKey, time.Now().Unix(), lifetime)
+		}
+	}()
+}
+
+// Fetches the metadata of each registration with a MetadataURL, saving the registrations whose metadata changed.
+// Registrations whose metadata can't be fetched or is invalid keep what they have.
+func (registry *Registry) refresh(logger *slog.Logger) error {
+	entries, err := registry.load()
+	if err != nil {
+		return err
+	}
+	// Fetched before taking the lock, so changes through the API don't wait on slow servers
+	fetched := make(map[string]*Entry)
+	for entityId, entry := range entries {
+		if entry.MetadataURL == "" {
+			continue
+		}
+		data, err := fetch(entry.MetadataURL)
+		if err != nil {
+			logger.Warn("Failed to refresh metadata", "sp", entityId, "url", entry.MetadataURL, "err", err)
+			continue
+		}
+		if string(data) == entry.Metadata {
+			continue
+		}
+		updated := *entry
+		updated.Metadata = string(data)
+		sp, err := updated.provider()
+		if err == nil && sp.EntityId != entityId {
+			err = fmt.Errorf("it describes %s", sp.EntityId)
+		}
+		if err != nil {
+			logger.Warn("Refreshed metadata isn't usable", "sp", entityId, "url", entry.MetadataURL, "err", err)
+			continue
+		}
+		fetched[entityId] = &updated
+	}
+	if len(fetched) == 0 {
+		return nil
+	}
+	unlock, err := registry.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Read again, as the registrations may have changed while fetching
+	if entries, err = registry.load(); err != nil {
+		return err
+	}
+	changed := false
+	for entityId, updated := range fetched {
+		// Registrations replaced while fetching keep their new settings
+		if entry, found := entries[entityId]; found && entry.MetadataURL == updated.MetadataURL {
+			entry.Metadata = updated.Metadata
+			entry.Updated = time.Now()
+			changed = true
+			logger.Info("Refreshed metadata", "sp", entityId, "url", entry.MetadataURL)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return registry.save(entries)
+}
+
+// Returns the release policies set through the API
+func (registry *Registry) ReleasePolicies() ([]*config.ReleasePolicy, error) {
+	var policies []*config.ReleasePolicy
+	err := registry.store.Retrieve(policiesKey, &policies)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// Replaces the release policies set through the API. They apply in addition to those in the file.
+func (registry *Registry) SetReleasePolicies(policies []*config.ReleasePolicy) error {
+	unlock, err := registry.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// Applied first so invalid expressions aren't stored
+	if err := registry.config.SetManagedReleasePolicies(policies); err != nil {
+		return err
+	}
+	if err := registry.store.Store(policiesKey, policies, lifetime); err != nil {
+		return err
+	}
+	return registry.bump()
+}
+
+// Makes the registered service providers and release policies active in the configuration
+func (registry *Registry) Apply() error {
+	// Read first, so a change made while applying is applied again
+	revision, err := registry.revision()
+	if err != nil {
+		return err
+	}
+	policies, err := registry.ReleasePolicies()
+	if err != nil {
+		return err
+	}
+	if err := registry.config.SetManagedReleasePolicies(policies); err != nil {
+		return err
+	}
+	entries, err := registry.load()
+	if err != nil {
+		return err
+	}
+	providers := make([]*config.ServiceProvider, 0, len(entries))
+	for entityId, entry := range entries {
+		sp, err := entry.provider()
+		if err != nil {
+			return fmt.Errorf("registered service provider %s: %s", entityId, err)
+		}
+		providers = append(providers, sp)
+	}
+	registry.config.SetManagedServiceProviders(providers)
+	atomic.StoreInt64(&registry.applied, revision)
+	return nil
+}
+
+// Returns a copy of the settings with the metadata applied, leaving the entry as stored
+func (entry *Entry) provider() (*config.ServiceProvider, error) {
+	sp := *entry.ServiceProvider
+	sp.AssertionConsumerServices = append(sp.AssertionConsumerServices[:0:0], sp.AssertionConsumerServices...)
+	if entry.Metadata != "" {
+		if err := sp.LoadMetadataFrom([]byte(entry.Metadata)); err != nil {
+			return nil, fmt.Errorf("invalid metadata: %s", err)
+		}
+	}
+	if sp.EntityId == "" {
+		return nil, errors.New("an entity ID is required when there's no metadata")
+	}
+	return &sp, nil
+}
+
+var client = &http.Client{Transport: httpclient.Transport, Timeout: 30 * time.Second}
+
+func fetch(url string) ([]byte, error) {
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Connections are only reused once their response has been read to the end
+		io.Copy(ioutil.Discard, io.LimitReader(response.Body, maxMetadata))
+		response.Body.Close()
+	}()
+	if response.StatusCode != 200 {
+		return nil, errors.New(response.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, maxMetadata+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMetadata {
+		return nil, errors.New("metadata is too large")
+	}
+	return data, nil
+}
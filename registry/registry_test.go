@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A holder whose lock expired and was taken by another instance doesn't release the other's lock
+func TestUnlockLeavesAnotherHoldersLock(t *testing.T) {
+	storer := store.NewMemory()
+	registry := New(storer, &config.Configuration{})
+	unlock, err := registry.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if the lock expired and another instance took it
+	if err := storer.Store(lockKey, "another instance", lockLifetime); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	var holder string
+	if err := storer.Retrieve(lockKey, &holder); err != nil || holder != "another instance" {
+		t.Errorf("lock is held by %q: %v", holder, err)
+	}
+	// The holder's own lock is released
+	storer.Delete(lockKey)
+	unlock, err = registry.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := storer.Retrieve(lockKey, &holder); err == nil {
+		t.Errorf("lock is still held by %q", holder)
+	}
+}
+
+// Returns SP metadata with an assertion consumer service at the location
+func spMetadata(location string) string {
+	return `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com">` +
+		`<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+		`<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="` +
+		location + `" index="0"/></SPSSODescriptor></EntityDescriptor>`
+}
+
+func TestRefreshFetchesChangedMetadata(t *testing.T) {
+	served := spMetadata("https://sp.example.com/acs")
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Write([]byte(served))
+	}))
+	defer server.Close()
+	settings := &config.Configuration{}
+	registry := New(store.NewMemory(), settings)
+	if err := registry.Put(&Entry{MetadataURL: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	served = spMetadata("https://sp.example.com/new-acs")
+	if err := registry.refresh(slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	sp := settings.ServiceProvider("https://sp.example.com")
+	if sp == nil || len(sp.AssertionConsumerServices) != 1 ||
+		sp.AssertionConsumerServices[0].Location != "https://sp.example.com/new-acs" {
+		t.Fatalf("refreshed SP is %+v", sp)
+	}
+	// Metadata that can't be used is ignored
+	served = "<html>maintenance</html>"
+	if err := registry.refresh(slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := registry.List()
+	if entries["https://sp.example.com"].Metadata != spMetadata("https://sp.example.com/new-acs") {
+		t.Error("unusable metadata replaced the registered metadata")
+	}
+}
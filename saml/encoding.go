@@ -0,0 +1,84 @@
+package saml
+
+const (
+	NameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	NameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	NameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+)
+
+var nameFormats = map[string]string{
+	"basic":       NameFormatBasic,
+	"uri":         NameFormatURI,
+	"unspecified": NameFormatUnspecified,
+}
+
+// urn:oid names of common inetOrgPerson, eduPerson and SCHAC attributes keyed by their LDAP names
+var KnownAttributes = map[string]string{
+	"uid":                         "urn:oid:0.9.2342.19200300.100.1.1",
+	"mail":                        "urn:oid:0.9.2342.19200300.100.1.3",
+	"cn":                          "urn:oid:2.5.4.3",
+	"sn":                          "urn:oid:2.5.4.4",
+	"givenName":                   "urn:oid:2.5.4.42",
+	"displayName":                 "urn:oid:2.16.840.1.113730.3.1.241",
+	"employeeNumber":              "urn:oid:2.16.840.1.113730.3.1.3",
+	"telephoneNumber":             "urn:oid:2.5.4.20",
+	"title":                       "urn:oid:2.5.4.12",
+	"o":                           "urn:oid:2.5.4.10",
+	"ou":                          "urn:oid:2.5.4.11",
+	"preferredLanguage":           "urn:oid:2.16.840.1.113730.3.1.39",
+	"eduPersonAffiliation":        "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+	"eduPersonNickname":           "urn:oid:1.3.6.1.4.1.5923.1.1.1.2",
+	"eduPersonOrgDN":              "urn:oid:1.3.6.1.4.1.5923.1.1.1.3",
+	"eduPersonOrgUnitDN":          "urn:oid:1.3.6.1.4.1.5923.1.1.1.4",
+	"eduPersonPrimaryAffiliation": "urn:oid:1.3.6.1.4.1.5923.1.1.1.5",
+	"eduPersonPrincipalName":      "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+	"eduPersonEntitlement":        "urn:oid:1.3.6.1.4.1.5923.1.1.1.7",
+	"eduPersonPrimaryOrgUnitDN":   "urn:oid:1.3.6.1.4.1.5923.1.1.1.8",
+	"eduPersonScopedAffiliation":  "urn:oid:1.3.6.1.4.1.5923.1.1.1.9",
+	"eduPersonAssurance":          "urn:oid:1.3.6.1.4.1.5923.1.1.1.11",
+	"eduPersonUniqueId":           "urn:oid:1.3.6.1.4.1.5923.1.1.1.13",
+	"eduPersonOrcid":              "urn:oid:1.3.6.1.4.1.5923.1.1.1.16",
+	"isMemberOf":                  "urn:oid:1.3.6.1.4.1.5923.1.5.1.1",
+	"schacHomeOrganization":       "urn:oid:1.3.6.1.4.1.25178.1.2.9",
+	"schacHomeOrganizationType":   "urn:oid:1.3.6.1.4.1.25178.1.2.10",
+	"schacPersonalUniqueCode":     "urn:oid:1.3.6.1.4.1.25178.1.2.14",
+}
+
+// How an attribute from the attribute store is named in assertions
+type AttributeEncoding struct {
+	// Name of the attribute in the attribute store
+	Source string
+	// Defaults to the urn:oid name of a known attribute when NameFormat is the uri format, otherwise Source
+	Name string
+	// Defaults to the basic format. The basic, uri and unspecified shorthands may be used.
+	NameFormat string
+	// Defaults to Source
+	FriendlyName string
+	// Sent as an EncryptedAttribute, and withheld from SPs without an encryption key
+	Sensitive bool
+	// Joins the values into a single AttributeValue for SPs that only accept one. By default each value is
+	// sent as its own AttributeValue in the order resolved.
+	Separator string
+}
+
+func (encoding *AttributeEncoding) newAttribute(source string) Attribute {
+	att := Attribute{Name: source, FriendlyName: source, NameFormat: NameFormatBasic}
+	if encoding == nil {
+		return att
+	}
+	if encoding.NameFormat != "" {
+		att.NameFormat = encoding.NameFormat
+		if format, found := nameFormats[encoding.NameFormat]; found {
+			att.NameFormat = format
+		}
+	}
+	if encoding.FriendlyName != "" {
+		att.FriendlyName = encoding.FriendlyName
+	}
+	if encoding.Name != "" {
+		att.Name = encoding.Name
+	} else if oid, found := KnownAttributes[source]; found && att.NameFormat == NameFormatURI {
+		att.Name = oid
+	}
+	return att
+}
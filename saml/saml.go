@@ -1,24 +1,76 @@
 package saml
 
+import (
+	"crypto/x509"
+	"github.com/amdonov/lite-idp/xmlenc"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"sort"
+	"strings"
+)
+
 func NewIssuer(issuer string) *Issuer {
 	return &Issuer{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity", Value: issuer}
 }
 
-func NewAttributeStatement(attributes map[string][]string) *AttributeStatement {
+// Creates a statement naming each attribute according to its encodings, once for each encoding. Attributes
+// without an encoding use the basic name format. Attributes are sorted by name so statements are repeatable.
+// Sensitive attributes are encrypted to the certificate, or left out when it's nil.
+func NewAttributeStatement(attributes map[string][]string, encodings map[string][]*AttributeEncoding,
+	cert *x509.Certificate, options xmlenc.Options) (*AttributeStatement, error) {
 	if attributes == nil {
-		return nil
+		return nil, nil
 	}
 	stmt := &AttributeStatement{}
-	for key, values := range attributes {
-		att := Attribute{}
-		att.FriendlyName = key
-		att.Name = key
-		att.NameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
-		for index := range values {
-			val := AttributeValue{Value: values[index]}
-			att.AttributeValues = append(att.AttributeValues, val)
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		values := attributes[key]
+		sourceEncodings := encodings[key]
+		if len(sourceEncodings) == 0 {
+			sourceEncodings = []*AttributeEncoding{nil}
+		}
+		for _, encoding := range sourceEncodings {
+			err := stmt.add(encoding, key, values, cert, options)
+			if err != nil {
+				return nil, err
+			}
 		}
+	}
+	if len(stmt.Attributes) == 0 && len(stmt.EncryptedAttributes) == 0 {
+		return nil, nil
+	}
+	return stmt, nil
+}
+
+func (stmt *AttributeStatement) add(encoding *AttributeEncoding, source string, values []string,
+	cert *x509.Certificate, options xmlenc.Options) error {
+	att := encoding.newAttribute(source)
+	if encoding != nil && encoding.Separator != "" && len(values) > 1 {
+		values = []string{strings.Join(values, encoding.Separator)}
+	}
+	for index := range values {
+		val := AttributeValue{Value: values[index]}
+		att.AttributeValues = append(att.AttributeValues, val)
+	}
+	if encoding == nil || !encoding.Sensitive {
 		stmt.Attributes = append(stmt.Attributes, att)
+		return nil
+	}
+	if cert == nil {
+		return nil
+	}
+	// Marshalled alone so the plaintext declares its own namespaces
+	data, err := xmlutil.Marshal(att)
+	if err != nil {
+		return err
+	}
+	encrypted, err := xmlenc.Encrypt(data, cert, options)
+	if err != nil {
+		return err
 	}
-	return stmt
+	stmt.EncryptedAttributes = append(stmt.EncryptedAttributes, EncryptedAttribute{EncryptedData: encrypted})
+	return nil
 }
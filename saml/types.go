@@ -2,11 +2,15 @@ package saml
 
 import (
 	"encoding/xml"
-	"github.com/amdonov/xmlsig"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/xmlenc"
 	"net"
 	"time"
 )
 
+// Namespace of assertions and the elements within them
+const Namespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+
 type Subject struct {
 	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
 	NameID              *NameID
@@ -24,6 +28,33 @@ type Conditions struct {
 	NotBefore           time.Time `xml:",attr"`
 	NotOnOrAfter        time.Time `xml:",attr"`
 	AudienceRestriction *AudienceRestriction
+	OneTimeUse          *OneTimeUse
+	ProxyRestriction    *ProxyRestriction
+	Delegation          *DelegationRestriction
+}
+
+// A Condition of DelegationRestrictionType listing the entities acting on the subject's behalf
+type DelegationRestriction struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Condition"`
+	Type     string   `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+	Delegate []Delegate
+}
+
+type Delegate struct {
+	XMLName            xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:conditions:delegation Delegate"`
+	DelegationInstant  time.Time `xml:",attr"`
+	ConfirmationMethod string    `xml:",attr,omitempty"`
+	NameID             *NameID
+}
+
+type OneTimeUse struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion OneTimeUse"`
+}
+
+type ProxyRestriction struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion ProxyRestriction"`
+	Count    *int     `xml:",attr,omitempty"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
 }
 
 type SubjectLocality struct {
@@ -32,21 +63,25 @@ type SubjectLocality struct {
 }
 
 type AuthnContext struct {
-	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContext"`
-	AuthnContextClassRef string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	XMLName                 xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContext"`
+	AuthnContextClassRef    string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	AuthenticatingAuthority []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthenticatingAuthority"`
 }
 
 type AuthnStatement struct {
-	XMLName         xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
-	AuthnInstant    time.Time `xml:",attr"`
-	SessionIndex    string    `xml:",attr"`
-	SubjectLocality *SubjectLocality
-	AuthnContext    *AuthnContext
+	XMLName             xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	AuthnInstant        time.Time  `xml:",attr"`
+	SessionIndex        string     `xml:",attr"`
+	SessionNotOnOrAfter *time.Time `xml:",attr,omitempty"`
+	SubjectLocality     *SubjectLocality
+	AuthnContext        *AuthnContext
 }
 
 type AttributeValue struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
 	Value   string   `xml:",chardata"`
+	// Set instead of Value for NameID valued attributes such as eduPersonTargetedID
+	NameID *NameID
 }
 
 type Attribute struct {
@@ -57,16 +92,27 @@ type Attribute struct {
 	AttributeValues []AttributeValue
 }
 
+type EncryptedAssertion struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAssertion"`
+	EncryptedData *xmlenc.EncryptedData
+}
+
+type EncryptedAttribute struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAttribute"`
+	EncryptedData *xmlenc.EncryptedData
+}
+
 type AttributeStatement struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement"`
-	Attributes []Attribute
+	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement"`
+	Attributes          []Attribute
+	EncryptedAttributes []EncryptedAttribute
 }
 
 type NameID struct {
 	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
 	Format          string   `xml:",attr"`
-	NameQualifier   string   `xml:",attr"`
-	SPNameQualifier string   `xml:",attr"`
+	NameQualifier   string   `xml:",attr,omitempty"`
+	SPNameQualifier string   `xml:",attr,omitempty"`
 	Value           string   `xml:",chardata"`
 }
 
@@ -77,16 +123,19 @@ type SubjectConfirmation struct {
 }
 
 type SubjectConfirmationData struct {
-	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+	// KeyInfoConfirmationDataType for holder-of-key confirmation
+	Type         string    `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr,omitempty"`
 	Address      net.IP    `xml:",attr"`
 	InResponseTo string    `xml:",attr"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
+	KeyInfo      *dsig.KeyInfo
 }
 
 type AudienceRestriction struct {
 	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
-	Audience string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
 }
 
 type Assertion struct {
@@ -95,7 +144,7 @@ type Assertion struct {
 	Version            string    `xml:",attr"`
 	IssueInstant       time.Time `xml:",attr"`
 	Issuer             *Issuer
-	Signature          *xmlsig.Signature
+	Signature          *dsig.Signature
 	Subject            *Subject
 	Conditions         *Conditions
 	AuthnStatement     *AuthnStatement
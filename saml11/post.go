@@ -0,0 +1,160 @@
+package saml11
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+const (
+	// Binding of SAML 1.1 browser/POST assertion consumer services
+	BrowserPOSTBinding = "urn:oasis:names:tc:SAML:1.0:profiles:browser-post"
+	protocolNamespace  = "urn:oasis:names:tc:SAML:1.0:protocol"
+	bearer             = "urn:oasis:names:tc:SAML:1.0:cm:bearer"
+	attributeNamespace = "urn:mace:shibboleth:1.0:attributeNamespace:uri"
+)
+
+// Authentication method URIs corresponding to SAML 2 context classes
+var authenticationMethods = map[string]string{
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport": "urn:oasis:names:tc:SAML:1.0:am:password",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:Password":                   "urn:oasis:names:tc:SAML:1.0:am:password",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:X509":                       "urn:ietf:rfc:2246",
+	"urn:oasis:names:tc:SAML:2.0:ac:classes:TLSClient":                  "urn:ietf:rfc:2246",
+}
+
+// Creates a marshaller that converts responses to SAML 1.1 and delivers them with the browser/POST profile.
+// Register it for BrowserPOSTBinding so legacy SPs share the SAML 2 sessions and attributes.
+func NewPOSTResponseMarshaller(signer dsig.Signer, config *config.Configuration) protocol.ResponseMarshaller {
+	marshaller := &postResponseMarshaller{signer: signer, config: config}
+	marshaller.template = template.Must(template.New("saml11Post").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html PUBLIC "-//W3C//DTD XHTML 1.1//EN"
+"http://www.w3.org/TR/xhtml11/DTD/xhtml11.dtd">
+<html xmlns="http://www.w3.org/1999/xhtml" xml:lang="en">
+<body onload="document.getElementById('samlpost').submit()">
+<noscript>
+<p>
+<strong>Note:</strong> Since your browser does not support JavaScript,
+you must press the Continue button once to proceed.
+</p>
+</noscript>
+<form action="{{ .AssertionConsumerServiceURL }}" method="post" id="samlpost">
+<div>
+<input type="hidden" name="TARGET"
+value="{{ .RelayState }}"/>
+<input type="hidden" name="SAMLResponse"
+value="{{ .SAMLResponse }}"/>
+</div>
+<noscript>
+<div>
+<input type="submit" value="Continue"/>
+</div>
+</noscript>
+</form>
+</body>
+</html>`))
+	return marshaller
+}
+
+type postResponseMarshaller struct {
+	template *template.Template
+	signer   dsig.Signer
+	config   *config.Configuration
+}
+
+func (gen *postResponseMarshaller) Marshal(writer http.ResponseWriter, request *http.Request,
+	response *protocol.Response, authRequest *protocol.AuthnRequest, relayState string) {
+	logger := logging.FromRequest(request)
+	signer, err := protocol.SignerFor(gen.signer, gen.config, authRequest.Issuer)
+	if err != nil {
+		logger.Error("Failed to choose signer", "err", err)
+		return
+	}
+	data, err := xmlutil.Marshal(Convert(response))
+	if err != nil {
+		logger.Error("Failed to marshal response", "err", err)
+		return
+	}
+	// The browser/POST profile requires a signed response
+	data, err = signer.SignElement(data, response.ID)
+	if err != nil {
+		logger.Error("Failed to sign response", "err", err)
+		return
+	}
+	samlMessage := base64.StdEncoding.EncodeToString(append([]byte(xml.Header), data...))
+	postResponse := protocol.POSTResponse{RelayState: relayState, SAMLResponse: samlMessage,
+		AssertionConsumerServiceURL: authRequest.AssertionConsumerServiceURL}
+	gen.template.Execute(writer, postResponse)
+}
+
+// Converts a SAML 2 response to its SAML 1.1 equivalent
+func Convert(response *protocol.Response) *Response {
+	r := &Response{ResponseID: response.ID, MajorVersion: 1, MinorVersion: 1,
+		IssueInstant: response.IssueInstant, Recipient: response.Destination}
+	r.Status = convertStatus(response.Status)
+	a := response.Assertion
+	if a == nil {
+		return r
+	}
+	assertion := &Assertion{AssertionID: a.ID, IssueInstant: a.IssueInstant, MajorVersion: 1, MinorVersion: 1}
+	if a.Issuer != nil {
+		assertion.Issuer = a.Issuer.Value
+	}
+	if a.Conditions != nil {
+		assertion.Conditions = &Conditions{NotBefore: a.Conditions.NotBefore, NotOnOrAfter: a.Conditions.NotOnOrAfter}
+		if a.Conditions.AudienceRestriction != nil {
+			assertion.Conditions.AudienceRestrictionCondition = &AudienceRestrictionCondition{
+				Audience: a.Conditions.AudienceRestriction.Audience}
+		}
+	}
+	subject := Subject{SubjectConfirmation: SubjectConfirmation{ConfirmationMethod: bearer}}
+	if a.Subject != nil && a.Subject.NameID != nil {
+		subject.NameIdentifier = NameIdentifier{Format: a.Subject.NameID.Format,
+			NameQualifier: a.Subject.NameID.NameQualifier, Value: a.Subject.NameID.Value}
+	}
+	if s := a.AuthnStatement; s != nil {
+		statement := &AuthenticationStatement{AuthenticationInstant: s.AuthnInstant, Subject: subject,
+			AuthenticationMethod: "urn:oasis:names:tc:SAML:1.0:am:unspecified"}
+		if s.AuthnContext != nil {
+			if method, found := authenticationMethods[s.AuthnContext.AuthnContextClassRef]; found {
+				statement.AuthenticationMethod = method
+			}
+		}
+		if s.SubjectLocality != nil {
+			statement.SubjectLocality = &SubjectLocality{IPAddress: s.SubjectLocality.Address}
+		}
+		assertion.AuthenticationStatement = statement
+	}
+	if a.AttributeStatement != nil && len(a.AttributeStatement.Attributes) > 0 {
+		statement := &AttributeStatement{Subject: subject}
+		for _, att := range a.AttributeStatement.Attributes {
+			attribute := Attribute{AttributeName: att.Name, AttributeNamespace: attributeNamespace}
+			for _, value := range att.AttributeValues {
+				attribute.AttributeValue = append(attribute.AttributeValue, value.Value)
+			}
+			statement.Attribute = append(statement.Attribute, attribute)
+		}
+		assertion.AttributeStatement = statement
+	}
+	r.Assertion = assertion
+	return r
+}
+
+// SAML 1.1 status codes are QNames. Only the top-level code carries over.
+func convertStatus(status *protocol.Status) Status {
+	code := "Responder"
+	message := ""
+	if status != nil {
+		value := status.StatusCode.Value
+		code = value[strings.LastIndex(value, ":")+1:]
+		message = status.StatusMessage
+	}
+	return Status{StatusCode: StatusCode{Value: xmlutil.Prefixes[protocolNamespace] + ":" + code},
+		StatusMessage: message}
+}
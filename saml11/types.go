@@ -0,0 +1,98 @@
+package saml11
+
+import (
+	"encoding/xml"
+	"net"
+	"time"
+)
+
+type Response struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:protocol Response"`
+	ResponseID   string    `xml:",attr"`
+	MajorVersion int       `xml:",attr"`
+	MinorVersion int       `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Recipient    string    `xml:",attr"`
+	Status       Status
+	Assertion    *Assertion
+}
+
+type Status struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:protocol Status"`
+	StatusCode    StatusCode
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:1.0:protocol StatusMessage,omitempty"`
+}
+
+// Value is a QName such as samlp1:Success
+type StatusCode struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:protocol StatusCode"`
+	Value   string   `xml:",attr"`
+}
+
+type Assertion struct {
+	XMLName                 xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion Assertion"`
+	AssertionID             string    `xml:",attr"`
+	Issuer                  string    `xml:",attr"`
+	IssueInstant            time.Time `xml:",attr"`
+	MajorVersion            int       `xml:",attr"`
+	MinorVersion            int       `xml:",attr"`
+	Conditions              *Conditions
+	AuthenticationStatement *AuthenticationStatement
+	AttributeStatement      *AttributeStatement
+}
+
+type Conditions struct {
+	XMLName                      xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion Conditions"`
+	NotBefore                    time.Time `xml:",attr"`
+	NotOnOrAfter                 time.Time `xml:",attr"`
+	AudienceRestrictionCondition *AudienceRestrictionCondition
+}
+
+type AudienceRestrictionCondition struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion AudienceRestrictionCondition"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:1.0:assertion Audience"`
+}
+
+type AuthenticationStatement struct {
+	XMLName               xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion AuthenticationStatement"`
+	AuthenticationMethod  string    `xml:",attr"`
+	AuthenticationInstant time.Time `xml:",attr"`
+	Subject               Subject
+	SubjectLocality       *SubjectLocality
+}
+
+type Subject struct {
+	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion Subject"`
+	NameIdentifier      NameIdentifier
+	SubjectConfirmation SubjectConfirmation
+}
+
+type NameIdentifier struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion NameIdentifier"`
+	Format        string   `xml:",attr,omitempty"`
+	NameQualifier string   `xml:",attr,omitempty"`
+	Value         string   `xml:",chardata"`
+}
+
+type SubjectConfirmation struct {
+	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion SubjectConfirmation"`
+	ConfirmationMethod string   `xml:"urn:oasis:names:tc:SAML:1.0:assertion ConfirmationMethod"`
+}
+
+type SubjectLocality struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion SubjectLocality"`
+	IPAddress net.IP   `xml:",attr,omitempty"`
+}
+
+type AttributeStatement struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion AttributeStatement"`
+	Subject   Subject
+	Attribute []Attribute
+}
+
+type Attribute struct {
+	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:assertion Attribute"`
+	AttributeName      string   `xml:",attr"`
+	AttributeNamespace string   `xml:",attr"`
+	AttributeValue     []string `xml:"urn:oasis:names:tc:SAML:1.0:assertion AttributeValue"`
+}
@@ -0,0 +1,55 @@
+#!/bin/sh
+# Walks a login through the load balancer of docker-compose.yml, one connection per request so consecutive
+# requests land on different instances. Fails unless the login and the session it creates work wherever
+# they're handled. Run it after docker compose up.
+set -eu
+
+IDP=${IDP:-https://localhost:8443}
+STATS=${STATS:-http://localhost:8404/stats}
+SP=https://sp.example.com/shibboleth
+JAR=$(mktemp)
+trap 'rm -f "$JAR"' EXIT
+
+fail() {
+	echo "FAIL: $*" >&2
+	exit 1
+}
+
+# Prints a deflated, encoded AuthnRequest for the redirect binding
+request() {
+	python3 - "$SP" <<'EOF'
+import base64, datetime, sys, urllib.parse, uuid, zlib
+xml = ('<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" '
+       'xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_%s" Version="2.0" IssueInstant="%s">'
+       '<saml:Issuer>%s</saml:Issuer></samlp:AuthnRequest>') % (
+    uuid.uuid4().hex, datetime.datetime.utcnow().strftime('%Y-%m-%dT%H:%M:%SZ'), sys.argv[1])
+deflate = zlib.compressobj(9, zlib.DEFLATED, -15)
+data = deflate.compress(xml.encode()) + deflate.flush()
+print(urllib.parse.quote(base64.b64encode(data).decode()))
+EOF
+}
+
+# Succeeds when the page carries a successful SAML response
+succeeded() {
+	python3 -c '
+import base64, html, re, sys
+match = re.search(r"name=\"SAMLResponse\"\s+value=\"([^\"]+)\"", sys.stdin.read())
+sys.exit(0 if match and b"status:Success" in base64.b64decode(html.unescape(match.group(1))) else 1)'
+}
+
+# Saves the AuthnRequest on one instance
+curl -sfk -c "$JAR" -b "$JAR" "$IDP/SAML2/Redirect/SSO?SAMLRequest=$(request)" | grep -q 'name="pwd"' ||
+	fail "the login form wasn't shown"
+# Signs in on the other, which must find the saved request
+curl -sfk -c "$JAR" -b "$JAR" -d uid=jdoe -d pwd=secret "$IDP/authenticate" | succeeded ||
+	fail "signing in didn't send the SP a successful response"
+# The session created there must be usable on the first
+curl -sfk -c "$JAR" -b "$JAR" "$IDP/SAML2/Redirect/SSO?SAMLRequest=$(request)" | succeeded ||
+	fail "the session wasn't reused for a second login"
+
+# Both instances must have taken part
+for server in idp1 idp2; do
+	sessions=$(curl -sf "$STATS;csv" | awk -F, -v server="$server" '$1 == "instances" && $2 == server { print $8 }')
+	[ "${sessions:-0}" -gt 0 ] || fail "$server handled no requests"
+done
+echo "PASS: the login was handled across both instances"
@@ -0,0 +1,243 @@
+package scim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The provisioned users and groups. Both files are read for every operation, like the login form reads the
+// users file at each sign in, so edits made elsewhere aren't lost.
+type Directory struct {
+	// Provisioned resources
+	file string
+	// The login form's users file, which holds the password hashes of active users
+	users string
+	// Where sessions of deprovisioned users are revoked
+	store store.Storer
+	lock  sync.Mutex
+}
+
+// Contents of the directory file
+type contents struct {
+	Users  []*account `json:"users"`
+	Groups []*Group   `json:"groups"`
+}
+
+// A user with the hash of the password last set for them, which is kept while they're inactive
+type account struct {
+	*User
+	PasswordHash string `json:"passwordHash,omitempty"`
+}
+
+func NewDirectory(file, users string, store store.Storer) *Directory {
+	return &Directory{file: file, users: users, store: store}
+}
+
+// Reads the directory. A missing file is empty.
+func (directory *Directory) load() (*contents, error) {
+	contents := &contents{}
+	data, err := ioutil.ReadFile(directory.file)
+	if os.IsNotExist(err) {
+		return contents, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, contents); err != nil {
+		return nil, err
+	}
+	// Resources added to the file by hand may have no metadata
+	for _, account := range contents.Users {
+		if account.Meta == nil {
+			account.Meta = &Meta{ResourceType: "User"}
+		}
+	}
+	for _, group := range contents.Groups {
+		if group.Meta == nil {
+			group.Meta = &Meta{ResourceType: "Group"}
+		}
+	}
+	return contents, nil
+}
+
+// Replaces the directory file, then brings the users file in line with it
+func (directory *Directory) save(contents *contents, previous map[string]bool) error {
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(filepath.Dir(directory.file), ".scim")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+	if _, err := temporary.Write(data); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temporary.Name(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(temporary.Name(), directory.file); err != nil {
+		return err
+	}
+	return directory.syncAccounts(contents, previous)
+}
+
+// Writes the password hashes of active users to the users file and removes users who were provisioned
+// before but are now inactive or gone, ending their sessions
+func (directory *Directory) syncAccounts(contents *contents, previous map[string]bool) error {
+	users, err := authentication.LoadUsers(directory.users)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for _, account := range contents.Users {
+		if account.active() && account.PasswordHash != "" {
+			current[account.UserName] = true
+			users[account.UserName] = account.PasswordHash
+		}
+	}
+	var removed []string
+	for name := range previous {
+		if !current[name] {
+			delete(users, name)
+			removed = append(removed, name)
+		}
+	}
+	if err := users.Save(directory.users); err != nil {
+		return err
+	}
+	for _, name := range removed {
+		if _, err := authentication.RevokeUserSessions(directory.store, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the names of users the directory has written to the users file
+func (contents *contents) signInNames() map[string]bool {
+	names := make(map[string]bool)
+	for _, account := range contents.Users {
+		if account.active() && account.PasswordHash != "" {
+			names[account.UserName] = true
+		}
+	}
+	return names
+}
+
+// Runs the change with the directory locked, saving it when the change succeeds
+func (directory *Directory) update(change func(*contents) error) error {
+	directory.lock.Lock()
+	defer directory.lock.Unlock()
+	contents, err := directory.load()
+	if err != nil {
+		return err
+	}
+	previous := contents.signInNames()
+	if err := change(contents); err != nil {
+		return err
+	}
+	return directory.save(contents, previous)
+}
+
+// Returns the directory's contents for reading
+func (directory *Directory) read() (*contents, error) {
+	directory.lock.Lock()
+	defer directory.lock.Unlock()
+	return directory.load()
+}
+
+// Reports whether a user name is taken by another provisioned user or by an account the directory
+// doesn't manage
+func (directory *Directory) nameTaken(contents *contents, name, id string) (bool, error) {
+	for _, account := range contents.Users {
+		if strings.EqualFold(account.UserName, name) {
+			return account.ID != id, nil
+		}
+	}
+	users, err := authentication.LoadUsers(directory.users)
+	if err != nil {
+		return false, err
+	}
+	_, found := users[name]
+	return found, nil
+}
+
+func (contents *contents) user(id string) *account {
+	for _, account := range contents.Users {
+		if account.ID == id {
+			return account
+		}
+	}
+	return nil
+}
+
+func (contents *contents) group(id string) *Group {
+	for _, group := range contents.Groups {
+		if group.ID == id {
+			return group
+		}
+	}
+	return nil
+}
+
+// Returns the groups the user is a member of
+func (contents *contents) groupsOf(id string) []*Group {
+	var groups []*Group
+	for _, group := range contents.Groups {
+		for _, member := range group.Members {
+			if member.Value == id {
+				groups = append(groups, group)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// Provides the attributes of active provisioned users to the attribute pipeline
+func (directory *Directory) Retrieve(ctx context.Context, user *protocol.AuthenticatedUser) (map[string][]string,
+	error) {
+	contents, err := directory.read()
+	if err != nil {
+		return nil, err
+	}
+	for _, account := range contents.Users {
+		if account.UserName != user.Name || !account.active() {
+			continue
+		}
+		attributes := make(map[string][]string)
+		add := func(name, value string) {
+			if value != "" {
+				attributes[name] = append(attributes[name], value)
+			}
+		}
+		add("displayName", account.DisplayName)
+		if account.Name != nil {
+			add("givenName", account.Name.GivenName)
+			add("sn", account.Name.FamilyName)
+		}
+		for _, email := range account.Emails {
+			add("mail", email.Value)
+		}
+		for _, group := range contents.groupsOf(account.ID) {
+			add("groups", group.DisplayName)
+		}
+		return attributes, nil
+	}
+	return nil, errors.New("No provisioned user " + user.Name)
+}
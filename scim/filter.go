@@ -0,0 +1,330 @@
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A parsed filter, evaluated against resources in their JSON form
+type filter func(resource map[string]interface{}) bool
+
+// Parses a filter as described in RFC 7644 section 3.4.2.2, such as
+// userName eq "jdoe" or (emails[type eq "work" and value co "@example.com"] and active eq true)
+func parseFilter(text string) (filter, error) {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{tokens: tokens}
+	result, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.done() {
+		return nil, fmt.Errorf("unexpected %q in filter", parser.peek())
+	}
+	return result, nil
+}
+
+// Splits a filter into parentheses, brackets, quoted strings and words. Strings keep their quotes so
+// they're told apart from words.
+func tokenize(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(text) && text[end] != '"'; end++ {
+				if text[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(text) {
+				return nil, errors.New("unterminated string in filter")
+			}
+			tokens = append(tokens, text[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(text) && strings.IndexByte(" \t()[]\"", text[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, text[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []string
+	next   int
+}
+
+func (parser *filterParser) done() bool {
+	return parser.next >= len(parser.tokens)
+}
+
+func (parser *filterParser) peek() string {
+	if parser.done() {
+		return ""
+	}
+	return parser.tokens[parser.next]
+}
+
+func (parser *filterParser) take() string {
+	token := parser.peek()
+	parser.next++
+	return token
+}
+
+func (parser *filterParser) expect(token string) error {
+	if next := parser.take(); next != token {
+		return fmt.Errorf("expected %q in filter but found %q", token, next)
+	}
+	return nil
+}
+
+func (parser *filterParser) or() (filter, error) {
+	left, err := parser.and()
+	for err == nil && strings.EqualFold(parser.peek(), "or") {
+		parser.take()
+		var right filter
+		right, err = parser.and()
+		first := left
+		left = func(resource map[string]interface{}) bool {
+			return first(resource) || right(resource)
+		}
+	}
+	return left, err
+}
+
+func (parser *filterParser) and() (filter, error) {
+	left, err := parser.factor()
+	for err == nil && strings.EqualFold(parser.peek(), "and") {
+		parser.take()
+		var right filter
+		right, err = parser.factor()
+		first := left
+		left = func(resource map[string]interface{}) bool {
+			return first(resource) && right(resource)
+		}
+	}
+	return left, err
+}
+
+func (parser *filterParser) factor() (filter, error) {
+	switch token := parser.take(); {
+	case token == "(":
+		inner, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, parser.expect(")")
+	case strings.EqualFold(token, "not"):
+		if err := parser.expect("("); err != nil {
+			return nil, err
+		}
+		inner, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		return func(resource map[string]interface{}) bool { return !inner(resource) }, parser.expect(")")
+	case token == "" || strings.IndexAny(token[:1], "()[]\"") >= 0:
+		return nil, fmt.Errorf("expected an attribute in filter but found %q", token)
+	default:
+		return parser.comparison(token)
+	}
+}
+
+// Parses the rest of a comparison of the attribute, or of a filter on its values in brackets
+func (parser *filterParser) comparison(path string) (filter, error) {
+	path = attributePath(path)
+	if parser.peek() == "[" {
+		parser.take()
+		inner, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		return func(resource map[string]interface{}) bool {
+			for _, value := range lookup(resource, path, false) {
+				if element, ok := value.(map[string]interface{}); ok && inner(element) {
+					return true
+				}
+			}
+			return false
+		}, parser.expect("]")
+	}
+	operator := strings.ToLower(parser.take())
+	if operator == "pr" {
+		return func(resource map[string]interface{}) bool {
+			for _, value := range lookup(resource, path, true) {
+				if value != nil && value != "" {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	switch operator {
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("unsupported filter operator %q", operator)
+	}
+	expected, err := literal(parser.take())
+	if err != nil {
+		return nil, err
+	}
+	return func(resource map[string]interface{}) bool {
+		for _, value := range lookup(resource, path, true) {
+			if operator == "ne" && compare("eq", value, expected) {
+				return false
+			}
+			if operator != "ne" && compare(operator, value, expected) {
+				return true
+			}
+		}
+		// ne holds when no value equals the literal, including when there are none
+		return operator == "ne"
+	}, nil
+}
+
+// Parses a comparison value: a quoted string, true, false, null or a number
+func literal(token string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(token, "\""):
+		return strconv.Unquote(token)
+	case token == "true", token == "false":
+		return token == "true", nil
+	case token == "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q in filter", token)
+	}
+	return number, nil
+}
+
+// Removes the schema URN of fully qualified paths such as urn:ietf:params:scim:schemas:core:2.0:User:userName
+func attributePath(path string) string {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		return path[strings.LastIndex(path, ":")+1:]
+	}
+	return path
+}
+
+// Returns the values at the dotted path, looking names up regardless of case and flattening multi-valued
+// attributes. Complex values stand for their value sub-attribute when primitives are wanted.
+func lookup(resource map[string]interface{}, path string, primitive bool) []interface{} {
+	values := []interface{}{resource}
+	for _, name := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, value := range values {
+			if object, ok := value.(map[string]interface{}); ok {
+				next = append(next, flatten(member(object, name))...)
+			}
+		}
+		values = next
+	}
+	if !primitive {
+		return values
+	}
+	primitives := make([]interface{}, len(values))
+	for i, value := range values {
+		primitives[i] = value
+		if object, ok := value.(map[string]interface{}); ok {
+			primitives[i] = member(object, "value")
+		}
+	}
+	return primitives
+}
+
+// Returns the object's member with the name, compared without regard to case
+func member(object map[string]interface{}, name string) interface{} {
+	if value, found := object[name]; found {
+		return value
+	}
+	for key, value := range object {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return nil
+}
+
+func flatten(value interface{}) []interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return value
+	default:
+		return []interface{}{value}
+	}
+}
+
+// Compares a value with a literal. Strings are compared without regard to case.
+func compare(operator string, value, expected interface{}) bool {
+	switch expected := expected.(type) {
+	case string:
+		actual, ok := value.(string)
+		if !ok {
+			return false
+		}
+		actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+		switch operator {
+		case "eq":
+			return actual == expected
+		case "co":
+			return strings.Contains(actual, expected)
+		case "sw":
+			return strings.HasPrefix(actual, expected)
+		case "ew":
+			return strings.HasSuffix(actual, expected)
+		}
+		return ordered(operator, strings.Compare(actual, expected))
+	case float64:
+		actual, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		if operator == "eq" {
+			return actual == expected
+		}
+		switch {
+		case actual < expected:
+			return ordered(operator, -1)
+		case actual > expected:
+			return ordered(operator, 1)
+		}
+		return ordered(operator, 0)
+	case bool:
+		actual, ok := value.(bool)
+		return ok && operator == "eq" && actual == expected
+	case nil:
+		return operator == "eq" && value == nil
+	}
+	return false
+}
+
+func ordered(operator string, comparison int) bool {
+	switch operator {
+	case "gt":
+		return comparison > 0
+	case "ge":
+		return comparison >= 0
+	case "lt":
+		return comparison < 0
+	case "le":
+		return comparison <= 0
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package scim
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const filterUser = `{"userName": "jdoe", "active": true, "name": {"givenName": "John", "familyName": "Doe"},
+	"emails": [{"type": "work", "value": "jdoe@example.com"}, {"type": "home", "value": "john@mail.example.org"}],
+	"meta": {"created": "2024-03-01T00:00:00Z"}}`
+
+func TestFilterMatches(t *testing.T) {
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(filterUser), &resource); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		filter  string
+		matches bool
+	}{
+		{`userName eq "jdoe"`, true},
+		{`UserName Eq "JDOE"`, true},
+		{`userName eq "asmith"`, false},
+		{`userName ne "asmith"`, true},
+		{`name.givenName sw "Jo"`, true},
+		{`name.familyName ew "oe" and active eq true`, true},
+		{`active eq false or userName co "do"`, true},
+		{`not (active eq true)`, false},
+		{`displayName pr`, false},
+		{`emails[type eq "work" and value co "@example.com"]`, true},
+		{`emails[type eq "home" and value co "@example.com"]`, false},
+		{`emails.value ew "example.org"`, true},
+		{`meta.created gt "2024-01-01T00:00:00Z"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "jdoe"`, true},
+	}
+	for _, test := range tests {
+		matches, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if matches(resource) != test.matches {
+			t.Errorf("%s matched %t", test.filter, !test.matches)
+		}
+	}
+}
+
+func TestFilterRejectsMalformed(t *testing.T) {
+	for _, text := range []string{`userName eq`, `(userName eq "jdoe"`, `userName zz "jdoe"`, `userName eq "jdoe`,
+		`emails[type eq "work"`, `userName eq "jdoe" extra`, `not userName eq "jdoe"`, `eq "jdoe"`} {
+		if _, err := parseFilter(text); err == nil {
+			t.Errorf("parsed %s", text)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package scim
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Applies PATCH operations to a resource in its JSON form, as described in RFC 7644 section 3.5.2
+func applyPatch(resource map[string]interface{}, operations []patchOperation) error {
+	for _, operation := range operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return &scimError{http.StatusBadRequest, "invalidSyntax", "unsupported operation " + operation.Op}
+		}
+		path := attributePath(strings.TrimSpace(operation.Path))
+		var err error
+		switch {
+		case path == "" && op == "remove":
+			err = &scimError{http.StatusBadRequest, "noTarget", "remove needs a path"}
+		case path == "":
+			// The value holds the attributes to add or replace
+			values, ok := operation.Value.(map[string]interface{})
+			if !ok {
+				return &scimError{http.StatusBadRequest, "invalidValue", "operations without a path need an object"}
+			}
+			for name, value := range values {
+				if err = set(resource, attributePath(name), op, value); err != nil {
+					break
+				}
+			}
+		case strings.Contains(path, "["):
+			err = patchFiltered(resource, path, op, operation.Value)
+		case op == "remove":
+			parent, name := parentOf(resource, path, false)
+			if parent != nil {
+				delete(parent, keyOf(parent, name))
+			}
+		default:
+			err = set(resource, path, op, operation.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds or replaces the attribute at the dotted path. Adding to a multi-valued attribute appends to it.
+func set(resource map[string]interface{}, path, op string, value interface{}) error {
+	parent, name := parentOf(resource, path, true)
+	if parent == nil {
+		return &scimError{http.StatusBadRequest, "invalidPath", "can't set " + path}
+	}
+	key := keyOf(parent, name)
+	existing, isList := parent[key].([]interface{})
+	if op == "add" && isList {
+		for _, added := range flatten(value) {
+			if !containsValue(existing, added) {
+				existing = append(existing, added)
+			}
+		}
+		parent[key] = existing
+		return nil
+	}
+	// Merging complex attributes keeps the sub-attributes the value doesn't mention
+	if object, ok := parent[key].(map[string]interface{}); ok && op == "add" {
+		if values, ok := value.(map[string]interface{}); ok {
+			for name, value := range values {
+				object[keyOf(object, name)] = value
+			}
+			return nil
+		}
+	}
+	parent[key] = value
+	return nil
+}
+
+// Applies an operation to the values of a multi-valued attribute matching a filter, such as
+// members[value eq "2819c223"] or emails[type eq "work"].value
+func patchFiltered(resource map[string]interface{}, path, op string, value interface{}) error {
+	open, end := strings.Index(path, "["), strings.LastIndex(path, "]")
+	if end < open {
+		return &scimError{http.StatusBadRequest, "invalidPath", "unterminated filter in " + path}
+	}
+	matches, err := parseFilter(path[open+1 : end])
+	if err != nil {
+		return &scimError{http.StatusBadRequest, "invalidFilter", err.Error()}
+	}
+	subAttribute := strings.TrimPrefix(path[end+1:], ".")
+	parent, name := parentOf(resource, path[:open], false)
+	if parent == nil {
+		return &scimError{http.StatusBadRequest, "noTarget", "nothing matches " + path}
+	}
+	key := keyOf(parent, name)
+	values, _ := parent[key].([]interface{})
+	var kept []interface{}
+	matched := false
+	for _, element := range values {
+		object, ok := element.(map[string]interface{})
+		if !ok || !matches(object) {
+			kept = append(kept, element)
+			continue
+		}
+		matched = true
+		switch {
+		case op == "remove" && subAttribute == "":
+			continue
+		case op == "remove":
+			delete(object, keyOf(object, subAttribute))
+		case subAttribute != "":
+			object[keyOf(object, subAttribute)] = value
+		default:
+			replacement, ok := value.(map[string]interface{})
+			if !ok {
+				return &scimError{http.StatusBadRequest, "invalidValue", path + " needs an object"}
+			}
+			for name, value := range replacement {
+				object[keyOf(object, name)] = value
+			}
+		}
+		kept = append(kept, object)
+	}
+	if !matched && op != "remove" {
+		return &scimError{http.StatusBadRequest, "noTarget", "nothing matches " + path}
+	}
+	parent[key] = kept
+	return nil
+}
+
+// Returns the object holding the last attribute of the dotted path and the attribute's name, creating
+// intermediate objects when asked
+func parentOf(resource map[string]interface{}, path string, create bool) (map[string]interface{}, string) {
+	names := strings.Split(path, ".")
+	parent := resource
+	for _, name := range names[:len(names)-1] {
+		key := keyOf(parent, name)
+		child, ok := parent[key].(map[string]interface{})
+		if !ok {
+			if !create || parent[key] != nil {
+				return nil, ""
+			}
+			child = make(map[string]interface{})
+			parent[key] = child
+		}
+		parent = child
+	}
+	return parent, names[len(names)-1]
+}
+
+// Returns the key the object already uses for the attribute, whose names aren't case sensitive, or the name
+// itself when it has none
+func keyOf(object map[string]interface{}, name string) string {
+	for key := range object {
+		if strings.EqualFold(key, name) {
+			return key
+		}
+	}
+	return name
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, existing := range values {
+		if fmt.Sprint(existing) == fmt.Sprint(value) {
+			return true
+		}
+	}
+	return false
+}
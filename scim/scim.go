@@ -0,0 +1,549 @@
+// Package scim serves a SCIM 2.0 API through which HR and identity systems provision and deprovision the
+// accounts the login form checks. Users and groups are kept in a Directory, which also provides their
+// attributes to the attribute pipeline.
+package scim
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/bearer"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/satori/go.uuid"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An error returned with its HTTP status and SCIM error type
+type scimError struct {
+	status   int
+	scimType string
+	detail   string
+}
+
+func (err *scimError) Error() string {
+	return err.detail
+}
+
+type server struct {
+	directory *Directory
+	// URL of the endpoint, used for resource locations
+	base string
+}
+
+// Creates the API handler. Relative to the SCIM path:
+//
+//	GET Users[?filter=<filter>&startIndex=<n>&count=<n>]  lists users
+//	POST Users                                            provisions a user
+//	GET|PUT|PATCH|DELETE Users/<id>                       returns, replaces, modifies or deprovisions a user
+//	GET Groups[?filter=<filter>&startIndex=<n>&count=<n>] lists groups
+//	POST Groups                                           creates a group
+//	GET|PUT|PATCH|DELETE Groups/<id>                      returns, replaces, modifies or deletes a group
+//	GET ServiceProviderConfig, ResourceTypes              describe the API
+//
+// Deactivated and deleted users can no longer sign in with the login form, and their sessions end.
+func New(directory *Directory, config *config.Configuration) http.Handler {
+	settings := config.SCIM.WithDefaults()
+	server := &server{directory, strings.TrimSuffix(config.BaseURL, "/") + settings.Path}
+	return http.StripPrefix(settings.Path, authorize(settings.Token, server))
+}
+
+func authorize(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if !bearer.Authorized(request, token) {
+			bearer.Challenge(writer)
+			fail(writer, request, &scimError{http.StatusUnauthorized, "", "a valid bearer token is required"})
+			return
+		}
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func (server *server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	method := request.Method
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "ServiceProviderConfig" && method == "GET":
+		server.serviceProviderConfig(writer)
+	case len(parts) == 1 && parts[0] == "ResourceTypes" && method == "GET":
+		server.resourceTypes(writer)
+	case len(parts) == 1 && parts[0] == "Users" && method == "GET":
+		err = server.list(writer, request, server.users)
+	case len(parts) == 1 && parts[0] == "Groups" && method == "GET":
+		err = server.list(writer, request, server.groups)
+	case len(parts) == 1 && parts[0] == "Users" && method == "POST":
+		err = server.createUser(writer, request)
+	case len(parts) == 1 && parts[0] == "Groups" && method == "POST":
+		err = server.createGroup(writer, request)
+	case len(parts) == 2 && parts[0] == "Users":
+		err = server.user(writer, request, parts[1])
+	case len(parts) == 2 && parts[0] == "Groups":
+		err = server.group(writer, request, parts[1])
+	default:
+		err = &scimError{http.StatusNotFound, "", "no such resource"}
+	}
+	if err != nil {
+		fail(writer, request, err)
+	}
+}
+
+// Lists the users or groups matching the filter, a page at a time
+func (server *server) list(writer http.ResponseWriter, request *http.Request,
+	resources func() ([]interface{}, error)) error {
+	query := request.URL.Query()
+	var matches filter
+	if text := query.Get("filter"); text != "" {
+		var err error
+		if matches, err = parseFilter(text); err != nil {
+			return &scimError{http.StatusBadRequest, "invalidFilter", err.Error()}
+		}
+	}
+	all, err := resources()
+	if err != nil {
+		return err
+	}
+	var found []interface{}
+	for _, resource := range all {
+		if matches == nil || matches(toJSON(resource)) {
+			found = append(found, resource)
+		}
+	}
+	start, _ := strconv.Atoi(query.Get("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	page := []interface{}{}
+	if start <= len(found) {
+		page = found[start-1:]
+	}
+	if count, err := strconv.Atoi(query.Get("count")); err == nil && count >= 0 && count < len(page) {
+		page = page[:count]
+	}
+	reply(writer, http.StatusOK, &listResponse{Schemas: []string{listSchema}, TotalResults: len(found),
+		StartIndex: start, ItemsPerPage: len(page), Resources: page})
+	return nil
+}
+
+func (server *server) users() ([]interface{}, error) {
+	contents, err := server.directory.read()
+	if err != nil {
+		return nil, err
+	}
+	users := make([]interface{}, len(contents.Users))
+	for i, account := range contents.Users {
+		users[i] = server.presentUser(contents, account)
+	}
+	return users, nil
+}
+
+func (server *server) groups() ([]interface{}, error) {
+	contents, err := server.directory.read()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]interface{}, len(contents.Groups))
+	for i, group := range contents.Groups {
+		groups[i] = server.presentGroup(contents, group)
+	}
+	return groups, nil
+}
+
+func (server *server) createUser(writer http.ResponseWriter, request *http.Request) error {
+	var user User
+	if err := decode(request, &user); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	user.ID = uuid.NewV4().String()
+	user.Meta = &Meta{ResourceType: "User", Created: now, LastModified: now}
+	var created *User
+	err := server.directory.update(func(contents *contents) error {
+		account, err := server.newAccount(contents, &user, "")
+		if err != nil {
+			return err
+		}
+		contents.Users = append(contents.Users, account)
+		created = server.presentUser(contents, account)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logging.FromRequest(request).Info("Provisioned user", "user", created.UserName, "id", created.ID)
+	writer.Header().Set("Location", created.Meta.Location)
+	reply(writer, http.StatusCreated, created)
+	return nil
+}
+
+// Checks a new or replaced user, hashing the password when one is set. Otherwise the account keeps the
+// previous hash.
+func (server *server) newAccount(contents *contents, user *User, previousHash string) (*account, error) {
+	if user.UserName == "" {
+		return nil, &scimError{http.StatusBadRequest, "invalidValue", "userName is required"}
+	}
+	taken, err := server.directory.nameTaken(contents, user.UserName, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, &scimError{http.StatusConflict, "uniqueness", "userName " + user.UserName + " is taken"}
+	}
+	account := &account{User: user, PasswordHash: previousHash}
+	if user.Password != "" {
+		if account.PasswordHash, err = authentication.HashPassword(user.Password); err != nil {
+			return nil, err
+		}
+	}
+	user.Schemas = []string{UserSchema}
+	user.Password, user.Groups = "", nil
+	user.Meta.Location = ""
+	return account, nil
+}
+
+func (server *server) user(writer http.ResponseWriter, request *http.Request, id string) error {
+	if request.Method == "GET" {
+		contents, err := server.directory.read()
+		if err != nil {
+			return err
+		}
+		account := contents.user(id)
+		if account == nil {
+			return &scimError{http.StatusNotFound, "", "no user " + id}
+		}
+		reply(writer, http.StatusOK, server.presentUser(contents, account))
+		return nil
+	}
+	var changes func(*User) error
+	switch request.Method {
+	case "PUT":
+		var replacement User
+		if err := decode(request, &replacement); err != nil {
+			return err
+		}
+		changes = func(user *User) error {
+			replacement.ID, replacement.Meta = user.ID, user.Meta
+			*user = replacement
+			return nil
+		}
+	case "PATCH":
+		var patch patchRequest
+		if err := decode(request, &patch); err != nil {
+			return err
+		}
+		changes = func(user *User) error {
+			return patchResource(user, patch.Operations)
+		}
+	case "DELETE":
+		var name string
+		err := server.directory.update(func(contents *contents) error {
+			for i, account := range contents.Users {
+				if account.ID == id {
+					name = account.UserName
+					contents.Users = append(contents.Users[:i], contents.Users[i+1:]...)
+					contents.removeMember(id)
+					return nil
+				}
+			}
+			return &scimError{http.StatusNotFound, "", "no user " + id}
+		})
+		if err != nil {
+			return err
+		}
+		logging.FromRequest(request).Info("Deprovisioned user", "user", name, "id", id)
+		writer.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return &scimError{http.StatusMethodNotAllowed, "", request.Method + " isn't supported"}
+	}
+	var updated *User
+	err := server.directory.update(func(contents *contents) error {
+		for i, existing := range contents.Users {
+			if existing.ID != id {
+				continue
+			}
+			user := *existing.User
+			if err := changes(&user); err != nil {
+				return err
+			}
+			user.ID = id
+			user.Meta = &Meta{ResourceType: "User", Created: existing.Meta.Created, LastModified: time.Now().UTC()}
+			account, err := server.newAccount(contents, &user, existing.PasswordHash)
+			if err != nil {
+				return err
+			}
+			contents.Users[i] = account
+			updated = server.presentUser(contents, account)
+			return nil
+		}
+		return &scimError{http.StatusNotFound, "", "no user " + id}
+	})
+	if err != nil {
+		return err
+	}
+	logging.FromRequest(request).Info("Updated user", "user", updated.UserName, "id", id,
+		"active", *updated.Active)
+	reply(writer, http.StatusOK, updated)
+	return nil
+}
+
+func (server *server) createGroup(writer http.ResponseWriter, request *http.Request) error {
+	var group Group
+	if err := decode(request, &group); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	group.ID = uuid.NewV4().String()
+	group.Meta = &Meta{ResourceType: "Group", Created: now, LastModified: now}
+	var created *Group
+	err := server.directory.update(func(contents *contents) error {
+		if err := checkGroup(contents, &group); err != nil {
+			return err
+		}
+		contents.Groups = append(contents.Groups, &group)
+		created = server.presentGroup(contents, &group)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logging.FromRequest(request).Info("Created group", "group", created.DisplayName, "id", created.ID)
+	writer.Header().Set("Location", created.Meta.Location)
+	reply(writer, http.StatusCreated, created)
+	return nil
+}
+
+// Checks a new or replaced group. Members must be provisioned users.
+func checkGroup(contents *contents, group *Group) error {
+	if group.DisplayName == "" {
+		return &scimError{http.StatusBadRequest, "invalidValue", "displayName is required"}
+	}
+	for i, member := range group.Members {
+		if contents.user(member.Value) == nil {
+			return &scimError{http.StatusBadRequest, "invalidValue", "no user " + member.Value}
+		}
+		// Display names and references are derived when the group is returned
+		group.Members[i] = Reference{Value: member.Value}
+	}
+	group.Schemas = []string{GroupSchema}
+	group.Meta.Location = ""
+	return nil
+}
+
+func (server *server) group(writer http.ResponseWriter, request *http.Request, id string) error {
+	if request.Method == "GET" {
+		contents, err := server.directory.read()
+		if err != nil {
+			return err
+		}
+		group := contents.group(id)
+		if group == nil {
+			return &scimError{http.StatusNotFound, "", "no group " + id}
+		}
+		reply(writer, http.StatusOK, server.presentGroup(contents, group))
+		return nil
+	}
+	var changes func(*Group) error
+	switch request.Method {
+	case "PUT":
+		var replacement Group
+		if err := decode(request, &replacement); err != nil {
+			return err
+		}
+		changes = func(group *Group) error {
+			replacement.ID, replacement.Meta = group.ID, group.Meta
+			*group = replacement
+			return nil
+		}
+	case "PATCH":
+		var patch patchRequest
+		if err := decode(request, &patch); err != nil {
+			return err
+		}
+		changes = func(group *Group) error {
+			return patchResource(group, patch.Operations)
+		}
+	case "DELETE":
+		err := server.directory.update(func(contents *contents) error {
+			for i, group := range contents.Groups {
+				if group.ID == id {
+					contents.Groups = append(contents.Groups[:i], contents.Groups[i+1:]...)
+					return nil
+				}
+			}
+			return &scimError{http.StatusNotFound, "", "no group " + id}
+		})
+		if err != nil {
+			return err
+		}
+		logging.FromRequest(request).Info("Deleted group", "id", id)
+		writer.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return &scimError{http.StatusMethodNotAllowed, "", request.Method + " isn't supported"}
+	}
+	var updated *Group
+	err := server.directory.update(func(contents *contents) error {
+		for i, existing := range contents.Groups {
+			if existing.ID != id {
+				continue
+			}
+			group := *existing
+			group.Members = append([]Reference(nil), existing.Members...)
+			if err := changes(&group); err != nil {
+				return err
+			}
+			group.ID = id
+			group.Meta = &Meta{ResourceType: "Group", Created: existing.Meta.Created, LastModified: time.Now().UTC()}
+			if err := checkGroup(contents, &group); err != nil {
+				return err
+			}
+			contents.Groups[i] = &group
+			updated = server.presentGroup(contents, &group)
+			return nil
+		}
+		return &scimError{http.StatusNotFound, "", "no group " + id}
+	})
+	if err != nil {
+		return err
+	}
+	logging.FromRequest(request).Info("Updated group", "group", updated.DisplayName, "id", id)
+	reply(writer, http.StatusOK, updated)
+	return nil
+}
+
+// Removes the user from every group
+func (contents *contents) removeMember(id string) {
+	for _, group := range contents.Groups {
+		var members []Reference
+		for _, member := range group.Members {
+			if member.Value != id {
+				members = append(members, member)
+			}
+		}
+		group.Members = members
+	}
+}
+
+// Applies PATCH operations to a user or group through its JSON form
+func patchResource(resource interface{}, operations []patchOperation) error {
+	values := toJSON(resource)
+	if err := applyPatch(values, operations); err != nil {
+		return err
+	}
+	// Some provisioning clients send booleans as strings, such as "False"
+	if active, ok := member(values, "active").(string); ok {
+		values[keyOf(values, "active")] = strings.EqualFold(active, "true")
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, resource); err != nil {
+		return &scimError{http.StatusBadRequest, "invalidValue", err.Error()}
+	}
+	return nil
+}
+
+// Returns a copy of the user as it's sent to clients
+func (server *server) presentUser(contents *contents, account *account) *User {
+	user := *account.User
+	active := user.active()
+	user.Active = &active
+	meta := *user.Meta
+	meta.Location = server.base + "/Users/" + user.ID
+	user.Meta = &meta
+	user.Groups = nil
+	for _, group := range contents.groupsOf(user.ID) {
+		user.Groups = append(user.Groups, Reference{Value: group.ID, Display: group.DisplayName,
+			Ref: server.base + "/Groups/" + group.ID})
+	}
+	return &user
+}
+
+// Returns a copy of the group as it's sent to clients
+func (server *server) presentGroup(contents *contents, group *Group) *Group {
+	presented := *group
+	meta := *group.Meta
+	meta.Location = server.base + "/Groups/" + group.ID
+	presented.Meta = &meta
+	presented.Members = make([]Reference, len(group.Members))
+	for i, member := range group.Members {
+		presented.Members[i] = Reference{Value: member.Value, Ref: server.base + "/Users/" + member.Value}
+		if account := contents.user(member.Value); account != nil {
+			presented.Members[i].Display = account.UserName
+		}
+	}
+	return &presented
+}
+
+func (server *server) serviceProviderConfig(writer http.ResponseWriter) {
+	supported := func(supported bool) map[string]bool {
+		return map[string]bool{"supported": supported}
+	}
+	reply(writer, http.StatusOK, map[string]interface{}{
+		"schemas":        []string{configSchema},
+		"patch":          supported(true),
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": 0},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]string{{"type": "oauthbearertoken", "name": "Bearer token",
+			"description": "The token configured for the IdP's SCIM API"}},
+		"meta": map[string]string{"resourceType": "ServiceProviderConfig",
+			"location": server.base + "/ServiceProviderConfig"},
+	})
+}
+
+func (server *server) resourceTypes(writer http.ResponseWriter) {
+	resourceType := func(name, endpoint, schema string) map[string]interface{} {
+		return map[string]interface{}{"schemas": []string{resourceTypeSchema}, "id": name, "name": name,
+			"endpoint": endpoint, "schema": schema,
+			"meta": map[string]string{"resourceType": "ResourceType",
+				"location": server.base + "/ResourceTypes/" + name}}
+	}
+	types := []interface{}{resourceType("User", "/Users", UserSchema), resourceType("Group", "/Groups", GroupSchema)}
+	reply(writer, http.StatusOK, &listResponse{Schemas: []string{listSchema}, TotalResults: len(types),
+		StartIndex: 1, ItemsPerPage: len(types), Resources: types})
+}
+
+func decode(request *http.Request, value interface{}) error {
+	if err := json.NewDecoder(request.Body).Decode(value); err != nil {
+		return &scimError{http.StatusBadRequest, "invalidSyntax", err.Error()}
+	}
+	return nil
+}
+
+// Returns the value's JSON form
+func toJSON(value interface{}) map[string]interface{} {
+	data, _ := json.Marshal(value)
+	var values map[string]interface{}
+	json.Unmarshal(data, &values)
+	return values
+}
+
+func reply(writer http.ResponseWriter, status int, body interface{}) {
+	writer.Header().Set("Content-Type", "application/scim+json")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.WriteHeader(status)
+	encoder := json.NewEncoder(writer)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(body)
+}
+
+// Sends the error, hiding the details of unexpected ones
+func fail(writer http.ResponseWriter, request *http.Request, err error) {
+	failure, ok := err.(*scimError)
+	if !ok {
+		logging.FromRequest(request).Error("SCIM request failed", "err", err)
+		failure = &scimError{http.StatusInternalServerError, "", "the request couldn't be completed"}
+	} else if failure.status != http.StatusNotFound {
+		logging.FromRequest(request).Warn("Rejected SCIM request", "status", failure.status,
+			"scimType", failure.scimType, "detail", failure.detail)
+	}
+	reply(writer, failure.status, &Error{Schemas: []string{errorSchema}, Status: strconv.Itoa(failure.status),
+		ScimType: failure.scimType, Detail: failure.detail})
+}
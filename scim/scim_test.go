@@ -0,0 +1,74 @@
+package scim
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/store"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testToken = "provisioning-token"
+
+func newTestAPI(t *testing.T) http.Handler {
+	dir := t.TempDir()
+	directory := NewDirectory(filepath.Join(dir, "scim.json"), filepath.Join(dir, "users.json"), store.NewMemory())
+	return New(directory, &config.Configuration{BaseURL: "https://idp.example.com",
+		SCIM: &config.SCIM{Token: testToken}})
+}
+
+// Sends the request with the bearer token unless it's empty
+func call(api http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	request.Header.Set("Content-Type", "application/scim+json")
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestAPIRequiresBearerToken(t *testing.T) {
+	api := newTestAPI(t)
+	for _, token := range []string{"", "wrong-token"} {
+		recorder := call(api, "GET", "/scim/v2/Users", token, "")
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("token %q answered with %d", token, recorder.Code)
+		}
+		if recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q wasn't challenged", token)
+		}
+	}
+	if recorder := call(api, "GET", "/scim/v2/Users", testToken, ""); recorder.Code != http.StatusOK {
+		t.Errorf("valid token answered with %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestAPIFiltersUsers(t *testing.T) {
+	api := newTestAPI(t)
+	for _, name := range []string{"jdoe", "asmith"} {
+		body := `{"schemas": ["` + UserSchema + `"], "userName": "` + name + `"}`
+		if recorder := call(api, "POST", "/scim/v2/Users", testToken, body); recorder.Code != http.StatusCreated {
+			t.Fatalf("provisioning %s answered with %d: %s", name, recorder.Code, recorder.Body)
+		}
+	}
+	recorder := call(api, "GET", `/scim/v2/Users?filter=userName+eq+%22jdoe%22`, testToken, "")
+	var list struct {
+		TotalResults int
+		Resources    []struct{ UserName string }
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &list); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("filtered list answered with %d: %s", recorder.Code, recorder.Body)
+	}
+	if list.TotalResults != 1 || len(list.Resources) != 1 || list.Resources[0].UserName != "jdoe" {
+		t.Errorf("filter matched %+v", list)
+	}
+	recorder = call(api, "GET", `/scim/v2/Users?filter=userName+zz+%22jdoe%22`, testToken, "")
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "invalidFilter") {
+		t.Errorf("malformed filter answered with %d: %s", recorder.Code, recorder.Body)
+	}
+}
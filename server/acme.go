@@ -0,0 +1,27 @@
+package server
+
+import (
+	"crypto/tls"
+	"github.com/amdonov/lite-idp/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"net/http"
+)
+
+// Has the listener obtain its certificate from the ACME CA on first use and renew it before it expires.
+// Returns a handler answering HTTP-01 challenges and redirecting everything else to HTTPS.
+func obtainCertificates(settings *config.ACME, tlsConfig *tls.Config) http.Handler {
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(settings.Cache),
+		HostPolicy: autocert.HostWhitelist(settings.Domains...),
+		Email:      settings.Email,
+	}
+	if settings.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: settings.DirectoryURL}
+	}
+	tlsConfig.GetCertificate = manager.GetCertificate
+	// Offered so TLS-ALPN-01 challenges can be answered on the listener itself
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, "h2", "http/1.1", acme.ALPNProto)
+	return manager.HTTPHandler(nil)
+}
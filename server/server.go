@@ -1,31 +1,87 @@
 package server
 
 import (
-	"crypto/tls"
-	"github.com/amdonov/lite-idp/attributes"
-	"github.com/amdonov/lite-idp/authentication"
+	"context"
+	"expvar"
 	"github.com/amdonov/lite-idp/config"
-	"github.com/amdonov/lite-idp/handler"
-	"github.com/amdonov/lite-idp/protocol"
-	"github.com/amdonov/lite-idp/store"
-	"github.com/amdonov/xmlsig"
-	"log"
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/systemd"
+	"github.com/amdonov/lite-idp/telemetry"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 type IDP interface {
 	Start() error
 }
 
-type idp struct {
-	server      *http.Server
-	certificate string
-	key         string
+type server struct {
+	listeners []*listener
+	config    *config.Configuration
+	provider  *idp.IdP
+	// Exports spans not yet sent
+	flushTraces func(context.Context) error
 }
 
-func (idp *idp) Start() error {
-	return idp.server.ListenAndServeTLS(idp.certificate, idp.key)
+// A socket the IdP serves on
+type listener struct {
+	// FileDescriptorName of a socket systemd may pass for it instead
+	name    string
+	address string
+	serve   func(net.Listener) error
+}
+
+// Serves on every listener, returning when one of them fails. Sockets passed by systemd are used in place
+// of those at the configured addresses, and systemd is told once every socket is open.
+func (server *server) Start() error {
+	inherited, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	failures := make(chan error, len(server.listeners))
+	for _, configured := range server.listeners {
+		socket, found := inherited[configured.name]
+		if !found {
+			if socket, err = net.Listen("tcp", configured.address); err != nil {
+				return err
+			}
+		}
+		go func(serve func(net.Listener) error, socket net.Listener) {
+			failures <- serve(socket)
+		}(configured.serve, socket)
+	}
+	systemd.Notify("READY=1")
+	// Requests don't wait on reloads, but a process too busy to start one is as good as hung
+	timeout := systemd.WatchdogInterval() / 4
+	systemd.Watchdog(func() bool {
+		return responsive(server.config, timeout)
+	})
+	err = <-failures
+	systemd.Notify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.provider.Close()
+	server.flushTraces(ctx)
+	return err
+}
+
+// Reports whether a request could take a configuration snapshot within the timeout
+func responsive(config *config.Configuration, timeout time.Duration) bool {
+	taken := make(chan bool, 1)
+	go config.Guard(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		taken <- true
+	})).ServeHTTP(nil, &http.Request{})
+	select {
+	case <-taken:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
 func New() (IDP, error) {
@@ -34,61 +90,81 @@ func New() (IDP, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Create a session store
-	store := store.New(config.Redis.Address)
-
-	// Configure the XML signer
-	signer, err := getSigner(config.Certificate, config.Key)
-	if err != nil {
+	if err := logging.Configure(config); err != nil {
 		return nil, err
 	}
-	// Load the JSON Attribute Store
-	log.Println(config.AttributeProviders.JsonStore.File)
-	people, err := os.Open(config.AttributeProviders.JsonStore.File)
+	flushTraces, err := telemetry.Configure(config.Telemetry)
 	if err != nil {
 		return nil, err
 	}
-	defer people.Close()
-	retriever, err := attributes.NewJSONRetriever(people)
+	provider, err := idp.New(config)
 	if err != nil {
 		return nil, err
 	}
-	requestParser := protocol.NewRedirectRequestParser()
-	marshallers := make(map[string]protocol.ResponseMarshaller)
-	marshallers["urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"] = protocol.NewArtifactResponseMarshaller(store)
-	marshallers["urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"] = protocol.NewPOSTResponseMarshaller(signer)
-	generator := protocol.NewDefaultGenerator(config.EntityId)
-	responder := &authnresponder{retriever, generator, marshallers}
-	passwordAuth := authentication.NewPasswordAuthenticator(responder.completeAuth, store, config.Authenticator.Fallback.Form)
-	pkiAuth := authentication.NewPKIAuthenticator(responder.completeAuth, store, passwordAuth)
-	authHandler := handler.NewAuthenticationHandler(requestParser, pkiAuth)
-	http.Handle(config.Services.Authentication, authHandler)
-	queryHandler := handler.NewQueryHandler(signer, retriever, config.EntityId)
-	artHandler := handler.NewArtifactHandler(store, signer, config.EntityId)
-	http.Handle(config.Services.ArtifactResolution, artHandler)
-	http.Handle(config.Services.AttributeQuery, queryHandler)
-	metadataHandler, err := handler.NewMetadataHandler(config)
+	mux := http.NewServeMux()
+	mux.Handle("/", provider)
+	// Signing statistics
+	mux.Handle("/debug/vars", expvar.Handler())
+	listeners, err := listen("https", config.Address, config.TLS, mux, config)
 	if err != nil {
+		provider.Close()
 		return nil, err
 	}
-	http.Handle(config.Services.Metadata, metadataHandler)
-	form := config.Authenticator.Fallback.Form
-	http.Handle(form.Context, http.StripPrefix(form.Context, http.FileServer(http.Dir(form.Directory))))
-	http.Handle(form.Action, passwordAuth)
-	tlsConfig := &tls.Config{ClientAuth: tls.RequestClientCert}
+	if config.BackChannel != nil {
+		more, err := listen("back-channel", config.BackChannel.Address, config.BackChannel.TLS,
+			provider.BackChannel(), config)
+		if err != nil {
+			provider.Close()
+			return nil, err
+		}
+		listeners = append(listeners, more...)
+	}
+	reloadOnHangup(provider)
 	// Start the server
-	return &idp{&http.Server{TLSConfig: tlsConfig, Addr: config.Address}, config.Certificate, config.Key}, nil
+	return &server{listeners, config, provider, flushTraces}, nil
 }
 
-func getSigner(certPath string, keyPath string) (xmlsig.Signer, error) {
-	cert, err := os.Open(certPath)
+// Prepares an HTTPS listener, and one answering ACME challenges when its certificate is obtained that way.
+// The challenge listener's systemd socket is named after the HTTPS one with -acme appended.
+func listen(name, address string, settings config.TLS, handler http.Handler,
+	config *config.Configuration) ([]*listener, error) {
+	tlsConfig, err := settings.Config()
 	if err != nil {
 		return nil, err
 	}
-	defer cert.Close()
-	key, err := os.Open(keyPath)
-	if err != nil {
-		return nil, err
+	server := &http.Server{TLSConfig: tlsConfig, Addr: address, Handler: handler}
+	if settings.ACME != nil {
+		challenges := obtainCertificates(settings.ACME, tlsConfig)
+		listeners := []*listener{{name, address, func(socket net.Listener) error {
+			return server.ServeTLS(socket, "", "")
+		}}}
+		if settings.ACME.HTTPAddress != "" {
+			challengeServer := &http.Server{Addr: settings.ACME.HTTPAddress, Handler: challenges}
+			listeners = append(listeners, &listener{name + "-acme", settings.ACME.HTTPAddress, challengeServer.Serve})
+		}
+		return listeners, nil
+	}
+	// The listener shares the signing key unless it has its own
+	certificate, key := config.Certificate, config.Key
+	if settings.Certificate != "" {
+		certificate, key = settings.Certificate, settings.Key
 	}
-	return xmlsig.NewSigner(key, cert)
+	return []*listener{{name, address, func(socket net.Listener) error {
+		return server.ServeTLS(socket, certificate, key)
+	}}}, nil
+}
+
+// Reloads the configuration when the process receives SIGHUP
+func reloadOnHangup(provider *idp.IdP) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := provider.Reload(); err != nil {
+				provider.Logger().Error("Failed to reload configuration", "err", err)
+				continue
+			}
+			provider.Logger().Info("Reloaded configuration")
+		}
+	}()
 }
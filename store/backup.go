@@ -0,0 +1,172 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"strings"
+	"time"
+)
+
+// Returned by Backup and Restore for stores that don't implement Dumper
+var ErrNoBackup = errors.New("the store can't be backed up")
+
+// A key copied out of the store by Backup
+type Entry struct {
+	Key string
+	// The value in the store's own serialization, such as Redis's DUMP format
+	Value []byte
+	// When the key expires, or zero if it doesn't
+	Expires time.Time `json:",omitempty"`
+}
+
+// Implemented by stores that can copy their keys out and back in
+type Dumper interface {
+	// Calls visit with each key starting with the prefix. Keys changed while this runs may or may not be seen.
+	Dump(prefix string, visit func(*Entry) error) error
+	// Writes the entry, replacing a key that's already present only if replace is set. Returns false if the
+	// key was kept.
+	Restore(entry *Entry, replace bool) (bool, error)
+}
+
+// Writes the keys starting with the prefix to the writer as JSON lines, one entry each, while the IdP keeps
+// running, and returns how many were written. Keys aren't read at a single point in time, so a login underway
+// may be caught part way through.
+func Backup(storer Storer, prefix string, writer io.Writer) (int, error) {
+	dumper, ok := storer.(Dumper)
+	if !ok {
+		return 0, ErrNoBackup
+	}
+	encoder := json.NewEncoder(writer)
+	count := 0
+	err := dumper.Dump(prefix, func(entry *Entry) error {
+		count++
+		return encoder.Encode(entry)
+	})
+	return count, err
+}
+
+// Writes the entries read from a backup back to the store and returns how many were restored. Keys keep the
+// expiry they had when backed up, so those that have since expired are skipped, as are keys already present
+// unless replace is set.
+func Restore(storer Storer, reader io.Reader, replace bool) (int, error) {
+	dumper, ok := storer.(Dumper)
+	if !ok {
+		return 0, ErrNoBackup
+	}
+	decoder := json.NewDecoder(bufio.NewReader(reader))
+	count := 0
+	for {
+		var entry Entry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if !entry.Expires.IsZero() && !time.Now().Before(entry.Expires) {
+			continue
+		}
+		restored, err := dumper.Restore(&entry, replace)
+		if err != nil {
+			return count, err
+		}
+		if restored {
+			count++
+		}
+	}
+}
+
+// Scans like Keys, reading each batch's values and lifetimes with DUMP and PTTL in one round trip
+func (s *storer) Dump(prefix string, visit func(*Entry) error) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	pattern := globEscaper.Replace(prefix) + "*"
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		var batch []string
+		if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+			return err
+		}
+		for _, key := range batch {
+			conn.Send("DUMP", key)
+			conn.Send("PTTL", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, key := range batch {
+			value, dumpErr := redis.Bytes(conn.Receive())
+			ttl, err := redis.Int64(conn.Receive())
+			if dumpErr == redis.ErrNil || ttl == -2 {
+				// Expired since it was scanned
+				continue
+			}
+			if dumpErr != nil {
+				return dumpErr
+			}
+			if err != nil {
+				return err
+			}
+			entry := &Entry{Key: key, Value: value}
+			if ttl > 0 {
+				entry.Expires = now.Add(time.Duration(ttl) * time.Millisecond)
+			}
+			if err := visit(entry); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func (s *storer) Restore(entry *Entry, replace bool) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	var ttl int64
+	if !entry.Expires.IsZero() {
+		// RESTORE takes zero as no expiry, so a key with under a millisecond left gets one
+		ttl = max(time.Until(entry.Expires).Milliseconds(), 1)
+	}
+	if replace {
+		_, err := conn.Do("RESTORE", entry.Key, ttl, entry.Value, "REPLACE")
+		return err == nil, err
+	}
+	// RESTORE refuses keys that are present with BUSYKEY, so one written by another client is left as is
+	_, err := conn.Do("RESTORE", entry.Key, ttl, entry.Value)
+	if reply, ok := err.(redis.Error); ok && strings.HasPrefix(string(reply), "BUSYKEY") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *prefixedStorer) Dump(prefix string, visit func(*Entry) error) error {
+	dumper, ok := s.storer.(Dumper)
+	if !ok {
+		return ErrNoBackup
+	}
+	return dumper.Dump(s.prefix+prefix, func(entry *Entry) error {
+		entry.Key = strings.TrimPrefix(entry.Key, s.prefix)
+		return visit(entry)
+	})
+}
+
+func (s *prefixedStorer) Restore(entry *Entry, replace bool) (bool, error) {
+	dumper, ok := s.storer.(Dumper)
+	if !ok {
+		return false, ErrNoBackup
+	}
+	prefixed := *entry
+	prefixed.Key = s.prefix + entry.Key
+	return dumper.Restore(&prefixed, replace)
+}
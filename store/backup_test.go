@@ -0,0 +1,38 @@
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	source := WithPrefix(NewMemory(), "tenant:a:")
+	source.Store("session", "jdoe", 3600)
+	source.Store("consent", "granted", 3600)
+	var backup bytes.Buffer
+	count, err := Backup(source, "", &backup)
+	if err != nil || count != 2 {
+		t.Fatalf("backed up %d keys: %v", count, err)
+	}
+
+	// Restoring under another prefix moves the keys, keeping what's there unless replacing
+	target := WithPrefix(NewMemory(), "tenant:b:")
+	target.Store("session", "asmith", 3600)
+	count, err = Restore(target, bytes.NewReader(backup.Bytes()), false)
+	if err != nil || count != 1 {
+		t.Fatalf("restored %d keys: %v", count, err)
+	}
+	var value string
+	if err := target.Retrieve("session", &value); err != nil || value != "asmith" {
+		t.Errorf("kept session is %q: %v", value, err)
+	}
+	if err := target.Retrieve("consent", &value); err != nil || value != "granted" {
+		t.Errorf("restored consent is %q: %v", value, err)
+	}
+	if _, err = Restore(target, bytes.NewReader(backup.Bytes()), true); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.Retrieve("session", &value); err != nil || value != "jdoe" {
+		t.Errorf("replaced session is %q: %v", value, err)
+	}
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Creates a store keeping values in this process's memory, for an IdP running as a single instance or in
+// tests. Values are lost when the process exits.
+func NewMemory() Storer {
+	return &memoryStorer{values: make(map[string]memoryValue)}
+}
+
+type memoryStorer struct {
+	mutex  sync.Mutex
+	values map[string]memoryValue
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time
+}
+
+// Returns the value of the key if it hasn't expired. The mutex must be held.
+func (s *memoryStorer) get(key string) ([]byte, bool) {
+	value, found := s.values[key]
+	if found && !time.Now().Before(value.expires) {
+		delete(s.values, key)
+		return nil, false
+	}
+	return value.data, found
+}
+
+func (s *memoryStorer) set(key string, data []byte, seconds int) {
+	s.values[key] = memoryValue{data, time.Now().Add(time.Duration(seconds) * time.Second)}
+}
+
+func (s *memoryStorer) Store(key, value interface{}, time int) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.set(fmt.Sprint(key), data, time)
+	return nil
+}
+
+func (s *memoryStorer) Retrieve(key interface{}, value interface{}) error {
+	s.mutex.Lock()
+	data, found := s.get(fmt.Sprint(key))
+	s.mutex.Unlock()
+	if !found {
+		return ErrNotFound
+	}
+	return json.Unmarshal(data, value)
+}
+
+func (s *memoryStorer) StoreIfAbsent(key, value interface{}, time int) (bool, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, found := s.get(fmt.Sprint(key)); found {
+		return false, nil
+	}
+	s.set(fmt.Sprint(key), data, time)
+	return true, nil
+}
+
+func (s *memoryStorer) Extend(key, value interface{}, time int) (bool, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, found := s.get(fmt.Sprint(key))
+	if !found || string(current) != string(data) {
+		return false, nil
+	}
+	s.set(fmt.Sprint(key), data, time)
+	return true, nil
+}
+
+func (s *memoryStorer) DeleteIfEqual(key, value interface{}) (bool, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, found := s.get(fmt.Sprint(key))
+	if !found || string(current) != string(data) {
+		return false, nil
+	}
+	delete(s.values, fmt.Sprint(key))
+	return true, nil
+}
+
+func (s *memoryStorer) Delete(keys ...interface{}) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range keys {
+		delete(s.values, fmt.Sprint(key))
+	}
+	return nil
+}
+
+func (s *memoryStorer) Keys(prefix string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var keys []string
+	for key := range s.values {
+		if _, found := s.get(key); found && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Values are kept as JSON, which is what the entries hold
+func (s *memoryStorer) Dump(prefix string, visit func(*Entry) error) error {
+	s.mutex.Lock()
+	var entries []*Entry
+	for key := range s.values {
+		if data, found := s.get(key); found && strings.HasPrefix(key, prefix) {
+			entries = append(entries, &Entry{Key: key, Value: data, Expires: s.values[key].expires})
+		}
+	}
+	s.mutex.Unlock()
+	for _, entry := range entries {
+		if err := visit(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStorer) Restore(entry *Entry, replace bool) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, found := s.get(entry.Key); found && !replace {
+		return false, nil
+	}
+	s.values[entry.Key] = memoryValue{entry.Value, entry.Expires}
+	return true, nil
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"time"
+)
+
+// Implemented by stores that keep sets of members under a key, as an index that can be read without scanning
+// the keys. Use AddMember, Members and RemoveMember rather than calling it, so stores without it still work.
+type SetStorer interface {
+	// Adds the member to the set, which is kept for at least time seconds
+	AddMember(key, member string, time int) error
+	// Returns the members of the set, none if it isn't present
+	Members(key string) ([]string, error)
+	// Removes the member. Sets that don't have it are ignored.
+	RemoveMember(key, member string) error
+}
+
+// A set kept as an ordinary value by stores without sets
+type memberList struct {
+	Members []string
+	Expires time.Time
+}
+
+func readMembers(storer Storer, key string) (*memberList, error) {
+	var list memberList
+	if err := storer.Retrieve(key, &list); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return &list, nil
+}
+
+func (list *memberList) save(storer Storer, key string) error {
+	remaining := int(time.Until(list.Expires).Seconds())
+	if len(list.Members) == 0 || remaining <= 0 {
+		return storer.Delete(key)
+	}
+	return storer.Store(key, list, remaining)
+}
+
+// Adds the member to the set under the key, keeping the set for at least time seconds. Stores without sets keep
+// it as an ordinary value, which members added at the same time by other instances may be lost from.
+func AddMember(storer Storer, key, member string, seconds int) error {
+	if sets, ok := storer.(SetStorer); ok {
+		return sets.AddMember(key, member, seconds)
+	}
+	list, err := readMembers(storer, key)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, existing := range list.Members {
+		found = found || existing == member
+	}
+	if !found {
+		list.Members = append(list.Members, member)
+	}
+	if until := time.Now().Add(time.Duration(seconds) * time.Second); until.After(list.Expires) {
+		list.Expires = until
+	}
+	return list.save(storer, key)
+}
+
+// Returns the members of the set under the key
+func Members(storer Storer, key string) ([]string, error) {
+	if sets, ok := storer.(SetStorer); ok {
+		return sets.Members(key)
+	}
+	list, err := readMembers(storer, key)
+	if err != nil {
+		return nil, err
+	}
+	return list.Members, nil
+}
+
+// Removes the member from the set under the key
+func RemoveMember(storer Storer, key, member string) error {
+	if sets, ok := storer.(SetStorer); ok {
+		return sets.RemoveMember(key, member)
+	}
+	list, err := readMembers(storer, key)
+	if err != nil {
+		return err
+	}
+	kept := list.Members[:0]
+	for _, existing := range list.Members {
+		if existing != member {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(list.Members) {
+		return nil
+	}
+	list.Members = kept
+	return list.save(storer, key)
+}
+
+// Adds and only ever lengthens the set's lifetime in one step
+var addMemberScript = redis.NewScript(1, `redis.call("SADD", KEYS[1], ARGV[1])
+if redis.call("TTL", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 1`)
+
+func (s *storer) AddMember(key, member string, time int) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := addMemberScript.Do(conn, key, member, time)
+	return err
+}
+
+func (s *storer) Members(key string) ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", key))
+}
+
+func (s *storer) RemoveMember(key, member string) error {
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", key, member)
+	return err
+}
+
+// Sets are kept as sorted JSON lists, so they read back like any other value
+func (s *memoryStorer) AddMember(key, member string, seconds int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members, expires, err := s.members(key)
+	if err != nil {
+		return err
+	}
+	if index := sort.SearchStrings(members, member); index == len(members) || members[index] != member {
+		members = append(members, member)
+		sort.Strings(members)
+	}
+	if until := time.Now().Add(time.Duration(seconds) * time.Second); until.After(expires) {
+		expires = until
+	}
+	return s.setMembers(key, members, expires)
+}
+
+func (s *memoryStorer) Members(key string) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members, _, err := s.members(key)
+	return members, err
+}
+
+func (s *memoryStorer) RemoveMember(key, member string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	members, expires, err := s.members(key)
+	if err != nil {
+		return err
+	}
+	index := sort.SearchStrings(members, member)
+	if index == len(members) || members[index] != member {
+		return nil
+	}
+	members = append(members[:index], members[index+1:]...)
+	if len(members) == 0 {
+		delete(s.values, key)
+		return nil
+	}
+	return s.setMembers(key, members, expires)
+}
+
+// Reads the set and when it expires. The mutex must be held.
+func (s *memoryStorer) members(key string) ([]string, time.Time, error) {
+	data, found := s.get(key)
+	if !found {
+		return nil, time.Time{}, nil
+	}
+	var members []string
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%s isn't a set: %w", key, err)
+	}
+	return members, s.values[key].expires, nil
+}
+
+// Saves the set. The mutex must be held.
+func (s *memoryStorer) setMembers(key string, members []string, expires time.Time) error {
+	data, err := json.Marshal(members)
+	if err != nil {
+		return err
+	}
+	s.values[key] = memoryValue{data, expires}
+	return nil
+}
+
+func (s *prefixedStorer) AddMember(key, member string, time int) error {
+	return AddMember(s.storer, s.key(key), member, time)
+}
+
+func (s *prefixedStorer) Members(key string) ([]string, error) {
+	return Members(s.storer, s.key(key))
+}
+
+func (s *prefixedStorer) RemoveMember(key, member string) error {
+	return RemoveMember(s.storer, s.key(key), member)
+}
+
+// Sets are changed on the server straight away, as they're read by every instance
+func (s *writeBehind) AddMember(key, member string, time int) error {
+	return AddMember(s.storer, key, member, time)
+}
+
+func (s *writeBehind) Members(key string) ([]string, error) {
+	return Members(s.storer, key)
+}
+
+func (s *writeBehind) RemoveMember(key, member string) error {
+	return RemoveMember(s.storer, key, member)
+}
@@ -0,0 +1,36 @@
+package store
+
+import (
+	"sort"
+	"testing"
+)
+
+// Hides the sets of the store it wraps
+type withoutSets struct {
+	Storer
+}
+
+func TestSets(t *testing.T) {
+	for name, storer := range map[string]Storer{"memory": NewMemory(), "prefixed": WithPrefix(NewMemory(), "a:"),
+		"without sets": withoutSets{NewMemory()}} {
+		for _, member := range []string{"b", "a", "b", "c"} {
+			if err := AddMember(storer, "set", member, 60); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := RemoveMember(storer, "set", "c"); err != nil {
+			t.Fatal(err)
+		}
+		members, err := Members(storer, "set")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(members)
+		if len(members) != 2 || members[0] != "a" || members[1] != "b" {
+			t.Errorf("%s: members are %v", name, members)
+		}
+		if members, err := Members(storer, "missing"); err != nil || len(members) != 0 {
+			t.Errorf("%s: missing set has %v: %v", name, members, err)
+		}
+	}
+}
@@ -1,14 +1,65 @@
+// Package store keeps the state IdP instances share in Redis. Everything a login needs from one request to
+// the next, such as the saved AuthnRequest, sessions, consent prompts, artifacts, RelayState and replay
+// records, lives here rather than in memory, so any instance sharing the store can handle any request and
+// a cluster needs no sticky sessions.
+//
+// Backup copies keys out of Redis while the IdP runs, keeping their values and expiry, and Restore writes
+// them back, as the lite-idp backup and restore commands do. Redis's own BGSAVE and RDB or AOF persistence
+// take a point in time snapshot of the whole server instead.
 package store
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
+	"strings"
 	"time"
 )
 
+// Returned by Retrieve when the key isn't present, such as after it expired. Stores passed to the IdP by
+// programs embedding it should return it too.
+var ErrNotFound = errors.New("key not found in the store")
+
+// Wrapped around the error when the store can't be reached, as opposed to one rejecting a request
+var ErrUnavailable = errors.New("store unavailable")
+
 type Storer interface {
 	Store(key, value interface{}, time int) error
 	Retrieve(key interface{}, value interface{}) error
+	// Atomically stores the value only if the key isn't already present. Returns false if the key exists.
+	StoreIfAbsent(key, value interface{}, time int) (bool, error)
+	// Atomically resets the key's lifetime if it still holds the value, as when renewing a lock. Returns
+	// false if it doesn't.
+	Extend(key, value interface{}, time int) (bool, error)
+	// Atomically removes the key if it still holds the value, as when releasing a lock. Returns false if it
+	// doesn't.
+	DeleteIfEqual(key, value interface{}) (bool, error)
+	// Removes the keys. Keys that don't exist are ignored.
+	Delete(keys ...interface{}) error
+	// Returns the keys starting with the prefix. A key may expire before it's read.
+	Keys(prefix string) ([]string, error)
+}
+
+// Implemented by stores that can read several keys in one round trip. Use RetrieveAll rather than calling it,
+// so stores without it still work.
+type BatchRetriever interface {
+	// Reads each key into the value at the same index. Returns the error for each key, ErrNotFound for those
+	// that aren't present.
+	RetrieveAll(keys []interface{}, values []interface{}) []error
+}
+
+// Reads each key into the value at the same index, in one round trip if the store can, and returns the error
+// for each key. Stores that can't are read one key at a time.
+func RetrieveAll(storer Storer, keys []interface{}, values []interface{}) []error {
+	if batch, ok := storer.(BatchRetriever); ok {
+		return batch.RetrieveAll(keys, values)
+	}
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = storer.Retrieve(key, values[i])
+	}
+	return errs
 }
 
 type storer struct {
@@ -22,28 +73,136 @@ func (s *storer) Store(key, value interface{}, time int) error {
 	if err != nil {
 		return err
 	}
-	conn.Do("SETEX", key, time, data)
-	return nil
+	_, err = conn.Do("SETEX", key, time, data)
+	return err
+}
+
+func (s *storer) StoreIfAbsent(key, value interface{}, time int) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	// SET with NX replies with nil when the key already exists
+	reply, err := conn.Do("SET", key, data, "EX", time, "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Compares and expires in one step, so a key taken over by someone else isn't extended
+var extendScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("EXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+func (s *storer) Extend(key, value interface{}, time int) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(extendScript.Do(conn, key, data, time))
+}
+
+// Compares and deletes in one step, so a key taken over by someone else is left alone
+var deleteIfEqualScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func (s *storer) DeleteIfEqual(key, value interface{}) (bool, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	return redis.Bool(deleteIfEqualScript.Do(conn, key, data))
 }
 
 func (s *storer) Retrieve(key interface{}, value interface{}) error {
 	conn := s.pool.Get()
 	defer conn.Close()
-	data, err := conn.Do("GET", key)
+	data, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return ErrNotFound
+	}
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data.([]byte), value)
+	return json.Unmarshal(data, value)
+}
+
+// Reads the keys with a single MGET
+func (s *storer) RetrieveAll(keys []interface{}, values []interface{}) []error {
+	errs := make([]error, len(keys))
+	if len(keys) == 0 {
+		return errs
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	replies, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	for i := range keys {
+		switch {
+		case err != nil:
+			errs[i] = err
+		case i >= len(replies) || replies[i] == nil:
+			errs[i] = ErrNotFound
+		default:
+			errs[i] = json.Unmarshal(replies[i], values[i])
+		}
+	}
+	return errs
+}
+
+func (s *storer) Delete(keys ...interface{}) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", keys...)
+	return err
+}
+
+// Iterates with SCAN rather than KEYS so the server isn't blocked
+func (s *storer) Keys(prefix string) ([]string, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+	pattern := globEscaper.Replace(prefix) + "*"
+	var keys []string
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, err
+		}
+		var batch []string
+		if _, err := redis.Scan(reply, &cursor, &batch); err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
 }
 
-func newPool(server string) *redis.Pool {
+// Makes a prefix match itself in a SCAN pattern
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func newPool(server, password string, maxIdle int, idleTimeout time.Duration) *redis.Pool {
 	return &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
+		MaxIdle:     maxIdle,
+		IdleTimeout: idleTimeout,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
+			c, err := redis.Dial("tcp", server, redis.DialPassword(password))
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
 			}
 			return c, err
 		},
@@ -54,6 +213,69 @@ func newPool(server string) *redis.Pool {
 	}
 }
 
-func New(address string) Storer {
-	return &storer{newPool(address)}
+// Creates a store keeping up to maxIdle idle connections to the Redis server for idleTimeout. Connections
+// authenticate with the password unless it's empty.
+func New(address, password string, maxIdle int, idleTimeout time.Duration) Storer {
+	return &storer{newPool(address, password, maxIdle, idleTimeout)}
+}
+
+// Creates a store keeping its keys apart from others sharing the server by prefixing them
+func WithPrefix(storer Storer, prefix string) Storer {
+	return &prefixedStorer{storer, prefix}
+}
+
+type prefixedStorer struct {
+	storer Storer
+	prefix string
+}
+
+func (s *prefixedStorer) key(key interface{}) string {
+	return s.prefix + fmt.Sprint(key)
+}
+
+func (s *prefixedStorer) Store(key, value interface{}, time int) error {
+	return s.storer.Store(s.key(key), value, time)
+}
+
+func (s *prefixedStorer) Retrieve(key interface{}, value interface{}) error {
+	return s.storer.Retrieve(s.key(key), value)
+}
+
+func (s *prefixedStorer) RetrieveAll(keys []interface{}, values []interface{}) []error {
+	prefixed := make([]interface{}, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.key(key)
+	}
+	return RetrieveAll(s.storer, prefixed, values)
+}
+
+func (s *prefixedStorer) StoreIfAbsent(key, value interface{}, time int) (bool, error) {
+	return s.storer.StoreIfAbsent(s.key(key), value, time)
+}
+
+func (s *prefixedStorer) Extend(key, value interface{}, time int) (bool, error) {
+	return s.storer.Extend(s.key(key), value, time)
+}
+
+func (s *prefixedStorer) DeleteIfEqual(key, value interface{}) (bool, error) {
+	return s.storer.DeleteIfEqual(s.key(key), value)
+}
+
+func (s *prefixedStorer) Delete(keys ...interface{}) error {
+	prefixed := make([]interface{}, len(keys))
+	for i, key := range keys {
+		prefixed[i] = s.key(key)
+	}
+	return s.storer.Delete(prefixed...)
+}
+
+func (s *prefixedStorer) Keys(prefix string) ([]string, error) {
+	keys, err := s.storer.Keys(s.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, s.prefix)
+	}
+	return keys, nil
 }
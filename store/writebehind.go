@@ -0,0 +1,205 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// A store saving values in the background. Closing it saves those still waiting.
+type QueuedStorer interface {
+	Storer
+	io.Closer
+}
+
+// Creates a store that saves values in the background, so callers don't wait for the server. Up to size
+// values wait to be saved, one at a time in the order they were stored, and once that many are waiting
+// values are saved before Store returns. Waiting values are read back by this process, but other instances
+// sharing the server only find them once they're saved. Close it to save those still waiting before the
+// process exits. Values that can't be saved are logged to the logger.
+func WriteBehind(storer Storer, size int, logger *slog.Logger) QueuedStorer {
+	behind := &writeBehind{storer: storer, queue: make(chan *pendingWrite, size),
+		pending: make(map[string]*pendingWrite), done: make(chan struct{}), logger: logger}
+	go behind.run()
+	return behind
+}
+
+type writeBehind struct {
+	storer Storer
+	queue  chan *pendingWrite
+	// Guards pending and closed
+	mutex   sync.Mutex
+	pending map[string]*pendingWrite
+	// Once closed, values are saved before Store returns
+	closed bool
+	// Closed once the waiting values are saved
+	done chan struct{}
+	// Held while writing to the server, so a value saved in the background can't overwrite a later one saved
+	// directly or bring back a deleted key
+	writing sync.Mutex
+	logger  *slog.Logger
+}
+
+type pendingWrite struct {
+	key  interface{}
+	data json.RawMessage
+	time int
+}
+
+func (s *writeBehind) run() {
+	defer close(s.done)
+	for write := range s.queue {
+		s.writing.Lock()
+		s.mutex.Lock()
+		current := s.pending[fmt.Sprint(write.key)] == write
+		s.mutex.Unlock()
+		// Values replaced or deleted while waiting aren't saved
+		if current {
+			if err := s.storer.Store(write.key, write.data, write.time); err != nil {
+				s.logger.Error("Failed to save in the background", "key", fmt.Sprint(write.key), "err", err)
+			}
+			// Keep reading the value from memory until it's saved
+			s.mutex.Lock()
+			if s.pending[fmt.Sprint(write.key)] == write {
+				delete(s.pending, fmt.Sprint(write.key))
+			}
+			s.mutex.Unlock()
+		}
+		s.writing.Unlock()
+	}
+}
+
+func (s *writeBehind) forget(keys ...interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, key := range keys {
+		delete(s.pending, fmt.Sprint(key))
+	}
+}
+
+func (s *writeBehind) Store(key, value interface{}, time int) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	write := &pendingWrite{key, data, time}
+	s.mutex.Lock()
+	if !s.closed {
+		select {
+		case s.queue <- write:
+			s.pending[fmt.Sprint(key)] = write
+			s.mutex.Unlock()
+			return nil
+		default:
+		}
+	}
+	s.mutex.Unlock()
+	// The queue is full or closed
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	s.forget(key)
+	return s.storer.Store(key, write.data, time)
+}
+
+func (s *writeBehind) waiting(key interface{}) *pendingWrite {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pending[fmt.Sprint(key)]
+}
+
+func (s *writeBehind) Retrieve(key interface{}, value interface{}) error {
+	if write := s.waiting(key); write != nil {
+		return json.Unmarshal(write.data, value)
+	}
+	return s.storer.Retrieve(key, value)
+}
+
+func (s *writeBehind) RetrieveAll(keys []interface{}, values []interface{}) []error {
+	errs := make([]error, len(keys))
+	var stored, into []interface{}
+	var indexes []int
+	for i, key := range keys {
+		if write := s.waiting(key); write != nil {
+			errs[i] = json.Unmarshal(write.data, values[i])
+			continue
+		}
+		stored = append(stored, key)
+		into = append(into, values[i])
+		indexes = append(indexes, i)
+	}
+	if len(stored) > 0 {
+		for i, err := range RetrieveAll(s.storer, stored, into) {
+			errs[indexes[i]] = err
+		}
+	}
+	return errs
+}
+
+func (s *writeBehind) StoreIfAbsent(key, value interface{}, time int) (bool, error) {
+	return s.storer.StoreIfAbsent(key, value, time)
+}
+
+func (s *writeBehind) Extend(key, value interface{}, time int) (bool, error) {
+	return s.storer.Extend(key, value, time)
+}
+
+// Values waiting to be saved are compared too, so one stored by this process can be deleted before it's saved
+func (s *writeBehind) DeleteIfEqual(key, value interface{}) (bool, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return false, err
+	}
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	if write := s.waiting(key); write != nil {
+		if string(write.data) != string(data) {
+			return false, nil
+		}
+		s.forget(key)
+		return true, s.storer.Delete(key)
+	}
+	return s.storer.DeleteIfEqual(key, value)
+}
+
+func (s *writeBehind) Delete(keys ...interface{}) error {
+	s.writing.Lock()
+	defer s.writing.Unlock()
+	s.forget(keys...)
+	return s.storer.Delete(keys...)
+}
+
+// Keys of values waiting to be saved are returned along with those already saved
+func (s *writeBehind) Keys(prefix string) ([]string, error) {
+	keys, err := s.storer.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	saved := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		saved[key] = true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key := range s.pending {
+		if strings.HasPrefix(key, prefix) && !saved[key] {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Saves the values still waiting and stops saving in the background. Values stored afterwards are saved before
+// Store returns.
+func (s *writeBehind) Close() error {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mutex.Unlock()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,84 @@
+package store
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+// Holds every write until released, so values stay waiting to be saved
+type heldStore struct {
+	Storer
+	release chan struct{}
+}
+
+func (storer *heldStore) Store(key, value interface{}, time int) error {
+	<-storer.release
+	return storer.Storer.Store(key, value, time)
+}
+
+// A session deleted while waiting to be saved isn't saved afterwards, and one waiting is listed
+func TestWriteBehindDeletesWaitingValues(t *testing.T) {
+	shared := &heldStore{Storer: NewMemory(), release: make(chan struct{})}
+	behind := WriteBehind(shared, 10, slog.Default())
+	behind.Store("session:a", "jdoe", 3600)
+	behind.Store("session:b", "asmith", 3600)
+	keys, err := behind.Keys("session:")
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("listed keys %v: %v", keys, err)
+	}
+	// The first write may already be under way, so delete the second
+	done := make(chan error)
+	go func() {
+		done <- behind.Delete("session:b")
+	}()
+	close(shared.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := behind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var value string
+	if err := shared.Retrieve("session:b", &value); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted session was saved as %q: %v", value, err)
+	}
+	if err := shared.Retrieve("session:a", &value); err != nil || value != "jdoe" {
+		t.Errorf("saved session is %q: %v", value, err)
+	}
+}
+
+// Closing saves the values still waiting, and later values are saved before Store returns
+func TestWriteBehindCloseSavesWaitingValues(t *testing.T) {
+	shared := &heldStore{Storer: NewMemory(), release: make(chan struct{})}
+	behind := WriteBehind(shared, 10, slog.Default())
+	for _, key := range []string{"a", "b", "c"} {
+		behind.Store(key, key, 3600)
+	}
+	close(shared.release)
+	if err := behind.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := behind.Store("d", "d", 3600); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		var value string
+		if err := shared.Retrieve(key, &value); err != nil || value != key {
+			t.Errorf("%s saved as %q: %v", key, value, err)
+		}
+	}
+}
+
+// Only a key still holding the value is deleted, whether it's saved or waiting to be
+func TestWriteBehindDeleteIfEqual(t *testing.T) {
+	behind := WriteBehind(NewMemory(), 10, slog.Default())
+	defer behind.Close()
+	behind.Store("lock", "mine", 60)
+	if deleted, err := behind.DeleteIfEqual("lock", "theirs"); err != nil || deleted {
+		t.Errorf("deleted another holder's lock: %v", err)
+	}
+	if deleted, err := behind.DeleteIfEqual("lock", "mine"); err != nil || !deleted {
+		t.Errorf("kept the holder's lock: %v", err)
+	}
+}
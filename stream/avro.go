@@ -0,0 +1,84 @@
+package stream
+
+import (
+	"encoding/binary"
+	"github.com/amdonov/lite-idp/webhook"
+)
+
+// Avro schema of streamed events, for registering with consumers
+const Schema = `{"type":"record","name":"IdentityEvent","namespace":"com.github.amdonov.liteidp","fields":[` +
+	`{"name":"ID","type":"string"},` +
+	`{"name":"Type","type":"string"},` +
+	`{"name":"Time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+	`{"name":"User","type":["null","string"],"default":null},` +
+	`{"name":"ServiceProvider","type":["null","string"],"default":null},` +
+	`{"name":"ClientIP","type":["null","string"],"default":null},` +
+	`{"name":"Reason","type":["null","string"],"default":null},` +
+	`{"name":"Sessions","type":"int","default":0},` +
+	`{"name":"AssertionID","type":["null","string"],"default":null},` +
+	`{"name":"AuthnContext","type":["null","string"],"default":null}]}`
+
+// The schema's Parsing Canonical Form, which its fingerprint is taken of
+const canonicalSchema = `{"name":"com.github.amdonov.liteidp.IdentityEvent","type":"record","fields":[` +
+	`{"name":"ID","type":"string"},` +
+	`{"name":"Type","type":"string"},` +
+	`{"name":"Time","type":"long"},` +
+	`{"name":"User","type":["null","string"]},` +
+	`{"name":"ServiceProvider","type":["null","string"]},` +
+	`{"name":"ClientIP","type":["null","string"]},` +
+	`{"name":"Reason","type":["null","string"]},` +
+	`{"name":"Sessions","type":"int"},` +
+	`{"name":"AssertionID","type":["null","string"]},` +
+	`{"name":"AuthnContext","type":["null","string"]}]}`
+
+// Starts every single-object encoded message: the marker and the schema's fingerprint
+var avroHeader = append([]byte{0xc3, 0x01}, fingerprint(canonicalSchema)...)
+
+// Encodes the event in Avro's single-object encoding, so consumers can tell which schema wrote it without
+// a schema registry
+func encodeAvro(event *webhook.Event) ([]byte, error) {
+	data := append([]byte{}, avroHeader...)
+	data = appendString(data, event.ID)
+	data = appendString(data, event.Type)
+	data = binary.AppendVarint(data, event.Time.UnixMilli())
+	for _, value := range []string{event.User, event.ServiceProvider, event.ClientIP, event.Reason} {
+		data = appendOptional(data, value)
+	}
+	data = binary.AppendVarint(data, int64(event.Sessions))
+	data = appendOptional(data, event.AssertionID)
+	data = appendOptional(data, event.AuthnContext)
+	return data, nil
+}
+
+// Avro's longs and lengths are zig-zag varints, as binary.AppendVarint writes
+func appendString(data []byte, value string) []byte {
+	return append(binary.AppendVarint(data, int64(len(value))), value...)
+}
+
+// Writes a ["null","string"] union, with empty strings as null
+func appendOptional(data []byte, value string) []byte {
+	if value == "" {
+		return binary.AppendVarint(data, 0)
+	}
+	return appendString(binary.AppendVarint(data, 1), value)
+}
+
+// Returns the schema's CRC-64-AVRO fingerprint, little-endian as the single-object encoding wants it
+func fingerprint(schema string) []byte {
+	const empty = 0xc15d213aa4d7a795
+	var table [256]uint64
+	for i := range table {
+		value := uint64(i)
+		for j := 0; j < 8; j++ {
+			value = (value >> 1) ^ (empty & -(value & 1))
+		}
+		table[i] = value
+	}
+	sum := uint64(empty)
+	for i := 0; i < len(schema); i++ {
+		sum = (sum >> 8) ^ table[byte(sum)^schema[i]]
+	}
+	result := make([]byte, 8)
+	binary.LittleEndian.PutUint64(result, sum)
+	return result
+}
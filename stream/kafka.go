@@ -0,0 +1,31 @@
+package stream
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+type kafkaBroker struct {
+	writer *kafka.Writer
+}
+
+func newKafka(settings *config.Kafka) (broker, error) {
+	writer := &kafka.Writer{Addr: kafka.TCP(settings.Brokers...), Topic: settings.Topic, Balancer: &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll, BatchTimeout: 10 * time.Millisecond}
+	if settings.TLS {
+		writer.Transport = &kafka.Transport{TLS: &tls.Config{}}
+	}
+	return &kafkaBroker{writer}, nil
+}
+
+func (broker *kafkaBroker) publish(ctx context.Context, messages []*message) error {
+	records := make([]kafka.Message, len(messages))
+	for i, message := range messages {
+		records[i] = kafka.Message{Key: []byte(message.key), Value: message.value,
+			Headers: []kafka.Header{{Key: "type", Value: []byte(message.eventType)}}}
+	}
+	return broker.writer.WriteMessages(ctx, records...)
+}
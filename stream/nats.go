@@ -0,0 +1,39 @@
+package stream
+
+import (
+	"context"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/nats-io/nats.go"
+	"strings"
+)
+
+type natsBroker struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// Connects to the server, reconnecting for as long as the IdP runs
+func newNATS(settings *config.NATS) (broker, error) {
+	options := []nats.Option{nats.Name("lite-idp"), nats.MaxReconnects(-1)}
+	if settings.Credentials != "" {
+		options = append(options, nats.UserCredentials(settings.Credentials))
+	}
+	conn, err := nats.Connect(settings.URL, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBroker{conn, strings.TrimSuffix(settings.Subject, ".")}, nil
+}
+
+// Publishes each event to the subject for its type. Flushing confirms the server received them.
+func (broker *natsBroker) publish(ctx context.Context, messages []*message) error {
+	for _, message := range messages {
+		msg := &nats.Msg{Subject: broker.subject + "." + message.eventType, Data: message.value,
+			Header: nats.Header{}}
+		msg.Header.Set("User", message.key)
+		if err := broker.conn.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	return broker.conn.Flush()
+}
@@ -0,0 +1,120 @@
+// Package stream publishes the IdP's identity events to Kafka or NATS for stream processors. Events are
+// queued and published in the background, so a slow broker never holds up a login.
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/webhook"
+	"log/slog"
+	"time"
+)
+
+// Longest wait between attempts to publish
+const maxRetryDelay = time.Minute
+
+// Most events published at once
+const maxBatch = 100
+
+// An encoded event
+type message struct {
+	// Events of a user share a key, so Kafka keeps them in order
+	key       string
+	eventType string
+	value     []byte
+}
+
+// Where messages are published
+type broker interface {
+	publish(ctx context.Context, messages []*message) error
+}
+
+type Publisher struct {
+	settings config.Streaming
+	events   map[string]bool
+	encode   func(*webhook.Event) ([]byte, error)
+	broker   broker
+	queue    chan *message
+	logger   *slog.Logger
+}
+
+// Connects to the configured broker and starts publishing. Events that can't be published are logged to
+// the logger.
+func New(settings *config.Streaming, logger *slog.Logger) (*Publisher, error) {
+	defaults := settings.WithDefaults()
+	publisher := &Publisher{settings: defaults, events: make(map[string]bool),
+		queue: make(chan *message, defaults.Buffer), logger: logger}
+	for _, event := range defaults.Events {
+		publisher.events[event] = true
+	}
+	publisher.encode = encodeJSON
+	if defaults.Format == config.StreamAvro {
+		publisher.encode = encodeAvro
+	}
+	var err error
+	switch {
+	case defaults.Kafka != nil:
+		publisher.broker, err = newKafka(defaults.Kafka)
+	case defaults.NATS != nil:
+		publisher.broker, err = newNATS(defaults.NATS)
+	default:
+		err = errors.New("no broker is configured")
+	}
+	if err != nil {
+		return nil, err
+	}
+	go publisher.run()
+	return publisher, nil
+}
+
+// Queues the event, dropping it when the queue is full
+func (publisher *Publisher) Publish(event *webhook.Event) {
+	if len(publisher.events) > 0 && !publisher.events[event.Type] {
+		return
+	}
+	value, err := publisher.encode(event)
+	if err != nil {
+		publisher.logger.Error("Failed to encode event", "event", event.Type, "err", err)
+		return
+	}
+	select {
+	case publisher.queue <- &message{event.User, event.Type, value}:
+	default:
+		publisher.logger.Error("Event stream queue is full, dropping event", "event", event.Type)
+	}
+}
+
+// Publishes whatever has queued up, a batch at a time
+func (publisher *Publisher) run() {
+	for first := range publisher.queue {
+		batch := []*message{first}
+		for len(batch) < maxBatch && len(publisher.queue) > 0 {
+			batch = append(batch, <-publisher.queue)
+		}
+		publisher.deliver(batch)
+	}
+}
+
+func (publisher *Publisher) deliver(batch []*message) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := publisher.broker.publish(context.Background(), batch)
+		if err == nil {
+			return
+		}
+		if attempt >= publisher.settings.Retries {
+			publisher.logger.Error("Failed to publish events", "count", len(batch), "err", err)
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func encodeJSON(event *webhook.Event) ([]byte, error) {
+	return json.Marshal(event)
+}
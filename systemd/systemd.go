@@ -0,0 +1,98 @@
+// Package systemd lets the IdP run as a systemd service: it serves on sockets systemd opened for it and
+// tells systemd when it's ready and still alive. Outside systemd everything here does nothing.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// Returns the sockets systemd passed to the process by their FileDescriptorName, which defaults to the
+// socket unit's name. The environment is cleared so child processes don't take them too.
+func Listeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		// The listener holds a duplicate of the descriptor
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners[name] = listener
+	}
+	return listeners, nil
+}
+
+// Sends a state such as READY=1 or STOPPING=1 to systemd. Does nothing when the service manager didn't
+// ask for notifications.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets are given with a leading @
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Returns how often systemd expects to hear the service is alive, or 0 when the watchdog isn't enabled
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Pings the watchdog at half its interval for as long as healthy reports no problem, so systemd restarts
+// a service that's hung or can no longer serve. Returns straight away when the watchdog isn't enabled.
+func Watchdog(healthy func() bool) {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval / 2) {
+			if healthy() {
+				Notify("WATCHDOG=1")
+			}
+		}
+	}()
+}
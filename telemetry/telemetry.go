@@ -0,0 +1,107 @@
+// Package telemetry traces requests with OpenTelemetry so a slow login can be followed from the SP's
+// request through session lookup, attribute sources, signing and the store. Until Configure is called
+// spans cost next to nothing and aren't exported.
+package telemetry
+
+import (
+	"context"
+	"github.com/amdonov/lite-idp/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+// Name spans are recorded under
+const instrumentation = "github.com/amdonov/lite-idp"
+
+// Starts exporting traces. Returns a function that flushes spans not yet exported, for use on shutdown.
+// Without settings nothing is exported and the function does nothing.
+func Configure(settings *config.Telemetry) (func(context.Context) error, error) {
+	// Trace context is passed on even when this process doesn't record spans
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{},
+		propagation.Baggage{}))
+	if settings == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+	defaults := settings.WithDefaults()
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(defaults.Endpoint),
+		otlptracehttp.WithHeaders(defaults.Headers))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(defaults.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", defaults.ServiceName))))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Starts a span, a child of any span in the context
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// Ends the span, marking it failed when there's an error
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Starts a span for the request and returns the request carrying it, so handlers further in add children
+func StartRequest(request *http.Request, name string, attributes ...attribute.KeyValue) (*http.Request,
+	trace.Span) {
+	ctx, span := Start(request.Context(), name, attributes...)
+	return request.WithContext(ctx), span
+}
+
+// Adds the trace context to the headers of a request to a backend
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// Wraps the handler so each request has a server span, continuing the caller's trace when it sent one
+func Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		ctx, span := otel.Tracer(instrumentation).Start(ctx, request.Method+" "+request.URL.Path,
+			trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				attribute.String("http.request.method", request.Method),
+				attribute.String("url.path", request.URL.Path),
+				attribute.String("client.address", request.RemoteAddr),
+				attribute.String("user_agent.original", request.UserAgent())))
+		defer span.End()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		handler.ServeHTTP(recorder, request.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if !recorder.wroteHeader {
+		recorder.status, recorder.wroteHeader = status, true
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	recorder.wroteHeader = true
+	return recorder.ResponseWriter.Write(data)
+}
@@ -0,0 +1,19 @@
+package tracer
+
+import (
+	"encoding/json"
+	"github.com/amdonov/lite-idp/bearer"
+	"net/http"
+)
+
+// Creates a handler listing the captured exchanges as JSON. Callers must present the token as a bearer
+// token in the Authorization header.
+func (tracer *Tracer) NewEndpoint(token string) http.Handler {
+	return bearer.Require(token, http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "no-store")
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(tracer.Exchanges())
+	}))
+}
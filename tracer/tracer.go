@@ -0,0 +1,198 @@
+// Package tracer captures the SAML messages exchanged at the IdP's endpoints to help troubleshoot SP
+// integrations. Captured messages contain personal data and are only kept in memory.
+package tracer
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Messages larger than this are truncated
+const maxCapture = 256 * 1024
+
+// A request to an endpoint and the IdP's reply
+type Exchange struct {
+	Time     time.Time
+	Endpoint string
+	Binding  string
+	Method   string
+	Remote   string
+	// Decoded inbound and outbound SAML messages
+	Request  string
+	Response string
+	Status   int
+	Duration time.Duration
+	// Results noted while handling the request, such as signature validation
+	Details map[string]string
+}
+
+// Keeps the most recent exchanges
+type Tracer struct {
+	mutex     sync.Mutex
+	exchanges []Exchange
+	next      int
+	full      bool
+}
+
+func New(size int) *Tracer {
+	return &Tracer{exchanges: make([]Exchange, size)}
+}
+
+func (tracer *Tracer) record(exchange Exchange) {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	tracer.exchanges[tracer.next] = exchange
+	tracer.next = (tracer.next + 1) % len(tracer.exchanges)
+	if tracer.next == 0 {
+		tracer.full = true
+	}
+}
+
+// Returns the captured exchanges, newest first
+func (tracer *Tracer) Exchanges() []Exchange {
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+	count := tracer.next
+	if tracer.full {
+		count = len(tracer.exchanges)
+	}
+	exchanges := make([]Exchange, 0, count)
+	for i := 1; i <= count; i++ {
+		index := (tracer.next - i + len(tracer.exchanges)) % len(tracer.exchanges)
+		exchanges = append(exchanges, tracer.exchanges[index])
+	}
+	return exchanges
+}
+
+type contextKey struct{}
+
+// Notes a result for the exchange being traced. Does nothing when the request isn't traced.
+func Annotate(request *http.Request, key, value string) {
+	if exchange, ok := request.Context().Value(contextKey{}).(*Exchange); ok {
+		exchange.Details[key] = value
+	}
+}
+
+// Wraps an endpoint so its messages are captured. A nil tracer returns the handler unchanged.
+func (tracer *Tracer) Handler(binding string, handler http.Handler) http.Handler {
+	if tracer == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		exchange := &Exchange{Time: start, Endpoint: request.URL.Path, Binding: binding, Method: request.Method,
+			Remote: request.RemoteAddr, Details: make(map[string]string)}
+		exchange.Request = captureRequest(request)
+		recorder := &recorder{ResponseWriter: writer, status: 200}
+		handler.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), contextKey{}, exchange)))
+		exchange.Duration = time.Since(start)
+		exchange.Status = recorder.status
+		exchange.Response = decodeResponse(recorder)
+		if exchange.Request != "" || exchange.Response != "" {
+			tracer.record(*exchange)
+		}
+	})
+}
+
+// Returns the SAML message in the request, leaving the body readable by the handler
+func captureRequest(request *http.Request) string {
+	if request.Method == "GET" {
+		return decodeParameters(request.URL.Query(), true)
+	}
+	if request.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, maxCapture))
+	if err != nil {
+		return ""
+	}
+	request.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		return decodeParameters(values, false)
+	}
+	return string(body)
+}
+
+var messageParameters = []string{"SAMLRequest", "SAMLResponse", "SAMLart", "TARGET"}
+
+// Decodes the first message parameter present. Redirect binding messages are deflated.
+func decodeParameters(values url.Values, deflated bool) string {
+	for _, name := range messageParameters {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return name + "=" + value
+		}
+		if deflated {
+			inflated, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(data)), maxCapture))
+			if err == nil {
+				return string(inflated)
+			}
+		}
+		return string(data)
+	}
+	return ""
+}
+
+var formMessage = regexp.MustCompile(`name="(SAMLResponse|SAMLRequest)"\s+value="([^"]*)"`)
+
+// Extracts the message from a redirect, an auto-submitting form or a SOAP reply
+func decodeResponse(recorder *recorder) string {
+	if location := recorder.Header().Get("Location"); location != "" {
+		if target, err := url.Parse(location); err == nil {
+			return decodeParameters(target.Query(), true)
+		}
+	}
+	body := recorder.body.Bytes()
+	if match := formMessage.FindSubmatch(body); match != nil {
+		data, err := base64.StdEncoding.DecodeString(html.UnescapeString(string(match[2])))
+		if err == nil {
+			return string(data)
+		}
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("<?xml")) && !bytes.Contains(body, []byte("<html")) {
+		return string(body)
+	}
+	return ""
+}
+
+// Copies what the handler writes, up to the capture limit
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (recorder *recorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *recorder) Write(data []byte) (int, error) {
+	if remaining := maxCapture - recorder.body.Len(); remaining > 0 {
+		if len(data) < remaining {
+			remaining = len(data)
+		}
+		recorder.body.Write(data[:remaining])
+	}
+	return recorder.ResponseWriter.Write(data)
+}
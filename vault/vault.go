@@ -0,0 +1,158 @@
+// Package vault reads secrets from HashiCorp Vault's KV engine and signs with keys kept by its Transit
+// engine, so the signing key never has to be on the IdP's host.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Prefix of settings naming a secret, such as vault:secret/data/idp#ldap-password
+const Scheme = "vault:"
+
+// Responses larger than this are rejected
+const maxResponse = 1 << 20
+
+type Client struct {
+	address   string
+	token     string
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+// Creates a client of the Vault server at address, such as https://vault.example.com:8200. VAULT_ADDR and
+// VAULT_TOKEN are used when address or token are empty. Without a token, the token is read from tokenFile
+// before each call, so a Vault Agent can renew it. caCertificate, when set, is the file of the CA trusted
+// for Vault's listener.
+func NewClient(address, token, tokenFile, namespace, caCertificate string) (*Client, error) {
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if address == "" {
+		return nil, errors.New("no Vault address is configured and VAULT_ADDR isn't set")
+	}
+	if token == "" && tokenFile == "" {
+		return nil, errors.New("no Vault token is configured and VAULT_TOKEN isn't set")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCertificate != "" {
+		data, err := ioutil.ReadFile(caCertificate)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + caCertificate)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &Client{address: strings.TrimSuffix(address, "/"), token: token, tokenFile: tokenFile,
+		namespace: namespace, client: &http.Client{Transport: transport, Timeout: 10 * time.Second}}, nil
+}
+
+// Splits a reference such as vault:secret/data/idp#ldap-password into the secret's path and the field.
+// Returns false for values that aren't references.
+func ParseReference(value string) (string, string, bool) {
+	if !strings.HasPrefix(value, Scheme) {
+		return "", "", false
+	}
+	reference := strings.TrimPrefix(value, Scheme)
+	hash := strings.LastIndex(reference, "#")
+	if hash <= 0 || hash == len(reference)-1 {
+		return "", "", false
+	}
+	return strings.Trim(reference[:hash], "/"), reference[hash+1:], true
+}
+
+// Returns the fields of the secret at path. Secrets of version 2 KV engines are read through their data
+// path, such as secret/data/idp for the idp secret of the engine at secret.
+func (client *Client) Read(ctx context.Context, path string) (map[string]interface{}, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := client.call(ctx, "GET", path, nil, &secret); err != nil {
+		return nil, err
+	}
+	// Version 2 nests the fields beside the version's metadata
+	if fields, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, versioned := secret.Data["metadata"]; versioned {
+			return fields, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+// Returns a string field of the secret at path
+func (client *Client) Field(ctx context.Context, path, field string) (string, error) {
+	fields, err := client.Read(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("the secret at %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+// Sends a request to the path of Vault's API, such as transit/sign/idp
+func (client *Client) call(ctx context.Context, method, path string, body, result interface{}) error {
+	var content io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(data)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, client.address+"/v1/"+strings.TrimPrefix(path, "/"),
+		content)
+	if err != nil {
+		return err
+	}
+	token := client.token
+	if token == "" {
+		data, err := ioutil.ReadFile(client.tokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	request.Header.Set("X-Vault-Token", token)
+	if client.namespace != "" {
+		request.Header.Set("X-Vault-Namespace", client.namespace)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := client.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	reader := io.LimitReader(response.Body, maxResponse)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(reader).Decode(&failure)
+		return fmt.Errorf("Vault %s %s returned %s %s", method, path, response.Status,
+			strings.Join(failure.Errors, "; "))
+	}
+	return json.NewDecoder(reader).Decode(result)
+}
@@ -0,0 +1,191 @@
+// Package webhook posts identity events, such as logins and revoked sessions, to the receivers configured in
+// Webhooks so systems like fraud detection can react to them. Events are delivered in the background and
+// retried; an event a receiver never accepts is logged and dropped.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/httpclient"
+	"github.com/amdonov/lite-idp/logging"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Longest wait between attempts to deliver an event
+const maxRetryDelay = time.Minute
+
+type Event struct {
+	// Unique to the event, so receivers can ignore repeated deliveries
+	ID   string
+	Type string
+	Time time.Time
+	User string `json:",omitempty"`
+	// The SP logged in to, declined or whose consent was revoked
+	ServiceProvider string `json:",omitempty"`
+	ClientIP        string `json:",omitempty"`
+	// Why a login failed
+	Reason string `json:",omitempty"`
+	// Sessions ended by a revocation
+	Sessions int `json:",omitempty"`
+	// The assertion issued for a login
+	AssertionID  string `json:",omitempty"`
+	AuthnContext string `json:",omitempty"`
+}
+
+// Receives every event alongside the webhooks, such as to stream them to a broker. Publish mustn't block.
+type Publisher interface {
+	Publish(event *Event)
+}
+
+// Sends events to the configured receivers and publishers. A nil Notifier sends nothing.
+type Notifier struct {
+	receivers  []*receiver
+	publishers []Publisher
+}
+
+type receiver struct {
+	settings config.Webhook
+	events   map[string]bool
+	queue    chan *Event
+	client   *http.Client
+	logger   *slog.Logger
+}
+
+// Starts delivering to the receivers, logging events they don't accept to the logger. Returns nil when there
+// are no receivers or publishers.
+func New(settings []*config.Webhook, logger *slog.Logger, publishers ...Publisher) *Notifier {
+	if len(settings) == 0 && len(publishers) == 0 {
+		return nil
+	}
+	notifier := &Notifier{publishers: publishers}
+	for _, webhook := range settings {
+		defaults := webhook.WithDefaults()
+		client := &http.Client{Transport: httpclient.Transport, Timeout: time.Duration(defaults.Timeout) * time.Second}
+		receiver := &receiver{settings: defaults, events: make(map[string]bool),
+			queue:  make(chan *Event, defaults.Buffer),
+			client: client, logger: logger}
+		for _, event := range defaults.Events {
+			receiver.events[event] = true
+		}
+		go receiver.run()
+		notifier.receivers = append(notifier.receivers, receiver)
+	}
+	return notifier
+}
+
+type contextKey struct{}
+
+// Makes the notifier available to the handler's requests. The handler is returned as is by a nil Notifier.
+func (notifier *Notifier) Handler(handler http.Handler) http.Handler {
+	if notifier == nil {
+		return handler
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		handler.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), contextKey{}, notifier)))
+	})
+}
+
+// Sends the event to the receivers and publishers of the IdP handling the request, noting when it happened
+// and the client's address. Does nothing when the IdP has none.
+func Notify(request *http.Request, event *Event) {
+	notifier, ok := request.Context().Value(contextKey{}).(*Notifier)
+	if !ok {
+		return
+	}
+	event.ID, event.Time = newID(), time.Now().UTC()
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		event.ClientIP = host
+	}
+	for _, publisher := range notifier.publishers {
+		publisher.Publish(event)
+	}
+	for _, receiver := range notifier.receivers {
+		if len(receiver.events) > 0 && !receiver.events[event.Type] {
+			continue
+		}
+		select {
+		case receiver.queue <- event:
+		default:
+			logging.FromRequest(request).Error("Webhook queue is full, dropping event", "url", receiver.settings.URL,
+				"event", event.Type)
+		}
+	}
+}
+
+func (receiver *receiver) run() {
+	for event := range receiver.queue {
+		receiver.deliver(event)
+	}
+}
+
+// Tries until the receiver accepts the event or the retries run out. Rejections other than throttling are
+// final, as sending the event again won't change the answer.
+func (receiver *receiver) deliver(event *Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		receiver.logger.Error("Failed to encode webhook event", "event", event.Type, "err", err)
+		return
+	}
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		status, err := receiver.send(event, body)
+		if err == nil && status >= 200 && status <= 299 {
+			return
+		}
+		retry := err != nil || status == http.StatusTooManyRequests || status >= 500
+		if !retry || attempt >= receiver.settings.Retries {
+			receiver.logger.Error("Webhook didn't accept event", "url", receiver.settings.URL, "event", event.Type,
+				"id", event.ID, "status", status, "err", err)
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+func (receiver *receiver) send(event *Event, body []byte) (int, error) {
+	request, err := http.NewRequest("POST", receiver.settings.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	// Signing the time as well lets receivers turn away old events replayed to them
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Webhook-ID", event.ID)
+	request.Header.Set("X-Webhook-Event", event.Type)
+	request.Header.Set("X-Webhook-Timestamp", timestamp)
+	if receiver.settings.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(receiver.settings.Secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+		request.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	response, err := receiver.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	// Connections are only reused once their response has been read to the end
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+	response.Body.Close()
+	return response.StatusCode, nil
+}
+
+func newID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,50 @@
+package wsfed
+
+import (
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/saml11"
+	"time"
+)
+
+const (
+	trustNamespace = "http://schemas.xmlsoap.org/ws/2005/02/trust"
+	issueRequest   = "http://schemas.xmlsoap.org/ws/2005/02/trust/Issue"
+	// Bearer tokens have no proof key
+	noProofKey = "http://schemas.xmlsoap.org/ws/2005/05/identity/NoProofKey"
+)
+
+// The token issued in a wsignin1.0 response's wresult
+type RequestSecurityTokenResponse struct {
+	XMLName                xml.Name `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust RequestSecurityTokenResponse"`
+	Lifetime               *Lifetime
+	AppliesTo              AppliesTo
+	RequestedSecurityToken RequestedSecurityToken
+	TokenType              string `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust TokenType"`
+	RequestType            string `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust RequestType"`
+	KeyType                string `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust KeyType"`
+}
+
+type Lifetime struct {
+	XMLName xml.Name  `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust Lifetime"`
+	Created time.Time `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Created"`
+	Expires time.Time `xml:"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd Expires"`
+}
+
+// Names the relying party's realm
+type AppliesTo struct {
+	XMLName           xml.Name `xml:"http://schemas.xmlsoap.org/ws/2004/09/policy AppliesTo"`
+	EndpointReference EndpointReference
+}
+
+type EndpointReference struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/08/addressing EndpointReference"`
+	Address string   `xml:"http://www.w3.org/2005/08/addressing Address"`
+}
+
+// Holds one of the assertions, depending on the relying party's token type
+type RequestedSecurityToken struct {
+	XMLName         xml.Name `xml:"http://schemas.xmlsoap.org/ws/2005/02/trust RequestedSecurityToken"`
+	SAML11Assertion *saml11.Assertion
+	SAML2Assertion  *saml.Assertion
+}
@@ -0,0 +1,255 @@
+// Package wsfed serves the WS-Federation passive requestor profile for relying parties, such as SharePoint
+// and older .NET applications, that can't speak SAML 2.0 Web SSO. Sign-in requests are handed to the
+// authenticators as AuthnRequests with Binding, and the responses generated for them are returned as SAML
+// 1.1 or 2.0 tokens in RequestSecurityTokenResponses.
+package wsfed
+
+import (
+	"github.com/amdonov/lite-idp/accesslog"
+	"github.com/amdonov/lite-idp/authentication"
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/errorpage"
+	"github.com/amdonov/lite-idp/logging"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/saml11"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/webhook"
+	"github.com/amdonov/lite-idp/xmlutil"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// Binding of relying parties' assertion consumer services, the addresses wreply may name. The Server is
+	// the marshaller of AuthnRequests with it.
+	Binding = "http://docs.oasis-open.org/wsfed/federation/200706"
+	// Actions named by the wa parameter
+	SignIn         = "wsignin1.0"
+	SignOut        = "wsignout1.0"
+	SignOutCleanup = "wsignoutcleanup1.0"
+)
+
+type Server struct {
+	authenticator authentication.Authenticator
+	signer        dsig.Signer
+	store         store.Storer
+	config        *config.Configuration
+	template      *template.Template
+}
+
+// Creates the server. Serve it at Services.WSFederation and register it as the marshaller of Binding.
+func New(authenticator authentication.Authenticator, signer dsig.Signer, store store.Storer,
+	config *config.Configuration) *Server {
+	server := &Server{authenticator: authenticator, signer: signer, store: store, config: config}
+	server.template = template.Must(template.New("wsfedPost").Parse(`<!DOCTYPE html>
+<html lang="en">
+<body onload="document.getElementById('wsfedpost').submit()">
+<noscript>
+<p>
+<strong>Note:</strong> Since your browser does not support JavaScript,
+you must press the Continue button once to proceed.
+</p>
+</noscript>
+<form action="{{ .Action }}" method="post" id="wsfedpost">
+<div>
+<input type="hidden" name="wa" value="wsignin1.0"/>
+<input type="hidden" name="wresult" value="{{ .Result }}"/>
+{{ if .Context }}<input type="hidden" name="wctx" value="{{ .Context }}"/>
+{{ end }}</div>
+<noscript>
+<div>
+<input type="submit" value="Continue"/>
+</div>
+</noscript>
+</form>
+</body>
+</html>`))
+	return server
+}
+
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if err := request.ParseForm(); err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	switch action := request.Form.Get("wa"); action {
+	case SignIn:
+		server.signIn(writer, request)
+	case SignOut, SignOutCleanup:
+		server.signOut(writer, request)
+	default:
+		errorpage.Error(writer, request, "unsupported WS-Federation action "+action, 400)
+	}
+}
+
+func (server *Server) signIn(writer http.ResponseWriter, request *http.Request) {
+	realm := request.Form.Get("wtrealm")
+	if realm == "" {
+		errorpage.Error(writer, request, "wtrealm is required", 400)
+		return
+	}
+	accesslog.SetServiceProvider(request, realm)
+	errorpage.SetServiceProvider(request, realm)
+	sp := server.config.ServiceProvider(realm)
+	if sp == nil {
+		errorpage.Error(writer, request, "The application isn't registered with the IdP.", 400)
+		return
+	}
+	// wct is optional, but when present it must be recent
+	if requestTime := request.Form.Get("wct"); requestTime != "" {
+		if err := protocol.ValidateIssueInstant(requestTime, server.config.ClockSkewFor(realm)); err != nil {
+			errorpage.Error(writer, request, err.Error(), 400)
+			return
+		}
+	}
+	// Present the request to the authenticators as if it were a SAML 2 request
+	authnRequest := &protocol.AuthnRequest{AssertionConsumerServiceURL: request.Form.Get("wreply"),
+		ProtocolBinding: Binding}
+	authnRequest.ID = protocol.NewID()
+	authnRequest.Version = "2.0"
+	authnRequest.IssueInstant = time.Now().UTC().Format(time.RFC3339)
+	authnRequest.Issuer = realm
+	acs, err := protocol.ResolveACSWithBindings(sp, authnRequest,
+		server.config.ProfileFor(realm).AllowedBindings([]string{Binding}))
+	if err != nil {
+		errorpage.Error(writer, request, err.Error(), 400)
+		return
+	}
+	authnRequest.AssertionConsumerServiceURL = acs.Location
+	server.authenticator.Authenticate(authnRequest, request.Form.Get("wctx"), writer, request)
+}
+
+// Ends the user's IdP session. The user is sent on to wreply when it's a relying party's address.
+func (server *Server) signOut(writer http.ResponseWriter, request *http.Request) {
+	if user := authentication.CurrentUser(request, server.store); user != nil {
+		logging.FromRequest(request).Info("Signing out", "user", user.Name)
+		err := authentication.RevokeSession(authentication.SessionStore(request, server.store), user.SessionID)
+		if err != nil {
+			logging.FromRequest(request).Error("Failed to end session", "user", user.Name, "err", err)
+			errorpage.Error(writer, request, "Signing out failed.", 500)
+			return
+		}
+		webhook.Notify(request, &webhook.Event{Type: config.EventLogout, User: user.Name})
+	}
+	if reply := request.Form.Get("wreply"); reply != "" && server.isReplyAddress(reply) {
+		http.Redirect(writer, request, reply, http.StatusFound)
+		return
+	}
+	writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer.Header().Set("Cache-Control", "no-store")
+	writer.Write([]byte("You have signed out.\n"))
+}
+
+// Reports whether the address is one of a relying party's assertion consumer services, so sign-out can't
+// be used to redirect users elsewhere
+func (server *Server) isReplyAddress(address string) bool {
+	for _, sp := range server.config.Current().ServiceProviders {
+		for _, acs := range sp.AssertionConsumerServices {
+			if acs.Binding == Binding && acs.Location == address {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Posts the token to the relying party. Failures are shown to the user, as the passive profile has no
+// way to tell the relying party.
+func (server *Server) Marshal(writer http.ResponseWriter, request *http.Request, response *protocol.Response,
+	authnRequest *protocol.AuthnRequest, relayState string) {
+	logger := logging.FromRequest(request)
+	if response.Status == nil || response.Status.StatusCode.Value != protocol.StatusSuccess ||
+		response.Assertion == nil {
+		message := "Signing in to the application failed."
+		if response.Status != nil && response.Status.StatusMessage != "" {
+			message = "Signing in to the application failed: " + response.Status.StatusMessage
+		}
+		errorpage.Error(writer, request, message, 403)
+		return
+	}
+	realm := authnRequest.Issuer
+	data, err := server.tokenResponse(realm, response.Assertion)
+	if err != nil {
+		logger.Error("Failed to issue WS-Federation token", "err", err)
+		errorpage.Error(writer, request, "Signing in to the application failed.", 500)
+		return
+	}
+	server.template.Execute(writer, struct{ Action, Result, Context string }{
+		authnRequest.AssertionConsumerServiceURL, string(data), relayState})
+}
+
+// Returns the RequestSecurityTokenResponse carrying the assertion as the relying party's token type, with
+// the assertion signed
+func (server *Server) tokenResponse(realm string, assertion *saml.Assertion) ([]byte, error) {
+	rp := config.WSFedRelyingParty{}
+	if sp := server.config.ServiceProvider(realm); sp != nil && sp.WSFederation != nil {
+		rp = *sp.WSFederation
+	}
+	rp = rp.WithDefaults()
+	rstr := &RequestSecurityTokenResponse{TokenType: rp.TokenType, RequestType: issueRequest, KeyType: noProofKey}
+	rstr.AppliesTo.EndpointReference.Address = realm
+	if conditions := assertion.Conditions; conditions != nil {
+		rstr.Lifetime = &Lifetime{Created: conditions.NotBefore, Expires: conditions.NotOnOrAfter}
+	}
+	id := assertion.ID
+	claims := claimTypes(assertion, rp.Claims)
+	if rp.TokenType == config.WSFedSAML11Token {
+		token := saml11.Convert(&protocol.Response{Assertion: assertion}).Assertion
+		if token.AttributeStatement != nil {
+			// Converted attributes are in the same order
+			for i := range token.AttributeStatement.Attribute {
+				attribute := &token.AttributeStatement.Attribute[i]
+				// SAML 1.1 claim types are split into namespace and name
+				if split := strings.LastIndex(claims[i], "/"); split > 0 {
+					attribute.AttributeNamespace, attribute.AttributeName = claims[i][:split], claims[i][split+1:]
+				} else if claims[i] != "" {
+					attribute.AttributeName = claims[i]
+				}
+			}
+		}
+		rstr.RequestedSecurityToken.SAML11Assertion = token
+	} else {
+		token := *assertion
+		if statement := assertion.AttributeStatement; statement != nil {
+			renamed := *statement
+			renamed.Attributes = append([]saml.Attribute(nil), statement.Attributes...)
+			for i := range renamed.Attributes {
+				if claim := claims[i]; claim != "" {
+					renamed.Attributes[i].Name = claim
+				}
+			}
+			token.AttributeStatement = &renamed
+		}
+		rstr.RequestedSecurityToken.SAML2Assertion = &token
+	}
+	data, err := xmlutil.Marshal(rstr)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := protocol.SignerFor(server.signer, server.config, realm)
+	if err != nil {
+		return nil, err
+	}
+	return signer.SignElement(data, id)
+}
+
+// Returns the claim types configured for the assertion's attributes, in order. Attributes without one get
+// an empty string.
+func claimTypes(assertion *saml.Assertion, names map[string]string) []string {
+	if assertion.AttributeStatement == nil {
+		return nil
+	}
+	claims := make([]string, len(assertion.AttributeStatement.Attributes))
+	for i, attribute := range assertion.AttributeStatement.Attributes {
+		claim := names[attribute.Name]
+		if claim == "" {
+			claim = names[attribute.FriendlyName]
+		}
+		claims[i] = claim
+	}
+	return claims
+}
@@ -0,0 +1,75 @@
+package wsfed
+
+import (
+	"github.com/amdonov/lite-idp/config"
+	"github.com/amdonov/lite-idp/metadata"
+	"github.com/amdonov/lite-idp/protocol"
+	"github.com/amdonov/lite-idp/store"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const (
+	testRealm = "urn:sharepoint:portal"
+	testReply = "https://portal.example.com/_trust/"
+)
+
+// Records the request handed to it rather than signing the user in
+type recordingAuthenticator struct {
+	request *protocol.AuthnRequest
+}
+
+func (authenticator *recordingAuthenticator) Authenticate(request *protocol.AuthnRequest, relayState string,
+	writer http.ResponseWriter, r *http.Request) {
+	authenticator.request = request
+}
+
+func newTestServer() (*Server, *recordingAuthenticator) {
+	authenticator := &recordingAuthenticator{}
+	sp := &config.ServiceProvider{EntityId: testRealm, AssertionConsumerServices: []metadata.IndexedEndpoint{
+		{Binding: Binding, Location: testReply}}}
+	settings := &config.Configuration{EntityId: "https://idp.example.com/idp", BaseURL: "https://idp.example.com",
+		ServiceProviders: []*config.ServiceProvider{sp}}
+	return New(authenticator, nil, store.NewMemory(), settings), authenticator
+}
+
+func serve(server *Server, query url.Values) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", "/wsfed?"+query.Encode(), nil))
+	return recorder
+}
+
+func TestSignInUsesRegisteredReply(t *testing.T) {
+	server, authenticator := newTestServer()
+	serve(server, url.Values{"wa": {SignIn}, "wtrealm": {testRealm}, "wreply": {testReply}})
+	if authenticator.request == nil {
+		t.Fatal("sign-in wasn't handed to the authenticator")
+	}
+	if acs := authenticator.request.AssertionConsumerServiceURL; acs != testReply {
+		t.Errorf("token would be posted to %s", acs)
+	}
+}
+
+// A wreply the relying party hasn't registered would have the token posted elsewhere
+func TestSignInRejectsUnregisteredReply(t *testing.T) {
+	server, authenticator := newTestServer()
+	recorder := serve(server, url.Values{"wa": {SignIn}, "wtrealm": {testRealm},
+		"wreply": {"https://attacker.example.net/"}})
+	if authenticator.request != nil || recorder.Code != http.StatusBadRequest {
+		t.Errorf("unregistered wreply answered with %d", recorder.Code)
+	}
+}
+
+func TestSignOutOnlyRedirectsToReplyAddresses(t *testing.T) {
+	server, _ := newTestServer()
+	recorder := serve(server, url.Values{"wa": {SignOut}, "wreply": {testReply}})
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusFound || location != testReply {
+		t.Errorf("registered wreply answered with %d to %q", recorder.Code, location)
+	}
+	recorder = serve(server, url.Values{"wa": {SignOut}, "wreply": {"https://attacker.example.net/"}})
+	if location := recorder.Header().Get("Location"); location != "" {
+		t.Errorf("sign-out redirected to %s", location)
+	}
+}
@@ -0,0 +1,125 @@
+package xmlenc
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/amdonov/lite-idp/dsig"
+	"io"
+)
+
+const (
+	AES128CBC   = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	AES256CBC   = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	AES128GCM   = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	AES256GCM   = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+	RSAOAEP     = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	RSA15       = "http://www.w3.org/2001/04/xmlenc#rsa-1_5"
+	TypeElement = "http://www.w3.org/2001/04/xmlenc#Element"
+
+	DefaultDataAlg = AES256GCM
+	DefaultKeyAlg  = RSAOAEP
+)
+
+var keySizes = map[string]int{
+	AES128CBC: 16,
+	AES256CBC: 32,
+	AES128GCM: 16,
+	AES256GCM: 32,
+}
+
+// Algorithms used when encrypting. Empty values select the defaults. Older SPs may need AES-CBC, which
+// doesn't protect the integrity of the content.
+type Options struct {
+	DataAlgorithm string
+	KeyAlgorithm  string
+}
+
+// Encrypts an element to the certificate's RSA key using a fresh content encryption key. The element should
+// declare every namespace it uses, such as the output of xmlutil.Marshal, so it can be decrypted in place.
+func Encrypt(element []byte, cert *x509.Certificate, options Options) (*EncryptedData, error) {
+	if options.DataAlgorithm == "" {
+		options.DataAlgorithm = DefaultDataAlg
+	}
+	if options.KeyAlgorithm == "" {
+		options.KeyAlgorithm = DefaultKeyAlg
+	}
+	size, found := keySizes[options.DataAlgorithm]
+	if !found {
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", options.DataAlgorithm)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("encryption requires an RSA certificate")
+	}
+	key := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	ciphertext, err := encryptData(options.DataAlgorithm, key, element)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey := EncryptedKey{EncryptionMethod: EncryptionMethod{Algorithm: options.KeyAlgorithm},
+		KeyInfo: &dsig.KeyInfo{X509Data: dsig.X509Data{X509Certificate: base64.StdEncoding.EncodeToString(cert.Raw)}}}
+	var wrapped []byte
+	switch options.KeyAlgorithm {
+	case RSAOAEP:
+		encryptedKey.EncryptionMethod.DigestMethod = &dsig.Method{Algorithm: dsig.SHA1}
+		wrapped, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, publicKey, key, nil)
+	case RSA15:
+		wrapped, err = rsa.EncryptPKCS1v15(rand.Reader, publicKey, key)
+	default:
+		err = fmt.Errorf("unsupported key transport algorithm %s", options.KeyAlgorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey.CipherData.CipherValue = base64.StdEncoding.EncodeToString(wrapped)
+	return &EncryptedData{
+		Type:             TypeElement,
+		EncryptionMethod: EncryptionMethod{Algorithm: options.DataAlgorithm},
+		KeyInfo:          &KeyInfo{EncryptedKey: encryptedKey},
+		CipherData:       CipherData{CipherValue: base64.StdEncoding.EncodeToString(ciphertext)},
+	}, nil
+}
+
+// Returns the IV or nonce followed by the ciphertext, as XML Encryption expects
+func encryptData(algorithm string, key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if algorithm == AES128GCM || algorithm == AES256GCM {
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	}
+	// XML Encryption padding: random bytes with the final byte giving the pad length
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := make([]byte, len(plaintext)+padding)
+	copy(padded, plaintext)
+	if _, err := io.ReadFull(rand.Reader, padded[len(plaintext):len(padded)-1]); err != nil {
+		return nil, err
+	}
+	padded[len(padded)-1] = byte(padding)
+	out := make([]byte, aes.BlockSize+len(padded))
+	iv := out[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[aes.BlockSize:], padded)
+	return out, nil
+}
@@ -0,0 +1,38 @@
+package xmlenc
+
+import (
+	"encoding/xml"
+	"github.com/amdonov/lite-idp/dsig"
+)
+
+type EncryptedData struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
+	Type             string   `xml:",attr"`
+	EncryptionMethod EncryptionMethod
+	KeyInfo          *KeyInfo
+	CipherData       CipherData
+}
+
+type EncryptedKey struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedKey"`
+	EncryptionMethod EncryptionMethod
+	KeyInfo          *dsig.KeyInfo
+	CipherData       CipherData
+}
+
+type EncryptionMethod struct {
+	XMLName      xml.Name     `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionMethod"`
+	Algorithm    string       `xml:",attr"`
+	DigestMethod *dsig.Method `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod"`
+}
+
+// KeyInfo carrying the content encryption key wrapped for the recipient
+type KeyInfo struct {
+	XMLName      xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	EncryptedKey EncryptedKey
+}
+
+type CipherData struct {
+	XMLName     xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
+	CipherValue string   `xml:"http://www.w3.org/2001/04/xmlenc# CipherValue"`
+}
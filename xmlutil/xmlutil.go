@@ -0,0 +1,231 @@
+package xmlutil
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// Prefixes used for well-known namespaces in generated XML. Other namespaces are assigned ns1, ns2, etc.
+var Prefixes = map[string]string{
+	"urn:oasis:names:tc:SAML:2.0:protocol":                                              "samlp",
+	"urn:oasis:names:tc:SAML:2.0:assertion":                                             "saml",
+	"urn:oasis:names:tc:SAML:2.0:metadata":                                              "md",
+	"urn:oasis:names:tc:SAML:metadata:algsupport":                                       "alg",
+	"urn:oasis:names:tc:SAML:2.0:conditions:delegation":                                 "del",
+	"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd": "wsse",
+	"urn:oasis:names:tc:SAML:1.0:protocol":                                              "samlp1",
+	"urn:oasis:names:tc:SAML:1.0:assertion":                                             "saml1",
+	"http://www.w3.org/2000/09/xmldsig#":                                                "ds",
+	"http://www.w3.org/2001/10/xml-exc-c14n#":                                           "ec",
+	"http://www.w3.org/2001/04/xmlenc#":                                                 "xenc",
+	"http://schemas.xmlsoap.org/soap/envelope/":                                         "soap",
+	"http://www.w3.org/2001/XMLSchema":                                                  "xs",
+	"http://www.w3.org/2001/XMLSchema-instance":                                         "xsi",
+	// WS-Federation
+	"http://schemas.xmlsoap.org/ws/2005/02/trust":                                        "t",
+	"http://schemas.xmlsoap.org/ws/2004/09/policy":                                       "wsp",
+	"http://www.w3.org/2005/08/addressing":                                               "wsa",
+	"http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd": "wsu",
+}
+
+// Counts the elements with the name anywhere in the document
+func Count(data []byte, space, local string) (int, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	count := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Space == space && start.Name.Local == local {
+			count++
+		}
+	}
+}
+
+// Buffers encoding/xml writes into before the output is normalized, reused as every response is marshalled
+// this way
+var encodings = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// Marshals the value and normalizes the result
+func Marshal(v interface{}) ([]byte, error) {
+	buffer := encodings.Get().(*bytes.Buffer)
+	defer encodings.Put(buffer)
+	buffer.Reset()
+	if err := xml.NewEncoder(buffer).Encode(v); err != nil {
+		return nil, err
+	}
+	// Normalize copies what it keeps, so the buffer can be reused once it returns
+	return Normalize(buffer.Bytes())
+}
+
+// A start tag, end tag or text kept by Normalize. Held by value rather than as an xml.Token, which would
+// box each one.
+type part struct {
+	// Set for a start tag
+	attr []xml.Attr
+	// Set for an end tag or a start tag
+	name xml.Name
+	// Set for text
+	text []byte
+	end  bool
+}
+
+// Rewrites a document so that every namespace uses a stable prefix declared on the root element.
+// Comments, processing instructions and whitespace between elements are removed, so the output
+// doesn't depend on how the input happened to be formatted.
+func Normalize(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	// Elements take a few dozen bytes at least, so this is rarely outgrown
+	parts := make([]part, 0, len(data)/32)
+	prefixes := make(map[string]string)
+	var namespaces []string
+	use := func(uri string) {
+		if uri == "" || uri == xmlNamespace {
+			return
+		}
+		if _, found := prefixes[uri]; found {
+			return
+		}
+		prefix, found := Prefixes[uri]
+		if !found {
+			prefix = "ns" + strconv.Itoa(len(namespaces)+1)
+		}
+		prefixes[uri] = prefix
+		namespaces = append(namespaces, uri)
+	}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			use(t.Name.Space)
+			for _, attr := range t.Attr {
+				if !isNamespaceDeclaration(attr) {
+					use(attr.Name.Space)
+				}
+			}
+			// Names and attributes are strings, so only text needs copying before the next token
+			parts = append(parts, part{name: t.Name, attr: t.Attr})
+		case xml.EndElement:
+			parts = append(parts, part{name: t.Name, end: true})
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				parts = append(parts, part{text: bytes.Clone(t)})
+			}
+		}
+	}
+
+	// The output is about as long as the input, give or take the namespace prefixes
+	var buffer bytes.Buffer
+	buffer.Grow(len(data) + len(data)/8)
+	root := true
+	for _, part := range parts {
+		switch {
+		case part.text != nil:
+			xml.EscapeText(&buffer, part.text)
+		case part.end:
+			buffer.WriteString("</")
+			writeName(&buffer, prefixes, part.name)
+			buffer.WriteByte('>')
+		default:
+			buffer.WriteByte('<')
+			writeName(&buffer, prefixes, part.name)
+			if root {
+				for _, uri := range namespaces {
+					buffer.WriteString(" xmlns:")
+					buffer.WriteString(prefixes[uri])
+					buffer.WriteString(`="`)
+					escapeString(&buffer, uri)
+					buffer.WriteByte('"')
+				}
+				root = false
+			}
+			for _, attr := range part.attr {
+				if isNamespaceDeclaration(attr) {
+					continue
+				}
+				buffer.WriteByte(' ')
+				writeName(&buffer, prefixes, attr.Name)
+				buffer.WriteString(`="`)
+				escapeString(&buffer, attr.Value)
+				buffer.WriteByte('"')
+			}
+			buffer.WriteByte('>')
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+// Escapes the string as xml.EscapeText does, without first copying it to a byte slice
+func escapeString(buffer *bytes.Buffer, text string) {
+	last := 0
+	for i := 0; i < len(text); {
+		r, width := utf8.DecodeRuneInString(text[i:])
+		var escaped string
+		switch {
+		case r == '"':
+			escaped = "&#34;"
+		case r == '\'':
+			escaped = "&#39;"
+		case r == '&':
+			escaped = "&amp;"
+		case r == '<':
+			escaped = "&lt;"
+		case r == '>':
+			escaped = "&gt;"
+		case r == '\t':
+			escaped = "&#x9;"
+		case r == '\n':
+			escaped = "&#xA;"
+		case r == '\r':
+			escaped = "&#xD;"
+		case !isInCharacterRange(r) || (r == utf8.RuneError && width == 1):
+			escaped = "\uFFFD"
+		}
+		if escaped != "" {
+			buffer.WriteString(text[last:i])
+			buffer.WriteString(escaped)
+			last = i + width
+		}
+		i += width
+	}
+	buffer.WriteString(text[last:])
+}
+
+// Reports whether the character may appear in an XML document
+func isInCharacterRange(r rune) bool {
+	return r == 0x09 || r == 0x0A || r == 0x0D || r >= 0x20 && r <= 0xD7FF || r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF
+}
+
+func isNamespaceDeclaration(attr xml.Attr) bool {
+	return attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns")
+}
+
+// Writes the name with its namespace's prefix, without building the qualified name as a string
+func writeName(buffer *bytes.Buffer, prefixes map[string]string, name xml.Name) {
+	switch name.Space {
+	case "":
+	case xmlNamespace:
+		buffer.WriteString("xml:")
+	default:
+		buffer.WriteString(prefixes[name.Space])
+		buffer.WriteByte(':')
+	}
+	buffer.WriteString(name.Local)
+}